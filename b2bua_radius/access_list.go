@@ -0,0 +1,251 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "encoding/csv"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+
+    "sippy/conf"
+)
+
+// The access list is a CSV file with the following columns:
+//
+//     action,network,auth,route,max_calls,tech_prefix
+//
+// The action is either "allow" or "deny" and the network is an IPv4 or
+// IPv6 address or a CIDR network, "*" matches everything. The entries are
+// checked in the order of appearance and the first matching one wins, the
+// requests not matching any entry are denied.
+//
+// The rest of the columns are the policy of the allowed requests and can
+// be left empty. The auth is "yes" to always authenticate the requests or
+// "no" to let them in without any authentication, when empty the global
+// authentication settings apply. The route is the B2BRoute string used
+// for the calls not routed by the AAA, the trunk or the routing table. The
+// max_calls caps the number of the concurrent calls from the network. The
+// tech_prefix is the prefix the CLD of the calls has to start with, it is
+// stripped before the call is routed any further.
+
+const (
+    acl_auth_default = iota
+    acl_auth_yes
+    acl_auth_no
+)
+
+type aclEntry struct {
+    allow           bool
+    ipnet           *net.IPNet // nil matches everything
+    auth            int
+    route           *B2BRoute
+    limit           *callLimit
+    tech_prefix     string
+}
+
+type accessList struct {
+    entries         []*aclEntry
+}
+
+// The policy of the requests when no access list has been configured.
+var acl_allow_all = &aclEntry{ allow : true }
+
+// Whether the requests matching the entry have to be authenticated.
+func (self *aclEntry) authRequired(auth_enable bool) bool {
+    switch self.auth {
+    case acl_auth_yes:
+        return true
+    case acl_auth_no:
+        return false
+    }
+    return auth_enable
+}
+
+// Build the access list from the accept_ips networks followed by the
+// entries of the ACL file, if any.
+func NewAccessList(accept_ips []string, fname string, config sippy_conf.Config) (*accessList, error) {
+    self := &accessList{}
+    for _, s := range accept_ips {
+        ipnet, err := parseIPNet(s)
+        if err != nil {
+            return nil, err
+        }
+        self.entries = append(self.entries, &aclEntry{ allow : true, ipnet : ipnet })
+    }
+    if fname == "" {
+        return self, nil
+    }
+    fd, err := os.Open(fname)
+    if err != nil {
+        return nil, err
+    }
+    defer fd.Close()
+    entries, err := parseAccessList(fd, config)
+    if err != nil {
+        return nil, errors.New(fname + ": " + err.Error())
+    }
+    self.entries = append(self.entries, entries...)
+    return self, nil
+}
+
+func parseAccessList(r io.Reader, config sippy_conf.Config) ([]*aclEntry, error) {
+    reader := csv.NewReader(r)
+    reader.Comment = '#'
+    reader.FieldsPerRecord = 6
+    reader.TrimLeadingSpace = true
+    entries := []*aclEntry{}
+    for {
+        record, err := reader.Read()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, err
+        }
+        line, _ := reader.FieldPos(0)
+        for i := range record {
+            record[i] = strings.TrimSpace(record[i])
+        }
+        action, network, auth, sroute, max_calls, tech_prefix := record[0], record[1], record[2], record[3], record[4], record[5]
+        entry := &aclEntry{ tech_prefix : tech_prefix }
+        switch action {
+        case "allow":
+            entry.allow = true
+        case "deny":
+        default:
+            return nil, fmt.Errorf("line %d: bad action '%s'", line, action)
+        }
+        if network != "*" && network != "" {
+            entry.ipnet, err = parseIPNet(network)
+            if err != nil {
+                return nil, fmt.Errorf("line %d: %s", line, err.Error())
+            }
+        }
+        switch auth {
+        case "":
+        case "yes":
+            entry.auth = acl_auth_yes
+        case "no":
+            entry.auth = acl_auth_no
+        default:
+            return nil, fmt.Errorf("line %d: bad auth '%s'", line, auth)
+        }
+        if sroute != "" {
+            entry.route, err = NewB2BRoute(sroute, config)
+            if err != nil {
+                return nil, fmt.Errorf("line %d: %s", line, err.Error())
+            }
+        }
+        if max_calls != "" {
+            n, err := strconv.ParseInt(max_calls, 10, 64)
+            if err != nil || n <= 0 {
+                return nil, fmt.Errorf("line %d: bad max_calls '%s'", line, max_calls)
+            }
+            entry.limit = newCallLimit("acl " + network, n, 0)
+        }
+        entries = append(entries, entry)
+    }
+    return entries, nil
+}
+
+// Returns the first entry matching the source address, nil when the
+// source is not allowed.
+func (self *accessList) Match(source string) *aclEntry {
+    if len(self.entries) == 0 {
+        return acl_allow_all
+    }
+    ip := net.ParseIP(source)
+    for _, entry := range self.entries {
+        if entry.ipnet != nil && (ip == nil || ! entry.ipnet.Contains(ip)) {
+            continue
+        }
+        if ! entry.allow {
+            return nil
+        }
+        return entry
+    }
+    return nil
+}
+
+// Whether any entry has its own route.
+func (self *accessList) hasRoutes() bool {
+    for _, entry := range self.entries {
+        if entry.allow && entry.route != nil {
+            return true
+        }
+    }
+    return false
+}
+
+// Whether any entry requires the authentication to be enabled.
+func (self *accessList) needsAuth() bool {
+    for _, entry := range self.entries {
+        if entry.allow && entry.auth == acl_auth_yes {
+            return true
+        }
+    }
+    return false
+}
+
+// Returns the counters of the limits of the entries.
+func (self *accessList) limitsStatus() []*limitStatus {
+    res := []*limitStatus{}
+    for _, entry := range self.entries {
+        if entry.limit != nil {
+            res = append(res, entry.limit.status())
+        }
+    }
+    return res
+}
+
+// Take over the limits of the old list having the same network, so that
+// the reload does not reset the counters of the calls in progress. The
+// new max_calls applies to the carried over limit.
+func (self *accessList) keepLimits(old *accessList) {
+    old_limits := make(map[string]*callLimit)
+    for _, entry := range old.entries {
+        if entry.limit != nil {
+            if _, ok := old_limits[entry.limit.name]; ! ok {
+                old_limits[entry.limit.name] = entry.limit
+            }
+        }
+    }
+    for _, entry := range self.entries {
+        if entry.limit == nil {
+            continue
+        }
+        if limit, ok := old_limits[entry.limit.name]; ok {
+            limit.setMaxCalls(entry.limit.max_calls)
+            entry.limit = limit
+            delete(old_limits, limit.name)
+        }
+    }
+}
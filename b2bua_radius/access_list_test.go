@@ -0,0 +1,131 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "strings"
+    "testing"
+    "time"
+
+    "sippy/conf"
+    "sippy/log"
+)
+
+const test_access_list = `
+# action,network,auth,route,max_calls,tech_prefix
+deny,10.1.2.3,,,,
+allow,10.1.0.0/16,no,192.0.2.1,10,7788#
+allow,10.0.0.0/8,yes,,,
+allow,2001:db8::/32,,,,
+deny,*,,,,
+`
+
+func TestAccessList(t *testing.T) {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+    entries, err := parseAccessList(strings.NewReader(test_access_list), config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    acl := &accessList{ entries : entries }
+    for _, tc := range []struct{ source string; allowed, auth bool; tech_prefix string }{
+        { "10.1.2.3", false, false, "" },
+        { "10.1.2.4", true, false, "7788#" },
+        { "10.2.0.1", true, true, "" },
+        { "2001:db8::1", true, false, "" },
+        { "2001:db9::1", false, false, "" },
+        { "192.0.2.1", false, false, "" },
+    } {
+        entry := acl.Match(tc.source)
+        if (entry != nil) != tc.allowed {
+            t.Errorf("%s: expected allowed %v", tc.source, tc.allowed)
+            continue
+        }
+        if entry == nil {
+            continue
+        }
+        if entry.authRequired(false) != tc.auth || entry.tech_prefix != tc.tech_prefix {
+            t.Errorf("%s: bad policy", tc.source)
+        }
+    }
+    if entry := acl.Match("2001:db8::1"); ! entry.authRequired(true) {
+        t.Error("the global auth setting has not been applied")
+    }
+    if entry := acl.Match("10.1.0.1"); entry.route == nil || entry.limit == nil || entry.limit.max_calls != 10 {
+        t.Error("bad route or limit of 10.1.0.0/16")
+    }
+    if ! acl.needsAuth() || ! acl.hasRoutes() {
+        t.Error("bad needsAuth() or hasRoutes()")
+    }
+
+    acl, err = NewAccessList([]string{ "192.0.2.0/24" }, "", config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if acl.Match("192.0.2.10") == nil || acl.Match("192.0.3.10") != nil {
+        t.Error("the accept_ips network has not been applied")
+    }
+    if acl, _ = NewAccessList(nil, "", config); acl.Match("192.0.3.10") != acl_allow_all {
+        t.Error("the empty access list does not allow everything")
+    }
+
+    for _, bad := range []string{ "permit,10.0.0.0/8,,,,\n", "allow,10.0.0.0/33,,,,\n", "allow,*,maybe,,,\n", "allow,*,,,0,\n" } {
+        if _, err = parseAccessList(strings.NewReader(bad), config); err == nil {
+            t.Errorf("no error parsing %q", bad)
+        }
+    }
+}
+
+func TestAccessListKeepLimits(t *testing.T) {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+    entries, err := parseAccessList(strings.NewReader("allow,10.0.0.0/8,,,1,\nallow,*,,,5,\n"), config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    old := &accessList{ entries : entries }
+    now := time.Now()
+    if ! old.Match("10.0.0.1").limit.acquire(now) {
+        t.Fatal("the first call has been rejected")
+    }
+    entries, err = parseAccessList(strings.NewReader("allow,10.0.0.0/8,,,2,\nallow,192.0.2.0/24,,,5,\n"), config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    acl := &accessList{ entries : entries }
+    acl.keepLimits(old)
+    limit := acl.Match("10.0.0.1").limit
+    if limit != old.Match("10.0.0.1").limit {
+        t.Fatal("the limit of the same network has not been carried over")
+    }
+    if st := limit.status(); st.Calls != 1 || st.MaxCalls != 2 {
+        t.Errorf("unexpected carried over limit %s", st)
+    }
+    if ! limit.acquire(now) || limit.acquire(now) {
+        t.Error("the new max_calls has not been applied")
+    }
+    if acl.Match("192.0.2.1").limit.status().Calls != 0 {
+        t.Error("the limit of the new network has not started from scratch")
+    }
+}
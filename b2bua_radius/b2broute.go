@@ -68,6 +68,16 @@ type B2BRoute struct {
     rtpp            bool
     outbound_proxy  *sippy_conf.HostPort
     rnum            int
+    gt_set          bool
+    gt_timeout      time.Duration
+    gt_skip         int
+    gt_skipto       int
+    fork            bool
+    tr_out          *trRules
+    tr_out_set      bool
+    location        bool
+    max_calls       int64
+    max_cps         float64
 }
 /*
 from sippy.SipHeader import SipHeader
@@ -107,8 +117,17 @@ func NewB2BRoute(sroute string, global_config sippy_conf.Config) (*B2BRoute, err
     } else {
         self.hostport = route[0]
     }
+    if self.hostport == "" {
+        return nil, errors.New("NewB2BRoute: no host in the route '" + sroute + "'")
+    }
+    // The "location" target is resolved via the location service of
+    // the built-in registrar when the call is routed.
+    self.location = self.hostport == "location"
     ipv6only := false
-    if self.hostport[0] != '[' {
+    if self.location {
+        hostport = []string{ self.hostport }
+        self.hostonly = self.hostport
+    } else if self.hostport[0] != '[' {
         hostport = strings.SplitN(self.hostport, ":", 2)
         self.hostonly = hostport[0]
     } else {
@@ -130,15 +149,17 @@ func NewB2BRoute(sroute string, global_config sippy_conf.Config) (*B2BRoute, err
         port = sippy_conf.NewMyPort(hostport[1])
     }
     self.ainfo = make([]*ainfo_item, 0)
-    ips, err := net.LookupIP(hostport[0])
-    if err != nil {
-        return nil, errors.New("NewB2BRoute: error resolving host IP '" + hostport[0] + "': " + err.Error())
-    }
-    for _, ip := range ips {
-        if ipv6only && ip.To4() != nil {
-            continue
+    if ! self.location {
+        ips, err := net.LookupIP(hostport[0])
+        if err != nil {
+            return nil, errors.New("NewB2BRoute: error resolving host IP '" + hostport[0] + "': " + err.Error())
+        }
+        for _, ip := range ips {
+            if ipv6only && ip.To4() != nil {
+                continue
+            }
+            self.ainfo = append(self.ainfo, &ainfo_item{ ip, port.String() })
         }
-        self.ainfo = append(self.ainfo, &ainfo_item{ ip, port.String() })
     }
     //self.params = []string{}
     for _, x := range route[1:] {
@@ -216,6 +237,47 @@ func NewB2BRoute(sroute string, global_config sippy_conf.Config) (*B2BRoute, err
             } else {
                 self.outbound_proxy = sippy_conf.NewHostPort(host_port[0], host_port[1])
             }
+        case "gt":
+            tmp := strings.SplitN(av[1], ",", 2)
+            if len(tmp) != 2 {
+                return nil, errors.New("Error parsing the gt (no comma) '" + av[1] + "'")
+            }
+            timeout, err := strconv.Atoi(tmp[0])
+            if err != nil {
+                return nil, errors.New("Error parsing the gt timeout '" + tmp[0] + "': " + err.Error())
+            }
+            skip, err := strconv.Atoi(tmp[1])
+            if err != nil {
+                return nil, errors.New("Error parsing the gt skip '" + tmp[1] + "': " + err.Error())
+            }
+            if timeout <= 0 || skip <= 0 {
+                return nil, errors.New("Error parsing the gt '" + av[1] + "': both values must be positive")
+            }
+            self.gt_timeout = time.Duration(timeout * int(time.Second))
+            self.gt_skip = skip
+            self.gt_set = true
+        case "fork":
+            self.fork = true
+        case "tr_out":
+            var v string
+            v, err = url.QueryUnescape(av[1])
+            if err == nil {
+                self.tr_out, err = parseTrRules(v)
+            }
+            if err != nil {
+                return nil, errors.New("Error parsing the tr_out '" + av[1] + "': " + err.Error())
+            }
+            self.tr_out_set = true
+        case "max_calls":
+            self.max_calls, err = strconv.ParseInt(av[1], 10, 64)
+            if err != nil || self.max_calls < 0 {
+                return nil, errors.New("Error parsing the max_calls '" + av[1] + "'")
+            }
+        case "max_cps":
+            self.max_cps, err = strconv.ParseFloat(av[1], 64)
+            if err != nil || self.max_cps < 0 {
+                return nil, errors.New("Error parsing the max_cps '" + av[1] + "'")
+            }
         //default:
         //    self.params[a] = v
         }
@@ -234,10 +296,9 @@ func (self *B2BRoute) customize(rnum int, default_cld, default_cli string, defau
     if ! self.crt_set {
         self.credit_time = default_credit_time
     }
-    //if self.params.has_key("gt") {
-    //    timeout, skip = self.params["gt"].split(",", 1)
-    //    self.params["group_timeout"] = (int(timeout), rnum + int(skip))
-    //}
+    if self.gt_set {
+        self.gt_skipto = rnum + self.gt_skip
+    }
     self.extra_headers = append(self.extra_headers, pass_headers...)
     if max_credit_time != 0 {
         if self.credit_time == 0 || self.credit_time > max_credit_time {
@@ -0,0 +1,86 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "testing"
+    "time"
+
+    "sippy/conf"
+    "sippy/log"
+)
+
+func TestB2BRouteCreditTime(t *testing.T) {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+    for _, tc := range []struct{ route string; aaa_credit, max_credit, expected time.Duration }{
+        { "192.0.2.1", 0, 0, 0 },
+        { "192.0.2.1", 0, 60 * time.Second, 60 * time.Second },
+        { "192.0.2.1", 30 * time.Second, 60 * time.Second, 30 * time.Second },
+        { "192.0.2.1", 90 * time.Second, 60 * time.Second, 60 * time.Second },
+        { "192.0.2.1;credit-time=20", 30 * time.Second, 0, 20 * time.Second },
+        { "192.0.2.1;credit-time=120", 30 * time.Second, 60 * time.Second, 60 * time.Second },
+    } {
+        oroute, err := NewB2BRoute(tc.route, config)
+        if err != nil {
+            t.Fatal(err)
+        }
+        oroute.customize(1, "cld", "cli", tc.aaa_credit, nil, tc.max_credit)
+        if oroute.credit_time != tc.expected {
+            t.Errorf("%s, aaa %s, max %s: credit time %s, expected %s", tc.route, tc.aaa_credit, tc.max_credit, oroute.credit_time, tc.expected)
+        }
+    }
+}
+
+func TestB2BRouteGroupTimeout(t *testing.T) {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+    oroute, err := NewB2BRoute("192.0.2.1;gt=5,2", config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if ! oroute.gt_set || oroute.gt_timeout != 5 * time.Second || oroute.gt_skip != 2 || oroute.fork {
+        t.Errorf("Unexpected group timeout: set %v, timeout %s, skip %d", oroute.gt_set, oroute.gt_timeout, oroute.gt_skip)
+    }
+    // The route number to skip to is only known once the route is placed
+    oroute.customize(3, "cld", "cli", 0, nil, 0)
+    if oroute.gt_skipto != 5 {
+        t.Errorf("gt skipto: expected 5, got %d", oroute.gt_skipto)
+    }
+    if oroute.getCopy().gt_timeout != 5 * time.Second {
+        t.Error("The group timeout has not been copied")
+    }
+    oroute, err = NewB2BRoute("192.0.2.1;fork", config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if ! oroute.fork || oroute.gt_set {
+        t.Errorf("Unexpected fork route: fork %v, gt %v", oroute.fork, oroute.gt_set)
+    }
+    for _, sroute := range []string{ "192.0.2.1;gt=5", "192.0.2.1;gt=x,1", "192.0.2.1;gt=5,y", "192.0.2.1;gt=0,1", "192.0.2.1;gt=5,-1" } {
+        if _, err = NewB2BRoute(sroute, config); err == nil {
+            t.Errorf("%s: the route should have been rejected", sroute)
+        }
+    }
+}
@@ -27,15 +27,21 @@
 package main
 
 import (
+    "crypto/md5"
+    "errors"
     "fmt"
+    "strconv"
     "strings"
     "sync"
+    "time"
 
     "sippy"
     "sippy/conf"
     "sippy/headers"
+    "sippy/log"
     "sippy/time"
     "sippy/types"
+    "sippy/utils"
 )
 
 type callController struct {
@@ -43,6 +49,8 @@ type callController struct {
     uaA             sippy_types.UA
     uaO             sippy_types.UA
     global_config   *myConfigParser
+    // The configuration snapshot taken when the call has been created
+    live            *liveConfig
     state           CCState
     remote_ip       *sippy_conf.MyAddress
     source          *sippy_conf.HostPort
@@ -60,6 +68,42 @@ type callController struct {
     acctA           *fakeAccounting
     sip_tm          sippy_types.SipTransactionManager
     proxied         bool
+    forks           []sippy_types.UA
+    early_leg       sippy_types.UA
+    ring_sent       bool
+    fork_fail_event sippy_types.CCEvent
+    realm           string
+    username        string
+    challenge       *sippy_header.SipWWWAuthenticate
+    // The registered trunk the call has come in from, if any
+    trunk           *regAgent
+    // The admission limits held by the call and the limits of the
+    // destinations of the current call legs
+    limits          []*callLimit
+    route_limits    []*callLimit
+    // The access list entry the call has been admitted by
+    acl             *aclEntry
+    auth_required   bool
+    // The credit time of every outgoing call leg placed, applied to the
+    // incoming one once the leg answers
+    credit_times    map[sippy_types.UA]time.Duration
+    warning_timer   *sippy.Timeout
+    // The SIP trace of the call if it has matched a trace rule
+    trace           *callTrace
+    // The error logger carrying the call context fields
+    logger          sippy_log.ErrorLogger
+    // The outgoing call legs attempted and the disconnect details for
+    // the CDR
+    legs            []*legStats
+    cdr_result      int
+    disc_origin     string
+    disc_reason     string
+    rtpp_stats      *sippy.RtpProxySessionStats
+    rtpp_query      bool
+    rtpp_deleting   bool
+    dead            bool
+    cdr_written     bool
+    live_released   bool
 }
 /*
 class CallController(object):
@@ -72,10 +116,11 @@ class CallController(object):
     auth_proc = nil
     challenge = nil
 */
-func NewCallController(id int64, remote_ip *sippy_conf.MyAddress, source *sippy_conf.HostPort, global_config *myConfigParser, pass_headers []sippy_header.SipHeader, sip_tm sippy_types.SipTransactionManager) *callController {
+func NewCallController(id int64, remote_ip *sippy_conf.MyAddress, source *sippy_conf.HostPort, live *liveConfig, pass_headers []sippy_header.SipHeader, sip_tm sippy_types.SipTransactionManager) *callController {
     self := &callController{
         id              : id,
-        global_config   : global_config,
+        global_config   : live.config,
+        live            : live,
         state           : CCStateIdle,
         remote_ip       : remote_ip,
         source          : source,
@@ -85,8 +130,11 @@ func NewCallController(id int64, remote_ip *sippy_conf.MyAddress, source *sippy_
         huntstop_scodes : make([]int, 0),
         proxied         : false,
         sip_tm          : sip_tm,
+        acl             : acl_allow_all,
+        credit_times    : make(map[sippy_types.UA]time.Duration),
+        logger          : live.config.ErrorLogger().With(sippy_log.F("cc_id", id)),
     }
-    self.uaA = sippy.NewUA(sip_tm, global_config, nil, self, self.lock, nil)
+    self.uaA = sippy.NewUA(sip_tm, live.config, nil, self, self.lock, nil)
     self.uaA.SetKaInterval(self.global_config.keepalive_ans)
     self.uaA.SetLocalUA(sippy_header.NewSipUserAgent(self.global_config.GetMyUAName()))
     self.uaA.SetConnCb(self.aConn)
@@ -106,6 +154,7 @@ func (self *callController) RecvEvent(event sippy_types.CCEvent, ua sippy_types.
                 return
             }
             self.cId = ev_try.GetSipCallId()
+            self.logger = self.logger.With(sippy_log.F("call_id", self.cId.CallId))
             self.cGUID = ev_try.GetSipCiscoGUID()
             self.cli = ev_try.GetCLI()
             self.cld = ev_try.GetCLD()
@@ -116,26 +165,47 @@ func (self *callController) RecvEvent(event sippy_types.CCEvent, ua sippy_types.
                 self.state = CCStateDead
                 return
             }
-/*
-            if body != nil && self.global_config.has_key('_allowed_pts') {
-                try:
-                    body.parse()
-                except:
-                    self.uaA.RecvEvent(CCEventFail((400, "Malformed SDP Body"), rtime = event.rtime))
+            if body := ev_try.GetBody(); body != nil && len(self.global_config.allowed_pts) > 0 {
+                sdp_body, err := body.GetParsedBody()
+                if err != nil {
+                    self.uaA.RecvEvent(sippy.NewCCEventFail(400, "Malformed SDP Body", event.GetRtime(), ""))
                     self.state = CCStateDead
                     return
-                allowed_pts = self.global_config['_allowed_pts']
-                mbody = body.content.sections[0].m_header
-                if mbody.transport.lower() == "rtp/avp" {
-                    old_len = len(mbody.formats)
-                    mbody.formats = [x for x in mbody.formats if x in allowed_pts]
-                    if len(mbody.formats) == 0 {
-                        self.uaA.RecvEvent(CCEventFail((488, "Not Acceptable Here")))
+                }
+                sections := sdp_body.GetSections()
+                if len(sections) > 0 && strings.ToLower(sections[0].GetMHeader().GetTransport()) == "rtp/avp" {
+                    old_formats := sections[0].GetMHeader().GetFormats()
+                    formats := make([]string, 0, len(old_formats))
+                    for _, format := range old_formats {
+                        pt, err := strconv.Atoi(format)
+                        if err != nil {
+                            continue
+                        }
+                        for _, allowed_pt := range self.global_config.allowed_pts {
+                            if pt == allowed_pt {
+                                formats = append(formats, format)
+                                break
+                            }
+                        }
+                    }
+                    if len(formats) == 0 {
+                        self.uaA.RecvEvent(sippy.NewCCEventFail(488, "Not Acceptable Here", event.GetRtime(), ""))
                         self.state = CCStateDead
                         return
-                    if old_len > len(mbody.formats) {
-                        body.content.sections[0].optimize_a()
-*/
+                    }
+                    if len(old_formats) > len(formats) {
+                        sections[0].SetFormats(formats)
+                    }
+                }
+            }
+            if self.acl.tech_prefix != "" {
+                if ! strings.HasPrefix(self.cld, self.acl.tech_prefix) {
+                    self.uaA.RecvEvent(sippy.NewCCEventFail(403, "Forbidden", event.GetRtime(), ""))
+                    self.state = CCStateDead
+                    return
+                }
+                self.cld = self.cld[len(self.acl.tech_prefix):]
+            }
             if strings.HasPrefix(self.cld, "nat-") {
                 self.cld = self.cld[4:]
                 if ev_try.GetBody() != nil {
@@ -143,15 +213,18 @@ func (self *callController) RecvEvent(event sippy_types.CCEvent, ua sippy_types.
                 }
                 event = sippy.NewCCEventTry(self.cId, self.cGUID, self.cli, self.cld, ev_try.GetBody(), ev_try.GetSipAuthorization(), self.caller_name, nil, "")
             }
-/*
-            if self.global_config.has_key('static_tr_in') {
-                self.cld = re_replace(self.global_config['static_tr_in'], self.cld)
-                event = sippy.NewCCEventTry(self.cId, self.cGUID, self.cli, self.cld, body, auth, self.caller_name)
+            if self.global_config.static_tr_in != nil {
+                self.cld, self.cli = self.global_config.static_tr_in.Apply(self.cld, self.cli)
+                if self.cld == "" {
+                    self.uaA.RecvEvent(sippy.NewCCEventFail(404, "Not Found", event.GetRtime(), ""))
+                    self.state = CCStateDead
+                    return
+                }
+                event = sippy.NewCCEventTry(self.cId, self.cGUID, self.cli, self.cld, ev_try.GetBody(), ev_try.GetSipAuthorization(), self.caller_name, nil, "")
             }
-*/
-            if len(global_rtp_proxy_clients) > 0 {
+            if len(self.live.rtp_proxy_clients) > 0 {
                 var err error
-                self.rtp_proxy_session, err = sippy.NewRtp_proxy_session(self.global_config, global_rtp_proxy_clients, self.cId.CallId, "", "", self.global_config.b2bua_socket, /*notify_tag*/ fmt.Sprintf("r%%20%d", self.id), self.lock, nil /* callee_origin */)
+                self.rtp_proxy_session, err = sippy.NewRtp_proxy_session(self.global_config, self.live.rtp_proxy_clients, self.cId.CallId, "", "", self.global_config.b2bua_socket, /*notify_tag*/ fmt.Sprintf("r%%20%d", self.id), self.lock, nil /* callee_origin */)
                 if err != nil {
                     self.uaA.RecvEvent(sippy.NewCCEventFail(500, "Internal Server Error (4)", event.GetRtime(), ""))
                     self.state = CCStateDead
@@ -161,28 +234,59 @@ func (self *callController) RecvEvent(event sippy_types.CCEvent, ua sippy_types.
                 self.rtp_proxy_session.SetInsertNortpp(true)
             }
             self.eTry = ev_try
+            if global_tracer != nil {
+                self.trace = global_tracer.startTrace(self)
+            }
             self.state = CCStateWaitRoute
-            //if ! self.global_config['auth_enable'] {
-                //self.username = self.remote_ip
-                self.rDone()
-            //} else if auth == nil || auth.username == nil || len(auth.username) == 0 {
-            //    self.username = self.remote_ip
-            //    self.auth_proc = self.global_config['_radius_client'].do_auth(self.remote_ip, self.cli, self.cld, self.cGUID, \
-            //      self.cId, self.remote_ip, self.rDone)
-            //} else {
-            //    self.username = auth.username
-            //    self.auth_proc = self.global_config['_radius_client'].do_auth(auth.username, self.cli, self.cld, self.cGUID, 
-            //      self.cId, self.remote_ip, self.rDone, auth.realm, auth.nonce, auth.uri, auth.response)
-            //}
+            auth := ev_try.GetSipAuthorization()
+            if ! self.auth_required {
+                self.username = self.remote_ip.String()
+                self.rDone(nil)
+            } else if auth == nil || auth.GetUsername() == "" {
+                if self.global_config.digest_auth {
+                    self.challenge = global_digest_auth.Challenge(self.realm, false)
+                }
+                self.username = self.remote_ip.String()
+                self.doAuth(nil)
+            } else {
+                valid, stale := global_digest_auth.CheckNonce(auth, self.realm)
+                if ! valid || stale {
+                    if self.global_config.digest_auth {
+                        self.uaA.RecvEvent(sippy.NewCCEventFail(401, "Unauthorized", event.GetRtime(), "", global_digest_auth.Challenge(self.realm, stale)))
+                    } else {
+                        self.uaA.RecvEvent(sippy.NewCCEventFail(403, "Auth Failed", event.GetRtime(), ""))
+                    }
+                    self.state = CCStateDead
+                    return
+                }
+                self.username = auth.GetUsername()
+                self.doAuth(auth)
+            }
             return
         }
         if (self.state != CCStateARComplete && self.state != CCStateConnected && self.state != CCStateDisconnecting) || self.uaO == nil {
             return
         }
+        if len(self.forks) > 0 {
+            // The legs report failures synchronously so iterate over the copy
+            for _, uaO := range append([]sippy_types.UA{}, self.forks...) {
+                uaO.RecvEvent(event)
+            }
+            return
+        }
         self.uaO.RecvEvent(event)
     } else {
+        if len(self.forks) > 0 {
+            var ok bool
+            if event, ok = self.forkEvent(event, ua); ! ok {
+                return
+            }
+        } else if ua != self.uaO {
+            // Late event from the leg that has been abandoned already
+            return
+        }
         ev_fail, is_ev_fail := event.(*sippy.CCEventFail)
-        _, is_ev_disconnect := event.(*sippy.CCEventFail)
+        _, is_ev_disconnect := event.(*sippy.CCEventDisconnect)
         _, is_state_trying := self.uaA.GetState().(*sippy.UasStateTrying)
         _, is_state_ringing := self.uaA.GetState().(*sippy.UasStateRinging)
         if (is_ev_fail || is_ev_disconnect) && self.state == CCStateARComplete &&
@@ -196,30 +300,177 @@ func (self *callController) RecvEvent(event sippy_types.CCEvent, ua sippy_types.
                     }
                 }
             }
-            if ! huntstop {
-                route := self.routes[0]
-                self.routes = self.routes[1:]
-                self.placeOriginate(route)
+            // Pass the failure through when the rest of the routes
+            // are over their limits
+            if ! huntstop && self.placeRoutes() {
                 return
             }
         }
+        if _, ok := event.(*sippy.CCEventConnect); ok {
+            self.startCreditTime(ua)
+        }
         self.uaA.RecvEvent(event)
     }
 }
 
-func (self *callController) rDone(/*results*/) {
-/*
+// startCreditTime limits the incoming call leg the same way as the
+// answered outgoing one, so that the call is over at the same time
+// regardless of which leg notices it first.
+func (self *callController) startCreditTime(ua sippy_types.UA) {
+    credit_time := self.credit_times[ua]
+    if credit_time <= 0 {
+        return
+    }
+    self.uaA.SetCreditTime(credit_time)
+    warning := self.global_config.credit_warning
+    if warning > 0 && credit_time > warning && self.rtp_proxy_session != nil && self.warning_timer == nil {
+        self.warning_timer = sippy.StartTimeout(self.creditWarning, self.lock, credit_time - warning, 1, self.logger)
+    }
+}
+
+func (self *callController) creditWarning() {
+    self.warning_timer = nil
+    if self.state != CCStateConnected || self.rtp_proxy_session == nil {
+        return
+    }
+    prompt := self.global_config.credit_warning_prompt
+    self.rtp_proxy_session.PlayCaller(prompt, 1, nil, 0)
+    self.rtp_proxy_session.PlayCallee(prompt, 1, nil, 0)
+}
+
+// Filter the event coming from one of the parallel call legs. Returns the
+// event to be processed by the regular hunting logic and false if the event
+// has been consumed.
+func (self *callController) forkEvent(event sippy_types.CCEvent, ua sippy_types.UA) (sippy_types.CCEvent, bool) {
+    idx := -1
+    for i, uaO := range self.forks {
+        if uaO == ua {
+            idx = i
+            break
+        }
+    }
+    if idx == -1 {
+        // Late event from the leg that has been abandoned already
+        return nil, false
+    }
+    switch ev := event.(type) {
+    case *sippy.CCEventRing:
+        if ev.GetBody() != nil && self.early_leg == nil {
+            self.early_leg = ua
+        }
+        if ua == self.early_leg {
+            self.uaO = ua
+            self.ring_sent = true
+            return event, true
+        }
+        if self.ring_sent {
+            return nil, false
+        }
+        // Let the caller know that something is ringing but don't
+        // pass the media from the leg that doesn't own early media
+        self.ring_sent = true
+        scode, reason := ev.GetScode(), ev.GetScodeReason()
+        if scode == 183 {
+            scode, reason = 180, "Ringing"
+        }
+        return sippy.NewCCEventRing(scode, reason, nil, ev.GetRtime(), ev.GetOrigin()), true
+    case *sippy.CCEventConnect, *sippy.CCEventPreConnect:
+        // The first leg to answer wins, CANCEL the rest
+        losers := self.forks
+        self.forks = nil
+        self.early_leg = nil
+        self.fork_fail_event = nil
+        self.uaO = ua
+        for _, uaO := range losers {
+            if uaO != ua {
+                uaO.Disconnect(nil)
+            }
+        }
+        return event, true
+    case *sippy.CCEventFail, *sippy.CCEventDisconnect, *sippy.CCEventRedirect:
+        self.forks = append(self.forks[:idx], self.forks[idx + 1:]...)
+        if self.fork_fail_event == nil || forkFailRank(event) < forkFailRank(self.fork_fail_event) {
+            self.fork_fail_event = event
+        }
+        if len(self.forks) > 0 {
+            if ua == self.early_leg {
+                self.early_leg = nil
+            }
+            if ua == self.uaO {
+                self.uaO = self.forks[0]
+            }
+            return nil, false
+        }
+        // All legs in the group have failed
+        event = self.fork_fail_event
+        self.early_leg = nil
+        self.fork_fail_event = nil
+        return event, true
+    }
+    if ua != self.uaO {
+        return nil, false
+    }
+    return event, true
+}
+
+// Rank the failure of the parallel leg, the lowest one is reported to the
+// caller once all legs in the group have failed. 6xx responses take
+// precedence over everything else, disconnects go last.
+func forkFailRank(event sippy_types.CCEvent) int {
+    switch ev := event.(type) {
+    case *sippy.CCEventFail:
+        if ev.GetScode() >= 600 {
+            return 0
+        }
+        return ev.GetScode()
+    case *sippy.CCEventRedirect:
+        return 300
+    }
+    return 1000
+}
+
+func (self *callController) doAuth(auth *sippy_header.SipAuthorization) {
+    req := &authRequest{
+        username        : self.username,
+        remote_ip       : self.remote_ip.String(),
+        cli             : self.cli,
+        cld             : self.cld,
+        method          : "INVITE",
+        call_id         : self.cId.CallId,
+        cGUID           : self.cGUID,
+        auth            : auth,
+        pass_headers    : self.pass_headers,
+    }
+    global_digest_auth.store.Authenticate(req, func(result *authResult) {
+        sippy_utils.SafeCall(func() {
+            if auth != nil && result.ok && ! global_digest_auth.UpdateNonceCount(auth) {
+                // Replayed while the credentials were being verified
+                if self.global_config.digest_auth {
+                    self.challenge = global_digest_auth.Challenge(self.realm, true)
+                }
+                result = &authResult{ ok : false }
+            }
+            self.rDone(result)
+        }, self.lock, self.logger)
+    })
+}
+
+func (self *callController) rDone(result *authResult) {
     // Check that we got necessary result from Radius
-    if len(results) != 2 || results[1] != 0:
-        if isinstance(self.uaA.state, UasStateTrying):
-            if self.challenge != nil:
-                event = CCEventFail((401, "Unauthorized"))
-                event.extra_header = self.challenge
-            else:
-                event = CCEventFail((403, "Auth Failed"))
+    if result != nil && ! result.ok {
+        if _, ok := self.uaA.GetState().(*sippy.UasStateTrying); ok {
+            var event *sippy.CCEventFail
+            if self.challenge != nil {
+                event = sippy.NewCCEventFail(401, "Unauthorized", nil, "", self.challenge)
+            } else {
+                event = sippy.NewCCEventFail(403, "Auth Failed", nil, "")
+            }
             self.uaA.RecvEvent(event)
             self.state = CCStateDead
+        }
         return
+    }
+/*
     if self.global_config['acct_enable']:
         self.acctA = RadiusAccounting(self.global_config, "answer", \
           send_start = self.global_config['start_acct_enable'], lperiod = \
@@ -234,43 +485,85 @@ func (self *callController) rDone(/*results*/) {
         //self.acctA.disc(self.uaA, time(), "caller")
         return
     }
-/*
-    cli = [x[1][4:] for x in results[0] if x[0] == "h323-ivr-in" && x[1].startswith("CLI:")]
-    if len(cli) > 0:
-        self.cli = cli[0]
-        if len(self.cli) == 0:
-            self.cli = nil
-    caller_name = [x[1][5:] for x in results[0] if x[0] == "h323-ivr-in" && x[1].startswith("CNAM:")]
-    if len(caller_name) > 0:
-        self.caller_name = caller_name[0]
-        if len(self.caller_name) == 0:
-            self.caller_name = nil
-    credit_time = [x for x in results[0] if x[0] == "h323-credit-time"]
-    if len(credit_time) > 0:
-        credit_time = int(credit_time[0][1])
-    else:
-        credit_time := time.Duration(0)
-    if ! self.global_config.has_key('_static_route'):
-        routing = [x for x in results[0] if x[0] == "h323-ivr-in" && x[1].startswith("Routing:")]
-        if len(routing) == 0:
-            self.uaA.RecvEvent(CCEventFail((500, "Internal Server Error (2)")))
+    for _, cli := range result.getAttributes("h323-ivr-in") {
+        if strings.HasPrefix(cli, "CLI:") {
+            self.cli = cli[4:]
+            break
+        }
+    }
+    for _, caller_name := range result.getAttributes("h323-ivr-in") {
+        if strings.HasPrefix(caller_name, "CNAM:") {
+            self.caller_name = caller_name[5:]
+            break
+        }
+    }
+    credit_time := time.Duration(0)
+    if tmp := result.getAttributes("h323-credit-time"); len(tmp) > 0 {
+        if v, err := strconv.Atoi(tmp[0]); err == nil && v > 0 {
+            credit_time = time.Duration(v) * time.Second
+        }
+    }
+    var routing []*B2BRoute
+    for _, x := range result.getAttributes("h323-ivr-in") {
+        if ! strings.HasPrefix(x, "Routing:") {
+            continue
+        }
+        oroute, err := NewB2BRoute(x[8:], self.global_config)
+        if err != nil {
+            self.logger.Error("Error parsing the AAA route: " + err.Error())
+            self.uaA.RecvEvent(sippy.NewCCEventFail(500, "Internal Server Error (2)", nil, ""))
             self.state = CCStateDead
             return
-        routing = [B2BRoute(x[1][8:]) for x in routing]
-    else {
-*/
-        routing := []*B2BRoute{ global_static_route.getCopy() }
+        }
+        routing = append(routing, oroute)
+    }
+    if len(routing) == 0 && self.trunk != nil && self.trunk.route != nil {
+        routing = []*B2BRoute{ self.trunk.route.getCopy() }
+    }
+    if len(routing) == 0 && self.live.routing_table != nil {
+        routing = self.live.routing_table.Lookup(self.cld, self.cli, self.source.Host.String(), time.Now())
+    }
+    if len(routing) == 0 && self.acl.route != nil {
+        routing = []*B2BRoute{ self.acl.route.getCopy() }
+    }
+    if len(routing) == 0 && self.live.static_route != nil {
+        routing = []*B2BRoute{ self.live.static_route.getCopy() }
+    }
+    if len(routing) == 0 {
+        self.uaA.RecvEvent(sippy.NewCCEventFail(404, "Not Found", nil, ""))
+        self.state = CCStateDead
+        return
+    }
 //    }
     rnum := 0
-    for _, oroute := range routing {
-        rnum += 1
-        oroute.customize(rnum, self.cld, self.cli, 0, self.pass_headers, 0)
-        //oroute.customize(rnum, self.cld, self.cli, credit_time, self.pass_headers, self.global_config.max_credit_time)
-        //if oroute.credit_time == 0 || oroute.expires == 0 {
-        //    continue
-        //}
-        self.routes = append(self.routes, oroute)
-        //println "Got route:", oroute.hostport, oroute.cld
+    unavailable := false
+    now := time.Now()
+    for _, lroute := range routing {
+        oroutes := []*B2BRoute{ lroute }
+        if lroute.location {
+            if global_location == nil {
+                self.logger.Error("The location route is used while the registrar is disabled")
+                continue
+            }
+            oroutes = global_location.Resolve(lroute, self.cld, now)
+            if len(oroutes) == 0 {
+                unavailable = true
+            }
+        }
+        for _, oroute := range oroutes {
+            rnum += 1
+            oroute.customize(rnum, self.cld, self.cli, credit_time, self.pass_headers, self.global_config.max_credit_time)
+            //if oroute.credit_time == 0 || oroute.expires == 0 {
+            //    continue
+            //}
+            self.routes = append(self.routes, oroute)
+            //println "Got route:", oroute.hostport, oroute.cld
+        }
+    }
+    if len(self.routes) == 0 && unavailable {
+        self.uaA.RecvEvent(sippy.NewCCEventFail(480, "Temporarily Unavailable", nil, ""))
+        self.state = CCStateDead
+        return
     }
     if len(self.routes) == 0 {
         self.uaA.RecvEvent(sippy.NewCCEventFail(500, "Internal Server Error (3)", nil, ""))
@@ -278,18 +571,97 @@ func (self *callController) rDone(/*results*/) {
         return
     }
     self.state = CCStateARComplete
-    route := self.routes[0]
-    self.routes = self.routes[1:]
-    self.placeOriginate(route)
+    if ! self.placeRoutes() {
+        self.uaA.RecvEvent(global_limiter.RejectEvent())
+        self.state = CCStateDead
+    }
+}
+
+// Place the next route along with all the routes following it which are
+// marked to be forked in parallel.
+// The routes whose destinations are over their limits are skipped. Returns
+// false when no route could be placed.
+func (self *callController) placeRoutes() bool {
+    // The legs of the previous group have all failed by now
+    releaseLimits(self.route_limits)
+    self.route_limits = nil
+    group := []*B2BRoute{}
+    now := time.Now()
+    for len(group) == 0 {
+        if len(self.routes) == 0 {
+            return false
+        }
+        candidates := []*B2BRoute{ self.routes[0] }
+        self.routes = self.routes[1:]
+        for len(self.routes) > 0 && self.routes[0].fork {
+            candidates = append(candidates, self.routes[0])
+            self.routes = self.routes[1:]
+        }
+        for _, oroute := range candidates {
+            limit := global_limiter.RouteLimit(oroute)
+            if limit == nil {
+                group = append(group, oroute)
+            } else if limit.acquire(now) {
+                group = append(group, oroute)
+                self.route_limits = append(self.route_limits, limit)
+            }
+        }
+    }
+    self.forks = nil
+    self.early_leg = nil
+    self.ring_sent = false
+    self.fork_fail_event = nil
+    self.huntstop_scodes = group[0].huntstop_scodes
+    if len(group) == 1 {
+        uaO, event := self.prepareOriginate(group[0], false)
+        self.uaO = uaO
+        uaO.RecvEvent(event)
+        return true
+    }
+    events := make([]sippy_types.CCEvent, len(group))
+    for i, oroute := range group {
+        var uaO sippy_types.UA
+        uaO, events[i] = self.prepareOriginate(oroute, true)
+        self.forks = append(self.forks, uaO)
+    }
+    self.uaO = self.forks[0]
+    // The legs report failures synchronously so iterate over the copy
+    for i, uaO := range append([]sippy_types.UA{}, self.forks...) {
+        uaO.RecvEvent(events[i])
+    }
+    return true
 }
 
-func (self *callController) placeOriginate(oroute *B2BRoute) {
+// Make sure that only the leg that owns early media can touch the callee
+// side of the rtpproxy session until some leg answers.
+func (self *callController) forkRemoteSdpChange(uaO sippy_types.UA, on_sdp_change sippy_types.OnRemoteSdpChange) sippy_types.OnRemoteSdpChange {
+    return func(body sippy_types.MsgBody, msg sippy_types.SipMsg, result_callback func(sippy_types.MsgBody)) error {
+        is_final := false
+        if resp, ok := msg.(sippy_types.SipResponse); ok && resp.GetSCodeNum() >= 200 {
+            is_final = true
+        }
+        if len(self.forks) == 0 {
+            if uaO == self.uaO {
+                return on_sdp_change(body, msg, result_callback)
+            }
+        } else if is_final || self.early_leg == nil || self.early_leg == uaO {
+            if ! is_final {
+                self.early_leg = uaO
+            }
+            return on_sdp_change(body, msg, result_callback)
+        }
+        result_callback(body)
+        return nil
+    }
+}
+
+func (self *callController) prepareOriginate(oroute *B2BRoute, fork bool) (sippy_types.UA, *sippy.CCEventTry) {
     //cId, cGUID, cli, cld, body, auth, caller_name = self.eTry.getData()
-    cld := oroute.cld
-    self.huntstop_scodes = oroute.huntstop_scodes
-    //if self.global_config.has_key('static_tr_out') {
-    //    cld = re_replace(self.global_config['static_tr_out'], cld)
-    //}
+    tr_out := self.global_config.static_tr_out
+    if oroute.tr_out_set {
+        tr_out = oroute.tr_out
+    }
+    cld, cli := tr_out.Apply(oroute.cld, oroute.cli)
     var nh_address *sippy_conf.HostPort
     if oroute.hostport == "sip-ua" {
         //host = self.source[0]
@@ -308,46 +680,64 @@ func (self *callController) placeOriginate(oroute *B2BRoute) {
     //else {
     //    self.acctO = nil
     //}
-    //self.acctA.credit_time = oroute.credit_time
     //disc_handlers = []
     //if ! oroute.forward_on_fail && self.global_config['acct_enable'] {
     //    disc_handlers.append(self.acctO.disc)
     //}
-    self.uaO = sippy.NewUA(self.sip_tm, self.global_config, nh_address, self, self.lock, nil)
+    uaO := sippy.NewUA(self.sip_tm, self.global_config, nh_address, self, self.lock, nil)
     // oroute.user, oroute.passw, nh_address, oroute.credit_time,
     //  /*expire_time*/ oroute.expires, /*no_progress_time*/ oroute.no_progress_expires, /*extra_headers*/ oroute.extra_headers)
-    //self.uaO.SetConnCbs([]sippy_types.OnConnectListener{ self.oConn })
-    self.uaO.SetExtraHeaders(oroute.extra_headers)
-    self.uaO.SetDeadCb(self.oDead)
-    self.uaO.SetLocalUA(sippy_header.NewSipUserAgent(self.global_config.GetMyUAName()))
+    //uaO.SetConnCbs([]sippy_types.OnConnectListener{ self.oConn })
+    uaO.SetExtraHeaders(oroute.extra_headers)
+    uaO.SetDeadCb(self.oDead)
+    uaO.SetLocalUA(sippy_header.NewSipUserAgent(self.global_config.GetMyUAName()))
     if oroute.outbound_proxy != nil && self.source.String() != oroute.outbound_proxy.String() {
-        self.uaO.SetOutboundProxy(oroute.outbound_proxy)
+        uaO.SetOutboundProxy(oroute.outbound_proxy)
     }
     var body sippy_types.MsgBody
     if self.rtp_proxy_session != nil && oroute.rtpp {
-        self.uaO.SetOnLocalSdpChange(self.rtp_proxy_session.OnCallerSdpChange)
-        self.uaO.SetOnRemoteSdpChange(self.rtp_proxy_session.OnCalleeSdpChange)
+        uaO.SetOnLocalSdpChange(self.rtp_proxy_session.OnCallerSdpChange)
+        if fork {
+            uaO.SetOnRemoteSdpChange(self.forkRemoteSdpChange(uaO, self.rtp_proxy_session.OnCalleeSdpChange))
+        } else {
+            uaO.SetOnRemoteSdpChange(self.rtp_proxy_session.OnCalleeSdpChange)
+        }
         self.rtp_proxy_session.SetCallerRaddress(nh_address)
         if self.eTry.GetBody() != nil {
             body = self.eTry.GetBody().GetCopy()
         }
         self.proxied = true
     }
-    self.uaO.SetKaInterval(self.global_config.keepalive_orig)
-    //if oroute.params.has_key('group_timeout') {
-    //    timeout, skipto = oroute.params['group_timeout']
-    //    Timeout(self.group_expires, timeout, 1, skipto)
-    //}
-    //if self.global_config.getdefault('hide_call_id', false) {
-    //    cId = SipCallId(md5(str(cId)).hexdigest() + ("-b2b_%d" % oroute.rnum))
-    //} else {
-        cId := sippy_header.NewSipCallIdFromString(self.eTry.GetSipCallId().CallId + fmt.Sprintf("-b2b_%d", oroute.rnum))
-    //}
+    uaO.SetKaInterval(self.global_config.keepalive_orig)
+    if oroute.credit_time > 0 {
+        uaO.SetCreditTime(oroute.credit_time)
+        self.credit_times[uaO] = oroute.credit_time
+    }
+    if oroute.gt_set {
+        skipto := oroute.gt_skipto
+        sippy.StartTimeout(func() { self.group_expires(skipto) }, self.lock, oroute.gt_timeout, 1, self.logger)
+    }
+    var cId *sippy_header.SipCallId
+    if self.global_config.hide_call_id {
+        cId = sippy_header.NewSipCallIdFromString(fmt.Sprintf("%x-b2b_%d", md5.Sum([]byte(self.eTry.GetSipCallId().CallId)), oroute.rnum))
+    } else {
+        cId = sippy_header.NewSipCallIdFromString(self.eTry.GetSipCallId().CallId + fmt.Sprintf("-b2b_%d", oroute.rnum))
+    }
+    if self.trace != nil {
+        global_tracer.addCallId(self.trace, cId.CallId)
+    }
+    leg := newLegStats(global_cmap.stats, oroute.hostport)
+    leg.logger = self.logger.With(sippy_log.F("leg", "O"), sippy_log.F("route", oroute.hostport), sippy_log.F("leg_call_id", cId.CallId))
+    leg.cld = cld
+    self.legs = append(self.legs, leg)
+    uaO.SetConnCb(leg.conn)
+    uaO.SetFailCb(leg.fail)
+    uaO.SetDiscCb(leg.disc)
     caller_name := oroute.caller_name
     if caller_name == "" {
         caller_name = self.caller_name
     }
-    event := sippy.NewCCEventTry(cId, self.eTry.GetSipCiscoGUID(), oroute.cli, cld, body, self.eTry.GetSipAuthorization(), caller_name, nil, "")
+    event := sippy.NewCCEventTry(cId, self.eTry.GetSipCiscoGUID(), cli, cld, body, self.eTry.GetSipAuthorization(), caller_name, nil, "")
     //if self.eTry.max_forwards != nil {
     //    event.max_forwards = self.eTry.max_forwards - 1
     //    if event.max_forwards <= 0 {
@@ -357,12 +747,51 @@ func (self *callController) placeOriginate(oroute *B2BRoute) {
     //    }
     //}
     event.SetReason(self.eTry.GetReason())
-    self.uaO.RecvEvent(event)
+    return uaO, event
+}
+
+func (self *callController) releaseLimits() {
+    releaseLimits(self.limits)
+    releaseLimits(self.route_limits)
+    self.limits = nil
+    self.route_limits = nil
+}
+
+// Release the config once the call is gone and its rtpproxy session has
+// been deleted, so that the rtpproxy clients dropped by a reload meanwhile
+// stay up until then.
+func (self *callController) releaseLive() {
+    if ! self.dead || self.rtpp_deleting || self.live_released {
+        return
+    }
+    self.live_released = true
+    self.live.release()
 }
 
 func (self *callController) disconnect(rtime *sippy_time.MonoTime) {
     self.uaA.Disconnect(rtime)
 }
+
+// Blind transfer of the caller to the target. The caller is sent the
+// REFER (or BYE with Also) and the outgoing leg is disconnected.
+func (self *callController) transfer(target *sippy_header.SipURL) error {
+    if self.state != CCStateConnected || self.uaO == nil {
+        return errors.New("the call is not connected")
+    }
+    rtime, _ := sippy_time.NewMonoTime()
+    self.uaA.RecvEvent(sippy.NewCCEventDisconnect(target, rtime, "switch"))
+    self.uaO.Disconnect(rtime)
+    return nil
+}
+
+// Starts recording of the call media by the rtpproxy.
+func (self *callController) startRecording() error {
+    if self.rtp_proxy_session == nil {
+        return errors.New("the call media is not relayed through the rtpproxy")
+    }
+    self.rtp_proxy_session.StartRecording("", nil, 0)
+    return nil
+}
 /*
     def oConn(self, ua, rtime, origin):
         if self.acctO != nil:
@@ -374,6 +803,8 @@ func (self *callController) aConn(rtime *sippy_time.MonoTime, origin string) {
 }
 
 func (self *callController) aFail(rtime *sippy_time.MonoTime, origin string, result int) {
+    global_cmap.stats.failed(result)
+    self.cdr_result = result
     self.aDisc(rtime, origin, result, nil)
 }
 
@@ -390,9 +821,18 @@ func (self *callController) aDisc(rtime *sippy_time.MonoTime, origin string, res
     //if self.acctA != nil {
     //    self.acctA.disc(ua, rtime, origin, result)
     //}
+    if self.disc_origin == "" {
+        self.disc_origin = origin
+        if inreq != nil && inreq.GetReason() != nil {
+            self.disc_reason = inreq.GetReason().Body()
+        }
+    }
+    if self.warning_timer != nil {
+        self.warning_timer.Cancel()
+        self.warning_timer = nil
+    }
     if self.rtp_proxy_session != nil {
-        self.rtp_proxy_session.Delete()
-        self.rtp_proxy_session = nil
+        self.deleteRtpProxySession()
     }
 }
 
@@ -403,7 +843,7 @@ func (self *callController) aDead() {
     }
     if self.uaO == nil || is_dead {
         if global_cmap.debug_mode {
-            println("garbadge collecting", self)
+            self.logger.Debug("garbage collecting")
         }
         self.acctA = nil
         //self.acctO = nil
@@ -414,7 +854,7 @@ func (self *callController) aDead() {
 func (self *callController) oDead() {
     if _, ok := self.uaA.GetState().(*sippy.UaStateDead); ok {
         if global_cmap.debug_mode {
-            println("garbadge collecting", self)
+            self.logger.Debug("garbage collecting")
         }
         self.acctA = nil
         //self.acctO = nil
@@ -422,19 +862,30 @@ func (self *callController) oDead() {
     }
 }
 
-/*
-    def group_expires(self, skipto):
-        if self.state != CCStateARComplete || len(self.routes) == 0 || self.routes[0][0] > skipto || \
-          (! isinstance(self.uaA.state, UasStateTrying) && ! isinstance(self.uaA.state, UasStateRinging)):
-            return
-        // When the last group in the list has timeouted don't disconnect
-        // the current attempt forcefully. Instead, make sure that if the
-        // current originate call leg fails no more routes will be
-        // processed.
-        if skipto == self.routes[-1][0] + 1:
-            self.routes = []
-            return
-        while self.routes[0][0] != skipto:
-            self.routes.pop(0)
-        self.uaO.disconnect()
-        */
+func (self *callController) group_expires(skipto int) {
+    _, is_state_trying := self.uaA.GetState().(*sippy.UasStateTrying)
+    _, is_state_ringing := self.uaA.GetState().(*sippy.UasStateRinging)
+    if self.state != CCStateARComplete || len(self.routes) == 0 || self.routes[0].rnum > skipto ||
+      (! is_state_trying && ! is_state_ringing) {
+        return
+    }
+    // When the last group in the list has timeouted don't disconnect
+    // the current attempt forcefully. Instead, make sure that if the
+    // current originate call leg fails no more routes will be
+    // processed.
+    if skipto == self.routes[len(self.routes) - 1].rnum + 1 {
+        self.routes = self.routes[:0]
+        return
+    }
+    for len(self.routes) > 0 && self.routes[0].rnum < skipto {
+        self.routes = self.routes[1:]
+    }
+    if len(self.forks) > 0 {
+        // The legs report failures synchronously so iterate over the copy
+        for _, uaO := range append([]sippy_types.UA{}, self.forks...) {
+            uaO.Disconnect(nil)
+        }
+        return
+    }
+    self.uaO.Disconnect(nil)
+}
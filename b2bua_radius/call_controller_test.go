@@ -0,0 +1,788 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "net"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "sippy"
+    "sippy/conf"
+    "sippy/headers"
+    "sippy/log"
+    "sippy/rtpptest"
+)
+
+const test_caller_sdp = "v=0\r\n" +
+    "o=- 12345 12345 IN IP4 10.0.0.1\r\n" +
+    "s=-\r\n" +
+    "c=IN IP4 10.0.0.1\r\n" +
+    "t=0 0\r\n" +
+    "m=audio 16000 RTP/AVP 0 8\r\n"
+
+const test_callee_sdp = "v=0\r\n" +
+    "o=- 54321 54321 IN IP4 10.0.0.2\r\n" +
+    "s=-\r\n" +
+    "c=IN IP4 10.0.0.2\r\n" +
+    "t=0 0\r\n" +
+    "m=audio 18000 RTP/AVP 0\r\n"
+
+var test_branch_seq int64
+
+// The SIP message as seen by the test call parties.
+type testSipMsg struct {
+    start       string
+    headers     [][2]string
+    body        string
+}
+
+func parseTestSipMsg(data string) *testSipMsg {
+    self := &testSipMsg{}
+    arr := strings.SplitN(data, "\r\n\r\n", 2)
+    if len(arr) == 2 {
+        self.body = arr[1]
+    }
+    lines := strings.Split(arr[0], "\r\n")
+    self.start = lines[0]
+    for _, line := range lines[1:] {
+        hv := strings.SplitN(line, ":", 2)
+        if len(hv) == 2 {
+            self.headers = append(self.headers, [2]string{ strings.ToLower(strings.TrimSpace(hv[0])), strings.TrimSpace(hv[1]) })
+        }
+    }
+    return self
+}
+
+func (self *testSipMsg) header(name string) string {
+    if all := self.allHeaders(name); len(all) > 0 {
+        return all[0]
+    }
+    return ""
+}
+
+func (self *testSipMsg) allHeaders(name string) []string {
+    ret := []string{}
+    name = strings.ToLower(name)
+    for _, hv := range self.headers {
+        if hv[0] == name {
+            ret = append(ret, hv[1])
+        }
+    }
+    return ret
+}
+
+func (self *testSipMsg) isRequest(method string) bool {
+    return strings.HasPrefix(self.start, method + " ")
+}
+
+func (self *testSipMsg) isResponse(scode int) bool {
+    return strings.HasPrefix(self.start, fmt.Sprintf("SIP/2.0 %d ", scode))
+}
+
+// Returns the URI of the Contact header.
+func (self *testSipMsg) contact() string {
+    contact := self.header("contact")
+    if i, j := strings.Index(contact, "<"), strings.Index(contact, ">"); i >= 0 && j > i {
+        return contact[i + 1:j]
+    }
+    return contact
+}
+
+// The caller or the callee talking to the B2BUA over UDP.
+type testSipPeer struct {
+    t           *testing.T
+    name        string
+    conn        *net.UDPConn
+    msgs        chan *testSipMsg
+    headers     string // added to the requests sent
+}
+
+func newTestSipPeer(t *testing.T, name string) *testSipPeer {
+    conn, err := net.ListenUDP("udp", &net.UDPAddr{ IP : net.ParseIP("127.0.0.1") })
+    if err != nil {
+        t.Fatal(err)
+    }
+    self := &testSipPeer{
+        t           : t,
+        name        : name,
+        conn        : conn,
+        msgs        : make(chan *testSipMsg, 100),
+    }
+    go func() {
+        buf := make([]byte, 65536)
+        for {
+            n, err := conn.Read(buf)
+            if err != nil {
+                close(self.msgs)
+                return
+            }
+            self.msgs <- parseTestSipMsg(string(buf[:n]))
+        }
+    }()
+    return self
+}
+
+func (self *testSipPeer) close() {
+    self.conn.Close()
+}
+
+func (self *testSipPeer) port() string {
+    return strconv.Itoa(self.conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func (self *testSipPeer) hostport() string {
+    return "127.0.0.1:" + self.port()
+}
+
+// Wait for the message matching the filter, the rest of the messages
+// (provisional responses, retransmits) are skipped.
+func (self *testSipPeer) expect(desc string, filter func(*testSipMsg) bool, timeout time.Duration) *testSipMsg {
+    deadline := time.After(timeout)
+    for {
+        select {
+        case msg, ok := <-self.msgs:
+            if ! ok {
+                self.t.Fatalf("%s: the connection has been closed while waiting for %s", self.name, desc)
+            }
+            if filter(msg) {
+                return msg
+            }
+        case <-deadline:
+            self.t.Fatalf("%s: timeout waiting for %s", self.name, desc)
+        }
+    }
+}
+
+func (self *testSipPeer) expectRequest(method string) *testSipMsg {
+    return self.expect(method, func(msg *testSipMsg) bool { return msg.isRequest(method) }, 5 * time.Second)
+}
+
+func finalResponseTo(method string) func(*testSipMsg) bool {
+    return func(msg *testSipMsg) bool {
+        return strings.HasPrefix(msg.start, "SIP/2.0 ") && ! strings.HasPrefix(msg.start, "SIP/2.0 1") &&
+          strings.HasSuffix(msg.header("cseq"), " " + method)
+    }
+}
+
+// Wait for the final response to the request with the CSeq method.
+func (self *testSipPeer) expectFinal(method string) *testSipMsg {
+    return self.expect("final response to " + method, finalResponseTo(method), 5 * time.Second)
+}
+
+// Make sure that no message matching the filter arrives within the
+// timeout.
+func (self *testSipPeer) expectNone(desc string, filter func(*testSipMsg) bool, timeout time.Duration) {
+    deadline := time.After(timeout)
+    for {
+        select {
+        case msg, ok := <-self.msgs:
+            if ok && filter(msg) {
+                self.t.Fatalf("%s: unexpected %s received: %s", self.name, desc, msg.start)
+            }
+        case <-deadline:
+            return
+        }
+    }
+}
+
+func (self *testSipPeer) expectNoRequest(method string, timeout time.Duration) {
+    self.expectNone(method, func(msg *testSipMsg) bool { return msg.isRequest(method) }, timeout)
+}
+
+func (self *testSipPeer) send(addr string, data string) {
+    raddr, err := net.ResolveUDPAddr("udp", addr)
+    if err != nil {
+        self.t.Fatal(err)
+    }
+    if _, err = self.conn.WriteToUDP([]byte(data), raddr); err != nil {
+        self.t.Fatal(err)
+    }
+}
+
+func withBody(msg, body string) string {
+    if body != "" {
+        msg += "Content-Type: application/sdp\r\n"
+    }
+    return msg + fmt.Sprintf("Content-Length: %d\r\n\r\n", len(body)) + body
+}
+
+// Send the request within the dialog described by the headers.
+func (self *testSipPeer) request(addr, method, ruri, from, to, call_id string, cseq int, body string) {
+    msg := method + " " + ruri + " SIP/2.0\r\n" +
+        fmt.Sprintf("Via: SIP/2.0/UDP %s;branch=z9hG4bK-test-%d\r\n", self.hostport(), atomic.AddInt64(&test_branch_seq, 1)) +
+        "From: " + from + "\r\n" +
+        "To: " + to + "\r\n" +
+        "Call-ID: " + call_id + "\r\n" +
+        fmt.Sprintf("CSeq: %d %s\r\n", cseq, method) +
+        "Contact: <sip:" + self.name + "@" + self.hostport() + ">\r\n" +
+        "Max-Forwards: 70\r\n" + self.headers
+    self.send(addr, withBody(msg, body))
+}
+
+// Reply to the request received from the B2BUA.
+func (self *testSipPeer) reply(req *testSipMsg, scode int, reason, to_tag, body string) {
+    msg := fmt.Sprintf("SIP/2.0 %d %s\r\n", scode, reason)
+    for _, via := range req.allHeaders("via") {
+        msg += "Via: " + via + "\r\n"
+    }
+    to := req.header("to")
+    if to_tag != "" && ! strings.Contains(to, ";tag=") {
+        to += ";tag=" + to_tag
+    }
+    msg += "From: " + req.header("from") + "\r\n" +
+        "To: " + to + "\r\n" +
+        "Call-ID: " + req.header("call-id") + "\r\n" +
+        "CSeq: " + req.header("cseq") + "\r\n" +
+        "Contact: <sip:" + self.name + "@" + self.hostport() + ">\r\n"
+    via := req.header("via")
+    via_hp := strings.Fields(strings.SplitN(via, ";", 2)[0])
+    self.send(via_hp[len(via_hp) - 1], withBody(msg, body))
+}
+
+// The side of the call facing the B2BUA from the caller.
+type testCaller struct {
+    *testSipPeer
+    b2b_addr    string
+    call_id     string
+    from        string
+    to          string
+    cseq        int
+}
+
+func newTestCaller(t *testing.T, b2b_addr string) *testCaller {
+    return &testCaller{
+        testSipPeer : newTestSipPeer(t, "caller"),
+        b2b_addr    : b2b_addr,
+        call_id     : fmt.Sprintf("test-%d@127.0.0.1", time.Now().UnixNano()),
+        from        : "<sip:caller@127.0.0.1>;tag=caller-tag",
+        to          : "<sip:12345@" + b2b_addr + ">",
+        cseq        : 1,
+    }
+}
+
+func (self *testCaller) invite(body string) {
+    self.request(self.b2b_addr, "INVITE", "sip:12345@" + self.b2b_addr, self.from, self.to, self.call_id, self.cseq, body)
+}
+
+// ACK the final response and remember the dialog established.
+func (self *testCaller) ack(resp *testSipMsg) {
+    self.to = resp.header("to")
+    ruri := self.b2b_addr
+    if resp.isResponse(200) {
+        ruri = strings.TrimPrefix(resp.contact(), "sip:")
+        if i := strings.Index(ruri, "@"); i >= 0 {
+            ruri = ruri[i + 1:]
+        }
+    }
+    self.request(self.b2b_addr, "ACK", "sip:12345@" + ruri, self.from, self.to, self.call_id, self.cseq, "")
+}
+
+func (self *testCaller) bye() {
+    self.cseq++
+    self.request(self.b2b_addr, "BYE", "sip:12345@" + self.b2b_addr, self.from, self.to, self.call_id, self.cseq, "")
+}
+
+// The B2BUA running in the test with the fake rtpproxy attached.
+type testB2B struct {
+    t           *testing.T
+    addr        string
+    rtpp        *sippy_rtpptest.FakeRtpProxy
+    live        *liveConfig
+    tmpdir      string
+    stop        func()
+}
+
+func freeUdpPort(t *testing.T) string {
+    conn, err := net.ListenUDP("udp", &net.UDPAddr{ IP : net.ParseIP("127.0.0.1") })
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    return strconv.Itoa(conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// Start the B2BUA routing the calls according to the routing table which
+// is a list of the routes in the order of priority.
+func newTestB2B(t *testing.T, routes []string, args ...string) *testB2B {
+    tmpdir, err := ioutil.TempDir("", "b2btest")
+    if err != nil {
+        t.Fatal(err)
+    }
+    rtpp, err := sippy_rtpptest.NewFakeRtpProxyUDP("127.0.0.1:0")
+    if err != nil {
+        os.RemoveAll(tmpdir)
+        t.Fatal(err)
+    }
+    rtpp.SetAdvertisedAddress("192.0.2.10")
+    self := &testB2B{
+        t           : t,
+        rtpp        : rtpp,
+        tmpdir      : tmpdir,
+    }
+    table := ""
+    for i, route := range routes {
+        table += fmt.Sprintf("*,*,*,*,%d,1,\"%s\"\n", i, route)
+    }
+    rtable := filepath.Join(tmpdir, "routes.csv")
+    if err = ioutil.WriteFile(rtable, []byte(table), 0644); err != nil {
+        self.cleanup()
+        t.Fatal(err)
+    }
+    port := freeUdpPort(t)
+    self.addr = "127.0.0.1:" + port
+    args = append([]string{ "-l", "127.0.0.1", "-p", port, "-routing_table", rtable,
+        "-rtp_proxy_clients", rtpp.Address(), "-c", filepath.Join(tmpdir, "b2bua.sock") }, args...)
+    cfg := newTestConfig(t, args...)
+    sip_logger, err := sippy_log.NewSipLogger("test", filepath.Join(tmpdir, "sip.log"))
+    if err != nil {
+        self.cleanup()
+        t.Fatal(err)
+    }
+    cfg.Config = sippy_conf.NewConfig(sippy_log.NewErrorLogger(), sip_logger)
+    cfg.SetMyPort(sippy_conf.NewMyPort(port))
+    cfg.SetMyAddress(sippy_conf.NewMyAddress("127.0.0.1"))
+    cfg.SetSipAddress(cfg.GetMyAddress())
+    self.live, err = newLiveConfig(cfg, nil)
+    if err != nil {
+        self.cleanup()
+        t.Fatal(err)
+    }
+    setLive(self.live)
+    global_limiter, err = NewCallLimiter(0, 0, "", cfg.limit_scode, cfg.limit_retry_after)
+    if err != nil {
+        self.cleanup()
+        t.Fatal(err)
+    }
+    global_cmap = NewCallMap(cfg)
+    sip_tm, err := sippy.NewSipTransactionManager(cfg, global_cmap)
+    if err != nil {
+        self.cleanup()
+        t.Fatal(err)
+    }
+    global_cmap.sip_tm = sip_tm
+    go sip_tm.Run()
+    self.stop = sip_tm.Shutdown
+    for _, rtpc := range self.live.rtp_proxy_clients {
+        if ! waitFor(rtpc.IsOnline, 3 * time.Second) {
+            self.cleanup()
+            t.Fatal("The rtpproxy client has not gone online")
+        }
+    }
+    return self
+}
+
+func (self *testB2B) cleanup() {
+    if self.stop != nil {
+        self.stop()
+    }
+    if self.live != nil {
+        for _, rtpc := range self.live.rtp_proxy_clients {
+            rtpc.Shutdown()
+        }
+    }
+    self.rtpp.Close()
+    os.RemoveAll(self.tmpdir)
+}
+
+func (self *testB2B) activeCalls() int {
+    return len(global_cmap.calls())
+}
+
+func waitFor(cond func() bool, timeout time.Duration) bool {
+    deadline := time.Now().Add(timeout)
+    for time.Now().Before(deadline) {
+        if cond() {
+            return true
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    return cond()
+}
+
+func TestCallControllerRtpProxyCall(t *testing.T) {
+    callee := newTestSipPeer(t, "callee")
+    defer callee.close()
+    b2b := newTestB2B(t, []string{ callee.hostport() })
+    defer b2b.cleanup()
+    caller := newTestCaller(t, b2b.addr)
+    defer caller.close()
+
+    caller.invite(test_caller_sdp)
+    invite := callee.expectRequest("INVITE")
+    if ! strings.Contains(invite.body, "c=IN IP4 192.0.2.10") || strings.Contains(invite.body, "m=audio 16000 ") {
+        t.Errorf("The offer has not been relayed through the rtpproxy:\n%s", invite.body)
+    }
+    if ! strings.Contains(invite.body, "nortpproxy=yes") {
+        t.Errorf("No nortpproxy attribute in the offer:\n%s", invite.body)
+    }
+    callee.reply(invite, 200, "OK", "callee-tag", test_callee_sdp)
+    resp := caller.expectFinal("INVITE")
+    if ! resp.isResponse(200) {
+        t.Fatalf("Unexpected response to the INVITE: %s", resp.start)
+    }
+    if ! strings.Contains(resp.body, "c=IN IP4 192.0.2.10") || strings.Contains(resp.body, "m=audio 18000 ") {
+        t.Errorf("The answer has not been relayed through the rtpproxy:\n%s", resp.body)
+    }
+    caller.ack(resp)
+    callee.expectRequest("ACK")
+    if b2b.rtpp.ActiveSessions() != 1 {
+        t.Errorf("Expected one rtpproxy session, got %d, commands: %v", b2b.rtpp.ActiveSessions(), b2b.rtpp.Commands())
+    }
+    for _, cmd := range b2b.rtpp.CommandsWithPrefix("U") {
+        if ! strings.Contains(cmd, caller.call_id) {
+            t.Errorf("The rtpproxy session is not bound to the call: %s", cmd)
+        }
+    }
+
+    caller.bye()
+    bye := callee.expectRequest("BYE")
+    callee.reply(bye, 200, "OK", "", "")
+    if resp = caller.expectFinal("BYE"); ! resp.isResponse(200) {
+        t.Errorf("Unexpected response to the BYE: %s", resp.start)
+    }
+    if ! waitFor(func() bool { return b2b.rtpp.ActiveSessions() == 0 }, 3 * time.Second) {
+        t.Errorf("The rtpproxy session has not been deleted, commands: %v", b2b.rtpp.Commands())
+    }
+    if len(b2b.rtpp.CommandsWithPrefix("D")) != 1 {
+        t.Errorf("Expected one delete command, got %v", b2b.rtpp.CommandsWithPrefix("D"))
+    }
+}
+
+// The credentials with a bogus nonce count that fail the verification
+// must not lock the real client out of the nonce.
+func TestCallControllerDigestNonceCount(t *testing.T) {
+    fd, err := ioutil.TempFile("", "b2bua_credentials")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.Remove(fd.Name())
+    fd.WriteString("user:alice:secret\n")
+    fd.Close()
+    store, err := newFileCredentialStore(fd.Name())
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Set up before the B2BUA starts using it
+    global_digest_auth, err = newDigestAuth(store, time.Minute, false, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer func() { global_digest_auth = nil }()
+    callee := newTestSipPeer(t, "callee")
+    defer callee.close()
+    b2b := newTestB2B(t, []string{ callee.hostport() }, "-auth_enable")
+    defer b2b.cleanup()
+    challenge := global_digest_auth.Challenge("127.0.0.1", false)
+    ruri := "sip:12345@" + b2b.addr
+
+    caller := newTestCaller(t, b2b.addr)
+    defer caller.close()
+    bogus := sippy_header.NewSipAuthorizationFromChallenge(challenge, "INVITE", ruri, "alice", "wrong", 0xffffffff, "")
+    caller.headers = bogus.String() + "\r\n"
+    caller.invite(test_caller_sdp)
+    resp := caller.expectFinal("INVITE")
+    if ! resp.isResponse(403) {
+        t.Fatalf("Unexpected response to the bogus credentials: %s", resp.start)
+    }
+    caller.ack(resp)
+
+    caller2 := newTestCaller(t, b2b.addr)
+    defer caller2.close()
+    caller2.call_id = "real-" + caller.call_id
+    auth := sippy_header.NewSipAuthorizationFromChallenge(challenge, "INVITE", ruri, "alice", "secret", 1, "")
+    caller2.headers = auth.String() + "\r\n"
+    caller2.invite(test_caller_sdp)
+    invite := callee.expectRequest("INVITE")
+    callee.reply(invite, 486, "Busy Here", "callee-tag", "")
+    callee.expectRequest("ACK")
+    if resp := caller2.expectFinal("INVITE"); ! resp.isResponse(486) {
+        t.Errorf("Unexpected response to the real credentials: %s", resp.start)
+    }
+}
+
+type testCdrSink struct {
+    cdrs        chan *cdr
+}
+
+func (self *testCdrSink) writeCdr(r *cdr) error {
+    self.cdrs <- r
+    return nil
+}
+
+func (self *testCdrSink) reopen() error {
+    return nil
+}
+
+// The call in progress keeps using the rtpproxy dropped by the reload
+// until it ends.
+func TestCallControllerReloadDuringCall(t *testing.T) {
+    sink := &testCdrSink{ cdrs : make(chan *cdr, 10) }
+    // Set up before the B2BUA starts using it
+    global_cdr = sink
+    defer func() { global_cdr = nil }()
+    callee := newTestSipPeer(t, "callee")
+    defer callee.close()
+    b2b := newTestB2B(t, []string{ callee.hostport() })
+    defer b2b.cleanup()
+    rtpp2, err := sippy_rtpptest.NewFakeRtpProxyUDP("127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer rtpp2.Close()
+    caller := newTestCaller(t, b2b.addr)
+    defer caller.close()
+
+    caller.invite(test_caller_sdp)
+    invite := callee.expectRequest("INVITE")
+    callee.reply(invite, 200, "OK", "callee-tag", test_callee_sdp)
+    resp := caller.expectFinal("INVITE")
+    if ! resp.isResponse(200) {
+        t.Fatalf("Unexpected response to the INVITE: %s", resp.start)
+    }
+    caller.ack(resp)
+    callee.expectRequest("ACK")
+
+    cfg := newTestConfig(t, "-routing_table", b2b.live.config.routing_table, "-rtp_proxy_clients", rtpp2.Address())
+    cfg.Config = b2b.live.config.Config
+    if err = swapLive(b2b.live, cfg); err != nil {
+        t.Fatal(err)
+    }
+    defer func() {
+        for _, rtpc := range currentLive().rtp_proxy_clients {
+            rtpc.Shutdown()
+        }
+    }()
+    removed := b2b.live.rtp_proxy_clients[0]
+    shut_down := func() bool {
+        ch := make(chan string, 1)
+        removed.SendCommand("V", func(res string) { ch <- res }, nil)
+        return <-ch == ""
+    }
+    if shut_down() {
+        t.Fatal("the rtpproxy client has been shut down while the call is in progress")
+    }
+
+    caller.bye()
+    bye := callee.expectRequest("BYE")
+    callee.reply(bye, 200, "OK", "", "")
+    caller.expectFinal("BYE")
+    if ! waitFor(func() bool { return len(b2b.rtpp.CommandsWithPrefix("D")) == 1 }, 3 * time.Second) {
+        t.Errorf("The rtpproxy session has not been deleted, commands: %v", b2b.rtpp.Commands())
+    }
+    // Do not wait for the UAs to go dead
+    for _, cc := range global_cmap.calls() {
+        global_cmap.withCall(cc, func() { global_cmap.DropCC(cc.id) })
+    }
+    select {
+    case r := <-sink.cdrs:
+        if r.CallId != caller.call_id || r.Rtpp == nil {
+            t.Errorf("Unexpected CDR: %+v", r)
+        }
+    case <-time.After(3 * time.Second):
+        t.Error("The CDR has not been written")
+    }
+    if ! waitFor(shut_down, 3 * time.Second) {
+        t.Error("the dropped rtpproxy client has not been shut down after the call")
+    }
+    if len(rtpp2.CommandsWithPrefix("U")) != 0 {
+        t.Error("the call has been moved to the new rtpproxy")
+    }
+}
+
+// Cancel the pending INVITE as the callee would.
+func (self *testSipPeer) cancelled(invite *testSipMsg, to_tag string) {
+    cancel := self.expectRequest("CANCEL")
+    self.reply(cancel, 200, "OK", to_tag, "")
+    self.reply(invite, 487, "Request Terminated", to_tag, "")
+    self.expectRequest("ACK")
+}
+
+func TestCallControllerForkWinner(t *testing.T) {
+    loser := newTestSipPeer(t, "loser")
+    defer loser.close()
+    winner := newTestSipPeer(t, "winner")
+    defer winner.close()
+    b2b := newTestB2B(t, []string{ loser.hostport(), winner.hostport() + ";fork" })
+    defer b2b.cleanup()
+    caller := newTestCaller(t, b2b.addr)
+    defer caller.close()
+
+    caller.invite(test_caller_sdp)
+    loser_invite := loser.expectRequest("INVITE")
+    winner_invite := winner.expectRequest("INVITE")
+    if loser_invite.header("call-id") == winner_invite.header("call-id") {
+        t.Errorf("The parallel legs share the Call-ID %s", loser_invite.header("call-id"))
+    }
+    loser.reply(loser_invite, 180, "Ringing", "loser-tag", "")
+    caller.expect("180 Ringing", func(msg *testSipMsg) bool { return msg.isResponse(180) }, 5 * time.Second)
+    winner.reply(winner_invite, 200, "OK", "winner-tag", test_callee_sdp)
+    // The first leg to answer wins and the rest are cancelled
+    loser.cancelled(loser_invite, "loser-tag")
+    resp := caller.expectFinal("INVITE")
+    if ! resp.isResponse(200) {
+        t.Fatalf("Unexpected response to the INVITE: %s", resp.start)
+    }
+    caller.ack(resp)
+    winner.expectRequest("ACK")
+
+    caller.bye()
+    bye := winner.expectRequest("BYE")
+    winner.reply(bye, 200, "OK", "", "")
+    if resp = caller.expectFinal("BYE"); ! resp.isResponse(200) {
+        t.Errorf("Unexpected response to the BYE: %s", resp.start)
+    }
+    loser.expectNoRequest("BYE", 200 * time.Millisecond)
+    if ! waitFor(func() bool { return b2b.rtpp.ActiveSessions() == 0 }, 3 * time.Second) {
+        t.Errorf("The rtpproxy session has not been deleted, commands: %v", b2b.rtpp.Commands())
+    }
+}
+
+func TestCallControllerForkAllFail(t *testing.T) {
+    busy := newTestSipPeer(t, "busy")
+    defer busy.close()
+    decline := newTestSipPeer(t, "decline")
+    defer decline.close()
+    b2b := newTestB2B(t, []string{ busy.hostport(), decline.hostport() + ";fork" })
+    defer b2b.cleanup()
+    caller := newTestCaller(t, b2b.addr)
+    defer caller.close()
+
+    caller.invite(test_caller_sdp)
+    busy_invite := busy.expectRequest("INVITE")
+    decline_invite := decline.expectRequest("INVITE")
+    busy.reply(busy_invite, 486, "Busy Here", "busy-tag", "")
+    busy.expectRequest("ACK")
+    // Nothing is reported until the last leg in the group fails
+    caller.expectNone("final response", finalResponseTo("INVITE"), 200 * time.Millisecond)
+    decline.reply(decline_invite, 603, "Decline", "decline-tag", "")
+    decline.expectRequest("ACK")
+    // The 6xx takes precedence over the rest of the failures
+    resp := caller.expectFinal("INVITE")
+    if ! resp.isResponse(603) {
+        t.Errorf("Unexpected response to the INVITE: %s", resp.start)
+    }
+    caller.ack(resp)
+}
+
+func TestCallControllerGroupTimeout(t *testing.T) {
+    slow := newTestSipPeer(t, "slow")
+    defer slow.close()
+    backup := newTestSipPeer(t, "backup")
+    defer backup.close()
+    b2b := newTestB2B(t, []string{ slow.hostport() + ";gt=1,1", backup.hostport() })
+    defer b2b.cleanup()
+    caller := newTestCaller(t, b2b.addr)
+    defer caller.close()
+
+    start := time.Now()
+    caller.invite(test_caller_sdp)
+    slow_invite := slow.expectRequest("INVITE")
+    slow.reply(slow_invite, 180, "Ringing", "slow-tag", "")
+    backup.expectNoRequest("INVITE", 500 * time.Millisecond)
+    // The slow leg is abandoned once the group timeout expires and the
+    // next route is tried
+    slow.cancelled(slow_invite, "slow-tag")
+    if elapsed := time.Since(start); elapsed < time.Second {
+        t.Errorf("The slow leg has been cancelled after %s, before the group timeout", elapsed)
+    }
+    backup_invite := backup.expectRequest("INVITE")
+    backup.reply(backup_invite, 200, "OK", "backup-tag", test_callee_sdp)
+    resp := caller.expectFinal("INVITE")
+    if ! resp.isResponse(200) {
+        t.Fatalf("Unexpected response to the INVITE: %s", resp.start)
+    }
+    caller.ack(resp)
+    backup.expectRequest("ACK")
+    caller.bye()
+    bye := backup.expectRequest("BYE")
+    backup.reply(bye, 200, "OK", "", "")
+    caller.expectFinal("BYE")
+}
+
+func testCalleeSdp(addr, port string) string {
+    return strings.Replace(strings.Replace(test_callee_sdp, "10.0.0.2", addr, -1), "18000", port, 1)
+}
+
+func TestCallControllerForkEarlyMedia(t *testing.T) {
+    early := newTestSipPeer(t, "early")
+    defer early.close()
+    late := newTestSipPeer(t, "late")
+    defer late.close()
+    b2b := newTestB2B(t, []string{ early.hostport(), late.hostport() + ";fork" })
+    defer b2b.cleanup()
+    caller := newTestCaller(t, b2b.addr)
+    defer caller.close()
+    rtpp_updated := func(addr string) bool {
+        for _, cmd := range b2b.rtpp.Commands() {
+            if strings.Contains(cmd, addr) {
+                return true
+            }
+        }
+        return false
+    }
+
+    caller.invite(test_caller_sdp)
+    early_invite := early.expectRequest("INVITE")
+    late_invite := late.expectRequest("INVITE")
+    early.reply(early_invite, 183, "Session Progress", "early-tag", testCalleeSdp("10.0.0.3", "20000"))
+    resp := caller.expect("183", func(msg *testSipMsg) bool { return msg.isResponse(183) }, 5 * time.Second)
+    if ! strings.Contains(resp.body, "c=IN IP4 192.0.2.10") {
+        t.Errorf("The early media has not been relayed through the rtpproxy:\n%s", resp.body)
+    }
+    if ! rtpp_updated("10.0.0.3 20000") {
+        t.Errorf("The rtpproxy has not been pointed to the early media, commands: %v", b2b.rtpp.Commands())
+    }
+    // The leg that doesn't own early media can't touch the rtpproxy
+    // session until it answers
+    late.reply(late_invite, 183, "Session Progress", "late-tag", testCalleeSdp("10.0.0.4", "22000"))
+    caller.expectNone("second 183", func(msg *testSipMsg) bool { return msg.isResponse(183) }, 200 * time.Millisecond)
+    if rtpp_updated("10.0.0.4 22000") {
+        t.Errorf("The rtpproxy has been updated by the leg without early media, commands: %v", b2b.rtpp.Commands())
+    }
+    late.reply(late_invite, 200, "OK", "late-tag", testCalleeSdp("10.0.0.4", "22000"))
+    early.cancelled(early_invite, "early-tag")
+    resp = caller.expectFinal("INVITE")
+    if ! resp.isResponse(200) {
+        t.Fatalf("Unexpected response to the INVITE: %s", resp.start)
+    }
+    if ! rtpp_updated("10.0.0.4 22000") {
+        t.Errorf("The rtpproxy has not been pointed to the answering leg, commands: %v", b2b.rtpp.Commands())
+    }
+    caller.ack(resp)
+    late.expectRequest("ACK")
+    caller.bye()
+    bye := late.expectRequest("BYE")
+    late.reply(bye, 200, "OK", "", "")
+    caller.expectFinal("BYE")
+}
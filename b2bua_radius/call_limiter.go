@@ -0,0 +1,367 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "errors"
+    "fmt"
+    "net"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "sippy"
+    "sippy/headers"
+    "sippy/types"
+)
+
+// The admission control. Each limit caps the number of the concurrent
+// calls and the rate of the new calls (calls per second) going through
+// it. The global limit applies to all incoming calls, the source limits to
+// the calls coming from the IP address or network, and the route limits
+// to the calls placed to the destination of the B2BRoute.
+//
+// The concurrent calls are counted with the atomic operations while the
+// rate is enforced with a token bucket having its own small lock, so the
+// limiter never needs any of the call map locks.
+
+type callLimit struct {
+    name            string
+    max_calls       int64   // 0 means unlimited
+    max_cps         float64 // 0 means unlimited
+    calls           int64
+    rejected        int64
+    lock            sync.Mutex
+    tokens          float64
+    last            time.Time
+}
+
+func newCallLimit(name string, max_calls int64, max_cps float64) *callLimit {
+    self := &callLimit{
+        name            : name,
+        max_calls       : max_calls,
+        max_cps         : max_cps,
+    }
+    self.tokens = self.burst()
+    return self
+}
+
+// The bucket holds one second worth of calls but no less than one call.
+func (self *callLimit) burst() float64 {
+    if self.max_cps < 1 {
+        return 1
+    }
+    return self.max_cps
+}
+
+func (self *callLimit) takeToken(now time.Time) bool {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if ! self.last.IsZero() {
+        self.tokens += now.Sub(self.last).Seconds() * self.max_cps
+        if self.tokens > self.burst() {
+            self.tokens = self.burst()
+        }
+    }
+    self.last = now
+    if self.tokens < 1 {
+        return false
+    }
+    self.tokens -= 1
+    return true
+}
+
+func (self *callLimit) acquire(now time.Time) bool {
+    max_calls := atomic.LoadInt64(&self.max_calls)
+    if calls := atomic.AddInt64(&self.calls, 1); max_calls > 0 && calls > max_calls {
+        atomic.AddInt64(&self.calls, -1)
+        atomic.AddInt64(&self.rejected, 1)
+        return false
+    }
+    if self.max_cps > 0 && ! self.takeToken(now) {
+        atomic.AddInt64(&self.calls, -1)
+        atomic.AddInt64(&self.rejected, 1)
+        return false
+    }
+    return true
+}
+
+func (self *callLimit) setMaxCalls(max_calls int64) {
+    atomic.StoreInt64(&self.max_calls, max_calls)
+}
+
+func (self *callLimit) release() {
+    atomic.AddInt64(&self.calls, -1)
+}
+
+// The counters of the limit as reported by the "limits" command, 0 means
+// unlimited.
+type limitStatus struct {
+    Name            string  `json:"name"`
+    Calls           int64   `json:"calls"`
+    MaxCalls        int64   `json:"max_calls"`
+    MaxCps          float64 `json:"max_cps"`
+    Rejected        int64   `json:"rejected"`
+}
+
+func (self *limitStatus) String() string {
+    max_calls, max_cps := "-", "-"
+    if self.MaxCalls > 0 {
+        max_calls = strconv.FormatInt(self.MaxCalls, 10)
+    }
+    if self.MaxCps > 0 {
+        max_cps = strconv.FormatFloat(self.MaxCps, 'f', -1, 64)
+    }
+    return fmt.Sprintf("%s: calls %d/%s, cps %s, rejected %d", self.Name, self.Calls,
+      max_calls, max_cps, self.Rejected)
+}
+
+func (self *callLimit) status() *limitStatus {
+    return &limitStatus{
+        Name            : self.name,
+        Calls           : atomic.LoadInt64(&self.calls),
+        MaxCalls        : atomic.LoadInt64(&self.max_calls),
+        MaxCps          : self.max_cps,
+        Rejected        : atomic.LoadInt64(&self.rejected),
+    }
+}
+
+func (self *callLimit) String() string {
+    return self.status().String()
+}
+
+// Undo the acquire() of the call that has been rejected by another limit,
+// the rate token is given back too so that the rejected calls do not use
+// up the rate of this limit.
+func (self *callLimit) cancel() {
+    atomic.AddInt64(&self.calls, -1)
+    if self.max_cps > 0 {
+        self.lock.Lock()
+        self.tokens += 1
+        if self.tokens > self.burst() {
+            self.tokens = self.burst()
+        }
+        self.lock.Unlock()
+    }
+}
+
+func cancelLimits(limits []*callLimit) {
+    for _, limit := range limits {
+        limit.cancel()
+    }
+}
+
+func releaseLimits(limits []*callLimit) {
+    for _, limit := range limits {
+        limit.release()
+    }
+}
+
+type sourceLimit struct {
+    ipnet           *net.IPNet
+    limit           *callLimit
+}
+
+type callLimiter struct {
+    global          *callLimit
+    sources         []*sourceLimit
+    routes          map[string]*callLimit
+    routes_lock     sync.RWMutex
+    reject_scode    int
+    retry_after     int
+}
+
+func NewCallLimiter(max_calls int64, max_cps float64, source_limits string, reject_scode, retry_after int) (*callLimiter, error) {
+    if reject_scode != 503 && reject_scode != 486 {
+        return nil, errors.New("the limit reject code should be either 503 or 486")
+    }
+    self := &callLimiter{
+        global          : newCallLimit("global", max_calls, max_cps),
+        routes          : make(map[string]*callLimit),
+        reject_scode    : reject_scode,
+        retry_after     : retry_after,
+    }
+    var err error
+    self.sources, err = parseSourceLimits(source_limits)
+    if err != nil {
+        return nil, err
+    }
+    return self, nil
+}
+
+// Parse the comma-separated list of the "<IP or CIDR>=<calls>/<cps>"
+// entries. The most specific network matching the source is applied.
+func parseSourceLimits(s string) ([]*sourceLimit, error) {
+    res := []*sourceLimit{}
+    for _, entry := range strings.Split(s, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        arr := strings.SplitN(entry, "=", 2)
+        if len(arr) != 2 {
+            return nil, errors.New("malformed source limit '" + entry + "'")
+        }
+        ipnet, err := parseIPNet(arr[0])
+        if err != nil {
+            return nil, err
+        }
+        max_calls, max_cps, err := parseLimit(arr[1])
+        if err != nil {
+            return nil, errors.New("malformed source limit '" + entry + "': " + err.Error())
+        }
+        res = append(res, &sourceLimit{ ipnet, newCallLimit("source " + ipnet.String(), max_calls, max_cps) })
+    }
+    sort.SliceStable(res, func(i, j int) bool {
+        ones_i, _ := res[i].ipnet.Mask.Size()
+        ones_j, _ := res[j].ipnet.Mask.Size()
+        return ones_i > ones_j
+    })
+    return res, nil
+}
+
+// Parse the "<calls>/<cps>" limit, either part can be 0 or empty for no
+// limit.
+func parseLimit(s string) (int64, float64, error) {
+    var max_calls int64
+    var max_cps float64
+    var err error
+    arr := strings.SplitN(s, "/", 2)
+    if arr[0] != "" {
+        if max_calls, err = strconv.ParseInt(arr[0], 10, 64); err != nil || max_calls < 0 {
+            return 0, 0, errors.New("bad number of calls '" + arr[0] + "'")
+        }
+    }
+    if len(arr) == 2 && arr[1] != "" {
+        if max_cps, err = strconv.ParseFloat(arr[1], 64); err != nil || max_cps < 0 {
+            return 0, 0, errors.New("bad calls per second '" + arr[1] + "'")
+        }
+    }
+    return max_calls, max_cps, nil
+}
+
+// Check the global and the source limits of the new incoming call. The
+// returned limits are held by the call until it ends, or cancelled with
+// cancelLimits() when the call is rejected by some other limit.
+func (self *callLimiter) Admit(source string, now time.Time) ([]*callLimit, bool) {
+    if ! self.global.acquire(now) {
+        return nil, false
+    }
+    ip := net.ParseIP(source)
+    if ip != nil {
+        for _, slimit := range self.sources {
+            if ! slimit.ipnet.Contains(ip) {
+                continue
+            }
+            if ! slimit.limit.acquire(now) {
+                self.global.cancel()
+                return nil, false
+            }
+            return []*callLimit{ self.global, slimit.limit }, true
+        }
+    }
+    return []*callLimit{ self.global }, true
+}
+
+// Returns the limit of the destination of the route, nil when the route
+// is not limited. The limits are shared by all routes to the same
+// destination and the first route seen defines the values.
+func (self *callLimiter) RouteLimit(oroute *B2BRoute) *callLimit {
+    if oroute.max_calls == 0 && oroute.max_cps == 0 {
+        return nil
+    }
+    self.routes_lock.RLock()
+    limit, ok := self.routes[oroute.hostport]
+    self.routes_lock.RUnlock()
+    if ok {
+        return limit
+    }
+    self.routes_lock.Lock()
+    defer self.routes_lock.Unlock()
+    if limit, ok = self.routes[oroute.hostport]; ! ok {
+        limit = newCallLimit("route " + oroute.hostport, oroute.max_calls, oroute.max_cps)
+        self.routes[oroute.hostport] = limit
+    }
+    return limit
+}
+
+func (self *callLimiter) rejectReason() (string, sippy_header.SipHeader) {
+    if self.reject_scode == 486 {
+        return "Busy Here", nil
+    }
+    return "Service Unavailable", sippy_header.NewSipGenericHF("Retry-After", strconv.Itoa(self.retry_after))
+}
+
+func (self *callLimiter) RejectResponse(req sippy_types.SipRequest) sippy_types.SipResponse {
+    reason, retry_after := self.rejectReason()
+    resp := req.GenResponse(self.reject_scode, reason, nil, nil)
+    if retry_after != nil {
+        resp.AppendHeader(retry_after)
+    }
+    return resp
+}
+
+func (self *callLimiter) RejectEvent() *sippy.CCEventFail {
+    reason, retry_after := self.rejectReason()
+    if retry_after != nil {
+        return sippy.NewCCEventFail(self.reject_scode, reason, nil, "", retry_after)
+    }
+    return sippy.NewCCEventFail(self.reject_scode, reason, nil, "")
+}
+
+// The reply of the "limits" command
+type limitsStatus struct {
+    Limits          []*limitStatus `json:"limits"`
+}
+
+func (self *limitsStatus) String() string {
+    res := "Limits:\n"
+    for _, limit := range self.Limits {
+        res += limit.String() + "\n"
+    }
+    return res
+}
+
+func (self *callLimiter) Status() *limitsStatus {
+    res := &limitsStatus{ Limits : []*limitStatus{ self.global.status() } }
+    for _, slimit := range self.sources {
+        res.Limits = append(res.Limits, slimit.limit.status())
+    }
+    self.routes_lock.RLock()
+    names := make([]string, 0, len(self.routes))
+    for name := range self.routes {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        res.Limits = append(res.Limits, self.routes[name].status())
+    }
+    self.routes_lock.RUnlock()
+    return res
+}
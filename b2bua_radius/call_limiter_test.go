@@ -0,0 +1,120 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestCallLimiter(t *testing.T) {
+    limiter, err := NewCallLimiter(3, 0, "10.0.0.0/8=2/0, 10.1.0.0/16=/1", 503, 5)
+    if err != nil {
+        t.Fatal(err)
+    }
+    now := time.Now()
+    held := [][]*callLimit{}
+    // The most specific network wins: 1 call per second from 10.1/16
+    if limits, ok := limiter.Admit("10.1.0.1", now); ! ok {
+        t.Fatal("the first call from 10.1.0.1 has been rejected")
+    } else {
+        held = append(held, limits)
+    }
+    if _, ok := limiter.Admit("10.1.0.2", now); ok {
+        t.Fatal("the cps limit of 10.1.0.0/16 has not been enforced")
+    }
+    if limits, ok := limiter.Admit("10.1.0.2", now.Add(time.Second)); ! ok {
+        t.Fatal("the cps limit of 10.1.0.0/16 has not been refilled")
+    } else {
+        held = append(held, limits)
+    }
+    // Two concurrent calls from 10/8 while the global limit is 3
+    if limits, ok := limiter.Admit("10.2.0.1", now); ! ok {
+        t.Fatal("the call from 10.2.0.1 has been rejected")
+    } else {
+        held = append(held, limits)
+    }
+    if _, ok := limiter.Admit("192.0.2.1", now); ok {
+        t.Fatal("the global limit has not been enforced")
+    }
+    releaseLimits(held[0])
+    if limits, ok := limiter.Admit("10.2.0.2", now); ! ok {
+        t.Fatal("the call from 10.2.0.2 has been rejected")
+    } else {
+        held = append(held, limits)
+    }
+    releaseLimits(held[1])
+    if _, ok := limiter.Admit("10.2.0.3", now); ok {
+        t.Fatal("the limit of 10.0.0.0/8 has not been enforced")
+    }
+    if limiter.global.calls != 2 || limiter.global.rejected != 1 {
+        t.Errorf("bad global counters: %s", limiter.global.String())
+    }
+
+    // The calls rejected by the source limit do not use up the global rate
+    limiter, err = NewCallLimiter(0, 1, "10.0.0.0/8=1/0", 503, 5)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if limits, ok := limiter.Admit("10.0.0.1", now); ! ok {
+        t.Fatal("the call from 10.0.0.1 has been rejected")
+    } else {
+        releaseLimits(limits)
+    }
+    later := now.Add(time.Second)
+    if limits, ok := limiter.Admit("10.0.0.2", later); ! ok {
+        t.Fatal("the call from 10.0.0.2 has been rejected")
+    } else {
+        held = append(held, limits)
+    }
+    if _, ok := limiter.Admit("10.0.0.3", later.Add(time.Second)); ok {
+        t.Fatal("the source limit has not been enforced")
+    }
+    if _, ok := limiter.Admit("192.0.2.1", later.Add(time.Second)); ! ok {
+        t.Error("the call rejected by the source limit has used up the global rate")
+    }
+
+    oroute := &B2BRoute{ hostport : "192.0.2.1:5060", max_calls : 1 }
+    limit := limiter.RouteLimit(oroute)
+    if limit == nil || limiter.RouteLimit(oroute.getCopy()) != limit {
+        t.Fatal("the route limit is not shared by the routes to the same destination")
+    }
+    if ! limit.acquire(now) || limit.acquire(now) {
+        t.Error("the route limit has not been enforced")
+    }
+    if limiter.RouteLimit(&B2BRoute{ hostport : "192.0.2.2:5060" }) != nil {
+        t.Error("got the limit for the unlimited route")
+    }
+
+    for _, bad := range []string{ "10.0.0.0/8", "10.0.0.0/8=x/1", "10.0.0.0/8=1/-1", "foo=1/1" } {
+        if _, err = NewCallLimiter(0, 0, bad, 503, 5); err == nil {
+            t.Errorf("no error parsing %q", bad)
+        }
+    }
+    if _, err = NewCallLimiter(0, 0, "", 404, 5); err == nil {
+        t.Error("the 404 reject code has been accepted")
+    }
+}
@@ -31,6 +31,7 @@ import (
     "os"
     "os/exec"
     "os/signal"
+    "sort"
     "strconv"
     "strings"
     "sync"
@@ -38,8 +39,10 @@ import (
     "time"
 
     "sippy/headers"
+    "sippy/log"
     "sippy/time"
     "sippy/types"
+    "sippy/utils"
 )
 
 type callMap struct {
@@ -53,6 +56,7 @@ type callMap struct {
     proxy           sippy_types.StatefulProxy
     cc_id           int64
     cc_id_lock      sync.Mutex
+    stats           *callStats
 }
 
 /*
@@ -71,10 +75,13 @@ func NewCallMap(global_config *myConfigParser) *callMap {
         gc_timeout      : time.Minute,
         debug_mode      : false,
         safe_restart    : false,
+        stats           : newCallStats(time.Now()),
     }
     go func() {
         sighup_ch := make(chan os.Signal, 1)
         signal.Notify(sighup_ch, syscall.SIGHUP)
+        sigusr1_ch := make(chan os.Signal, 1)
+        signal.Notify(sigusr1_ch, syscall.SIGUSR1)
         sigusr2_ch := make(chan os.Signal, 1)
         signal.Notify(sigusr2_ch, syscall.SIGUSR2)
         sigprof_ch := make(chan os.Signal, 1)
@@ -84,7 +91,9 @@ func NewCallMap(global_config *myConfigParser) *callMap {
         for {
             select {
             case <-sighup_ch:
-                self.discAll(syscall.SIGHUP)
+                self.reload(syscall.SIGHUP)
+            case <-sigusr1_ch:
+                self.reopenLogs(syscall.SIGUSR1)
             case <-sigusr2_ch:
                 self.toggleDebug()
             case <-sigprof_ch:
@@ -129,33 +138,48 @@ func (self *callMap) OnNewDialog(req sippy_types.SipRequest, sip_t sippy_types.S
         }
         remote_ip := via.GetTAddr(self.global_config).Host
         source := req.GetSource()
+        // The call holds the config until it is gone
+        live := acquireLive()
+        var cc *callController
+        defer func() {
+            if cc == nil {
+                live.release()
+            }
+        }()
+        now := time.Now()
+        self.stats.newCall(now)
 
         // First check if request comes from IP that
         // we want to accept our traffic from
-        if ! self.global_config.checkIP(source.Host.String())  {
-            return nil, nil, req.GenResponse(403, "Forbidden", nil, nil)
+        acl := live.acl.Match(source.Host.String())
+        if acl == nil {
+            return nil, nil, self.reject(req.GenResponse(403, "Forbidden", nil, nil))
         }
-/*
-        var challenge *sippy_header.SipWWWAuthenticate
-        if self.global_config.auth_enable {
-            // Prepare challenge if no authorization header is present.
-            // Depending on configuration, we might try remote ip auth
-            // first and then challenge it or challenge immediately.
-            if self.global_config["digest_auth"] && req.countHFs("authorization") == 0 {
-                challenge = NewSipWWWAuthenticate()
-                challenge.getBody().realm = req.getRURI().host
-            }
+        var realm string
+        auth_required := acl.authRequired(live.config.auth_enable)
+        if auth_required {
+            realm = req.GetRURI().Host.String()
             // Send challenge immediately if digest is the
             // only method of authenticating
-            if challenge != nil && self.global_config.getdefault("digest_auth_only", false) {
-                resp = req.GenResponse(401, "Unauthorized")
-                resp.appendHeader(challenge)
-                return resp, nil, nil
+            if live.config.digest_auth && req.GetSipAuthorization() == nil && global_digest_auth.ChallengeOnly(source.Host.String()) {
+                resp := req.GenResponse(401, "Unauthorized", nil, nil)
+                resp.AppendHeader(global_digest_auth.Challenge(realm, false))
+                return nil, nil, self.reject(resp)
             }
         }
-*/
+        limits, ok := global_limiter.Admit(source.Host.String(), now)
+        if ! ok {
+            return nil, nil, self.reject(global_limiter.RejectResponse(req))
+        }
+        if acl.limit != nil {
+            if ! acl.limit.acquire(now) {
+                cancelLimits(limits)
+                return nil, nil, self.reject(global_limiter.RejectResponse(req))
+            }
+            limits = append(limits, acl.limit)
+        }
         pass_headers := []sippy_header.SipHeader{}
-        for _, header := range self.global_config.pass_headers {
+        for _, header := range live.config.pass_headers {
             hfs := req.GetHFs(header)
             pass_headers = append(pass_headers, hfs...)
         }
@@ -163,14 +187,26 @@ func (self *callMap) OnNewDialog(req sippy_types.SipRequest, sip_t sippy_types.S
         id := self.cc_id
         self.cc_id++
         self.cc_id_lock.Unlock()
-        cc := NewCallController(id, remote_ip, source, self.global_config, pass_headers, self.sip_tm)
-        //cc.challenge = challenge
+        cc = NewCallController(id, remote_ip, source, live, pass_headers, self.sip_tm)
+        cc.realm = realm
+        cc.acl = acl
+        cc.auth_required = auth_required
+        cc.limits = limits
+        if global_trunks != nil {
+            cc.trunk = global_trunks.Match(req.GetRURI(), source.Host.String())
+        }
         //rval := cc.uaA.RecvRequest(req, sip_t)
         self.ccmap_lock.Lock()
         self.ccmap[id] = cc
         self.ccmap_lock.Unlock()
         return cc.uaA, cc.uaA, nil
     }
+    if req.GetMethod() == "REGISTER" && currentLive().acl.Match(req.GetSource().Host.String()) == nil {
+        return nil, nil, req.GenResponse(403, "Forbidden", nil, nil)
+    }
+    if global_location != nil && req.GetMethod() == "REGISTER" {
+        return nil, global_location, nil
+    }
     if self.proxy != nil && (req.GetMethod() == "REGISTER" || req.GetMethod() == "SUBSCRIBE") {
         return nil, self.proxy, nil
     }
@@ -181,41 +217,89 @@ func (self *callMap) OnNewDialog(req sippy_types.SipRequest, sip_t sippy_types.S
     return nil, nil, req.GenResponse(501, "Not Implemented", nil, nil)
 }
 
-func (self callMap) safeStop() {
+// Counts the failure response sent to the new call before it has got a
+// call controller.
+func (self *callMap) reject(resp sippy_types.SipResponse) sippy_types.SipResponse {
+    self.stats.failed(resp.GetSCodeNum())
+    return resp
+}
+
+func (self *callMap) safeStop() {
     self.discAll(0)
+    if global_trunks != nil {
+        global_trunks.Stop()
+    }
+    if global_location != nil {
+        global_location.Flush()
+    }
     time.Sleep(time.Second)
+    if ! self.global_config.foreground {
+        removePidFile(self.global_config.pidfile)
+    }
     os.Exit(0)
 }
 
 func (self *callMap) discAll(signum syscall.Signal) {
     if signum > 0 {
-        println(fmt.Sprintf("Signal %d received, disconnecting all calls", signum))
+        self.global_config.ErrorLogger().Info("Signal received, disconnecting all calls", sippy_log.F("signal", int(signum)))
     }
-    for _, cc := range self.ccmap {
-        cc.disconnect(nil)
+    for _, cc := range self.calls() {
+        self.withCall(cc, func() { cc.disconnect(nil) })
+    }
+}
+
+func (self *callMap) reload(signum syscall.Signal) error {
+    if signum > 0 {
+        self.global_config.ErrorLogger().Info("Signal received, reloading the configuration", sippy_log.F("signal", int(signum)))
+    }
+    err := reloadConfig()
+    if err != nil {
+        self.global_config.ErrorLogger().Error("Error reloading the configuration, the changes are not applied: " + err.Error())
+    }
+    return err
+}
+
+func (self *callMap) reopenLogs(signum syscall.Signal) {
+    self.global_config.ErrorLogger().Info("Signal received, reopening logs", sippy_log.F("signal", int(signum)))
+    if err := self.global_config.ReopenLogs(); err != nil {
+        self.global_config.ErrorLogger().Error("Error reopening logs: " + err.Error())
+    }
+    if ! self.global_config.foreground {
+        if err := sippy_utils.ReopenStdio(self.global_config.logfile); err != nil {
+            self.global_config.ErrorLogger().Error("Error reopening stdout and stderr: " + err.Error())
+        }
+    }
+    if global_cdr != nil {
+        if err := global_cdr.reopen(); err != nil {
+            self.global_config.ErrorLogger().Error("Error reopening CDR files: " + err.Error())
+        }
     }
 }
 
 func (self *callMap) toggleDebug() {
     if self.debug_mode {
-        println("Signal received, toggling extra debug output off")
+        self.global_config.ErrorLogger().Info("Signal received, toggling extra debug output off")
     } else {
-        println("Signal received, toggling extra debug output on")
+        self.global_config.ErrorLogger().Info("Signal received, toggling extra debug output on")
     }
     self.debug_mode = ! self.debug_mode
 }
 
 func (self *callMap) safeRestart() {
-    println("Signal received, scheduling safe restart")
+    self.global_config.ErrorLogger().Info("Signal received, scheduling safe restart")
     self.safe_restart = true
 }
 
 func (self *callMap) GClector() {
-    fmt.Printf("GC is invoked, %d calls in map\n", len(self.ccmap))
+    self.global_config.ErrorLogger().Debug("GC is invoked", sippy_log.F("calls", len(self.ccmap)))
     if self.debug_mode {
         //println(self.global_config["_sip_tm"].tclient, self.global_config["_sip_tm"].tserver)
         for _, cc := range self.ccmap {
-            println(cc.uaA.GetState().String(), cc.uaO.GetState().String())
+            fields := []sippy_log.Field{ sippy_log.F("cc_id", cc.id), sippy_log.F("a_state", cc.uaA.GetState().String()) }
+            if cc.uaO != nil {
+                fields = append(fields, sippy_log.F("o_state", cc.uaO.GetState().String()))
+            }
+            self.global_config.ErrorLogger().Log(sippy_log.LevelDebug, "call state", fields...)
         }
     //} else {
     //    fmt.Printf("[%d]: %d client, %d server transactions in memory\n",
@@ -229,7 +313,7 @@ func (self *callMap) GClector() {
             cmd.Env = os.Environ()
             err := cmd.Start()
             if err != nil {
-                fmt.Println(err)
+                self.global_config.ErrorLogger().Error("Cannot restart: " + err.Error())
                 os.Exit(1)
             }
             os.Exit(0)
@@ -239,122 +323,283 @@ func (self *callMap) GClector() {
     }
 }
 
+// recvCommand processes a CLI command. The command prefixed with "json"
+// replies in the JSON format instead of the plain text.
 func (self *callMap) recvCommand(data string) string {
     args := strings.Split(strings.TrimSpace(data), " ")
+    json_out := false
+    if len(args) > 1 && strings.ToLower(args[0]) == "json" {
+        json_out = true
+        args = args[1:]
+    }
     cmd := strings.ToLower(args[0])
     args = args[1:]
-    switch cmd {
-    case "q":
+    if cmd == "q" {
         return ""
+    }
+    return formatReply(self.command(cmd, args), json_out)
+}
+
+func (self *callMap) command(cmd string, args []string) cliReply {
+    switch cmd {
     case "l":
-        res := "In-memory calls:\n"
-        total := 0
-        self.ccmap_lock.Lock()
-        defer self.ccmap_lock.Unlock()
-        for _, cc := range self.ccmap {
-            cc.lock.Lock()
-            res += fmt.Sprintf("%s: %s (", cc.cId.CallId, cc.state.String())
-            if cc.uaA != nil {
-                res += fmt.Sprintf("%s %s %s %s -> ", cc.uaA.GetState().String(), cc.uaA.GetRAddr0().String(),
-                  cc.uaA.GetCLD(), cc.uaA.GetCLI())
-            } else {
-                res += "N/A -> "
-            }
-            if cc.uaO != nil {
-                res += fmt.Sprintf("%s %s %s %s)\n", cc.uaO.GetState().String(), cc.uaO.GetRAddr0().String(),
-                  cc.uaO.GetCLI(), cc.uaO.GetCLD())
-            } else {
-                res += "N/A)\n"
-            }
-            total += 1
-            cc.lock.Unlock()
+        filter, err := parseCallFilter(args)
+        if err != nil {
+            return cliError(err.Error() + ", syntax: l [cld=<pattern>] [cli=<pattern>] [source=<IP or network>]")
         }
-        return res + fmt.Sprintf("Total: %d\n", total)
-/*
-    case "lt":
-        res = "In-memory server transactions:\n"
-        for tid, t in self.global_config["_sip_tm"].tserver.iteritems() {
-            res += "%s %s %s\n" % (tid, t.method, t.state)
-        }
-        res += "In-memory client transactions:\n"
-        for tid, t in self.global_config["_sip_tm"].tclient.iteritems():
-            res += "%s %s %s\n" % (tid, t.method, t.state)
+        return self.listCalls(filter)
+    case "show":
+        if len(args) != 2 || strings.ToLower(args[0]) != "call" {
+            return cliError("syntax error: show call <id>|<call-id>")
+        }
+        cc := self.findCall(args[1])
+        if cc == nil {
+            return cliError("no call with id of " + args[1] + " has been found")
+        }
+        var res *callDetails
+        self.withCall(cc, func() { res = cc.details() })
         return res
+    case "stats":
+        if len(args) != 0 {
+            return cliError("syntax error: stats")
+        }
+        return self.statsStatus()
     case "lt", "llt":
-        if cmd == "llt":
-            mindur = 60.0
-        else:
-            mindur = 0.0
-        ctime = time()
-        res = "In-memory server transactions:\n"
-        for tid, t in self.global_config["_sip_tm"].tserver.iteritems():
-            duration = ctime - t.rtime
-            if duration < mindur:
-                continue
-            res += "%s %s %s %s\n" % (tid, t.method, t.state, duration)
-        res += "In-memory client transactions:\n"
-        for tid, t in self.global_config["_sip_tm"].tclient.iteritems():
-            duration = ctime - t.rtime
-            if duration < mindur:
-                continue
-            res += "%s %s %s %s\n" % (tid, t.method, t.state, duration)
-        return res
-*/
+        min_age := time.Duration(0)
+        if cmd == "llt" {
+            min_age = 60 * time.Second
+            if len(args) == 1 {
+                secs, err := strconv.Atoi(args[0])
+                if err != nil || secs < 0 {
+                    return cliError("non-negative integer argument expected: " + args[0])
+                }
+                min_age = time.Duration(secs) * time.Second
+                args = args[1:]
+            }
+        }
+        if len(args) != 0 {
+            return cliError("syntax error: lt | llt [<min age in seconds>]")
+        }
+        return &transactionList{
+            Server  : newTransactionInfos(self.sip_tm.ServerTransactions(), min_age),
+            Client  : newTransactionInfos(self.sip_tm.ClientTransactions(), min_age),
+        }
     case "d":
-        if len(args) != 1 {
-            return "ERROR: syntax error: d <call-id>\n"
+        if len(args) == 0 {
+            return cliError("syntax error: d <call-id>|*|[cld=<pattern>] [cli=<pattern>] [source=<IP or network>]")
         }
-        if args[0] == "*" {
+        if len(args) == 1 && args[0] == "*" {
             self.discAll(0)
-            return "OK\n"
+            return cliOK{}
         }
-        dlist := []*callController{}
-        self.ccmap_lock.Lock()
-        for _, cc := range self.ccmap {
-            if cc.cId.CallId != args[0] {
-                continue
+        var filter *callFilter
+        if strings.IndexByte(args[0], '=') >= 0 {
+            var err error
+            if filter, err = parseCallFilter(args); err != nil {
+                return cliError(err.Error())
             }
-            dlist = append(dlist, cc)
+        } else if len(args) != 1 {
+            return cliError("syntax error: d <call-id>|*|[cld=<pattern>] [cli=<pattern>] [source=<IP or network>]")
+        }
+        dlist := []*callController{}
+        for _, cc := range self.calls() {
+            self.withCall(cc, func() {
+                if filter != nil && filter.match(cc) || filter == nil && cc.cId != nil && cc.cId.CallId == args[0] {
+                    dlist = append(dlist, cc)
+                }
+            })
         }
-        self.ccmap_lock.Unlock()
         if len(dlist) == 0 {
-            return fmt.Sprintf("ERROR: no call with id of %s has been found\n", args[0])
+            if filter != nil {
+                return cliError("no matching calls have been found")
+            }
+            return cliError("no call with id of " + args[0] + " has been found")
         }
         for _, cc := range dlist {
-            cc.disconnect(nil)
+            self.withCall(cc, func() { cc.disconnect(nil) })
         }
-        return "OK\n"
+        return cliOK{}
     case "r":
         if len(args) != 1 {
-            return "ERROR: syntax error: r [<id>]\n"
+            return cliError("syntax error: r [<id>]")
         }
         idx, err := strconv.ParseInt(args[0], 10, 64)
         if err != nil {
-            return "ERROR: non-integer argument: " + args[0] + "\n"
+            return cliError("non-integer argument: " + args[0])
         }
         self.ccmap_lock.Lock()
         cc, ok := self.ccmap[idx]
         self.ccmap_lock.Unlock()
         if ! ok {
-            return fmt.Sprintf("ERROR: no call with id of %d has been found\n", idx)
-        }
-        if cc.proxied {
-            ts, _ := sippy_time.NewMonoTime()
-            ts = ts.Add(-60 * time.Second)
-            if cc.state == CCStateConnected {
-                cc.disconnect(ts)
-            } else if cc.state == CCStateARComplete {
-                cc.uaO.Disconnect(ts)
+            return cliError(fmt.Sprintf("no call with id of %d has been found", idx))
+        }
+        self.withCall(cc, func() {
+            if cc.proxied {
+                ts, _ := sippy_time.NewMonoTime()
+                ts = ts.Add(-60 * time.Second)
+                if cc.state == CCStateConnected {
+                    cc.disconnect(ts)
+                } else if cc.state == CCStateARComplete {
+                    cc.uaO.Disconnect(ts)
+                }
             }
+        })
+        return cliOK{}
+    case "reload":
+        if len(args) != 0 {
+            return cliError("syntax error: reload")
+        }
+        if err := self.reload(0); err != nil {
+            return cliError(err.Error())
+        }
+        return cliOK{}
+    case "loc":
+        if global_location == nil {
+            return cliError("the registrar is disabled")
+        }
+        if len(args) > 1 {
+            return cliError("syntax error: loc [<aor>]")
+        }
+        aor := ""
+        if len(args) == 1 {
+            aor = args[0]
+        }
+        return global_location.Status(aor)
+    case "limits":
+        res := global_limiter.Status()
+        res.Limits = append(res.Limits, currentLive().acl.limitsStatus()...)
+        return res
+    case "trace":
+        return self.traceCommand(args)
+    case "rtpp":
+        if len(args) != 0 {
+            return cliError("syntax error: rtpp")
+        }
+        return rtpProxyStatus()
+    case "reg":
+        if global_trunks == nil {
+            return cliError("no trunks configured")
+        }
+        return global_trunks.Status()
+    case "tr":
+        if len(args) < 2 || len(args) > 3 || (args[0] != "in" && args[0] != "out") {
+            return cliError("syntax error: tr in|out <cld> [<cli>]")
+        }
+        cli := ""
+        if len(args) == 3 {
+            cli = args[2]
+        }
+        config := currentLive().config
+        if args[0] == "in" {
+            return config.static_tr_in.DryRun(args[1], cli)
+        }
+        return config.static_tr_out.DryRun(args[1], cli)
+    }
+    return cliError("unknown command")
+}
+
+// Returns the snapshot of the calls in memory ordered by the id.
+func (self *callMap) calls() []*callController {
+    self.ccmap_lock.Lock()
+    res := make([]*callController, 0, len(self.ccmap))
+    for _, cc := range self.ccmap {
+        res = append(res, cc)
+    }
+    self.ccmap_lock.Unlock()
+    sort.Slice(res, func(i, j int) bool { return res[i].id < res[j].id })
+    return res
+}
+
+// Runs the function with the call locked the same way the SIP stack does
+// when it delivers the requests and timer events to the call.
+func (self *callMap) withCall(cc *callController, fn func()) {
+    sippy_utils.SafeCall(fn, cc.lock, self.global_config.ErrorLogger())
+}
+
+// Returns the call by either the id or the Call-ID, nil if there is no
+// such call.
+func (self *callMap) findCall(id string) *callController {
+    for _, cc := range self.calls() {
+        found := false
+        self.withCall(cc, func() {
+            found = strconv.FormatInt(cc.id, 10) == id || (cc.cId != nil && cc.cId.CallId == id)
+        })
+        if found {
+            return cc
         }
-        return "OK\n"
-    default:
-        return "ERROR: unknown command\n"
     }
+    return nil
+}
+
+func (self *callMap) listCalls(filter *callFilter) *callList {
+    res := &callList{ Calls : []*callInfo{} }
+    for _, cc := range self.calls() {
+        self.withCall(cc, func() {
+            if filter.match(cc) {
+                res.Calls = append(res.Calls, cc.info())
+            }
+        })
+    }
+    res.Total = len(res.Calls)
+    return res
+}
+
+func (self *callMap) statsStatus() *statsReply {
+    states := make(map[string]int)
+    for _, cc := range self.calls() {
+        self.withCall(cc, func() { states[cc.state.String()]++ })
+    }
+    return self.stats.status(time.Now(), states)
 }
 
 func (self *callMap) DropCC(cc_id int64) {
     self.ccmap_lock.Lock()
+    cc, ok := self.ccmap[cc_id]
     delete(self.ccmap, cc_id)
     self.ccmap_lock.Unlock()
+    if ok {
+        cc.releaseLimits()
+        if cc.trace != nil {
+            global_tracer.endTrace(cc.trace)
+        }
+        cc.dead = true
+        cc.writeCdr()
+        cc.releaseLive()
+    }
+}
+
+func (self *callMap) traceCommand(args []string) cliReply {
+    const syntax = "syntax: trace [list] | trace add [cld=<pattern>] [cli=<pattern>] [source=<IP or network>] " +
+        "[call_id=<Call-ID>] [format=pcap|text] [calls=<N>] [time=<seconds>] | trace del <id>|*"
+    if global_tracer == nil {
+        return cliError("the tracing is not available")
+    }
+    if len(args) == 0 || (len(args) == 1 && args[0] == "list") {
+        return global_tracer.status()
+    }
+    switch args[0] {
+    case "add":
+        rule, err := parseTraceRule(args[1:])
+        if err != nil {
+            return cliError(err.Error() + ", " + syntax)
+        }
+        global_tracer.addRule(rule)
+        return global_tracer.status()
+    case "del":
+        if len(args) != 2 {
+            return cliError("syntax error, " + syntax)
+        }
+        id := int64(0)
+        if args[1] != "*" {
+            var err error
+            if id, err = strconv.ParseInt(args[1], 10, 64); err != nil || id <= 0 {
+                return cliError("bad rule id: " + args[1])
+            }
+        }
+        if ! global_tracer.delRule(id) {
+            return cliError("no trace rule with id of " + args[1] + " has been found")
+        }
+        return cliOK{}
+    }
+    return cliError("syntax error, " + syntax)
 }
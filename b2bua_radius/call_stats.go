@@ -0,0 +1,330 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "fmt"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+
+    "sippy/log"
+    "sippy/time"
+    "sippy/types"
+)
+
+// The number of seconds the per second call counters are kept for.
+const cps_window = 60
+
+// The upper bounds of the call setup time and duration histogram buckets,
+// in seconds.
+var setup_time_buckets = []float64{ 0.5, 1, 2, 3, 5, 10, 20, 30, 60 }
+var duration_buckets = []float64{ 10, 30, 60, 120, 300, 600, 1800, 3600, 7200 }
+
+// histogram is a cumulative histogram the way Prometheus exposes it, the
+// last count is for the observations over the largest bound.
+type histogram struct {
+    bounds          []float64
+    counts          []int64
+    count           int64
+    sum             float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+    return &histogram{
+        bounds          : bounds,
+        counts          : make([]int64, len(bounds) + 1),
+    }
+}
+
+func (self *histogram) observe(v float64) {
+    idx := sort.SearchFloat64s(self.bounds, v)
+    self.counts[idx]++
+    self.count++
+    self.sum += v
+}
+
+func (self *histogram) getCopy() *histogram {
+    tmp := *self
+    tmp.counts = append([]int64{}, self.counts...)
+    return &tmp
+}
+
+// routeStats counts the outgoing call legs placed to a destination. The
+// ASR is answers / attempts and the ACD is the average of the duration
+// histogram.
+type routeStats struct {
+    route           string
+    attempts        int64
+    answers         int64
+    failures        int64
+    setup_time      *histogram
+    duration        *histogram
+}
+
+// callStats counts the incoming calls and the failure responses sent to
+// the callers for the "stats" command along with the outgoing call legs
+// for the metrics.
+type callStats struct {
+    lock            sync.Mutex
+    start           time.Time
+    calls           int64
+    failures        map[int]int64
+    routes          map[string]*routeStats
+    // The number of new calls during each of the last cps_window seconds,
+    // the slot is reused when its second is over
+    cps_calls       [cps_window]int64
+    cps_secs        [cps_window]int64
+}
+
+func newCallStats(now time.Time) *callStats {
+    return &callStats{
+        start           : now,
+        failures        : make(map[int]int64),
+        routes          : make(map[string]*routeStats),
+    }
+}
+
+func (self *callStats) newCall(now time.Time) {
+    sec := now.Unix()
+    idx := sec % cps_window
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.calls++
+    if self.cps_secs[idx] != sec {
+        self.cps_secs[idx] = sec
+        self.cps_calls[idx] = 0
+    }
+    self.cps_calls[idx]++
+}
+
+func (self *callStats) failed(scode int) {
+    self.lock.Lock()
+    self.failures[scode]++
+    self.lock.Unlock()
+}
+
+// Must be called with the lock held.
+func (self *callStats) route(name string) *routeStats {
+    rs, ok := self.routes[name]
+    if ! ok {
+        rs = &routeStats{
+            route           : name,
+            setup_time      : newHistogram(setup_time_buckets),
+            duration        : newHistogram(duration_buckets),
+        }
+        self.routes[name] = rs
+    }
+    return rs
+}
+
+func (self *callStats) routeAttempt(name string) {
+    self.lock.Lock()
+    self.route(name).attempts++
+    self.lock.Unlock()
+}
+
+func (self *callStats) routeAnswer(name string, setup_time time.Duration) {
+    self.lock.Lock()
+    rs := self.route(name)
+    rs.answers++
+    rs.setup_time.observe(setup_time.Seconds())
+    self.lock.Unlock()
+}
+
+func (self *callStats) routeFailure(name string) {
+    self.lock.Lock()
+    self.route(name).failures++
+    self.lock.Unlock()
+}
+
+func (self *callStats) routeDuration(name string, duration time.Duration) {
+    self.lock.Lock()
+    self.route(name).duration.observe(duration.Seconds())
+    self.lock.Unlock()
+}
+
+// Returns a copy of the per route counters sorted by the route.
+func (self *callStats) routesStatus() []*routeStats {
+    self.lock.Lock()
+    res := make([]*routeStats, 0, len(self.routes))
+    for _, rs := range self.routes {
+        tmp := *rs
+        tmp.setup_time = rs.setup_time.getCopy()
+        tmp.duration = rs.duration.getCopy()
+        res = append(res, &tmp)
+    }
+    self.lock.Unlock()
+    sort.Slice(res, func(i, j int) bool { return res[i].route < res[j].route })
+    return res
+}
+
+// Returns the average rate of the new calls over the given number of the
+// last complete seconds.
+func (self *callStats) cps(now time.Time, window int64) float64 {
+    sec := now.Unix()
+    calls := int64(0)
+    self.lock.Lock()
+    for i := range self.cps_secs {
+        if self.cps_secs[i] < sec && self.cps_secs[i] >= sec - window {
+            calls += self.cps_calls[i]
+        }
+    }
+    self.lock.Unlock()
+    return float64(calls) / float64(window)
+}
+
+// The reply of the "stats" command
+type statsReply struct {
+    Uptime          int64            `json:"uptime"`
+    Calls           int              `json:"calls"`
+    States          map[string]int   `json:"states"`
+    TotalCalls      int64            `json:"total_calls"`
+    Cps1            float64          `json:"cps_1s"`
+    Cps10           float64          `json:"cps_10s"`
+    Cps60           float64          `json:"cps_60s"`
+    Failures        map[int]int64    `json:"failures"`
+}
+
+func (self *callStats) status(now time.Time, states map[string]int) *statsReply {
+    res := &statsReply{
+        Uptime          : int64(now.Sub(self.start).Seconds()),
+        States          : states,
+        Cps1            : self.cps(now, 1),
+        Cps10           : self.cps(now, 10),
+        Cps60           : self.cps(now, cps_window),
+        Failures        : make(map[int]int64),
+    }
+    for _, n := range states {
+        res.Calls += n
+    }
+    self.lock.Lock()
+    res.TotalCalls = self.calls
+    for scode, n := range self.failures {
+        res.Failures[scode] = n
+    }
+    self.lock.Unlock()
+    return res
+}
+
+func (self *statsReply) String() string {
+    res := fmt.Sprintf("Calls: %d\n", self.Calls)
+    states := make([]string, 0, len(self.States))
+    for state := range self.States {
+        states = append(states, state)
+    }
+    sort.Strings(states)
+    for _, state := range states {
+        res += fmt.Sprintf("  %s: %d\n", state, self.States[state])
+    }
+    res += fmt.Sprintf("Total calls: %d in %ds\n", self.TotalCalls, self.Uptime)
+    res += "CPS: " + strconv.FormatFloat(self.Cps1, 'f', 2, 64) + " (1s), " +
+        strconv.FormatFloat(self.Cps10, 'f', 2, 64) + " (10s), " +
+        strconv.FormatFloat(self.Cps60, 'f', 2, 64) + " (60s)\n"
+    res += "Failures:\n"
+    scodes := make([]int, 0, len(self.Failures))
+    for scode := range self.Failures {
+        scodes = append(scodes, scode)
+    }
+    sort.Ints(scodes)
+    for _, scode := range scodes {
+        res += fmt.Sprintf("  %d: %d\n", scode, self.Failures[scode])
+    }
+    return res
+}
+
+// legStats tracks a single outgoing call leg for the per route counters.
+// The leg is accounted as failed unless it is answered, the UA callbacks
+// may fire more than once so only the first one counts.
+type legStats struct {
+    stats           *callStats
+    route           string
+    start           time.Time
+    answered        time.Time
+    done            bool
+    // The leg context logger, optional
+    logger          sippy_log.ErrorLogger
+    // The outcome of the leg for the CDR
+    cld             string
+    code            int
+    origin          string
+    reason          string
+}
+
+func newLegStats(stats *callStats, route string) *legStats {
+    stats.routeAttempt(route)
+    return &legStats{
+        stats           : stats,
+        route           : route,
+        start           : time.Now(),
+    }
+}
+
+func (self *legStats) conn(rtime *sippy_time.MonoTime, origin string) {
+    if self.done || ! self.answered.IsZero() {
+        return
+    }
+    self.answered = time.Now()
+    self.stats.routeAnswer(self.route, self.answered.Sub(self.start))
+    if self.logger != nil {
+        self.logger.Log(sippy_log.LevelDebug, "call leg answered", sippy_log.F("setup_time", self.answered.Sub(self.start)))
+    }
+}
+
+func (self *legStats) fail(rtime *sippy_time.MonoTime, origin string, result int) {
+    self.end(origin, result)
+}
+
+func (self *legStats) disc(rtime *sippy_time.MonoTime, origin string, result int, inreq sippy_types.SipRequest) {
+    if inreq != nil && inreq.GetReason() != nil && self.reason == "" {
+        self.reason = inreq.GetReason().Body()
+    }
+    self.end(origin, result)
+}
+
+func (self *legStats) end(origin string, result int) {
+    if self.done {
+        return
+    }
+    self.done = true
+    self.origin = origin
+    if self.answered.IsZero() {
+        self.code = result
+        self.stats.routeFailure(self.route)
+        if self.logger != nil {
+            self.logger.Log(sippy_log.LevelDebug, "call leg failed", sippy_log.F("origin", origin), sippy_log.F("result", result))
+        }
+    } else {
+        self.code = 200
+        duration := time.Since(self.answered)
+        self.stats.routeDuration(self.route, duration)
+        if self.logger != nil {
+            self.logger.Log(sippy_log.LevelDebug, "call leg disconnected", sippy_log.F("origin", origin),
+                sippy_log.F("result", result), sippy_log.F("duration", duration))
+        }
+    }
+}
@@ -0,0 +1,458 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "net"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "sippy/conf"
+    "sippy/hep"
+    "sippy/log"
+    "sippy/time"
+)
+
+// The messages of the calls not known yet are kept for this long so that
+// the initial INVITE makes it into the trace once the call matches.
+const trace_pending_ttl = 10 * time.Second
+const trace_pending_max = 10000
+const trace_queue_size = 10000
+
+// traceRule arms the tracing of the calls that match the filter or the
+// Call-ID. The rule is removed once it has matched max_calls calls or
+// has expired, whichever comes first.
+type traceRule struct {
+    id              int64
+    filter          *callFilter
+    call_id         string
+    format          string
+    // The filter as given in the command
+    args            string
+    calls_left      int
+    expires         time.Time
+}
+
+func (self *traceRule) match(cc *callController) bool {
+    if self.call_id != "" {
+        return cc.cId != nil && cc.cId.CallId == self.call_id
+    }
+    return self.filter.match(cc)
+}
+
+// callTrace is the trace file of a single call, it covers the messages
+// of the incoming leg and of all outgoing ones.
+type callTrace struct {
+    fname           string
+    format          string
+    call_ids        []string
+    fd              *os.File
+    w               *bufio.Writer
+    failed          bool
+}
+
+type tracePacket struct {
+    data            []byte
+    src             net.Addr
+    dst             net.Addr
+    ts              time.Time
+}
+
+type traceOp struct {
+    trace           *callTrace
+    pkt             *tracePacket
+    close           bool
+}
+
+// callTracer sits in the SIP capture chain in front of the HEP exporter
+// (if any) and writes the messages of the traced calls into the per call
+// files. The files are written by a separate goroutine and the messages
+// are dropped rather than block the signalling when it falls behind.
+type callTracer struct {
+    next            sippy_conf.SipCapture
+    dir             string
+    lock            sync.Mutex
+    rules           []*traceRule
+    last_rule_id    int64
+    traces          map[string]*callTrace
+    pending         map[string][]*tracePacket
+    pending_old     map[string][]*tracePacket
+    pending_rotated time.Time
+    queue           chan *traceOp
+    dropped         int64
+    logger          sippy_log.ErrorLogger
+}
+
+func newCallTracer(dir string, next sippy_conf.SipCapture, logger sippy_log.ErrorLogger) *callTracer {
+    self := &callTracer{
+        next            : next,
+        dir             : dir,
+        traces          : make(map[string]*callTrace),
+        pending         : make(map[string][]*tracePacket),
+        pending_old     : make(map[string][]*tracePacket),
+        pending_rotated : time.Now(),
+        queue           : make(chan *traceOp, trace_queue_size),
+        logger          : logger,
+    }
+    go self.run()
+    return self
+}
+
+// Capture implements the sippy_conf.SipCapture interface.
+func (self *callTracer) Capture(data []byte, src, dst net.Addr, ts *sippy_time.MonoTime) {
+    if self.next != nil {
+        self.next.Capture(data, src, dst, ts)
+    }
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if len(self.rules) == 0 && len(self.traces) == 0 {
+        return
+    }
+    call_id := sippy_hep.CallId(data)
+    if call_id == "" {
+        return
+    }
+    now := time.Now()
+    if ts != nil {
+        now = ts.Realt()
+    }
+    pkt := &tracePacket{
+        data            : append([]byte{}, data...),
+        src             : src,
+        dst             : dst,
+        ts              : now,
+    }
+    if trace, ok := self.traces[call_id]; ok {
+        self.enqueue(&traceOp{ trace : trace, pkt : pkt })
+        return
+    }
+    if len(self.rules) == 0 {
+        return
+    }
+    if time.Since(self.pending_rotated) > trace_pending_ttl {
+        self.pending_old = self.pending
+        self.pending = make(map[string][]*tracePacket)
+        self.pending_rotated = time.Now()
+    }
+    if len(self.pending) < trace_pending_max {
+        self.pending[call_id] = append(self.pending[call_id], pkt)
+    }
+}
+
+// Must be called with the lock held.
+func (self *callTracer) enqueue(op *traceOp) {
+    select {
+    case self.queue <- op:
+    default:
+        self.dropped++
+    }
+}
+
+// Must be called with the lock held.
+func (self *callTracer) expireRules(now time.Time) {
+    rules := self.rules[:0]
+    for _, rule := range self.rules {
+        if now.Before(rule.expires) {
+            rules = append(rules, rule)
+        }
+    }
+    self.rules = rules
+}
+
+// startTrace checks the new call against the armed rules and returns the
+// trace of the call if it matches any. Must be called with the call
+// locked once the CLD and CLI of the call are known.
+func (self *callTracer) startTrace(cc *callController) *callTrace {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.expireRules(time.Now())
+    for i, rule := range self.rules {
+        if ! rule.match(cc) {
+            continue
+        }
+        if rule.calls_left > 0 {
+            rule.calls_left--
+            if rule.calls_left == 0 {
+                self.rules = append(self.rules[:i], self.rules[i + 1:]...)
+            }
+        }
+        ext := "txt"
+        if rule.format == "pcap" {
+            ext = "pcap"
+        }
+        trace := &callTrace{
+            fname           : filepath.Join(self.dir, fmt.Sprintf("b2bua-%d-%s.%s", cc.id, sanitizeFileName(cc.cId.CallId), ext)),
+            format          : rule.format,
+        }
+        self.addCallIdLocked(trace, cc.cId.CallId)
+        return trace
+    }
+    return nil
+}
+
+// addCallId adds the Call-ID of an outgoing call leg to the trace.
+func (self *callTracer) addCallId(trace *callTrace, call_id string) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.addCallIdLocked(trace, call_id)
+}
+
+func (self *callTracer) addCallIdLocked(trace *callTrace, call_id string) {
+    trace.call_ids = append(trace.call_ids, call_id)
+    self.traces[call_id] = trace
+    for _, pending := range []map[string][]*tracePacket{ self.pending_old, self.pending } {
+        for _, pkt := range pending[call_id] {
+            self.enqueue(&traceOp{ trace : trace, pkt : pkt })
+        }
+        delete(pending, call_id)
+    }
+}
+
+// endTrace closes the trace file once the call is over.
+func (self *callTracer) endTrace(trace *callTrace) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    for _, call_id := range trace.call_ids {
+        delete(self.traces, call_id)
+    }
+    // The close must not be lost when the queue is full
+    go func() { self.queue <- &traceOp{ trace : trace, close : true } }()
+}
+
+func (self *callTracer) run() {
+    for op := range self.queue {
+        trace := op.trace
+        if op.close {
+            if trace.fd != nil {
+                trace.w.Flush()
+                trace.fd.Close()
+                trace.fd = nil
+            }
+            continue
+        }
+        if trace.failed {
+            continue
+        }
+        if trace.fd == nil {
+            if err := trace.open(); err != nil {
+                self.logger.Error("Cannot open the trace file: " + err.Error())
+                trace.failed = true
+                continue
+            }
+        }
+        if err := trace.write(op.pkt); err != nil {
+            self.logger.Error("Cannot write the trace file " + trace.fname + ": " + err.Error())
+        }
+    }
+}
+
+func (self *callTrace) open() error {
+    // Never follow a link planted in a shared directory
+    fd, err := os.OpenFile(self.fname, os.O_WRONLY | os.O_CREATE | os.O_EXCL, 0600)
+    if err != nil {
+        return err
+    }
+    self.fd = fd
+    self.w = bufio.NewWriter(fd)
+    if self.format == "pcap" {
+        return writePcapHeader(self.w)
+    }
+    return nil
+}
+
+func (self *callTrace) write(pkt *tracePacket) error {
+    if self.format == "pcap" {
+        return writePcapPacket(self.w, pkt.data, pkt.src, pkt.dst, pkt.ts)
+    }
+    t := pkt.ts
+    _, err := fmt.Fprintf(self.w, "%d %s %02d:%02d:%06.3f: message from %s to %s:\n%s\n",
+        t.Day(), t.Month().String()[:3], t.Hour(), t.Minute(), float64(t.Second()) + float64(t.Nanosecond()) / 1e9,
+        pkt.src, pkt.dst, pkt.data)
+    return err
+}
+
+func sanitizeFileName(s string) string {
+    return strings.Map(func(r rune) rune {
+        if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune(".-_@", r) {
+            return r
+        }
+        return '_'
+    }, s)
+}
+
+// parseTraceRule parses the arguments of the "trace add" command.
+func parseTraceRule(args []string) (*traceRule, error) {
+    self := &traceRule{
+        format          : "pcap",
+        calls_left      : 1,
+    }
+    ttl := 600 * time.Second
+    filter_args := []string{}
+    for _, arg := range args {
+        arr := strings.SplitN(arg, "=", 2)
+        if len(arr) != 2 || arr[1] == "" {
+            return nil, errors.New("bad argument '" + arg + "'")
+        }
+        switch strings.ToLower(arr[0]) {
+        case "call_id":
+            self.call_id = arr[1]
+            self.args = arg
+        case "format":
+            if arr[1] != "pcap" && arr[1] != "text" {
+                return nil, errors.New("unknown format '" + arr[1] + "'")
+            }
+            self.format = arr[1]
+        case "calls":
+            n, err := strconv.Atoi(arr[1])
+            if err != nil || n < 0 {
+                return nil, errors.New("bad number of calls '" + arr[1] + "'")
+            }
+            self.calls_left = n
+        case "time":
+            secs, err := strconv.Atoi(arr[1])
+            if err != nil || secs <= 0 {
+                return nil, errors.New("bad time limit '" + arr[1] + "'")
+            }
+            ttl = time.Duration(secs) * time.Second
+        default:
+            filter_args = append(filter_args, arg)
+        }
+    }
+    var err error
+    if self.filter, err = parseCallFilter(filter_args); err != nil {
+        return nil, err
+    }
+    if self.call_id != "" && len(filter_args) > 0 {
+        return nil, errors.New("call_id cannot be combined with the other filters")
+    }
+    if self.call_id == "" {
+        self.args = strings.Join(filter_args, " ")
+        if self.args == "" {
+            self.args = "*"
+        }
+    }
+    self.expires = time.Now().Add(ttl)
+    return self, nil
+}
+
+type traceRuleInfo struct {
+    Id              int64   `json:"id"`
+    Filter          string  `json:"filter"`
+    Format          string  `json:"format"`
+    CallsLeft       int     `json:"calls_left"`
+    ExpiresIn       int64   `json:"expires_in"`
+}
+
+// The reply of the "trace" command
+type traceList struct {
+    Rules           []*traceRuleInfo `json:"rules"`
+    Files           []string         `json:"files"`
+    Dropped         int64            `json:"dropped"`
+}
+
+func (self *traceList) String() string {
+    res := "Trace rules:\n"
+    for _, rule := range self.Rules {
+        calls := "unlimited"
+        if rule.CallsLeft > 0 {
+            calls = strconv.Itoa(rule.CallsLeft)
+        }
+        res += fmt.Sprintf("%d: %s, format %s, calls left %s, expires in %ds\n", rule.Id, rule.Filter, rule.Format, calls, rule.ExpiresIn)
+    }
+    res += "Active traces:\n"
+    for _, fname := range self.Files {
+        res += fname + "\n"
+    }
+    if self.Dropped > 0 {
+        res += fmt.Sprintf("Dropped messages: %d\n", self.Dropped)
+    }
+    return res
+}
+
+func (self *callTracer) addRule(rule *traceRule) int64 {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.last_rule_id++
+    rule.id = self.last_rule_id
+    self.rules = append(self.rules, rule)
+    return rule.id
+}
+
+// Removes the rule by the id, all of them if the id is zero. Returns
+// false if there is no such rule.
+func (self *callTracer) delRule(id int64) bool {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if id == 0 {
+        self.rules = nil
+        return true
+    }
+    for i, rule := range self.rules {
+        if rule.id == id {
+            self.rules = append(self.rules[:i], self.rules[i + 1:]...)
+            return true
+        }
+    }
+    return false
+}
+
+func (self *callTracer) status() *traceList {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    now := time.Now()
+    self.expireRules(now)
+    res := &traceList{
+        Rules           : []*traceRuleInfo{},
+        Files           : []string{},
+        Dropped         : self.dropped,
+    }
+    for _, rule := range self.rules {
+        res.Rules = append(res.Rules, &traceRuleInfo{
+            Id              : rule.id,
+            Filter          : rule.args,
+            Format          : rule.format,
+            CallsLeft       : rule.calls_left,
+            ExpiresIn       : int64(rule.expires.Sub(now).Seconds()),
+        })
+    }
+    seen := make(map[*callTrace]bool)
+    for _, trace := range self.traces {
+        if ! seen[trace] {
+            seen[trace] = true
+            res.Files = append(res.Files, trace.fname)
+        }
+    }
+    sort.Strings(res.Files)
+    return res
+}
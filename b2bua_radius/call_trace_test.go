@@ -0,0 +1,204 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "bytes"
+    "encoding/binary"
+    "io/ioutil"
+    "net"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "sippy/conf"
+    "sippy/headers"
+    "sippy/log"
+    "sippy/time"
+)
+
+type captureRecorder struct {
+    count           int
+}
+
+func (self *captureRecorder) Capture(data []byte, src, dst net.Addr, ts *sippy_time.MonoTime) {
+    self.count++
+}
+
+func traceMsg(call_id string) []byte {
+    return []byte("INVITE sip:123@192.0.2.2 SIP/2.0\r\nCall-ID: " + call_id + "\r\nCSeq: 1 INVITE\r\n\r\n")
+}
+
+// Waits for the trace writer to produce the file with the given content.
+func waitTraceFile(t *testing.T, fname string, check func([]byte) bool) []byte {
+    var data []byte
+    for i := 0; i < 100; i++ {
+        data, _ = ioutil.ReadFile(fname)
+        if check(data) {
+            return data
+        }
+        time.Sleep(20 * time.Millisecond)
+    }
+    t.Fatalf("%s: unexpected content %q", fname, data)
+    return nil
+}
+
+func TestPcapPacket(t *testing.T) {
+    buf := bytes.NewBuffer(nil)
+    payload := []byte("OPTIONS sip:192.0.2.2 SIP/2.0\r\n\r\n")
+    src := &net.UDPAddr{ IP : net.ParseIP("192.0.2.1"), Port : 5060 }
+    dst := &net.UDPAddr{ IP : net.ParseIP("192.0.2.2"), Port : 5070 }
+    if err := writePcapPacket(buf, payload, src, dst, time.Unix(1500000000, 5000)); err != nil {
+        t.Fatal(err)
+    }
+    data := buf.Bytes()
+    if binary.LittleEndian.Uint32(data[0:]) != 1500000000 || binary.LittleEndian.Uint32(data[4:]) != 5 ||
+      int(binary.LittleEndian.Uint32(data[8:])) != 20 + 8 + len(payload) || len(data) != 16 + 20 + 8 + len(payload) {
+        t.Fatalf("bad pcap record header: %v", data[:16])
+    }
+    ip := data[16:36]
+    if ip[0] != 0x45 || ip[9] != 17 || foldChecksum(ipChecksum(0, ip)) != 0 {
+        t.Errorf("bad IPv4 header: %v", ip)
+    }
+    if binary.BigEndian.Uint16(data[36:]) != 5060 || binary.BigEndian.Uint16(data[38:]) != 5070 || ! bytes.Equal(data[44:], payload) {
+        t.Errorf("bad UDP datagram: %v", data[36:])
+    }
+
+    buf.Reset()
+    src.IP = net.ParseIP("2001:db8::1")
+    if err := writePcapPacket(buf, payload, src, dst, time.Now()); err != nil {
+        t.Fatal(err)
+    }
+    data = buf.Bytes()[16:]
+    if data[0] >> 4 != 6 || data[6] != 17 {
+        t.Fatalf("bad IPv6 header: %v", data[:40])
+    }
+    // The checksum over the pseudo header and the datagram must fold to zero
+    udp := data[40:]
+    sum := ipChecksum(0, data[8:40]) + uint32(len(udp)) + 17
+    if foldChecksum(ipChecksum(sum, udp)) != 0 {
+        t.Errorf("bad UDP checksum")
+    }
+}
+
+func TestParseTraceRule(t *testing.T) {
+    for _, args := range [][]string{ { "format=foo" }, { "calls=-1" }, { "time=0" }, { "call_id=a", "cld=1*" }, { "foo=1" }, { "calls" } } {
+        if _, err := parseTraceRule(args); err == nil {
+            t.Errorf("%v: the error is expected", args)
+        }
+    }
+    rule, err := parseTraceRule([]string{ "source=10.0.0.0/8", "calls=3", "time=60" })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if rule.format != "pcap" || rule.calls_left != 3 || rule.filter.source.String() != "10.0.0.0/8" ||
+      time.Until(rule.expires) > 60 * time.Second || time.Until(rule.expires) < 50 * time.Second {
+        t.Errorf("unexpected rule: %+v", rule)
+    }
+}
+
+func TestCallTracer(t *testing.T) {
+    dir, err := ioutil.TempDir("", "b2bua_trace")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    cfg := newTestConfig(t, "-s", "192.0.2.1")
+    live, err := newLiveConfig(cfg, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    next := &captureRecorder{}
+    tracer := newCallTracer(dir, next, sippy_log.NewErrorLogger())
+    laddr := &net.UDPAddr{ IP : net.ParseIP("192.0.2.1"), Port : 5060 }
+    raddr := &net.UDPAddr{ IP : net.ParseIP("10.0.0.1"), Port : 5060 }
+
+    tracer.Capture(traceMsg("call1"), raddr, laddr, nil)
+    if next.count != 1 || len(tracer.pending) != 0 {
+        t.Errorf("the message has to be passed through and not kept when no rules are armed")
+    }
+    rule, _ := parseTraceRule([]string{ "source=10.0.0.0/8", "format=text" })
+    tracer.addRule(rule)
+    rule, _ = parseTraceRule([]string{ "call_id=call3" })
+    tracer.addRule(rule)
+    rule, _ = parseTraceRule([]string{ "cld=nomatch" })
+    rule.expires = time.Now().Add(-time.Second)
+    tracer.addRule(rule)
+    if status := tracer.status(); len(status.Rules) != 2 || status.Rules[0].Id != 1 || status.Rules[1].Id != 2 {
+        t.Errorf("unexpected rules: %+v", status.Rules)
+    }
+
+    // The initial INVITE comes in before the call is known
+    tracer.Capture(traceMsg("call1"), raddr, laddr, nil)
+    source := sippy_conf.NewHostPort("10.0.0.1", "5060")
+    cc := NewCallController(1, source.Host, source, live, nil, nil)
+    cc.cId = sippy_header.NewSipCallIdFromString("call1")
+    trace := tracer.startTrace(cc)
+    if trace == nil {
+        t.Fatal("the call should have matched")
+    }
+    tracer.addCallId(trace, "call1-b2b_1")
+    tracer.Capture(traceMsg("call1-b2b_1"), laddr, &net.UDPAddr{ IP : net.ParseIP("192.0.2.2"), Port : 5060 }, nil)
+    tracer.Capture(traceMsg("call2"), raddr, laddr, nil)
+    // The rule is disarmed after the first call
+    cc2 := NewCallController(2, source.Host, source, live, nil, nil)
+    cc2.cId = sippy_header.NewSipCallIdFromString("call2")
+    if tracer.startTrace(cc2) != nil {
+        t.Errorf("the rule should have been disarmed")
+    }
+    if status := tracer.status(); len(status.Rules) != 1 || len(status.Files) != 1 {
+        t.Errorf("unexpected status: %+v", status)
+    }
+    tracer.endTrace(trace)
+    data := waitTraceFile(t, filepath.Join(dir, "b2bua-1-call1.txt"), func(data []byte) bool {
+        return strings.Contains(string(data), "Call-ID: call1-b2b_1")
+    })
+    if ! strings.Contains(string(data), "message from 10.0.0.1:5060 to 192.0.2.1:5060:\nINVITE") ||
+      strings.Contains(string(data), "call2") {
+        t.Errorf("unexpected trace: %s", data)
+    }
+
+    cc3 := NewCallController(3, source.Host, source, live, nil, nil)
+    cc3.cId = sippy_header.NewSipCallIdFromString("call3")
+    trace = tracer.startTrace(cc3)
+    if trace == nil {
+        t.Fatal("the call should have matched by the Call-ID")
+    }
+    tracer.Capture(traceMsg("call3"), raddr, laddr, nil)
+    tracer.endTrace(trace)
+    data = waitTraceFile(t, filepath.Join(dir, "b2bua-3-call3.pcap"), func(data []byte) bool {
+        return len(data) > 24
+    })
+    if binary.LittleEndian.Uint32(data) != 0xa1b2c3d4 || binary.LittleEndian.Uint32(data[20:]) != pcap_linktype_raw ||
+      ! bytes.HasSuffix(data, traceMsg("call3")) {
+        t.Errorf("unexpected pcap file: %v", data)
+    }
+    if len(tracer.status().Files) != 0 {
+        t.Errorf("the traces should have been closed")
+    }
+}
@@ -0,0 +1,435 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "bytes"
+    "encoding/csv"
+    "encoding/json"
+    "errors"
+    "log/syslog"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+
+    "sippy"
+    "sippy/log"
+    "sippy/time"
+    "sippy/types"
+)
+
+// cdr is the call detail record written when the call controller dies.
+type cdr struct {
+    CcId                int64           `json:"cc_id"`
+    CallId              string          `json:"call_id"`
+    Cli                 string          `json:"cli"`
+    Cld                 string          `json:"cld"`
+    CallerName          string          `json:"caller_name"`
+    Username            string          `json:"username"`
+    RemoteIp            string          `json:"remote_ip"`
+    SetupTime           string          `json:"setup_time"`
+    ConnectTime         string          `json:"connect_time"`
+    DisconnectTime      string          `json:"disconnect_time"`
+    Duration            float64         `json:"duration"`
+    SetupDelay          float64         `json:"setup_delay"`
+    Result              int             `json:"result"`
+    DisconnectOrigin    string          `json:"disconnect_origin"`
+    DisconnectReason    string          `json:"disconnect_reason"`
+    Routes              []*cdrRoute     `json:"routes"`
+    Codecs              []string        `json:"codecs"`
+    Rtpp                *sippy.RtpProxySessionStats `json:"rtpproxy,omitempty"`
+}
+
+// cdrRoute is an outgoing call leg attempted for the call.
+type cdrRoute struct {
+    Route               string          `json:"route"`
+    Cld                 string          `json:"cld"`
+    Code                int             `json:"code"`
+    Origin              string          `json:"origin"`
+    Reason              string          `json:"reason"`
+}
+
+var cdr_csv_header = []string{
+    "cc_id", "call_id", "cli", "cld", "caller_name", "username", "remote_ip",
+    "setup_time", "connect_time", "disconnect_time", "duration", "setup_delay",
+    "result", "disconnect_origin", "disconnect_reason", "routes", "codecs",
+    "rtpp_caller_packets", "rtpp_callee_packets", "rtpp_relayed", "rtpp_dropped",
+}
+
+func cdrTime(ts *sippy_time.MonoTime) string {
+    if ts == nil {
+        return ""
+    }
+    return ts.Realt().UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// csvRecord returns the columns listed in cdr_csv_header. The routes are
+// "route/code" separated by the semicolons.
+func (self *cdr) csvRecord() []string {
+    routes := make([]string, len(self.Routes))
+    for i, r := range self.Routes {
+        routes[i] = r.Route + "/" + strconv.Itoa(r.Code)
+    }
+    rtpp := []string{ "", "", "", "" }
+    if self.Rtpp != nil {
+        rtpp = []string{
+            strconv.FormatInt(self.Rtpp.CallerPackets, 10),
+            strconv.FormatInt(self.Rtpp.CalleePackets, 10),
+            strconv.FormatInt(self.Rtpp.Relayed, 10),
+            strconv.FormatInt(self.Rtpp.Dropped, 10),
+        }
+    }
+    return append([]string{
+        strconv.FormatInt(self.CcId, 10), self.CallId, self.Cli, self.Cld, self.CallerName, self.Username, self.RemoteIp,
+        self.SetupTime, self.ConnectTime, self.DisconnectTime,
+        strconv.FormatFloat(self.Duration, 'f', 3, 64), strconv.FormatFloat(self.SetupDelay, 'f', 3, 64),
+        strconv.Itoa(self.Result), self.DisconnectOrigin, self.DisconnectReason,
+        strings.Join(routes, ";"), strings.Join(self.Codecs, ","),
+    }, rtpp...)
+}
+
+func encodeCsv(record []string) []byte {
+    buf := &bytes.Buffer{}
+    w := csv.NewWriter(buf)
+    w.Write(record)
+    w.Flush()
+    return buf.Bytes()
+}
+
+var static_payload_types = map[string]string{
+    "0"     : "PCMU",
+    "3"     : "GSM",
+    "4"     : "G723",
+    "8"     : "PCMA",
+    "9"     : "G722",
+    "13"    : "CN",
+    "18"    : "G729",
+}
+
+// sdpCodecs returns the names of the payload types offered in the audio
+// and video streams of the SDP body.
+func sdpCodecs(body sippy_types.MsgBody) []string {
+    codecs := []string{}
+    if body == nil {
+        return codecs
+    }
+    sdp_body, err := body.GetParsedBody()
+    if err != nil {
+        return codecs
+    }
+    for _, section := range sdp_body.GetSections() {
+        rtpmap := make(map[string]string)
+        for _, a := range section.GetAHeaders() {
+            if ! strings.HasPrefix(a, "rtpmap:") {
+                continue
+            }
+            arr := strings.Fields(a[7:])
+            if len(arr) == 2 {
+                rtpmap[arr[0]] = strings.SplitN(arr[1], "/", 2)[0]
+            }
+        }
+        for _, format := range section.GetMHeader().GetFormats() {
+            if name, ok := rtpmap[format]; ok {
+                codecs = append(codecs, name)
+            } else if name, ok = static_payload_types[format]; ok {
+                codecs = append(codecs, name)
+            } else {
+                codecs = append(codecs, format)
+            }
+        }
+    }
+    return codecs
+}
+
+// cdrSink is the destination of the CDRs. Several sinks are combined
+// with cdrSinks.
+type cdrSink interface {
+    writeCdr(*cdr) error
+    reopen() error
+}
+
+type cdrSinks []cdrSink
+
+func (self cdrSinks) writeCdr(r *cdr) error {
+    var res error
+    for _, sink := range self {
+        if err := sink.writeCdr(r); err != nil && res == nil {
+            res = err
+        }
+    }
+    return res
+}
+
+func (self cdrSinks) reopen() error {
+    var res error
+    for _, sink := range self {
+        if err := sink.reopen(); err != nil && res == nil {
+            res = err
+        }
+    }
+    return res
+}
+
+// cdrFileSink writes the CDRs in the CSV or JSON lines format. The file
+// is rotated to fname.1, fname.2 ... once it grows over max_size bytes.
+// The external rotation is supported with reopen().
+type cdrFileSink struct {
+    lock            sync.Mutex
+    fname           string
+    csv             bool
+    max_size        int64
+    max_files       int
+    fd              *os.File
+    size            int64
+}
+
+func newCdrFileSink(fname, format string, max_size int64, max_files int) (*cdrFileSink, error) {
+    if format != "csv" && format != "json" {
+        return nil, errors.New("unknown CDR format: " + format)
+    }
+    if max_files < 1 {
+        return nil, errors.New("the number of the CDR files should be positive")
+    }
+    self := &cdrFileSink{
+        fname           : fname,
+        csv             : format == "csv",
+        max_size        : max_size,
+        max_files       : max_files,
+    }
+    if err := self.open(); err != nil {
+        return nil, err
+    }
+    return self, nil
+}
+
+func (self *cdrFileSink) open() error {
+    fd, err := os.OpenFile(self.fname, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0644)
+    if err != nil {
+        return err
+    }
+    st, err := fd.Stat()
+    if err != nil {
+        fd.Close()
+        return err
+    }
+    if self.fd != nil {
+        self.fd.Close()
+    }
+    self.fd, self.size = fd, st.Size()
+    return nil
+}
+
+func (self *cdrFileSink) writeCdr(r *cdr) error {
+    var buf []byte
+    if self.csv {
+        buf = encodeCsv(r.csvRecord())
+    } else {
+        var err error
+        if buf, err = json.Marshal(r); err != nil {
+            return err
+        }
+        buf = append(buf, '\n')
+    }
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if self.max_size > 0 && self.size > 0 && self.size + int64(len(buf)) > self.max_size {
+        if err := self.rotate(); err != nil {
+            return err
+        }
+    }
+    if self.size == 0 && self.csv {
+        buf = append(encodeCsv(cdr_csv_header), buf...)
+    }
+    n, err := self.fd.Write(buf)
+    self.size += int64(n)
+    return err
+}
+
+func (self *cdrFileSink) rotate() error {
+    for i := self.max_files - 1; i > 0; i-- {
+        fname := self.fname + "." + strconv.Itoa(i)
+        if err := os.Rename(fname, self.fname + "." + strconv.Itoa(i + 1)); err != nil && ! os.IsNotExist(err) {
+            return err
+        }
+    }
+    if err := os.Rename(self.fname, self.fname + ".1"); err != nil {
+        return err
+    }
+    return self.open()
+}
+
+func (self *cdrFileSink) reopen() error {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.open()
+}
+
+// cdrSyslogSink sends the CDRs in the JSON format to the local syslog.
+type cdrSyslogSink struct {
+    w               *syslog.Writer
+}
+
+func newCdrSyslogSink(facility string) (*cdrSyslogSink, error) {
+    prio, err := sippy_log.ParseSyslogFacility(facility)
+    if err != nil {
+        return nil, err
+    }
+    w, err := syslog.New(prio | syslog.LOG_INFO, "b2bua-cdr")
+    if err != nil {
+        return nil, err
+    }
+    return &cdrSyslogSink{ w : w }, nil
+}
+
+func (self *cdrSyslogSink) writeCdr(r *cdr) error {
+    buf, err := json.Marshal(r)
+    if err != nil {
+        return err
+    }
+    return self.w.Info(string(buf))
+}
+
+func (self *cdrSyslogSink) reopen() error {
+    return nil
+}
+
+// newCdrSinks creates the sinks enabled in the configuration, nil if
+// there are none.
+func newCdrSinks(config *myConfigParser) (cdrSink, error) {
+    sinks := cdrSinks{}
+    max_size := int64(config.cdr_max_size) * 1024 * 1024
+    for _, it := range []struct{ fname, format string }{ { config.cdr_csv, "csv" }, { config.cdr_json, "json" } } {
+        if it.fname == "" {
+            continue
+        }
+        sink, err := newCdrFileSink(it.fname, it.format, max_size, config.cdr_max_files)
+        if err != nil {
+            return nil, err
+        }
+        sinks = append(sinks, sink)
+    }
+    if config.cdr_syslog != "" {
+        sink, err := newCdrSyslogSink(config.cdr_syslog)
+        if err != nil {
+            return nil, err
+        }
+        sinks = append(sinks, sink)
+    }
+    if len(sinks) == 0 {
+        return nil, nil
+    }
+    return sinks, nil
+}
+
+// makeCdr collects the CDR of the call from the incoming call leg and
+// the outgoing legs attempted.
+func (self *callController) makeCdr() *cdr {
+    r := &cdr{
+        CcId            : self.id,
+        Cli             : self.cli,
+        Cld             : self.cld,
+        CallerName      : self.caller_name,
+        Username        : self.username,
+        Result          : self.cdr_result,
+        DisconnectOrigin : self.disc_origin,
+        DisconnectReason : self.disc_reason,
+        Routes          : make([]*cdrRoute, 0, len(self.legs)),
+        Rtpp            : self.rtpp_stats,
+    }
+    if self.cId != nil {
+        r.CallId = self.cId.CallId
+    }
+    if self.remote_ip != nil {
+        r.RemoteIp = self.remote_ip.String()
+    }
+    duration, delay, connected, _ := self.uaA.GetAcct(nil)
+    r.SetupTime = cdrTime(self.uaA.GetSetupTs())
+    r.DisconnectTime = cdrTime(self.uaA.GetDisconnectTs())
+    r.SetupDelay = delay.Seconds()
+    var answered sippy_types.UA
+    if connected {
+        r.ConnectTime = cdrTime(self.uaA.GetConnectTs())
+        r.Duration = duration.Seconds()
+        r.Result = 200
+        answered = self.uaO
+    }
+    for _, leg := range self.legs {
+        r.Routes = append(r.Routes, &cdrRoute{
+            Route   : leg.route,
+            Cld     : leg.cld,
+            Code    : leg.code,
+            Origin  : leg.origin,
+            Reason  : leg.reason,
+        })
+        if r.DisconnectReason == "" && ! leg.answered.IsZero() {
+            r.DisconnectReason = leg.reason
+        }
+    }
+    if answered != nil {
+        r.Codecs = sdpCodecs(answered.GetRSDP())
+    } else {
+        r.Codecs = sdpCodecs(self.uaA.GetRSDP())
+    }
+    return r
+}
+
+// writeCdr writes the CDR once the call is dead and the rtpproxy stats
+// have arrived.
+func (self *callController) writeCdr() {
+    if global_cdr == nil || self.cdr_written || self.rtpp_query {
+        return
+    }
+    self.cdr_written = true
+    if err := global_cdr.writeCdr(self.makeCdr()); err != nil {
+        self.logger.Error("Cannot write the CDR: " + err.Error())
+    }
+}
+
+// deleteRtpProxySession deletes the media session, with the CDRs enabled
+// its stats are queried first.
+func (self *callController) deleteRtpProxySession() {
+    rtp_proxy_session := self.rtp_proxy_session
+    self.rtp_proxy_session = nil
+    self.rtpp_deleting = true
+    deleted := func() {
+        self.rtpp_deleting = false
+        self.releaseLive()
+    }
+    if global_cdr == nil {
+        rtp_proxy_session.DeleteWithCallback(deleted)
+        return
+    }
+    self.rtpp_query = true
+    rtp_proxy_session.Query(func(stats *sippy.RtpProxySessionStats) {
+        rtp_proxy_session.DeleteWithCallback(deleted)
+        self.rtpp_stats = stats
+        self.rtpp_query = false
+        if self.dead {
+            self.writeCdr()
+        }
+    })
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "encoding/csv"
+    "encoding/json"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+
+    "sippy"
+)
+
+const test_cdr_sdp = "v=0\r\n" +
+    "o=- 12345 12345 IN IP4 10.0.0.1\r\n" +
+    "s=-\r\n" +
+    "c=IN IP4 10.0.0.1\r\n" +
+    "t=0 0\r\n" +
+    "m=audio 16000 RTP/AVP 8 0 96 101\r\n" +
+    "a=rtpmap:96 opus/48000/2\r\n" +
+    "a=rtpmap:101 telephone-event/8000\r\n"
+
+func testCdr(cc_id int64) *cdr {
+    return &cdr{
+        CcId            : cc_id,
+        CallId          : "abc@192.0.2.1",
+        Cli             : "100",
+        Cld             : "200",
+        CallerName      : "Alice, Bob",
+        RemoteIp        : "192.0.2.1",
+        SetupTime       : "2024-01-01T12:00:00.000Z",
+        ConnectTime     : "2024-01-01T12:00:02.000Z",
+        DisconnectTime  : "2024-01-01T12:01:02.000Z",
+        Duration        : 60,
+        SetupDelay      : 2,
+        Result          : 200,
+        DisconnectOrigin : "caller",
+        DisconnectReason : "Q.850;cause=16",
+        Routes          : []*cdrRoute{
+            { Route : "192.0.2.2:5060", Cld : "200", Code : 503, Origin : "callee" },
+            { Route : "192.0.2.3:5060", Cld : "200", Code : 200, Origin : "caller" },
+        },
+        Codecs          : []string{ "PCMA" },
+        Rtpp            : &sippy.RtpProxySessionStats{ Ttl : 60, CallerPackets : 3000, CalleePackets : 2990 },
+    }
+}
+
+func TestSdpCodecs(t *testing.T) {
+    codecs := sdpCodecs(sippy.NewMsgBody(test_cdr_sdp, "application/sdp"))
+    if expected := []string{ "PCMA", "PCMU", "opus", "telephone-event" }; ! reflect.DeepEqual(codecs, expected) {
+        t.Errorf("expected %v, got %v", expected, codecs)
+    }
+    if codecs = sdpCodecs(nil); len(codecs) != 0 {
+        t.Errorf("unexpected codecs without the body: %v", codecs)
+    }
+}
+
+func TestCdrFileSinks(t *testing.T) {
+    dir, err := ioutil.TempDir("", "cdr")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    csv_fname, json_fname := filepath.Join(dir, "cdr.csv"), filepath.Join(dir, "cdr.json")
+    csv_sink, err := newCdrFileSink(csv_fname, "csv", 0, 10)
+    if err != nil {
+        t.Fatal(err)
+    }
+    json_sink, err := newCdrFileSink(json_fname, "json", 0, 10)
+    if err != nil {
+        t.Fatal(err)
+    }
+    sinks := cdrSinks{ csv_sink, json_sink }
+    for i := int64(1); i <= 2; i++ {
+        if err = sinks.writeCdr(testCdr(i)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    fd, err := os.Open(csv_fname)
+    if err != nil {
+        t.Fatal(err)
+    }
+    records, err := csv.NewReader(fd).ReadAll()
+    fd.Close()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(records) != 3 || ! reflect.DeepEqual(records[0], cdr_csv_header) {
+        t.Fatalf("expected the header and two records, got %v", records)
+    }
+    row := make(map[string]string)
+    for i, name := range cdr_csv_header {
+        row[name] = records[2][i]
+    }
+    for k, v := range map[string]string{ "cc_id" : "2", "caller_name" : "Alice, Bob", "duration" : "60.000",
+            "routes" : "192.0.2.2:5060/503;192.0.2.3:5060/200", "codecs" : "PCMA", "rtpp_callee_packets" : "2990" } {
+        if row[k] != v {
+            t.Errorf("%s: expected %q, got %q", k, v, row[k])
+        }
+    }
+    buf, err := ioutil.ReadFile(json_fname)
+    if err != nil {
+        t.Fatal(err)
+    }
+    lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+    if len(lines) != 2 {
+        t.Fatalf("expected two JSON lines, got %q", buf)
+    }
+    var res cdr
+    if err = json.Unmarshal([]byte(lines[0]), &res); err != nil {
+        t.Fatal(err)
+    }
+    if ! reflect.DeepEqual(&res, testCdr(1)) {
+        t.Errorf("the JSON CDR does not match: %s", lines[0])
+    }
+    // The externally rotated file is recreated with the CSV header
+    if err = os.Rename(csv_fname, csv_fname + ".old"); err != nil {
+        t.Fatal(err)
+    }
+    if err = sinks.reopen(); err != nil {
+        t.Fatal(err)
+    }
+    if err = sinks.writeCdr(testCdr(3)); err != nil {
+        t.Fatal(err)
+    }
+    if buf, err = ioutil.ReadFile(csv_fname); err != nil {
+        t.Fatal(err)
+    }
+    if ! strings.HasPrefix(string(buf), "cc_id,call_id,") || strings.Count(string(buf), "\n") != 2 {
+        t.Errorf("unexpected content after the reopen: %s", buf)
+    }
+}
+
+func TestCdrFileSinkRotation(t *testing.T) {
+    dir, err := ioutil.TempDir("", "cdr")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    fname := filepath.Join(dir, "cdr.json")
+    line, _ := json.Marshal(testCdr(1))
+    // Every file holds two records
+    sink, err := newCdrFileSink(fname, "json", int64(2 * (len(line) + 1)), 2)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for i := int64(1); i <= 7; i++ {
+        if err = sink.writeCdr(testCdr(1)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    for name, lines := range map[string]int{ "cdr.json" : 1, "cdr.json.1" : 2, "cdr.json.2" : 2 } {
+        buf, err := ioutil.ReadFile(filepath.Join(dir, name))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if n := strings.Count(string(buf), "\n"); n != lines {
+            t.Errorf("%s: expected %d records, got %d", name, lines, n)
+        }
+    }
+    if _, err = os.Stat(fname + ".3"); ! os.IsNotExist(err) {
+        t.Errorf("more rotated files than configured are kept")
+    }
+    if _, err = newCdrFileSink(fname, "xml", 0, 1); err == nil {
+        t.Errorf("the unknown format has been accepted")
+    }
+}
@@ -0,0 +1,456 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net"
+    "path"
+    "strings"
+    "time"
+
+    "sippy/time"
+    "sippy/types"
+)
+
+// cliReply is the result of a CLI command. The text form is what the
+// command prints by default, the JSON form (the "json" command prefix)
+// is the reply itself marshalled.
+type cliReply interface {
+    String() string
+}
+
+type cliError string
+
+func (self cliError) String() string {
+    return "ERROR: " + string(self) + "\n"
+}
+
+func (self cliError) MarshalJSON() ([]byte, error) {
+    return json.Marshal(map[string]string{ "error" : string(self) })
+}
+
+type cliOK struct{}
+
+func (self cliOK) String() string {
+    return "OK\n"
+}
+
+func (self cliOK) MarshalJSON() ([]byte, error) {
+    return json.Marshal(map[string]string{ "result" : "OK" })
+}
+
+func formatReply(reply cliReply, json_out bool) string {
+    if ! json_out {
+        return reply.String()
+    }
+    buf, err := json.Marshal(reply)
+    if err != nil {
+        return cliError(err.Error()).String()
+    }
+    return string(buf) + "\n"
+}
+
+// callFilter selects the calls for the "l" and "d" commands by the CLD and
+// CLI of the incoming leg (shell patterns) and by the source address.
+type callFilter struct {
+    cld             string
+    cli             string
+    source          *net.IPNet
+}
+
+// parseCallFilter parses the list of the "cld=<pattern>", "cli=<pattern>"
+// and "source=<IP or network>" arguments.
+func parseCallFilter(args []string) (*callFilter, error) {
+    self := &callFilter{}
+    for _, arg := range args {
+        arr := strings.SplitN(arg, "=", 2)
+        if len(arr) != 2 || arr[1] == "" {
+            return nil, errors.New("bad filter '" + arg + "'")
+        }
+        var err error
+        switch strings.ToLower(arr[0]) {
+        case "cld":
+            self.cld = arr[1]
+            _, err = path.Match(self.cld, "")
+        case "cli":
+            self.cli = arr[1]
+            _, err = path.Match(self.cli, "")
+        case "source":
+            self.source, err = parseIPNet(arr[1])
+        default:
+            return nil, errors.New("unknown filter '" + arr[0] + "'")
+        }
+        if err != nil {
+            return nil, errors.New("bad filter '" + arg + "': " + err.Error())
+        }
+    }
+    return self, nil
+}
+
+// Must be called with the call locked
+func (self *callFilter) match(cc *callController) bool {
+    if self.cld != "" {
+        if ok, _ := path.Match(self.cld, cc.uaA.GetCLD()); ! ok {
+            return false
+        }
+    }
+    if self.cli != "" {
+        if ok, _ := path.Match(self.cli, cc.uaA.GetCLI()); ! ok {
+            return false
+        }
+    }
+    if self.source != nil {
+        if cc.source == nil || ! self.source.Contains(net.ParseIP(strings.Trim(cc.source.Host.String(), "[]"))) {
+            return false
+        }
+    }
+    return true
+}
+
+type legInfo struct {
+    State           string  `json:"state"`
+    Remote          string  `json:"remote"`
+    CLD             string  `json:"cld"`
+    CLI             string  `json:"cli"`
+}
+
+func newLegInfo(ua sippy_types.UA) *legInfo {
+    if ua == nil {
+        return nil
+    }
+    self := &legInfo{
+        State           : "None",
+        CLD             : ua.GetCLD(),
+        CLI             : ua.GetCLI(),
+    }
+    // The state is not set until the first request or event
+    if state := ua.GetState(); state != nil {
+        self.State = state.String()
+    }
+    if raddr := ua.GetRAddr0(); raddr != nil {
+        self.Remote = raddr.String()
+    }
+    return self
+}
+
+type callInfo struct {
+    Id              int64    `json:"id"`
+    CallId          string   `json:"call_id"`
+    State           string   `json:"state"`
+    A               *legInfo `json:"a_leg"`
+    O               *legInfo `json:"o_leg"`
+}
+
+// Must be called with the call locked
+func (self *callController) info() *callInfo {
+    res := &callInfo{
+        Id              : self.id,
+        State           : self.state.String(),
+        A               : newLegInfo(self.uaA),
+        O               : newLegInfo(self.uaO),
+    }
+    if self.cId != nil {
+        res.CallId = self.cId.CallId
+    }
+    return res
+}
+
+func (self *callInfo) String() string {
+    res := fmt.Sprintf("%s: %s (", self.CallId, self.State)
+    if self.A != nil {
+        res += fmt.Sprintf("%s %s %s %s -> ", self.A.State, self.A.Remote, self.A.CLD, self.A.CLI)
+    } else {
+        res += "N/A -> "
+    }
+    if self.O != nil {
+        res += fmt.Sprintf("%s %s %s %s)", self.O.State, self.O.Remote, self.O.CLI, self.O.CLD)
+    } else {
+        res += "N/A)"
+    }
+    return res
+}
+
+// The reply of the "l" command
+type callList struct {
+    Calls           []*callInfo `json:"calls"`
+    Total           int         `json:"total"`
+}
+
+func (self *callList) String() string {
+    res := "In-memory calls:\n"
+    for _, call := range self.Calls {
+        res += call.String() + "\n"
+    }
+    return res + fmt.Sprintf("Total: %d\n", self.Total)
+}
+
+type legDetails struct {
+    legInfo
+    SetupTs         string  `json:"setup_ts,omitempty"`
+    ConnectTs       string  `json:"connect_ts,omitempty"`
+    DisconnectTs    string  `json:"disconnect_ts,omitempty"`
+    LocalSdp        string  `json:"local_sdp,omitempty"`
+    RemoteSdp       string  `json:"remote_sdp,omitempty"`
+}
+
+func formatTs(ts *sippy_time.MonoTime) string {
+    if ts == nil {
+        return ""
+    }
+    return ts.Fptime()
+}
+
+func formatSdp(body sippy_types.MsgBody) string {
+    if body == nil {
+        return ""
+    }
+    return body.String()
+}
+
+func newLegDetails(ua sippy_types.UA) *legDetails {
+    if ua == nil {
+        return nil
+    }
+    return &legDetails{
+        legInfo         : *newLegInfo(ua),
+        SetupTs         : formatTs(ua.GetSetupTs()),
+        ConnectTs       : formatTs(ua.GetConnectTs()),
+        DisconnectTs    : formatTs(ua.GetDisconnectTs()),
+        LocalSdp        : formatSdp(ua.GetLSDP()),
+        RemoteSdp       : formatSdp(ua.GetRSDP()),
+    }
+}
+
+func (self *legDetails) String() string {
+    res := fmt.Sprintf("%s %s %s %s\n", self.State, self.Remote, self.CLD, self.CLI)
+    for _, ts := range [][2]string{ { "setup", self.SetupTs }, { "connect", self.ConnectTs }, { "disconnect", self.DisconnectTs } } {
+        if ts[1] != "" {
+            res += fmt.Sprintf("  %s: %s\n", ts[0], ts[1])
+        }
+    }
+    for _, sdp := range [][2]string{ { "local", self.LocalSdp }, { "remote", self.RemoteSdp } } {
+        if sdp[1] == "" {
+            continue
+        }
+        res += "  " + sdp[0] + " SDP:\n"
+        for _, line := range strings.Split(strings.TrimRight(sdp[1], "\r\n"), "\n") {
+            res += "    " + strings.TrimRight(line, "\r") + "\n"
+        }
+    }
+    return res
+}
+
+type rtppDetails struct {
+    Rtpproxy        string  `json:"rtpproxy"`
+    CallId          string  `json:"call_id"`
+    FromTag         string  `json:"from_tag"`
+    ToTag           string  `json:"to_tag"`
+}
+
+type routeInfo struct {
+    Rnum            int     `json:"rnum"`
+    Hostport        string  `json:"hostport"`
+    CLD             string  `json:"cld"`
+    CLI             string  `json:"cli"`
+    CreditTime      int64   `json:"credit_time"`
+    Expires         int64   `json:"expires"`
+    Fork            bool    `json:"fork"`
+}
+
+func (self *routeInfo) String() string {
+    return fmt.Sprintf("%d: %s@%s cli=%s credit_time=%d expires=%d fork=%t", self.Rnum, self.CLD, self.Hostport,
+      self.CLI, self.CreditTime, self.Expires, self.Fork)
+}
+
+// The reply of the "show call" command
+type callDetails struct {
+    Id              int64        `json:"id"`
+    CallId          string       `json:"call_id"`
+    State           string       `json:"state"`
+    Source          string       `json:"source"`
+    CLD             string       `json:"cld"`
+    CLI             string       `json:"cli"`
+    A               *legDetails  `json:"a_leg"`
+    O               *legDetails  `json:"o_leg"`
+    Rtpproxy        *rtppDetails `json:"rtpproxy"`
+    Routes          []*routeInfo `json:"routes_remaining"`
+}
+
+// Must be called with the call locked
+func (self *callController) details() *callDetails {
+    res := &callDetails{
+        Id              : self.id,
+        State           : self.state.String(),
+        CLD             : self.cld,
+        CLI             : self.cli,
+        A               : newLegDetails(self.uaA),
+        O               : newLegDetails(self.uaO),
+        Routes          : []*routeInfo{},
+    }
+    if self.cId != nil {
+        res.CallId = self.cId.CallId
+    }
+    if self.source != nil {
+        res.Source = self.source.String()
+    }
+    if self.rtp_proxy_session != nil {
+        res.Rtpproxy = &rtppDetails{
+            Rtpproxy        : self.rtp_proxy_session.GetProxyAddress(),
+            CallId          : self.rtp_proxy_session.GetCallId(),
+            FromTag         : self.rtp_proxy_session.GetFromTag(),
+            ToTag           : self.rtp_proxy_session.GetToTag(),
+        }
+    }
+    for _, route := range self.routes {
+        res.Routes = append(res.Routes, &routeInfo{
+            Rnum            : route.rnum,
+            Hostport        : route.hostport,
+            CLD             : route.cld,
+            CLI             : route.cli,
+            CreditTime      : int64(route.credit_time / time.Second),
+            Expires         : int64(route.expires / time.Second),
+            Fork            : route.fork,
+        })
+    }
+    return res
+}
+
+func (self *callDetails) String() string {
+    res := fmt.Sprintf("Call %d: %s %s\n", self.Id, self.CallId, self.State)
+    res += fmt.Sprintf("Source: %s cld=%s cli=%s\n", self.Source, self.CLD, self.CLI)
+    if self.A != nil {
+        res += "A leg: " + self.A.String()
+    } else {
+        res += "A leg: N/A\n"
+    }
+    if self.O != nil {
+        res += "O leg: " + self.O.String()
+    } else {
+        res += "O leg: N/A\n"
+    }
+    if self.Rtpproxy != nil {
+        res += fmt.Sprintf("Rtpproxy: %s %s %s %s\n", self.Rtpproxy.Rtpproxy, self.Rtpproxy.CallId,
+          self.Rtpproxy.FromTag, self.Rtpproxy.ToTag)
+    } else {
+        res += "Rtpproxy: N/A\n"
+    }
+    res += fmt.Sprintf("Routes remaining: %d\n", len(self.Routes))
+    for _, route := range self.Routes {
+        res += "  " + route.String() + "\n"
+    }
+    return res
+}
+
+type transactionInfo struct {
+    CallId          string  `json:"call_id"`
+    CSeq            string  `json:"cseq"`
+    Branch          string  `json:"branch"`
+    Method          string  `json:"method"`
+    State           string  `json:"state"`
+    Remote          string  `json:"remote"`
+    Age             float64 `json:"age"`
+}
+
+func newTransactionInfos(tlist []*sippy_types.TransactionInfo, min_age time.Duration) []*transactionInfo {
+    res := []*transactionInfo{}
+    for _, t := range tlist {
+        if t.Age < min_age {
+            continue
+        }
+        res = append(res, &transactionInfo{
+            CallId          : t.TID.CallId,
+            CSeq            : t.TID.CSeq,
+            Branch          : t.TID.Branch,
+            Method          : t.Method,
+            State           : t.State,
+            Remote          : t.Remote,
+            Age             : t.Age.Seconds(),
+        })
+    }
+    return res
+}
+
+func formatTransactions(tlist []*transactionInfo) string {
+    res := ""
+    for _, t := range tlist {
+        res += fmt.Sprintf("%s/%s/%s %s %s %s %.3f\n", t.CallId, t.CSeq, t.Branch, t.Method, t.State,
+          t.Remote, t.Age)
+    }
+    return res
+}
+
+// The reply of the "lt" and "llt" commands
+type transactionList struct {
+    Server          []*transactionInfo `json:"server"`
+    Client          []*transactionInfo `json:"client"`
+}
+
+func (self *transactionList) String() string {
+    return "In-memory server transactions:\n" + formatTransactions(self.Server) +
+        "In-memory client transactions:\n" + formatTransactions(self.Client)
+}
+
+type rtppStatus struct {
+    Address         string  `json:"address"`
+    Online          bool    `json:"online"`
+    ActiveSessions  int64   `json:"active_sessions"`
+    ActiveStreams   int64   `json:"active_streams"`
+    Latency         float64 `json:"latency"`
+}
+
+type rtppList struct {
+    Rtpproxies      []*rtppStatus `json:"rtpproxies"`
+}
+
+func (self *rtppList) String() string {
+    res := "Rtpproxies:\n"
+    for _, rtpp := range self.Rtpproxies {
+        state := "offline"
+        if rtpp.Online {
+            state = "online"
+        }
+        res += fmt.Sprintf("%s: %s, sessions %d, streams %d, latency %.3f\n", rtpp.Address, state,
+          rtpp.ActiveSessions, rtpp.ActiveStreams, rtpp.Latency)
+    }
+    return res
+}
+
+func rtpProxyStatus() *rtppList {
+    res := &rtppList{ Rtpproxies : []*rtppStatus{} }
+    for _, rtpp := range currentLive().rtp_proxy_clients {
+        res.Rtpproxies = append(res.Rtpproxies, &rtppStatus{
+            Address         : rtpp.GetProxyAddress(),
+            Online          : rtpp.IsOnline(),
+            ActiveSessions  : rtpp.GetActiveSessions(),
+            ActiveStreams   : rtpp.GetActiveStreams(),
+            Latency         : rtpp.GetRtpcDelay(),
+        })
+    }
+    return res
+}
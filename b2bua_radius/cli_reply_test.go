@@ -0,0 +1,163 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "encoding/json"
+    "strings"
+    "testing"
+    "time"
+
+    "sippy/conf"
+)
+
+func TestCallStatsCps(t *testing.T) {
+    t0 := time.Unix(1000000, 0)
+    stats := newCallStats(t0)
+    for i := 0; i < 3; i++ {
+        stats.newCall(t0)
+    }
+    stats.newCall(t0.Add(1500 * time.Millisecond))
+    // The current second is not complete yet and is not counted
+    stats.newCall(t0.Add(2 * time.Second))
+    now := t0.Add(2100 * time.Millisecond)
+    if cps := stats.cps(now, 1); cps != 1 {
+        t.Errorf("1s rate: expected 1, got %g", cps)
+    }
+    if cps := stats.cps(now, 10); cps != 0.4 {
+        t.Errorf("10s rate: expected 0.4, got %g", cps)
+    }
+    // The slot of the first second is reused
+    stats.newCall(t0.Add(cps_window * time.Second))
+    if cps := stats.cps(t0.Add(cps_window * time.Second + 1500 * time.Millisecond), cps_window); cps != 3.0 / cps_window {
+        t.Errorf("60s rate: expected %g, got %g", 3.0 / cps_window, cps)
+    }
+    stats.failed(404)
+    stats.failed(404)
+    stats.failed(503)
+    res := stats.status(now, map[string]int{ "Connected" : 2, "ARComplete" : 1 })
+    if res.Calls != 3 || res.TotalCalls != 6 || res.Failures[404] != 2 || res.Failures[503] != 1 {
+        t.Errorf("unexpected stats: %+v", res)
+    }
+    text := res.String()
+    for _, s := range []string{ "Calls: 3\n", "  ARComplete: 1\n  Connected: 2\n", "  404: 2\n  503: 1\n" } {
+        if ! strings.Contains(text, s) {
+            t.Errorf("%q not found in:\n%s", s, text)
+        }
+    }
+}
+
+func TestCallFilter(t *testing.T) {
+    for _, args := range [][]string{ { "cld" }, { "cld=" }, { "foo=1" }, { "cli=[" }, { "source=1.2.3" } } {
+        if _, err := parseCallFilter(args); err == nil {
+            t.Errorf("%v: the error is expected", args)
+        }
+    }
+    filter, err := parseCallFilter([]string{ "cld=1800*", "CLI=?23", "source=10.0.0.0/8" })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if filter.cld != "1800*" || filter.cli != "?23" || filter.source.String() != "10.0.0.0/8" {
+        t.Errorf("unexpected filter: %+v", filter)
+    }
+}
+
+func TestRecvCommandJson(t *testing.T) {
+    cmap := &callMap{
+        global_config   : newTestConfig(t),
+        ccmap           : make(map[int64]*callController),
+        stats           : newCallStats(time.Now()),
+    }
+    cmap.stats.failed(486)
+    var stats statsReply
+    if err := json.Unmarshal([]byte(cmap.recvCommand("json stats\n")), &stats); err != nil {
+        t.Fatal(err)
+    }
+    if stats.Calls != 0 || stats.Failures[486] != 1 {
+        t.Errorf("unexpected stats: %+v", stats)
+    }
+    var calls callList
+    if err := json.Unmarshal([]byte(cmap.recvCommand("json l cld=1*")), &calls); err != nil {
+        t.Fatal(err)
+    }
+    if calls.Total != 0 || calls.Calls == nil {
+        t.Errorf("unexpected call list: %+v", calls)
+    }
+    if res := cmap.recvCommand("l"); res != "In-memory calls:\nTotal: 0\n" {
+        t.Errorf("unexpected text output: %q", res)
+    }
+    var reply map[string]string
+    for cmd, expect := range map[string]string{
+                "json show call 1" : "no call with id of 1 has been found",
+                "json l foo=bar" : "unknown filter 'foo', syntax: l [cld=<pattern>] [cli=<pattern>] [source=<IP or network>]",
+                "json d cld=1*" : "no matching calls have been found",
+                "json foo" : "unknown command",
+            } {
+        if err := json.Unmarshal([]byte(cmap.recvCommand(cmd)), &reply); err != nil {
+            t.Fatal(err)
+        }
+        if reply["error"] != expect {
+            t.Errorf("%s: unexpected reply %v", cmd, reply)
+        }
+    }
+    if res := cmap.recvCommand("foo"); res != "ERROR: unknown command\n" {
+        t.Errorf("unexpected text output: %q", res)
+    }
+}
+
+func TestShowCall(t *testing.T) {
+    cfg := newTestConfig(t, "-s", "192.0.2.1")
+    live, err := newLiveConfig(cfg, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    source := sippy_conf.NewHostPort("10.0.0.1", "5060")
+    cc := NewCallController(7, source.Host, source, live, nil, nil)
+    cc.routes = append(cc.routes, live.static_route.getCopy())
+    cmap := &callMap{
+        global_config   : cfg,
+        ccmap           : map[int64]*callController{ 7 : cc },
+        stats           : newCallStats(time.Now()),
+    }
+    var details callDetails
+    if err := json.Unmarshal([]byte(cmap.recvCommand("json show call 7")), &details); err != nil {
+        t.Fatal(err)
+    }
+    if details.Id != 7 || details.State != "Idle" || details.Source != "10.0.0.1:5060" || details.A == nil ||
+      details.O != nil || len(details.Routes) != 1 || details.Routes[0].Hostport != "192.0.2.1" {
+        t.Errorf("unexpected details: %+v", details)
+    }
+    res := cmap.recvCommand("show call 7")
+    if ! strings.HasPrefix(res, "Call 7:  Idle\nSource: 10.0.0.1:5060") || ! strings.Contains(res, "O leg: N/A\n") {
+        t.Errorf("unexpected text output: %q", res)
+    }
+    if res := cmap.recvCommand("l source=10.0.0.0/8"); ! strings.HasSuffix(res, "Total: 1\n") {
+        t.Errorf("the call has not been found: %q", res)
+    }
+    if res := cmap.recvCommand("l source=192.168.0.0/16"); ! strings.HasSuffix(res, "Total: 0\n") {
+        t.Errorf("the call has been found: %q", res)
+    }
+}
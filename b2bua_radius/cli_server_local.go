@@ -26,17 +26,18 @@
 package main
 
 import (
-    "bufio"
     "net"
     "os"
+    "time"
 
     "sippy/log"
     "sippy/utils"
 )
 
 type Cli_server_local struct {
-    command_cb      func(string) string
+    command_cb      cliCommandCb
     listener        net.Listener
+    idle_timeout    time.Duration
     logger          sippy_log.ErrorLogger
 }
 /*
@@ -49,7 +50,7 @@ from os.path import exists
 class Cli_server_local(Factory):
     command_cb = nil
 */
-func NewCli_server_local(command_cb func(string) string, address string, logger sippy_log.ErrorLogger/*, sock_owner = nil*/) (*Cli_server_local, error) {
+func NewCli_server_local(command_cb cliCommandCb, address string, idle_timeout time.Duration, logger sippy_log.ErrorLogger/*, sock_owner = nil*/) (*Cli_server_local, error) {
     if _, err := os.Stat(address); err == nil {
         err = os.Remove(address)
         if err != nil { return nil, err }
@@ -61,10 +62,10 @@ func NewCli_server_local(command_cb func(string) string, address string, logger
     if err != nil { return nil, err }
 
     self := &Cli_server_local{
-        command_cb  : command_cb,
-//        protocol    : NewCli_session,
-        listener    : listener,
-        logger      : logger,
+        command_cb      : command_cb,
+        listener        : listener,
+        idle_timeout    : idle_timeout,
+        logger          : logger,
     }
     //if address == nil:
     //    address = '/var/run/ccm.sock'
@@ -83,24 +84,13 @@ func (self *Cli_server_local) run() {
         if err != nil {
             break
         }
-        go sippy_utils.SafeCall(func() { self.handle_request(conn) }, nil, self.logger)
+        clim := NewCli_session(conn, self.command_cb, self.idle_timeout, self.logger)
+        go sippy_utils.SafeCall(clim.run, nil, self.logger)
     }
 }
 
-func (self *Cli_server_local) handle_request(conn net.Conn) {
-    defer conn.Close()
-    reader := bufio.NewReader(conn)
-    for {
-        line, err := reader.ReadString('\n')
-        if err != nil {
-            break
-        }
-        res := self.command_cb(line)
-        _, err = conn.Write([]byte(res))
-        if err != nil {
-            break
-        }
-    }
+func (self *Cli_server_local) Shutdown() {
+    self.listener.Close()
 }
 /*
     def buildProtocol(self, addr):
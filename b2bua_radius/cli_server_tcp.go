@@ -25,6 +25,21 @@
 // SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package main
 
+import (
+    "net"
+    "time"
+
+    "sippy/log"
+    "sippy/utils"
+)
+
+type Cli_server_tcp struct {
+    command_cb      cliCommandCb
+    listener        net.Listener
+    accept_list     []*net.IPNet
+    idle_timeout    time.Duration
+    logger          sippy_log.ErrorLogger
+}
 /*
 from twisted.internet.protocol import Factory
 from twisted.internet import reactor
@@ -34,23 +49,68 @@ class Cli_server_tcp(Factory):
     command_cb = nil
     lport = nil
     accept_list = nil
+*/
+// NewCli_server_tcp creates the CLI server listening on the address in
+// the "host:port" format. When the accept_list is not empty the
+// connections from the addresses outside of it are dropped.
+func NewCli_server_tcp(command_cb cliCommandCb, address string, accept_list []*net.IPNet, idle_timeout time.Duration, logger sippy_log.ErrorLogger) (*Cli_server_tcp, error) {
+    listener, err := net.Listen("tcp", address)
+    if err != nil { return nil, err }
 
-    def __init__(self, command_cb, address):
-        self.command_cb = command_cb
-        self.protocol = Cli_session
-        self.lport = reactor.listenTCP(address[1], self, interface = address[0])
+    self := &Cli_server_tcp{
+        command_cb      : command_cb,
+        listener        : listener,
+        accept_list     : accept_list,
+        idle_timeout    : idle_timeout,
+        logger          : logger,
+    }
+    return self, nil
+}
 
-    def buildProtocol(self, addr):
-        if self.accept_list != nil and addr.host not in self.accept_list:
-            return nil
-        p = Factory.buildProtocol(self, addr)
-        p.command_cb = self.command_cb
-        p.raddr = addr
-        return p
+func (self *Cli_server_tcp) Start() {
+    go self.run()
+}
 
-    def shutdown(self):
-        self.lport.stopListening()
+func (self *Cli_server_tcp) run() {
+    for {
+        conn, err := self.listener.Accept()
+        if err != nil {
+            break
+        }
+        if ! self.accepted(conn.RemoteAddr()) {
+            self.logger.Debug("Cli_server_tcp: connection from " + conn.RemoteAddr().String() + " rejected")
+            conn.Close()
+            continue
+        }
+        clim := NewCli_session(conn, self.command_cb, self.idle_timeout, self.logger)
+        go sippy_utils.SafeCall(clim.run, nil, self.logger)
+    }
+}
 
+func (self *Cli_server_tcp) accepted(addr net.Addr) bool {
+    if len(self.accept_list) == 0 {
+        return true
+    }
+    taddr, ok := addr.(*net.TCPAddr)
+    if ! ok {
+        return false
+    }
+    for _, ipnet := range self.accept_list {
+        if ipnet.Contains(taddr.IP) {
+            return true
+        }
+    }
+    return false
+}
+
+func (self *Cli_server_tcp) GetLaddress() net.Addr {
+    return self.listener.Addr()
+}
+
+func (self *Cli_server_tcp) Shutdown() {
+    self.listener.Close()
+}
+/*
 if __name__ == '__main__':
     def callback(clm, cmd):
         print cmd
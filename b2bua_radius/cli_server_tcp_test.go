@@ -0,0 +1,143 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "bufio"
+    "io"
+    "net"
+    "strings"
+    "testing"
+    "time"
+
+    "sippy/log"
+)
+
+func testCliCommand(clim *Cli_session, cmd string) bool {
+    switch {
+    case cmd == "q":
+        clim.Close()
+    case cmd == "slow":
+        // Complete the command asynchronously
+        go func() {
+            time.Sleep(50 * time.Millisecond)
+            clim.Send("slow done\n")
+            clim.Done()
+        }()
+        return true
+    case strings.HasPrefix(cmd, "echo "):
+        clim.Send(cmd[5:] + "\n")
+    }
+    return false
+}
+
+func startTestCliServer(t *testing.T, accept_list string, idle_timeout time.Duration) *Cli_server_tcp {
+    var acl []*net.IPNet
+    if accept_list != "" {
+        ipnet, err := parseIPNet(accept_list)
+        if err != nil {
+            t.Fatal(err)
+        }
+        acl = append(acl, ipnet)
+    }
+    cli_server, err := NewCli_server_tcp(testCliCommand, "127.0.0.1:0", acl, idle_timeout, sippy_log.NewErrorLogger())
+    if err != nil {
+        t.Fatal(err)
+    }
+    cli_server.Start()
+    return cli_server
+}
+
+func TestCliServerTcp(t *testing.T) {
+    cli_server := startTestCliServer(t, "127.0.0.0/8", 0)
+    defer cli_server.Shutdown()
+    conn, err := net.Dial("tcp", cli_server.GetLaddress().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+    // The commands are processed in order even if the input arrives at once
+    if _, err = conn.Write([]byte("slow\n\necho 1\r\necho 2\n")); err != nil {
+        t.Fatal(err)
+    }
+    reader := bufio.NewReader(conn)
+    for _, expect := range []string{ "slow done\n", "1\n", "2\n" } {
+        line, err := reader.ReadString('\n')
+        if err != nil {
+            t.Fatal(err)
+        }
+        if line != expect {
+            t.Errorf("expected %q, got %q", expect, line)
+        }
+    }
+    if _, err = conn.Write([]byte("q\necho 3\n")); err != nil {
+        t.Fatal(err)
+    }
+    if line, err := reader.ReadString('\n'); err != io.EOF {
+        t.Errorf("the session has not been closed, got %q", line)
+    }
+}
+
+func TestCliServerTcpAcceptList(t *testing.T) {
+    cli_server := startTestCliServer(t, "192.0.2.0/24", 0)
+    defer cli_server.Shutdown()
+    conn, err := net.Dial("tcp", cli_server.GetLaddress().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+    conn.Write([]byte("echo 1\n"))
+    if _, err = bufio.NewReader(conn).ReadString('\n'); err == nil {
+        t.Error("the connection from outside of the accept_list has been served")
+    }
+}
+
+func TestCliSessionIdleTimeout(t *testing.T) {
+    cli_server := startTestCliServer(t, "", 100 * time.Millisecond)
+    defer cli_server.Shutdown()
+    conn, err := net.Dial("tcp", cli_server.GetLaddress().String())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+    reader := bufio.NewReader(conn)
+    if _, err = conn.Write([]byte("echo 1\n")); err != nil {
+        t.Fatal(err)
+    }
+    if line, err := reader.ReadString('\n'); err != nil || line != "1\n" {
+        t.Fatalf("unexpected reply %q, %v", line, err)
+    }
+    start := time.Now()
+    if _, err = reader.ReadString('\n'); err != io.EOF {
+        t.Errorf("the idle session has not been closed: %v", err)
+    }
+    if time.Since(start) > 2 * time.Second {
+        t.Error("the idle session has been closed too late")
+    }
+}
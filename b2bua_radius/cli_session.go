@@ -25,6 +25,48 @@
 // (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
 // SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package main
+
+import (
+    "bufio"
+    "net"
+    "strings"
+    "sync"
+    "time"
+
+    "sippy/log"
+    "sippy/utils"
+)
+
+// cliCommandCb processes a single command. It returns true when the
+// command has not been completed yet, in that case the session does not
+// process any further input until Done() is called.
+type cliCommandCb func(*Cli_session, string) bool
+
+// syncCommandCb adapts a synchronous command handler to cliCommandCb. The
+// result is sent back to the client, an empty result closes the session.
+func syncCommandCb(command_cb func(string) string) cliCommandCb {
+    return func(clim *Cli_session, cmd string) bool {
+        res := command_cb(cmd)
+        if res == "" {
+            clim.Close()
+        } else {
+            clim.Send(res)
+        }
+        return false
+    }
+}
+
+type Cli_session struct {
+    conn            net.Conn
+    command_cb      cliCommandCb
+    idle_timeout    time.Duration
+    logger          sippy_log.ErrorLogger
+    raddr           net.Addr
+    wlock           sync.Mutex
+    done_ch         chan bool
+    close_ch        chan bool
+    close_once      sync.Once
+}
 /*
 from twisted.internet.protocol import Protocol
 import sys, traceback
@@ -44,7 +86,57 @@ class Cli_session(Protocol):
     #def connectionMade(self):
     #    print self.transport.getPeer()
     #    self.transport.loseConnection()
+*/
+func NewCli_session(conn net.Conn, command_cb cliCommandCb, idle_timeout time.Duration, logger sippy_log.ErrorLogger) *Cli_session {
+    return &Cli_session{
+        conn            : conn,
+        command_cb      : command_cb,
+        idle_timeout    : idle_timeout,
+        logger          : logger,
+        raddr           : conn.RemoteAddr(),
+        done_ch         : make(chan bool, 1),
+        close_ch        : make(chan bool),
+    }
+}
 
+// run reads the commands line by line and passes them to the command
+// callback one at a time until the connection is closed or stays idle
+// for longer than idle_timeout.
+func (self *Cli_session) run() {
+    defer self.Close()
+    reader := bufio.NewReader(self.conn)
+    for {
+        if self.idle_timeout > 0 {
+            self.conn.SetReadDeadline(time.Now().Add(self.idle_timeout))
+        }
+        line, err := reader.ReadString('\n')
+        if err != nil {
+            if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+                self.logger.Debug("Cli_session: idle timeout, closing connection from " + self.raddr.String())
+            }
+            return
+        }
+        cmd := strings.TrimSpace(line)
+        if len(cmd) == 0 {
+            continue
+        }
+        cb_busy := false
+        sippy_utils.SafeCall(func() { cb_busy = self.command_cb(self, cmd) }, nil, self.logger)
+        if cb_busy {
+            select {
+            case <-self.done_ch:
+            case <-self.close_ch:
+                return
+            }
+        }
+        select {
+        case <-self.close_ch:
+            return
+        default:
+        }
+    }
+}
+/*
     def dataReceived(self, data):
 	#print 'Cli_session::dataReceived', self, data
         if len(data) == 0:
@@ -71,16 +163,31 @@ class Cli_session(Protocol):
                     print '-' * 70
                     traceback.print_exc(file = sys.stdout)
                     print '-' * 70
+*/
 
-    def done(self):
-        self.cb_busy = false
-        self.pump_rxdata()
+// Done signals that the command the callback has returned true for is
+// complete and the session can proceed with the next one.
+func (self *Cli_session) Done() {
+    select {
+    case self.done_ch <- true:
+    default:
+    }
+}
 
-    def send(self, data):
-        if isinstance(data, unicode):
-            data = data.encode('ascii')
-        return self.transport.write(data)
+func (self *Cli_session) Send(data string) error {
+    self.wlock.Lock()
+    defer self.wlock.Unlock()
+    _, err := self.conn.Write([]byte(data))
+    return err
+}
 
-    def close(self):
-        return self.transport.loseConnection()
-*/
+func (self *Cli_session) Close() {
+    self.close_once.Do(func() {
+        close(self.close_ch)
+        self.conn.Close()
+    })
+}
+
+func (self *Cli_session) GetRemoteAddr() net.Addr {
+    return self.raddr
+}
@@ -0,0 +1,211 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "bufio"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "strings"
+)
+
+// Single letter command line options that are aliases of the long ones.
+// The options not listed here (-A, -D, -k, -W) have no long counterpart
+// and cannot be set from the config file.
+var short_options = map[string]string{
+    "C" : "config",
+    "F" : "allowed_pts",
+    "H" : "hide_call_id",
+    "L" : "logfile",
+    "M" : "max_radiusclients",
+    "P" : "pidfile",
+    "R" : "radiusclient.conf",
+    "T" : "static_tr_out",
+    "a" : "accept_ips",
+    "c" : "b2bua_socket",
+    "f" : "foreground",
+    "h" : "pass_header",
+    "l" : "sip_address",
+    "m" : "max_credit_time",
+    "p" : "sip_port",
+    "r" : "rtp_proxy_client",
+    "s" : "static_route",
+    "t" : "static_tr_in",
+}
+
+// Options that may appear several times in the config file, every
+// occurence adds one more element to the list.
+var list_options = map[string]bool{
+    "pass_header"       : true,
+    "rtp_proxy_client"  : true,
+}
+
+// Options that are never read from or written to the config file.
+var cmdline_only_options = map[string]bool{
+    "config"            : true,
+}
+
+type configOption struct {
+    line    int
+    name    string
+    value   string
+}
+
+// parseConfigFile reads the file in the RawConfigParser format. All the
+// options live in the [general] section, the other sections are ignored.
+func parseConfigFile(r io.Reader) ([]*configOption, error) {
+    ret := []*configOption{}
+    scanner := bufio.NewScanner(r)
+    section := "general"
+    line := 0
+    for scanner.Scan() {
+        line++
+        s := strings.TrimSpace(scanner.Text())
+        if s == "" || s[0] == '#' || s[0] == ';' {
+            continue
+        }
+        if s[0] == '[' {
+            if s[len(s) - 1] != ']' {
+                return nil, fmt.Errorf("line %d: malformed section header", line)
+            }
+            section = strings.TrimSpace(s[1:len(s) - 1])
+            continue
+        }
+        if section != "general" {
+            continue
+        }
+        idx := strings.IndexAny(s, "=:")
+        if idx <= 0 {
+            return nil, fmt.Errorf("line %d: 'name = value' expected", line)
+        }
+        ret = append(ret, &configOption{
+            line    : line,
+            name    : strings.ToLower(strings.TrimSpace(s[:idx])),
+            value   : strings.TrimSpace(s[idx + 1:]),
+        })
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, err
+    }
+    return ret, nil
+}
+
+func isConfigOption(f *flag.Flag) bool {
+    return len(f.Name) > 1 && ! cmdline_only_options[f.Name]
+}
+
+func configBool(value string) (string, bool) {
+    switch strings.ToLower(value) {
+    case "1", "yes", "true", "on":
+        return "true", true
+    case "0", "no", "false", "off":
+        return "false", true
+    }
+    return "", false
+}
+
+// applyConfigFile sets the options found in the file unless they have been
+// already given on the command line.
+func applyConfigFile(fs *flag.FlagSet, r io.Reader) error {
+    opts, err := parseConfigFile(r)
+    if err != nil {
+        return err
+    }
+    cmdline := map[string]bool{}
+    fs.Visit(func(f *flag.Flag) {
+        if name, ok := short_options[f.Name]; ok {
+            cmdline[name] = true
+        } else {
+            cmdline[f.Name] = true
+        }
+    })
+    seen := map[string]bool{}
+    for _, opt := range opts {
+        f := fs.Lookup(opt.name)
+        if f == nil || ! isConfigOption(f) {
+            return fmt.Errorf("line %d: unknown option '%s'", opt.line, opt.name)
+        }
+        value := opt.value
+        if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && bf.IsBoolFlag() {
+            if value, ok = configBool(opt.value); ! ok {
+                return fmt.Errorf("line %d: %s: not a boolean: '%s'", opt.line, opt.name, opt.value)
+            }
+        }
+        if cmdline[opt.name] {
+            continue
+        }
+        if list_options[opt.name] && seen[opt.name] {
+            value = f.Value.String() + "," + value
+        }
+        seen[opt.name] = true
+        if err = fs.Set(opt.name, value); err != nil {
+            return fmt.Errorf("line %d: %s: %s", opt.line, opt.name, err.Error())
+        }
+    }
+    return nil
+}
+
+func loadConfigFile(fs *flag.FlagSet, fname string) error {
+    fd, err := os.Open(fname)
+    if err != nil {
+        return err
+    }
+    defer fd.Close()
+    if err = applyConfigFile(fs, fd); err != nil {
+        return fmt.Errorf("%s: %s", fname, err.Error())
+    }
+    return nil
+}
+
+// writeConfig dumps the effective configuration in the format understood
+// by the -config option.
+func writeConfig(fs *flag.FlagSet, w io.Writer) error {
+    if _, err := fmt.Fprintln(w, "[general]"); err != nil {
+        return err
+    }
+    var err error
+    fs.VisitAll(func(f *flag.Flag) {
+        if err != nil || ! isConfigOption(f) {
+            return
+        }
+        _, err = fmt.Fprintf(w, "%s = %s\n", f.Name, f.Value.String())
+    })
+    return err
+}
+
+func (self *myConfigParser) WriteConf() error {
+    fd, err := os.Create(self.writeconf)
+    if err != nil {
+        return err
+    }
+    err = writeConfig(self.flags, fd)
+    if cerr := fd.Close(); err == nil {
+        err = cerr
+    }
+    return err
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "bytes"
+    "flag"
+    "strings"
+    "testing"
+)
+
+type testConfig struct {
+    sip_port        int
+    logfile         string
+    pass_header     string
+    config          string
+    hide_call_id    bool
+}
+
+func newTestFlagSet(cfg *testConfig) *flag.FlagSet {
+    fs := flag.NewFlagSet("test", flag.ContinueOnError)
+    fs.StringVar(&cfg.config, "C", "", "")
+    fs.StringVar(&cfg.config, "config", "", "")
+    fs.IntVar(&cfg.sip_port, "p", 5060, "")
+    fs.IntVar(&cfg.sip_port, "sip_port", 5060, "")
+    fs.StringVar(&cfg.logfile, "logfile", "/var/log/sip.log", "")
+    fs.StringVar(&cfg.pass_header, "pass_header", "", "")
+    fs.BoolVar(&cfg.hide_call_id, "hide_call_id", false, "")
+    return fs
+}
+
+func TestConfigFile(t *testing.T) {
+    cfg := &testConfig{}
+    fs := newTestFlagSet(cfg)
+    if err := fs.Parse([]string{ "-p", "5070" }); err != nil {
+        t.Fatal(err)
+    }
+    err := applyConfigFile(fs, strings.NewReader(`
+# comment
+[general]
+sip_port = 5080
+logfile: /tmp/b2bua.log
+pass_header = X-Foo
+pass_header = X-Bar
+hide_call_id = yes
+[other]
+foo = bar
+`))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if cfg.sip_port != 5070 {
+        t.Errorf("the command line option has been overridden: %d", cfg.sip_port)
+    }
+    if cfg.logfile != "/tmp/b2bua.log" || cfg.pass_header != "X-Foo,X-Bar" || ! cfg.hide_call_id {
+        t.Errorf("unexpected values: %s %s %v", cfg.logfile, cfg.pass_header, cfg.hide_call_id)
+    }
+    for _, s := range []string{ "foo = bar\n", "hide_call_id = maybe\n", "sip_port = x\n", "p = 1\n", "config = x\n", "sip_port\n", "[general\n" } {
+        if err := applyConfigFile(newTestFlagSet(&testConfig{}), strings.NewReader(s)); err == nil {
+            t.Errorf("'%s' should have failed", strings.TrimSpace(s))
+        }
+    }
+    buf := bytes.NewBuffer(nil)
+    if err := writeConfig(fs, buf); err != nil {
+        t.Fatal(err)
+    }
+    expected := "[general]\nhide_call_id = true\nlogfile = /tmp/b2bua.log\npass_header = X-Foo,X-Bar\nsip_port = 5070\n"
+    if buf.String() != expected {
+        t.Errorf("unexpected config dump:\n%s", buf.String())
+    }
+}
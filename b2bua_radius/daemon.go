@@ -0,0 +1,88 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "strconv"
+    "strings"
+    "syscall"
+)
+
+// readPidFile returns the PID stored in the file if the process with
+// that PID is still running and is not us.
+func readPidFile(fname string) int {
+    buf, err := ioutil.ReadFile(fname)
+    if err != nil {
+        return 0
+    }
+    pid, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+    if err != nil || pid <= 0 || pid == os.Getpid() {
+        return 0
+    }
+    if err = syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
+        return 0
+    }
+    return pid
+}
+
+// checkPidFile fails if the pidfile belongs to a running process. The
+// stale pidfiles left after a crash are ignored.
+func checkPidFile(fname string) error {
+    if pid := readPidFile(fname); pid != 0 {
+        return fmt.Errorf("%s: another instance is already running with PID %d", fname, pid)
+    }
+    return nil
+}
+
+func writePidFile(fname string) error {
+    if err := checkPidFile(fname); err != nil {
+        return err
+    }
+    tmp := fname + ".tmp"
+    if err := ioutil.WriteFile(tmp, []byte(strconv.Itoa(os.Getpid()) + "\n"), 0644); err != nil {
+        return err
+    }
+    if err := os.Rename(tmp, fname); err != nil {
+        os.Remove(tmp)
+        return err
+    }
+    return nil
+}
+
+// removePidFile removes the pidfile unless it has been taken over by
+// another instance.
+func removePidFile(fname string) {
+    buf, err := ioutil.ReadFile(fname)
+    if err != nil {
+        return
+    }
+    if pid, _ := strconv.Atoi(strings.TrimSpace(string(buf))); pid == os.Getpid() {
+        os.Remove(fname)
+    }
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strconv"
+    "testing"
+)
+
+func TestPidFile(t *testing.T) {
+    dir, err := ioutil.TempDir("", "pidfile")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    fname := filepath.Join(dir, "b2bua.pid")
+    if err = writePidFile(fname); err != nil {
+        t.Fatal(err)
+    }
+    if readPidFile(fname) != 0 {
+        t.Error("our own pidfile should not be reported as another instance")
+    }
+    // The pidfile of a running process
+    if err = ioutil.WriteFile(fname, []byte(strconv.Itoa(os.Getppid()) + "\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err = checkPidFile(fname); err == nil {
+        t.Error("the running instance has not been detected")
+    }
+    removePidFile(fname)
+    if _, err = os.Stat(fname); err != nil {
+        t.Error("the pidfile of another instance has been removed")
+    }
+    // The stale pidfile
+    if err = ioutil.WriteFile(fname, []byte("999999999\n"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err = writePidFile(fname); err != nil {
+        t.Fatal(err)
+    }
+    removePidFile(fname)
+    if _, err = os.Stat(fname); ! os.IsNotExist(err) {
+        t.Error("the pidfile has not been removed")
+    }
+}
@@ -0,0 +1,412 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "bufio"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "sippy/headers"
+)
+
+// The nonces are stateless: the hex encoded creation time followed by the
+// HMAC of the time and the realm keyed with the secret generated at the
+// startup. This allows to detect both forged and expired (stale) nonces
+// without keeping any per-client state. The replays are detected by the
+// digestAuth which tracks the nonce counts of the nonces in use.
+type nonceFactory struct {
+    secret          []byte
+    lifetime        time.Duration
+}
+
+func newNonceFactory(lifetime time.Duration) *nonceFactory {
+    self := &nonceFactory{
+        secret          : make([]byte, 32),
+        lifetime        : lifetime,
+    }
+    rand.Read(self.secret)
+    return self
+}
+
+func (self *nonceFactory) sign(ts, realm string) string {
+    mac := hmac.New(sha256.New, self.secret)
+    mac.Write([]byte(ts + ":" + realm))
+    return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+func (self *nonceFactory) New(realm string, now time.Time) string {
+    ts := fmt.Sprintf("%016x", now.UnixNano())
+    return ts + self.sign(ts, realm)
+}
+
+// Returns whether the nonce has been issued by us for the realm and
+// whether it has expired already.
+func (self *nonceFactory) Check(nonce, realm string, now time.Time) (bool, bool) {
+    if len(nonce) <= 16 {
+        return false, false
+    }
+    if ! hmac.Equal([]byte(nonce[16:]), []byte(self.sign(nonce[:16], realm))) {
+        return false, false
+    }
+    issued, ok := nonceIssued(nonce)
+    if ! ok {
+        return false, false
+    }
+    if self.expired(issued, now) {
+        return true, true
+    }
+    return true, false
+}
+
+func (self *nonceFactory) expired(issued, now time.Time) bool {
+    return now.Before(issued) || now.Sub(issued) > self.lifetime
+}
+
+func nonceIssued(nonce string) (time.Time, bool) {
+    if len(nonce) < 16 {
+        return time.Time{}, false
+    }
+    nsec, err := strconv.ParseInt(nonce[:16], 16, 64)
+    if err != nil {
+        return time.Time{}, false
+    }
+    return time.Unix(0, nsec), true
+}
+
+type authRequest struct {
+    username        string
+    remote_ip       string
+    cli             string
+    cld             string
+    method          string
+    call_id         string
+    cGUID           *sippy_header.SipCiscoGUID
+    auth            *sippy_header.SipAuthorization // nil for the IP authentication
+    pass_headers    []sippy_header.SipHeader
+}
+
+// The algorithm of the digest credentials, MD5 when not specified.
+func (self *authRequest) digestAlgorithm() string {
+    if algorithm := self.auth.GetAlgorithm(); algorithm != "" {
+        return algorithm
+    }
+    return "MD5"
+}
+
+type authResult struct {
+    ok              bool
+    // Extra attributes returned by the AAA backend, if any
+    attributes      [][2]string
+}
+
+func (self *authResult) getAttributes(name string) []string {
+    res := []string{}
+    if self == nil {
+        return res
+    }
+    for _, av := range self.attributes {
+        if av[0] == name {
+            res = append(res, av[1])
+        }
+    }
+    return res
+}
+
+// The credential store verifies either the source IP address or the digest
+// credentials of the request. The result_cb is never called from within
+// the Authenticate() itself since the caller holds the session lock.
+type credentialStore interface {
+    Authenticate(req *authRequest, result_cb func(*authResult))
+}
+
+type digestAuth struct {
+    nonces          *nonceFactory
+    store           credentialStore
+    challenge_only  bool
+    challenge_only_nets []*net.IPNet
+    // The highest nonce count seen for each of the nonces that have not
+    // expired yet
+    nc_lock         sync.Mutex
+    nonce_counts    map[string]uint64
+    nc_purged       time.Time
+}
+
+func newDigestAuth(store credentialStore, nonce_lifetime time.Duration, challenge_only bool, challenge_only_ips string) (*digestAuth, error) {
+    self := &digestAuth{
+        nonces          : newNonceFactory(nonce_lifetime),
+        store           : store,
+        challenge_only  : challenge_only,
+        challenge_only_nets : make([]*net.IPNet, 0),
+        nonce_counts    : make(map[string]uint64),
+        nc_purged       : time.Now(),
+    }
+    for _, s := range strings.Split(challenge_only_ips, ",") {
+        s = strings.TrimSpace(s)
+        if s == "" {
+            continue
+        }
+        ipnet, err := parseIPNet(s)
+        if err != nil {
+            return nil, err
+        }
+        self.challenge_only_nets = append(self.challenge_only_nets, ipnet)
+    }
+    return self, nil
+}
+
+// Whether the requests from the source should be challenged right away
+// instead of trying the IP authentication first.
+func (self *digestAuth) ChallengeOnly(source string) bool {
+    if self.challenge_only {
+        return true
+    }
+    ip := net.ParseIP(source)
+    if ip == nil {
+        return false
+    }
+    for _, ipnet := range self.challenge_only_nets {
+        if ipnet.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+func (self *digestAuth) Challenge(realm string, stale bool) *sippy_header.SipWWWAuthenticate {
+    challenge := sippy_header.NewSipWWWAuthenticateWithNonce(realm, self.nonces.New(realm, time.Now()))
+    challenge.SetQop("auth")
+    challenge.SetStale(stale)
+    return challenge
+}
+
+// Returns whether the nonce in the credentials is valid and whether it is
+// stale. The nonce count has to grow with every request made with the
+// same nonce, the replayed credentials are reported as stale so that the
+// client is challenged with a fresh nonce. The credentials without qop
+// carry no nonce count and such nonce can only be used once. The nonce
+// count is only remembered by UpdateNonceCount() once the credentials
+// have been verified, otherwise anyone who has seen the nonce could lock
+// the client out with a bogus high nonce count.
+func (self *digestAuth) CheckNonce(auth *sippy_header.SipAuthorization, realm string) (bool, bool) {
+    if auth.GetRealm() != realm {
+        return false, false
+    }
+    now := time.Now()
+    valid, stale := self.nonces.Check(auth.GetNonce(), realm, now)
+    if ! valid || stale {
+        return valid, stale
+    }
+    nc, ok := nonceCount(auth)
+    if ! ok {
+        return false, false
+    }
+    self.nc_lock.Lock()
+    defer self.nc_lock.Unlock()
+    self.purgeNonceCounts(now)
+    if nc <= self.nonce_counts[auth.GetNonce()] {
+        return true, true
+    }
+    return true, false
+}
+
+// Remember the nonce count of the verified credentials. Returns false when
+// the same or a higher count has been used in the meantime, i.e. the
+// request is a replay that has raced with the original.
+func (self *digestAuth) UpdateNonceCount(auth *sippy_header.SipAuthorization) bool {
+    nc, ok := nonceCount(auth)
+    if ! ok {
+        return false
+    }
+    self.nc_lock.Lock()
+    defer self.nc_lock.Unlock()
+    if nc <= self.nonce_counts[auth.GetNonce()] {
+        return false
+    }
+    self.nonce_counts[auth.GetNonce()] = nc
+    return true
+}
+
+func nonceCount(auth *sippy_header.SipAuthorization) (uint64, bool) {
+    if auth.GetQop() == "" {
+        return 1, true
+    }
+    nc, err := strconv.ParseUint(auth.GetNc(), 16, 32)
+    if err != nil || nc == 0 {
+        return 0, false
+    }
+    return nc, true
+}
+
+// Forget the nonce counts of the expired nonces. The expired nonces are
+// rejected as stale anyway.
+func (self *digestAuth) purgeNonceCounts(now time.Time) {
+    if now.Sub(self.nc_purged) < self.nonces.lifetime {
+        return
+    }
+    self.nc_purged = now
+    for nonce := range self.nonce_counts {
+        if issued, ok := nonceIssued(nonce); ! ok || self.nonces.expired(issued, now) {
+            delete(self.nonce_counts, nonce)
+        }
+    }
+}
+
+// The file based credential store. Each line of the file is one of:
+//
+//     user:<username>:<password>
+//     ha1:<username>:<HA1>
+//     ip:<address or CIDR>
+//
+// where the HA1 is MD5(username:realm:password) as hex string. Lines
+// starting with "#" are ignored.
+type fileCredentialStore struct {
+    fname           string
+    lock            sync.Mutex
+    passwords       map[string]string
+    ha1s            map[string]string
+    nets            []*net.IPNet
+}
+
+func newFileCredentialStore(fname string) (*fileCredentialStore, error) {
+    self := &fileCredentialStore{
+        fname           : fname,
+    }
+    if err := self.Reload(); err != nil {
+        return nil, err
+    }
+    return self, nil
+}
+
+func (self *fileCredentialStore) Reload() error {
+    fd, err := os.Open(self.fname)
+    if err != nil {
+        return errors.New("Error opening the credentials file: " + err.Error())
+    }
+    defer fd.Close()
+    passwords, ha1s, nets, err := parseCredentials(fd)
+    if err != nil {
+        return errors.New("Error parsing the credentials file " + self.fname + ": " + err.Error())
+    }
+    self.lock.Lock()
+    self.passwords, self.ha1s, self.nets = passwords, ha1s, nets
+    self.lock.Unlock()
+    return nil
+}
+
+func parseCredentials(r io.Reader) (map[string]string, map[string]string, []*net.IPNet, error) {
+    passwords := make(map[string]string)
+    ha1s := make(map[string]string)
+    nets := make([]*net.IPNet, 0)
+    scanner := bufio.NewScanner(r)
+    lineno := 0
+    for scanner.Scan() {
+        lineno++
+        line := strings.TrimSpace(scanner.Text())
+        if line == "" || line[0] == '#' {
+            continue
+        }
+        arr := strings.SplitN(line, ":", 2)
+        if len(arr) != 2 {
+            return nil, nil, nil, fmt.Errorf("line %d: malformed entry", lineno)
+        }
+        switch arr[0] {
+        case "user", "ha1":
+            up := strings.SplitN(arr[1], ":", 2)
+            if len(up) != 2 || up[0] == "" {
+                return nil, nil, nil, fmt.Errorf("line %d: malformed %s entry", lineno, arr[0])
+            }
+            if arr[0] == "user" {
+                passwords[up[0]] = up[1]
+            } else {
+                ha1s[up[0]] = strings.ToLower(up[1])
+            }
+        case "ip":
+            ipnet, err := parseIPNet(arr[1])
+            if err != nil {
+                return nil, nil, nil, fmt.Errorf("line %d: %s", lineno, err.Error())
+            }
+            nets = append(nets, ipnet)
+        default:
+            return nil, nil, nil, fmt.Errorf("line %d: unknown entry type '%s'", lineno, arr[0])
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return nil, nil, nil, err
+    }
+    return passwords, ha1s, nets, nil
+}
+
+func (self *fileCredentialStore) Authenticate(req *authRequest, result_cb func(*authResult)) {
+    res := &authResult{ ok : self.authenticate(req) }
+    go result_cb(res)
+}
+
+func (self *fileCredentialStore) authenticate(req *authRequest) bool {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if req.auth == nil {
+        ip := net.ParseIP(req.remote_ip)
+        if ip == nil {
+            return false
+        }
+        for _, ipnet := range self.nets {
+            if ipnet.Contains(ip) {
+                return true
+            }
+        }
+        return false
+    }
+    if password, ok := self.passwords[req.username]; ok {
+        return req.auth.Verify(password, req.method)
+    }
+    if ha1, ok := self.ha1s[req.username]; ok {
+        return req.auth.VerifyHA1(ha1, req.method)
+    }
+    return false
+}
+
+func newCredentialStore(spec string, config *myConfigParser) (credentialStore, error) {
+    switch {
+    case spec == "radius":
+        return newRadiusAuthorisation(config), nil
+    case strings.HasPrefix(spec, "file:"):
+        return newFileCredentialStore(spec[5:])
+    case strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://"):
+        return newHttpAuthorisation(spec, config.auth_http_timeout, config.auth_fallback_route, config)
+    }
+    return nil, errors.New("unknown credential store '" + spec + "'")
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "crypto/md5"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "testing"
+    "time"
+
+    "sippy/headers"
+)
+
+func TestNonceFactory(t *testing.T) {
+    nf := newNonceFactory(time.Minute)
+    now := time.Now()
+    nonce := nf.New("example.com", now)
+    if valid, stale := nf.Check(nonce, "example.com", now.Add(time.Second)); ! valid || stale {
+        t.Errorf("fresh nonce: valid=%v stale=%v", valid, stale)
+    }
+    if valid, stale := nf.Check(nonce, "example.com", now.Add(2 * time.Minute)); ! valid || ! stale {
+        t.Errorf("expired nonce: valid=%v stale=%v", valid, stale)
+    }
+    if valid, _ := nf.Check(nonce, "example.org", now); valid {
+        t.Errorf("nonce accepted for the wrong realm")
+    }
+    if valid, _ := nf.Check(nonce[:len(nonce) - 1] + "x", "example.com", now); valid {
+        t.Errorf("forged nonce accepted")
+    }
+    if valid, _ := newNonceFactory(time.Minute).Check(nonce, "example.com", now); valid {
+        t.Errorf("nonce of the other factory accepted")
+    }
+}
+
+func TestFileCredentialStore(t *testing.T) {
+    ha1 := fmt.Sprintf("%x", md5.Sum([]byte("bob:example.com:secret2")))
+    fd, err := ioutil.TempFile("", "b2bua_credentials")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.Remove(fd.Name())
+    fd.WriteString("# test credentials\nuser:alice:sec:ret\nha1:bob:" + ha1 + "\nip:192.0.2.0/24\n")
+    fd.Close()
+    store, err := newFileCredentialStore(fd.Name())
+    if err != nil {
+        t.Fatal(err)
+    }
+    auth := func(username, password, remote_ip string) bool {
+        req := &authRequest{ username : username, remote_ip : remote_ip, method : "INVITE" }
+        if username != "" {
+            req.auth = sippy_header.NewSipAuthorization("example.com", "0123", "INVITE", "sip:123@example.com", username, password)
+        }
+        res_ch := make(chan bool, 1)
+        store.Authenticate(req, func(res *authResult) { res_ch <- res.ok })
+        return <-res_ch
+    }
+    for _, tc := range []struct{ username, password, remote_ip string; ok bool }{
+        { "alice", "sec:ret", "", true },
+        { "alice", "secret", "", false },
+        { "bob", "secret2", "", true },
+        { "bob", "secret", "", false },
+        { "carol", "secret", "", false },
+        { "", "", "192.0.2.10", true },
+        { "", "", "198.51.100.1", false },
+    } {
+        if ok := auth(tc.username, tc.password, tc.remote_ip); ok != tc.ok {
+            t.Errorf("%s/%s/%s: expected %v, got %v", tc.username, tc.password, tc.remote_ip, tc.ok, ok)
+        }
+    }
+    for _, s := range []string{ "user:alice", "ip:300.0.0.1", "foo:bar", "garbage" } {
+        fd, _ := ioutil.TempFile("", "b2bua_credentials")
+        fd.WriteString(s + "\n")
+        fd.Close()
+        if _, err := newFileCredentialStore(fd.Name()); err == nil {
+            t.Errorf("%s: error expected", s)
+        }
+        os.Remove(fd.Name())
+    }
+}
+
+func TestDigestAuthNonceCount(t *testing.T) {
+    da, err := newDigestAuth(nil, time.Minute, false, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    challenge := da.Challenge("example.com", false)
+    for _, tc := range []struct{ nc int; valid, stale bool }{
+        { 1, true, false },
+        // replayed
+        { 1, true, true },
+        { 2, true, false },
+        { 5, true, false },
+        // out of order
+        { 3, true, true },
+        { 0, false, false },
+    } {
+        auth := sippy_header.NewSipAuthorizationFromChallenge(challenge, "INVITE", "sip:123@example.com", "alice", "secret", tc.nc, "")
+        if valid, stale := da.CheckNonce(auth, "example.com"); valid != tc.valid || stale != tc.stale {
+            t.Errorf("nc %d: expected valid=%v stale=%v, got valid=%v stale=%v", tc.nc, tc.valid, tc.stale, valid, stale)
+        }
+        if tc.valid && ! tc.stale && ! da.UpdateNonceCount(auth) {
+            t.Errorf("nc %d: the nonce count has not been updated", tc.nc)
+        }
+    }
+    // The replay that has been verified concurrently with the original
+    auth := sippy_header.NewSipAuthorizationFromChallenge(challenge, "INVITE", "sip:123@example.com", "alice", "secret", 5, "")
+    if da.UpdateNonceCount(auth) {
+        t.Error("the replayed nonce count has been accepted")
+    }
+    // Without the qop the nonce can only be used once
+    nonce := da.nonces.New("example.com", time.Now())
+    auth = sippy_header.NewSipAuthorization("example.com", nonce, "INVITE", "sip:123@example.com", "alice", "secret")
+    if valid, stale := da.CheckNonce(auth, "example.com"); ! valid || stale {
+        t.Errorf("no qop: valid=%v stale=%v", valid, stale)
+    }
+    da.UpdateNonceCount(auth)
+    if valid, stale := da.CheckNonce(auth, "example.com"); ! valid || ! stale {
+        t.Errorf("no qop replayed: valid=%v stale=%v", valid, stale)
+    }
+    if len(da.nonce_counts) != 2 {
+        t.Errorf("Expected 2 nonces tracked, got %d", len(da.nonce_counts))
+    }
+    da.purgeNonceCounts(time.Now().Add(2 * time.Minute))
+    if len(da.nonce_counts) != 0 {
+        t.Errorf("The expired nonces have not been purged: %d", len(da.nonce_counts))
+    }
+}
+
+// The nonce count of the credentials that fail the verification must not
+// be remembered.
+func TestDigestAuthNonceCountUnverified(t *testing.T) {
+    da, err := newDigestAuth(nil, time.Minute, false, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    challenge := da.Challenge("example.com", false)
+    bogus := sippy_header.NewSipAuthorizationFromChallenge(challenge, "INVITE", "sip:123@example.com", "alice", "wrong", 0xffffffff, "")
+    if valid, stale := da.CheckNonce(bogus, "example.com"); ! valid || stale {
+        t.Fatalf("bogus nc: valid=%v stale=%v", valid, stale)
+    }
+    // The store rejects the credentials and the nonce count is not updated
+    auth := sippy_header.NewSipAuthorizationFromChallenge(challenge, "INVITE", "sip:123@example.com", "alice", "secret", 1, "")
+    if valid, stale := da.CheckNonce(auth, "example.com"); ! valid || stale {
+        t.Errorf("the real client has been locked out: valid=%v stale=%v", valid, stale)
+    }
+}
+
+func TestRadiusDigestAttributes(t *testing.T) {
+    da, err := newDigestAuth(nil, time.Minute, false, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    attributes := func(auth *sippy_header.SipAuthorization) map[string]string {
+        ret := make(map[string]string)
+        for _, av := range radiusDigestAttributes(&authRequest{ username : "alice", method : "INVITE", auth : auth }) {
+            ret[av[0]] = av[1]
+        }
+        return ret
+    }
+    challenge := da.Challenge("example.com", false)
+    challenge.SetAlgorithm("SHA-256")
+    auth := sippy_header.NewSipAuthorizationFromChallenge(challenge, "INVITE", "sip:123@example.com", "alice", "secret", 3, "")
+    attrs := attributes(auth)
+    if attrs["Digest-Algorithm"] != "SHA-256" || attrs["Digest-Qop"] != "auth" || attrs["Digest-Nonce-Count"] != "00000003" ||
+      attrs["Digest-CNonce"] != auth.GetCnonce() || attrs["Digest-CNonce"] == "" || attrs["Digest-Response"] != auth.GetResponse() {
+        t.Errorf("Unexpected digest attributes: %v", attrs)
+    }
+    auth = sippy_header.NewSipAuthorization("example.com", "0123", "INVITE", "sip:123@example.com", "alice", "secret")
+    attrs = attributes(auth)
+    if attrs["Digest-Algorithm"] != "MD5" {
+        t.Errorf("The default algorithm is not MD5: %v", attrs)
+    }
+    if _, ok := attrs["Digest-Qop"]; ok {
+        t.Errorf("The qop is sent for the credentials without it: %v", attrs)
+    }
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "bufio"
+    "io"
+    "os/exec"
+    "strings"
+
+    "sippy/log"
+)
+
+// The external command runs a pool of helper processes. Every request is
+// written to the stdin of a helper as a sequence of lines terminated by an
+// empty line and the reply is read back from the stdout in the same way.
+type externalCommand struct {
+    command         []string
+    work_ch         chan *extWorkItem
+    logger          sippy_log.ErrorLogger
+}
+
+type extWorkItem struct {
+    data            []string
+    result_cb       func([]string)
+}
+
+type extWorker struct {
+    owner           *externalCommand
+    cmd             *exec.Cmd
+    stdin           io.WriteCloser
+    stdout          *bufio.Reader
+}
+
+func newExternalCommand(command []string, max_workers int, logger sippy_log.ErrorLogger) *externalCommand {
+    self := &externalCommand{
+        command         : command,
+        work_ch         : make(chan *extWorkItem, 1000),
+        logger          : logger,
+    }
+    for i := 0; i < max_workers; i++ {
+        w := &extWorker{ owner : self }
+        go w.run()
+    }
+    return self
+}
+
+// Queue the request. The result_cb is called from the worker goroutine,
+// with nil if the helper process has failed.
+func (self *externalCommand) processCommand(data []string, result_cb func([]string)) {
+    select {
+    case self.work_ch <- &extWorkItem{ data : data, result_cb : result_cb }:
+    default:
+        self.logger.Error("externalCommand: the work queue is full, dropping the request")
+        go result_cb(nil)
+    }
+}
+
+func (self *extWorker) run() {
+    for wi := range self.owner.work_ch {
+        res, err := self.process(wi.data)
+        if err != nil {
+            self.owner.logger.Error("externalCommand: error running " + self.owner.command[0] + ": " + err.Error())
+            self.close()
+            res = nil
+        }
+        wi.result_cb(res)
+    }
+}
+
+func (self *extWorker) start() error {
+    var err error
+    self.cmd = exec.Command(self.owner.command[0], self.owner.command[1:]...)
+    if self.stdin, err = self.cmd.StdinPipe(); err != nil {
+        return err
+    }
+    stdout, err := self.cmd.StdoutPipe()
+    if err != nil {
+        return err
+    }
+    self.stdout = bufio.NewReader(stdout)
+    return self.cmd.Start()
+}
+
+func (self *extWorker) close() {
+    if self.cmd == nil {
+        return
+    }
+    if self.stdin != nil {
+        self.stdin.Close()
+    }
+    if self.cmd.Process != nil {
+        self.cmd.Process.Kill()
+        self.cmd.Wait()
+    }
+    self.cmd = nil
+}
+
+func (self *extWorker) process(data []string) ([]string, error) {
+    if self.cmd == nil {
+        if err := self.start(); err != nil {
+            return nil, err
+        }
+    }
+    if _, err := io.WriteString(self.stdin, strings.Join(data, "\n") + "\n\n"); err != nil {
+        return nil, err
+    }
+    res := []string{}
+    for {
+        line, err := self.stdout.ReadString('\n')
+        if err != nil {
+            return nil, err
+        }
+        line = strings.TrimSpace(line)
+        if line == "" {
+            break
+        }
+        res = append(res, line)
+    }
+    return res, nil
+}
@@ -0,0 +1,285 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "crypto/subtle"
+    "encoding/json"
+    "net"
+    "net/http"
+    "net/url"
+    "strings"
+    "time"
+
+    "sippy/headers"
+    "sippy/log"
+)
+
+// httpApi is the HTTP management API, the REST counterpart of the CLI.
+// The replies are the same as of the CLI commands in the JSON mode and the
+// calls are accessed through the same callMap methods, i.e. with the call
+// locked. Every request has to carry the token in the Authorization
+// header.
+//
+//  GET    /api/calls[?cld=&cli=&source=]   list the calls ("l")
+//  GET    /api/calls/{id}                  call details ("show call")
+//  DELETE /api/calls/{id}                  disconnect the call
+//  POST   /api/calls/{id}/record           start recording the call media
+//  POST   /api/calls/{id}/transfer         transfer the caller to the "target" URI
+//  GET    /api/stats                       call statistics ("stats")
+//  POST   /api/reload                      reload the configuration ("reload")
+//  GET    /api/rtpproxy                    rtpproxy clients health
+//  GET    /metrics                         Prometheus metrics
+type httpApi struct {
+    cmap            *callMap
+    token           string
+    listener        net.Listener
+    server          *http.Server
+    logger          sippy_log.ErrorLogger
+}
+
+func NewHttpApi(cmap *callMap, address, token string, logger sippy_log.ErrorLogger) (*httpApi, error) {
+    listener, err := net.Listen("tcp", address)
+    if err != nil {
+        return nil, err
+    }
+    self := &httpApi{
+        cmap            : cmap,
+        token           : token,
+        listener        : listener,
+        logger          : logger,
+    }
+    self.server = &http.Server{
+        Handler         : self.authenticate(http.HandlerFunc(self.route)),
+        ReadTimeout     : 10 * time.Second,
+        WriteTimeout    : 30 * time.Second,
+    }
+    return self, nil
+}
+
+func (self *httpApi) Start() {
+    go func() {
+        err := self.server.Serve(self.listener)
+        if err != nil && err != http.ErrServerClosed {
+            self.logger.Error("HTTP API server failed: " + err.Error())
+        }
+    }()
+}
+
+func (self *httpApi) Shutdown() {
+    self.server.Close()
+}
+
+func (self *httpApi) GetLaddress() net.Addr {
+    return self.listener.Addr()
+}
+
+func (self *httpApi) authenticate(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+        if subtle.ConstantTimeCompare([]byte(token), []byte(self.token)) != 1 {
+            w.Header().Set("WWW-Authenticate", "Bearer")
+            self.reply(w, http.StatusUnauthorized, cliError("invalid token"))
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+func (self *httpApi) route(w http.ResponseWriter, r *http.Request) {
+    // The Call-ID may contain the slash so split the escaped path
+    path := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+    for i := range path {
+        path[i], _ = url.PathUnescape(path[i])
+    }
+    if len(path) == 1 && path[0] == "metrics" {
+        if r.Method != "GET" {
+            w.Header().Set("Allow", "GET")
+            self.reply(w, http.StatusMethodNotAllowed, cliError("method not allowed"))
+            return
+        }
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+        w.Write(self.cmap.metrics().Bytes())
+        return
+    }
+    if len(path) < 2 || path[0] != "api" {
+        self.reply(w, http.StatusNotFound, cliError("not found"))
+        return
+    }
+    var handler func(http.ResponseWriter, *http.Request, string)
+    var method string
+    switch {
+    case len(path) == 2 && path[1] == "calls":
+        method, handler = "GET", self.listCalls
+    case len(path) == 3 && path[1] == "calls" && r.Method == "DELETE":
+        method, handler = "DELETE", self.disconnectCall
+    case len(path) == 3 && path[1] == "calls":
+        method, handler = "GET", self.showCall
+    case len(path) == 4 && path[1] == "calls" && path[3] == "record":
+        method, handler = "POST", self.recordCall
+    case len(path) == 4 && path[1] == "calls" && path[3] == "transfer":
+        method, handler = "POST", self.transferCall
+    case len(path) == 2 && path[1] == "stats":
+        method, handler = "GET", self.stats
+    case len(path) == 2 && path[1] == "reload":
+        method, handler = "POST", self.reload
+    case len(path) == 2 && path[1] == "rtpproxy":
+        method, handler = "GET", self.rtpproxy
+    default:
+        self.reply(w, http.StatusNotFound, cliError("not found"))
+        return
+    }
+    if r.Method != method {
+        w.Header().Set("Allow", method)
+        self.reply(w, http.StatusMethodNotAllowed, cliError("method not allowed"))
+        return
+    }
+    id := ""
+    if len(path) > 2 {
+        id = path[2]
+    }
+    handler(w, r, id)
+}
+
+func (self *httpApi) reply(w http.ResponseWriter, code int, reply cliReply) {
+    buf, err := json.Marshal(reply)
+    if err != nil {
+        code = http.StatusInternalServerError
+        buf, _ = json.Marshal(cliError(err.Error()))
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(code)
+    w.Write(append(buf, '\n'))
+}
+
+// Returns the call the request is for, replies with 404 if there is no
+// such call.
+func (self *httpApi) call(w http.ResponseWriter, id string) *callController {
+    cc := self.cmap.findCall(id)
+    if cc == nil {
+        self.reply(w, http.StatusNotFound, cliError("no call with id of " + id + " has been found"))
+    }
+    return cc
+}
+
+func (self *httpApi) listCalls(w http.ResponseWriter, r *http.Request, id string) {
+    args := []string{}
+    for _, name := range []string{ "cld", "cli", "source" } {
+        if value := r.URL.Query().Get(name); value != "" {
+            args = append(args, name + "=" + value)
+        }
+    }
+    filter, err := parseCallFilter(args)
+    if err != nil {
+        self.reply(w, http.StatusBadRequest, cliError(err.Error()))
+        return
+    }
+    self.reply(w, http.StatusOK, self.cmap.listCalls(filter))
+}
+
+func (self *httpApi) showCall(w http.ResponseWriter, r *http.Request, id string) {
+    cc := self.call(w, id)
+    if cc == nil {
+        return
+    }
+    var res *callDetails
+    self.cmap.withCall(cc, func() { res = cc.details() })
+    self.reply(w, http.StatusOK, res)
+}
+
+func (self *httpApi) disconnectCall(w http.ResponseWriter, r *http.Request, id string) {
+    cc := self.call(w, id)
+    if cc == nil {
+        return
+    }
+    self.cmap.withCall(cc, func() { cc.disconnect(nil) })
+    self.reply(w, http.StatusOK, cliOK{})
+}
+
+func (self *httpApi) recordCall(w http.ResponseWriter, r *http.Request, id string) {
+    cc := self.call(w, id)
+    if cc == nil {
+        return
+    }
+    var err error
+    self.cmap.withCall(cc, func() { err = cc.startRecording() })
+    if err != nil {
+        self.reply(w, http.StatusConflict, cliError(err.Error()))
+        return
+    }
+    self.reply(w, http.StatusOK, cliOK{})
+}
+
+// The target is taken from either the "target" form value or the JSON
+// body of the {"target": "<SIP URI>"} form.
+func (self *httpApi) transferCall(w http.ResponseWriter, r *http.Request, id string) {
+    target := r.FormValue("target")
+    if target == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+        var body struct {
+            Target  string  `json:"target"`
+        }
+        if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+            self.reply(w, http.StatusBadRequest, cliError("bad request body: " + err.Error()))
+            return
+        }
+        target = body.Target
+    }
+    if target == "" {
+        self.reply(w, http.StatusBadRequest, cliError("the transfer target is not specified"))
+        return
+    }
+    target_url, err := sippy_header.ParseSipURL(target, false, self.cmap.global_config)
+    if err != nil {
+        self.reply(w, http.StatusBadRequest, cliError("bad transfer target: " + err.Error()))
+        return
+    }
+    cc := self.call(w, id)
+    if cc == nil {
+        return
+    }
+    self.cmap.withCall(cc, func() { err = cc.transfer(target_url) })
+    if err != nil {
+        self.reply(w, http.StatusConflict, cliError(err.Error()))
+        return
+    }
+    self.reply(w, http.StatusOK, cliOK{})
+}
+
+func (self *httpApi) stats(w http.ResponseWriter, r *http.Request, id string) {
+    self.reply(w, http.StatusOK, self.cmap.statsStatus())
+}
+
+func (self *httpApi) reload(w http.ResponseWriter, r *http.Request, id string) {
+    if err := self.cmap.reload(0); err != nil {
+        self.reply(w, http.StatusInternalServerError, cliError(err.Error()))
+        return
+    }
+    self.reply(w, http.StatusOK, cliOK{})
+}
+
+func (self *httpApi) rtpproxy(w http.ResponseWriter, r *http.Request, id string) {
+    self.reply(w, http.StatusOK, rtpProxyStatus())
+}
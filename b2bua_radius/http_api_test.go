@@ -0,0 +1,136 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "encoding/json"
+    "io"
+    "net/http"
+    "net/url"
+    "strings"
+    "testing"
+    "time"
+
+    "sippy/conf"
+    "sippy/log"
+)
+
+func TestHttpApi(t *testing.T) {
+    cfg := newTestConfig(t, "-s", "192.0.2.1")
+    live, err := newLiveConfig(cfg, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    setLive(live)
+    source := sippy_conf.NewHostPort("10.0.0.1", "5060")
+    cc := NewCallController(7, source.Host, source, live, nil, nil)
+    cmap := &callMap{
+        global_config   : cfg,
+        ccmap           : map[int64]*callController{ 7 : cc },
+        stats           : newCallStats(time.Now()),
+    }
+    api, err := NewHttpApi(cmap, "127.0.0.1:0", "secret", sippy_log.NewErrorLogger())
+    if err != nil {
+        t.Fatal(err)
+    }
+    api.Start()
+    defer api.Shutdown()
+    base := "http://" + api.GetLaddress().String()
+
+    do := func(method, path, token string, body io.Reader, content_type string, res interface{}) int {
+        req, err := http.NewRequest(method, base + path, body)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if token != "" {
+            req.Header.Set("Authorization", "Bearer " + token)
+        }
+        if content_type != "" {
+            req.Header.Set("Content-Type", content_type)
+        }
+        resp, err := http.DefaultClient.Do(req)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer resp.Body.Close()
+        if res != nil {
+            if err = json.NewDecoder(resp.Body).Decode(res); err != nil {
+                t.Fatalf("%s %s: %s", method, path, err.Error())
+            }
+        }
+        return resp.StatusCode
+    }
+    for _, token := range []string{ "", "wrong" } {
+        for _, path := range []string{ "/api/calls", "/metrics" } {
+            if code := do("GET", path, token, nil, "", nil); code != http.StatusUnauthorized {
+                t.Errorf("%s with token %q: unexpected status %d", path, token, code)
+            }
+        }
+    }
+    var calls callList
+    if code := do("GET", "/api/calls", "secret", nil, "", &calls); code != http.StatusOK || calls.Total != 1 || calls.Calls[0].Id != 7 {
+        t.Errorf("unexpected call list: %d %+v", code, calls)
+    }
+    calls = callList{}
+    if code := do("GET", "/api/calls?source=192.168.0.0/16", "secret", nil, "", &calls); code != http.StatusOK || calls.Total != 0 {
+        t.Errorf("unexpected filtered call list: %d %+v", code, calls)
+    }
+    var reply map[string]string
+    if code := do("GET", "/api/calls?cld=[", "secret", nil, "", &reply); code != http.StatusBadRequest || reply["error"] == "" {
+        t.Errorf("unexpected reply to the bad filter: %d %v", code, reply)
+    }
+    var details callDetails
+    if code := do("GET", "/api/calls/7", "secret", nil, "", &details); code != http.StatusOK || details.Id != 7 || details.Source != "10.0.0.1:5060" {
+        t.Errorf("unexpected call details: %d %+v", code, details)
+    }
+    for _, check := range []struct {
+        method, path, body, content_type string
+        code int
+    }{
+        { "GET", "/api/calls/99", "", "", http.StatusNotFound },
+        { "POST", "/api/calls/7/record", "", "", http.StatusConflict },
+        { "POST", "/api/calls/7/transfer", "", "", http.StatusBadRequest },
+        { "POST", "/api/calls/7/transfer", "{\"target\": \"foo\"}", "application/json", http.StatusBadRequest },
+        { "POST", "/api/calls/7/transfer", "{\"target\": \"sip:1000@192.0.2.5\"}", "application/json", http.StatusConflict },
+        { "POST", "/api/calls/99/transfer", url.Values{ "target" : { "sip:1000@192.0.2.5" } }.Encode(), "application/x-www-form-urlencoded", http.StatusNotFound },
+        { "DELETE", "/api/calls/7", "", "", http.StatusOK },
+        { "PUT", "/api/calls/7", "", "", http.StatusMethodNotAllowed },
+        { "GET", "/metrics", "", "", http.StatusOK },
+        { "POST", "/metrics", "", "", http.StatusMethodNotAllowed },
+    } {
+        if code := do(check.method, check.path, "secret", strings.NewReader(check.body), check.content_type, nil); code != check.code {
+            t.Errorf("%s %s: expected %d, got %d", check.method, check.path, check.code, code)
+        }
+    }
+    var stats statsReply
+    if code := do("GET", "/api/stats", "secret", nil, "", &stats); code != http.StatusOK || stats.Calls != 1 {
+        t.Errorf("unexpected stats: %d %+v", code, stats)
+    }
+    var rtpps rtppList
+    if code := do("GET", "/api/rtpproxy", "secret", nil, "", &rtpps); code != http.StatusOK || rtpps.Rtpproxies == nil {
+        t.Errorf("unexpected rtpproxy list: %d %+v", code, rtpps)
+    }
+}
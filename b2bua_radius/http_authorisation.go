@@ -0,0 +1,195 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "time"
+)
+
+// httpAuthRequest is the body POSTed to the routing webhook.
+type httpAuthRequest struct {
+    CallId          string              `json:"call_id"`
+    Cli             string              `json:"cli"`
+    Cld             string              `json:"cld"`
+    RemoteIp        string              `json:"remote_ip"`
+    Username        string              `json:"username"`
+    Method          string              `json:"method"`
+    ConfId          string              `json:"h323_conf_id,omitempty"`
+    Headers         []httpAuthHeader    `json:"headers"`
+    Digest          *httpAuthDigest     `json:"digest,omitempty"`
+}
+
+type httpAuthHeader struct {
+    Name            string              `json:"name"`
+    Value           string              `json:"value"`
+}
+
+// httpAuthDigest carries the digest credentials of the request for the
+// webhook to verify. The qop, nc and cnonce are only present when the
+// client has used the qop.
+type httpAuthDigest struct {
+    Username        string              `json:"username"`
+    Realm           string              `json:"realm"`
+    Nonce           string              `json:"nonce"`
+    Uri             string              `json:"uri"`
+    Response        string              `json:"response"`
+    Algorithm       string              `json:"algorithm"`
+    Qop             string              `json:"qop,omitempty"`
+    Nc              string              `json:"nc,omitempty"`
+    Cnonce          string              `json:"cnonce,omitempty"`
+}
+
+// httpAuthReply is the webhook response. The routes use the B2BRoute
+// syntax, the credit time is in seconds.
+type httpAuthReply struct {
+    Accept          bool                `json:"accept"`
+    Routes          []string            `json:"routes"`
+    CreditTime      int                 `json:"credit_time"`
+    Cli             string              `json:"cli"`
+    Cnam            string              `json:"cnam"`
+}
+
+// httpAuthorisation is the AAA backend that authorises and routes the
+// calls with a JSON webhook. The reply is converted to the attributes
+// the Radius server would have returned. If the webhook fails the call
+// is routed to the fallback route, or rejected if there is none.
+type httpAuthorisation struct {
+    global_config   *myConfigParser
+    url             string
+    client          *http.Client
+    fallback_route  string
+}
+
+func newHttpAuthorisation(url string, timeout time.Duration, fallback_route string, global_config *myConfigParser) (*httpAuthorisation, error) {
+    if fallback_route != "" {
+        if _, err := NewB2BRoute(fallback_route, global_config); err != nil {
+            return nil, errors.New("Error parsing the fallback route: " + err.Error())
+        }
+    }
+    return &httpAuthorisation{
+        global_config   : global_config,
+        url             : url,
+        client          : &http.Client{ Timeout : timeout },
+        fallback_route  : fallback_route,
+    }, nil
+}
+
+func (self *httpAuthorisation) Authenticate(req *authRequest, result_cb func(*authResult)) {
+    body := &httpAuthRequest{
+        CallId          : req.call_id,
+        Cli             : req.cli,
+        Cld             : req.cld,
+        RemoteIp        : req.remote_ip,
+        Username        : req.username,
+        Method          : req.method,
+        Headers         : make([]httpAuthHeader, 0, len(req.pass_headers)),
+    }
+    if req.cGUID != nil {
+        body.ConfId = req.cGUID.Body()
+    }
+    for _, hdr := range req.pass_headers {
+        body.Headers = append(body.Headers, httpAuthHeader{ Name : hdr.Name(), Value : hdr.Body() })
+    }
+    if req.auth != nil {
+        body.Digest = &httpAuthDigest{
+            Username    : req.username,
+            Realm       : req.auth.GetRealm(),
+            Nonce       : req.auth.GetNonce(),
+            Uri         : req.auth.GetUri(),
+            Response    : req.auth.GetResponse(),
+            Algorithm   : req.digestAlgorithm(),
+        }
+        if qop := req.auth.GetQop(); qop != "" {
+            body.Digest.Qop = qop
+            body.Digest.Nc = req.auth.GetNc()
+            body.Digest.Cnonce = req.auth.GetCnonce()
+        }
+    }
+    go func() {
+        btime := time.Now()
+        reply, err := self.post(body)
+        delay := time.Now().Sub(btime).Seconds()
+        if err != nil {
+            self.global_config.SipLogger().Write(nil, req.call_id, fmt.Sprintf("Error sending AAA request (delay is %.3f): %s\n", delay, err.Error()))
+            self.global_config.ErrorLogger().Error("Routing webhook request failed: " + err.Error())
+            if self.fallback_route == "" {
+                result_cb(&authResult{ ok : false })
+                return
+            }
+            reply = &httpAuthReply{ Accept : true, Routes : []string{ self.fallback_route } }
+        } else if reply.Accept {
+            self.global_config.SipLogger().Write(nil, req.call_id, fmt.Sprintf("AAA request accepted (delay is %.3f)\n", delay))
+        } else {
+            self.global_config.SipLogger().Write(nil, req.call_id, fmt.Sprintf("AAA request rejected (delay is %.3f)\n", delay))
+        }
+        result_cb(reply.authResult())
+    }()
+}
+
+func (self *httpAuthorisation) post(body *httpAuthRequest) (*httpAuthReply, error) {
+    buf, err := json.Marshal(body)
+    if err != nil {
+        return nil, err
+    }
+    self.global_config.SipLogger().Write(nil, body.CallId, "sending AAA request:\n" + string(buf) + "\n")
+    resp, err := self.client.Post(self.url, "application/json", bytes.NewReader(buf))
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode / 100 != 2 {
+        return nil, errors.New("unexpected HTTP status " + resp.Status)
+    }
+    reply := &httpAuthReply{}
+    if err = json.NewDecoder(io.LimitReader(resp.Body, 1 << 20)).Decode(reply); err != nil {
+        return nil, errors.New("malformed reply: " + err.Error())
+    }
+    return reply, nil
+}
+
+func (self *httpAuthReply) authResult() *authResult {
+    res := &authResult{ ok : self.Accept }
+    if self.Cli != "" {
+        res.attributes = append(res.attributes, [2]string{ "h323-ivr-in", "CLI:" + self.Cli })
+    }
+    if self.Cnam != "" {
+        res.attributes = append(res.attributes, [2]string{ "h323-ivr-in", "CNAM:" + self.Cnam })
+    }
+    for _, route := range self.Routes {
+        res.attributes = append(res.attributes, [2]string{ "h323-ivr-in", "Routing:" + route })
+    }
+    if self.CreditTime > 0 {
+        res.attributes = append(res.attributes, [2]string{ "h323-credit-time", strconv.Itoa(self.CreditTime) })
+    }
+    return res
+}
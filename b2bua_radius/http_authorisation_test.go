@@ -0,0 +1,159 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "encoding/json"
+    "io/ioutil"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "reflect"
+    "testing"
+    "time"
+
+    "sippy/conf"
+    "sippy/headers"
+    "sippy/log"
+)
+
+func newTestHttpAuthorisation(t *testing.T, url, fallback_route string) *httpAuthorisation {
+    dir, err := ioutil.TempDir("", "http_auth")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { os.RemoveAll(dir) })
+    sip_logger, err := sippy_log.NewSipLogger("test", filepath.Join(dir, "sip.log"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    cfg := newTestConfig(t)
+    cfg.Config = sippy_conf.NewConfig(sippy_log.NewErrorLogger(), sip_logger)
+    store, err := newHttpAuthorisation(url, 200 * time.Millisecond, fallback_route, cfg)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return store
+}
+
+func httpAuthenticate(store credentialStore, req *authRequest) *authResult {
+    res_ch := make(chan *authResult, 1)
+    store.Authenticate(req, func(res *authResult) { res_ch <- res })
+    return <-res_ch
+}
+
+func TestHttpAuthorisation(t *testing.T) {
+    var got httpAuthRequest
+    var reply string
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != "POST" || r.Header.Get("Content-Type") != "application/json" {
+            t.Errorf("unexpected request: %s %s", r.Method, r.Header.Get("Content-Type"))
+        }
+        got = httpAuthRequest{}
+        json.NewDecoder(r.Body).Decode(&got)
+        w.Write([]byte(reply))
+    }))
+    defer srv.Close()
+    store := newTestHttpAuthorisation(t, srv.URL, "")
+    pass_headers := []sippy_header.SipHeader{ sippy_header.NewSipGenericHF("X-Account", "42") }
+    req := &authRequest{
+        username        : "alice",
+        remote_ip       : "192.0.2.1",
+        cli             : "100",
+        cld             : "200",
+        method          : "INVITE",
+        call_id         : "abc@192.0.2.1",
+        auth            : sippy_header.NewSipAuthorization("example.com", "0123", "INVITE", "sip:200@example.com", "alice", "secret"),
+        pass_headers    : pass_headers,
+    }
+    reply = `{"accept": true, "routes": ["200@192.0.2.2;credit-time=10", "200@192.0.2.3"], "credit_time": 60, "cli": "300", "cnam": "Bob"}`
+    res := httpAuthenticate(store, req)
+    if got.CallId != "abc@192.0.2.1" || got.Cld != "200" || got.RemoteIp != "192.0.2.1" || got.Digest == nil ||
+      got.Digest.Realm != "example.com" || got.Digest.Response != req.auth.GetResponse() ||
+      got.Digest.Algorithm != "MD5" || got.Digest.Qop != "" {
+        t.Errorf("unexpected webhook request: %+v", got)
+    }
+    if expected := []httpAuthHeader{ { "X-Account", "42" } }; ! reflect.DeepEqual(got.Headers, expected) {
+        t.Errorf("expected headers %v, got %v", expected, got.Headers)
+    }
+    if ! res.ok {
+        t.Fatal("the call has been rejected")
+    }
+    expected := [][2]string{
+        { "h323-ivr-in", "CLI:300" }, { "h323-ivr-in", "CNAM:Bob" },
+        { "h323-ivr-in", "Routing:200@192.0.2.2;credit-time=10" }, { "h323-ivr-in", "Routing:200@192.0.2.3" },
+        { "h323-credit-time", "60" },
+    }
+    if ! reflect.DeepEqual(res.attributes, expected) {
+        t.Errorf("expected attributes %v, got %v", expected, res.attributes)
+    }
+    da, err := newDigestAuth(nil, time.Minute, false, "")
+    if err != nil {
+        t.Fatal(err)
+    }
+    challenge := da.Challenge("example.com", false)
+    challenge.SetAlgorithm("SHA-256")
+    req.auth = sippy_header.NewSipAuthorizationFromChallenge(challenge, "INVITE", "sip:200@example.com", "alice", "secret", 2, "")
+    httpAuthenticate(store, req)
+    if got.Digest == nil || got.Digest.Algorithm != "SHA-256" || got.Digest.Qop != "auth" || got.Digest.Nc != "00000002" ||
+      got.Digest.Cnonce == "" || got.Digest.Cnonce != req.auth.GetCnonce() || got.Digest.Response != req.auth.GetResponse() {
+        t.Errorf("unexpected digest with the qop: %+v", got.Digest)
+    }
+    reply = `{"accept": false}`
+    if res = httpAuthenticate(store, &authRequest{ remote_ip : "192.0.2.1", method : "INVITE" }); res.ok {
+        t.Error("the rejected call has been accepted")
+    }
+    if got.Digest != nil {
+        t.Errorf("the digest has been sent for the IP authentication: %+v", got.Digest)
+    }
+}
+
+func TestHttpAuthorisationFallback(t *testing.T) {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Path {
+        case "/slow":
+            time.Sleep(time.Second)
+        case "/error":
+            http.Error(w, "failure", http.StatusInternalServerError)
+            return
+        }
+        w.Write([]byte("not a JSON"))
+    }))
+    defer srv.Close()
+    for _, path := range []string{ "/slow", "/error", "/malformed" } {
+        res := httpAuthenticate(newTestHttpAuthorisation(t, srv.URL + path, "200@192.0.2.9"), &authRequest{})
+        if expected := [][2]string{ { "h323-ivr-in", "Routing:200@192.0.2.9" } }; ! res.ok || ! reflect.DeepEqual(res.attributes, expected) {
+            t.Errorf("%s: expected the fallback route, got %v %v", path, res.ok, res.attributes)
+        }
+        if res = httpAuthenticate(newTestHttpAuthorisation(t, srv.URL + path, ""), &authRequest{}); res.ok {
+            t.Errorf("%s: the call has been accepted without the fallback route", path)
+        }
+    }
+    if _, err := newHttpAuthorisation(srv.URL, time.Second, "200@", newTestConfig(t)); err == nil {
+        t.Error("the malformed fallback route has been accepted")
+    }
+}
@@ -0,0 +1,320 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+    "fmt"
+    "strings"
+    "sync"
+
+    "sippy"
+    "sippy/types"
+)
+
+// The options that are only used when the B2BUA starts. Changing them
+// in the config file has no effect until the restart, see also
+// myConfigParser.keepStartupOptions().
+var restart_options = []string{
+    "auth_enable", "auth_http_fallback_route", "auth_http_timeout",
+    "auth_nonce_lifetime", "auth_store", "b2bua_socket", "cdr_csv", "cdr_json",
+    "cdr_max_files", "cdr_max_size", "cdr_syslog", "cli_accept_list",
+    "cli_idle_timeout", "digest_auth_only", "digest_auth_only_ips",
+    "foreground", "hep_auth_key", "hep_capture_id", "hep_collector",
+    "hep_queue_size", "http_api", "http_api_token", "limit_retry_after",
+    "limit_scode", "log_format", "log_level", "log_syslog", "logfile",
+    "max_calls", "max_cps", "max_radiusclients", "nat_traversal", "pidfile",
+    "radiusclient", "radiusclient.conf", "registrar", "registrar_db",
+    "registrar_max_expires", "registrar_min_expires", "sip_address", "sip_port",
+    "sip_proxy", "source_limits", "trace_dir", "trunks", "xmpp_b2bua_id",
+}
+
+// liveConfig is the part of the configuration that can be replaced while
+// running. Every call takes the current one when it is created and keeps
+// using it until it ends regardless of the reloads.
+type liveConfig struct {
+    config              *myConfigParser
+    static_route        *B2BRoute
+    routing_table       *routingTable
+    acl                 *accessList
+    rtp_proxy_clients   []sippy_types.RtpProxyClient
+    // The calls using the config plus one while it is the current one,
+    // guarded by the global_live_lock
+    refs                int
+}
+
+var global_live *liveConfig
+var global_live_lock sync.Mutex
+
+// The number of the configs in use holding each rtpproxy client. The
+// client dropped by a reload is shut down once the last call using it is
+// gone. Guarded by the global_live_lock.
+var global_rtpp_refs = make(map[sippy_types.RtpProxyClient]int)
+
+func currentLive() *liveConfig {
+    global_live_lock.Lock()
+    defer global_live_lock.Unlock()
+    return global_live
+}
+
+// acquireLive returns the current config for the new call, the call has
+// to release() it when it is gone.
+func acquireLive() *liveConfig {
+    global_live_lock.Lock()
+    defer global_live_lock.Unlock()
+    if global_live != nil {
+        global_live.refs++
+    }
+    return global_live
+}
+
+func (self *liveConfig) release() {
+    if self == nil {
+        return
+    }
+    global_live_lock.Lock()
+    unused := self.unref()
+    global_live_lock.Unlock()
+    shutdownRtpProxyClients(unused)
+}
+
+// Drop the reference to the config and return the rtpproxy clients that
+// are no longer used by any config. Must be called with the
+// global_live_lock held.
+func (self *liveConfig) unref() []sippy_types.RtpProxyClient {
+    self.refs--
+    if self.refs > 0 {
+        return nil
+    }
+    unused := []sippy_types.RtpProxyClient{}
+    for _, rtpp := range self.rtp_proxy_clients {
+        global_rtpp_refs[rtpp]--
+        if global_rtpp_refs[rtpp] <= 0 {
+            delete(global_rtpp_refs, rtpp)
+            unused = append(unused, rtpp)
+        }
+    }
+    return unused
+}
+
+// The clients are released from the rtpproxy reply callbacks, so they are
+// shut down asynchronously not to wait for the worker making the call.
+func shutdownRtpProxyClients(clients []sippy_types.RtpProxyClient) {
+    for _, rtpp := range clients {
+        go rtpp.Shutdown()
+    }
+}
+
+func setLive(live *liveConfig) {
+    global_live_lock.Lock()
+    live.refs++
+    for _, rtpp := range live.rtp_proxy_clients {
+        global_rtpp_refs[rtpp]++
+    }
+    old := global_live
+    global_live = live
+    var unused []sippy_types.RtpProxyClient
+    if old != nil {
+        unused = old.unref()
+    }
+    global_live_lock.Unlock()
+    shutdownRtpProxyClients(unused)
+}
+
+// newLiveConfig builds everything that depends on the config. The rtpproxy
+// clients and the access list limits of the old configuration are reused
+// when the address or the network stays the same, so that the reload does
+// not reset their state.
+func newLiveConfig(config *myConfigParser, old *liveConfig) (*liveConfig, error) {
+    self, err := parseLiveConfig(config)
+    if err != nil {
+        return nil, err
+    }
+    if err = self.startRtpProxyClients(old); err != nil {
+        return nil, err
+    }
+    if old != nil {
+        self.acl.keepLimits(old.acl)
+    }
+    return self, nil
+}
+
+// parseLiveConfig loads the routes and the access list without starting
+// anything, so that the result can be validated and thrown away cheaply.
+func parseLiveConfig(config *myConfigParser) (*liveConfig, error) {
+    var err error
+    self := &liveConfig{
+        config  : config,
+    }
+    if config.static_route != "" {
+        self.static_route, err = NewB2BRoute(config.static_route, config)
+        if err != nil {
+            return nil, errors.New("Error parsing the static route: " + err.Error())
+        }
+    }
+    if config.routing_table != "" {
+        self.routing_table, err = NewRoutingTable(config.routing_table, config)
+        if err != nil {
+            return nil, errors.New("Error loading the routing table: " + err.Error())
+        }
+    }
+    self.acl, err = NewAccessList(config.accept_ips, config.acl, config)
+    if err != nil {
+        return nil, errors.New("Error loading the access list: " + err.Error())
+    }
+    return self, nil
+}
+
+func (self *liveConfig) rtpProxyClientMap() map[string]sippy_types.RtpProxyClient {
+    clients := make(map[string]sippy_types.RtpProxyClient)
+    for i, address := range self.config.rtp_proxy_clients {
+        clients[address] = self.rtp_proxy_clients[i]
+    }
+    return clients
+}
+
+// startRtpProxyClients creates the clients for the new addresses. When one
+// of them cannot be created the ones started so far are shut down.
+func (self *liveConfig) startRtpProxyClients(old *liveConfig) error {
+    old_clients := make(map[string]sippy_types.RtpProxyClient)
+    if old != nil {
+        old_clients = old.rtpProxyClientMap()
+    }
+    started := []sippy_types.RtpProxyClient{}
+    self.rtp_proxy_clients = make([]sippy_types.RtpProxyClient, len(self.config.rtp_proxy_clients))
+    for i, address := range self.config.rtp_proxy_clients {
+        if rtpp, ok := old_clients[address]; ok {
+            self.rtp_proxy_clients[i] = rtpp
+            continue
+        }
+        rtpp, err := newRtpProxyClient(address, self.config)
+        if err != nil {
+            for _, rtpp := range started {
+                rtpp.Shutdown()
+            }
+            return errors.New("Cannot initialize rtpproxy client: " + err.Error())
+        }
+        self.rtp_proxy_clients[i] = rtpp
+        started = append(started, rtpp)
+    }
+    return nil
+}
+
+func newRtpProxyClient(address string, config *myConfigParser) (sippy_types.RtpProxyClient, error) {
+    opts := sippy.NewRtpProxyClientOpts()
+    opts.SetSocketPath(address)
+    opts.SetHeartbeatInterval(config.hrtb_ival)
+    opts.SetHeartbeatRetryInterval(config.hrtb_retr_ival)
+    opts.SetHealthCb(func(rtpc sippy_types.RtpProxyClient, online bool) {
+        if online {
+            config.ErrorLogger().Debug("rtpproxy " + address + " is online")
+        } else {
+            config.ErrorLogger().Error("rtpproxy " + address + " went offline")
+        }
+    })
+    return sippy.NewRtpProxyClient(opts, config, config.ErrorLogger())
+}
+
+func (self *liveConfig) hasRoutes() bool {
+    return self.static_route != nil || self.routing_table != nil || global_aaa_routing || self.acl.hasRoutes()
+}
+
+// restartOptions returns the names of the options that differ between
+// the two configs but cannot be applied without restarting.
+func restartOptions(old, cfg *myConfigParser) ([]string, error) {
+    old_values, err := configValues(old)
+    if err != nil {
+        return nil, err
+    }
+    new_values, err := configValues(cfg)
+    if err != nil {
+        return nil, err
+    }
+    ret := []string{}
+    for _, name := range restart_options {
+        if old_values[name] != new_values[name] {
+            ret = append(ret, name)
+        }
+    }
+    return ret, nil
+}
+
+func configValues(cfg *myConfigParser) (map[string]string, error) {
+    buf := bytes.NewBuffer(nil)
+    if err := writeConfig(cfg.flags, buf); err != nil {
+        return nil, err
+    }
+    ret := make(map[string]string)
+    scanner := bufio.NewScanner(buf)
+    for scanner.Scan() {
+        arr := strings.SplitN(scanner.Text(), " = ", 2)
+        if len(arr) == 2 {
+            ret[arr[0]] = arr[1]
+        }
+    }
+    return ret, nil
+}
+
+// reloadConfig re-reads the config file, the routing table, the access
+// lists and the rtpproxy list. Either all of them are replaced or, in case
+// of any error, none.
+func reloadConfig() error {
+    old := currentLive()
+    cfg, err := old.config.Reload()
+    if err != nil {
+        return err
+    }
+    return swapLive(old, cfg)
+}
+
+func swapLive(old *liveConfig, cfg *myConfigParser) error {
+    changed, err := restartOptions(old.config, cfg)
+    if err != nil {
+        return err
+    }
+    cfg.keepStartupOptions(old.config)
+    live, err := parseLiveConfig(cfg)
+    if err != nil {
+        return err
+    }
+    if live.acl.needsAuth() && global_digest_auth == nil {
+        return errors.New("the access list requires the authentication which has not been enabled at startup")
+    }
+    if ! live.hasRoutes() {
+        return errors.New("static route or routing table should be specified when Radius auth is disabled")
+    }
+    if err = live.startRtpProxyClients(old); err != nil {
+        return err
+    }
+    live.acl.keepLimits(old.acl)
+    for _, name := range changed {
+        cfg.ErrorLogger().Error(fmt.Sprintf("The '%s' option has been changed, the new value is ignored until restart", name))
+    }
+    setLive(live)
+    return nil
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "flag"
+    "io"
+    "testing"
+    "time"
+
+    "sippy/conf"
+    "sippy/log"
+    "sippy/rtpptest"
+    "sippy/types"
+)
+
+func newTestConfig(t *testing.T, args ...string) *myConfigParser {
+    fs := flag.NewFlagSet("test", flag.ContinueOnError)
+    fs.SetOutput(io.Discard)
+    cfg := NewMyConfigParser()
+    if err := cfg.parse(fs, args); err != nil {
+        t.Fatal(err)
+    }
+    cfg.Config = sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+    return cfg
+}
+
+func TestLiveConfigReload(t *testing.T) {
+    cfg := newTestConfig(t, "-s", "192.0.2.1", "-a", "10.0.0.0/8", "-p", "5070")
+    live, err := newLiveConfig(cfg, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    setLive(live)
+    if live.acl.Match("10.1.1.1") == nil || live.acl.Match("192.168.1.1") != nil {
+        t.Error("unexpected access list")
+    }
+    // The broken routing table must not leave anything half-applied
+    if err = swapLive(live, newTestConfig(t, "-s", "192.0.2.2", "-routing_table", "/nonexistent")); err == nil {
+        t.Error("the reload should have failed")
+    }
+    if currentLive() != live {
+        t.Error("the failed reload has replaced the config")
+    }
+    cfg2 := newTestConfig(t, "-s", "192.0.2.2", "-a", "192.168.0.0/16", "-p", "5080")
+    if err = swapLive(live, cfg2); err != nil {
+        t.Fatal(err)
+    }
+    live2 := currentLive()
+    if live2 == live || live2.config != cfg2 {
+        t.Fatal("the config has not been replaced")
+    }
+    if live2.acl.Match("192.168.1.1") == nil || live2.static_route.hostport != "192.0.2.2" {
+        t.Error("the new config has not been applied")
+    }
+    if cfg2.sip_port != 5070 {
+        t.Error("the startup only option has been changed by the reload")
+    }
+    // The calls created before the reload keep their snapshot
+    if live.acl.Match("10.1.1.1") == nil || live.static_route.hostport != "192.0.2.1" {
+        t.Error("the old snapshot has been modified")
+    }
+}
+
+
+func TestLiveConfigReloadRtpProxy(t *testing.T) {
+    rtpps := make([]*sippy_rtpptest.FakeRtpProxy, 3)
+    for i := range rtpps {
+        rtpp, err := sippy_rtpptest.NewFakeRtpProxyUDP("127.0.0.1:0")
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer rtpp.Close()
+        rtpps[i] = rtpp
+    }
+    live, err := newLiveConfig(newTestConfig(t, "-s", "192.0.2.1", "-rtp_proxy_clients",
+        rtpps[0].Address() + "," + rtpps[1].Address()), nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    setLive(live)
+    removed, kept := live.rtp_proxy_clients[0], live.rtp_proxy_clients[1]
+    defer removed.Shutdown()
+    defer kept.Shutdown()
+    // The invalid config must not start any client
+    if err = swapLive(live, newTestConfig(t, "-rtp_proxy_clients", rtpps[2].Address())); err == nil {
+        t.Fatal("the reload without any route should have failed")
+    }
+    time.Sleep(200 * time.Millisecond)
+    if len(rtpps[2].Commands()) != 0 {
+        t.Error("the client has been started by the failed reload")
+    }
+    if err = swapLive(live, newTestConfig(t, "-s", "192.0.2.1", "-rtp_proxy_clients", rtpps[1].Address())); err != nil {
+        t.Fatal(err)
+    }
+    if currentLive().rtp_proxy_clients[0] != kept {
+        t.Error("the client of the same address has not been reused")
+    }
+    replied := func(rtpc sippy_types.RtpProxyClient) bool {
+        ch := make(chan string, 1)
+        rtpc.SendCommand("V", func(res string) { ch <- res }, nil)
+        select {
+        case res := <-ch:
+            // The shut down client replies with the empty result
+            return res != ""
+        case <-time.After(500 * time.Millisecond):
+            return false
+        }
+    }
+    if ! replied(kept) {
+        t.Error("the reused client has stopped working")
+    }
+    if replied(removed) {
+        t.Error("the removed client has not been shut down")
+    }
+}
@@ -0,0 +1,467 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "encoding/csv"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "os"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+
+    "sippy"
+    "sippy/conf"
+    "sippy/headers"
+    "sippy/types"
+)
+
+// The built-in registrar. The REGISTER requests are authenticated with the
+// digest credentials against the configured credential store, unless the
+// access list exempts the source from the authentication, and the
+// bindings are kept in memory keyed by the user part of the To URI. The
+// bindings are optionally persisted into a CSV file with the following
+// columns:
+//
+//     aor,contact,q,expires,call_id,cseq,source
+//
+// where the expires is the UNIX time when the binding expires and the
+// source is the address the REGISTER has been received from. The calls to
+// the registered users are sent to that address so that the clients behind
+// NAT are reachable. The file is rewritten in the background at most once
+// per loc_save_delay so that the bursts of REGISTERs do not hold the lock
+// while the whole database is being written.
+
+const loc_save_delay = time.Second
+
+type locBinding struct {
+    url             *sippy_header.SipURL
+    q               float64
+    expires_at      time.Time
+    call_id         string
+    cseq            int
+    source          *sippy_conf.HostPort
+}
+
+type locationService struct {
+    fname           string
+    bindings        map[string][]*locBinding
+    lock            sync.Mutex
+    save_lock       sync.Mutex
+    save_timer      *sippy.Timeout
+    min_expires     int
+    max_expires     int
+    sip_tm          sippy_types.SipTransactionManager
+    config          sippy_conf.Config
+}
+
+func NewLocationService(fname string, min_expires, max_expires int, config sippy_conf.Config) (*locationService, error) {
+    self := &locationService{
+        fname           : fname,
+        bindings        : make(map[string][]*locBinding),
+        min_expires     : min_expires,
+        max_expires     : max_expires,
+        config          : config,
+    }
+    if fname == "" {
+        return self, nil
+    }
+    fd, err := os.Open(fname)
+    if os.IsNotExist(err) {
+        return self, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    defer fd.Close()
+    self.bindings, err = parseBindings(fd, time.Now(), config)
+    if err != nil {
+        return nil, errors.New(fname + ": " + err.Error())
+    }
+    return self, nil
+}
+
+func parseBindings(r io.Reader, now time.Time, config sippy_conf.Config) (map[string][]*locBinding, error) {
+    reader := csv.NewReader(r)
+    reader.Comment = '#'
+    reader.FieldsPerRecord = 7
+    bindings := make(map[string][]*locBinding)
+    for {
+        record, err := reader.Read()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, err
+        }
+        line, _ := reader.FieldPos(0)
+        url, err := sippy_header.ParseSipURL(record[1], false, config)
+        if err != nil {
+            return nil, fmt.Errorf("line %d: %s", line, err.Error())
+        }
+        q, err := strconv.ParseFloat(record[2], 64)
+        if err != nil {
+            return nil, fmt.Errorf("line %d: bad q '%s'", line, record[2])
+        }
+        expires, err := strconv.ParseInt(record[3], 10, 64)
+        if err != nil {
+            return nil, fmt.Errorf("line %d: bad expires '%s'", line, record[3])
+        }
+        cseq, err := strconv.Atoi(record[5])
+        if err != nil {
+            return nil, fmt.Errorf("line %d: bad cseq '%s'", line, record[5])
+        }
+        host, port, err := net.SplitHostPort(record[6])
+        if err != nil {
+            return nil, fmt.Errorf("line %d: bad source '%s'", line, record[6])
+        }
+        binding := &locBinding{
+            url             : url,
+            q               : q,
+            expires_at      : time.Unix(expires, 0),
+            call_id         : record[4],
+            cseq            : cseq,
+            source          : sippy_conf.NewHostPort(host, port),
+        }
+        if binding.expires_at.After(now) {
+            bindings[record[0]] = append(bindings[record[0]], binding)
+        }
+    }
+    return bindings, nil
+}
+
+// Schedule the database to be written. Must be called with the lock held.
+func (self *locationService) save() {
+    if self.fname == "" || self.save_timer != nil {
+        return
+    }
+    self.save_timer = sippy.StartTimeout(self.Flush, nil, loc_save_delay, 1, self.config.ErrorLogger())
+}
+
+// Write the pending changes into the database now.
+func (self *locationService) Flush() {
+    self.save_lock.Lock()
+    defer self.save_lock.Unlock()
+    self.lock.Lock()
+    if self.save_timer == nil {
+        self.lock.Unlock()
+        return
+    }
+    self.save_timer.Cancel()
+    self.save_timer = nil
+    records := [][]string{}
+    for aor, bindings := range self.bindings {
+        for _, b := range bindings {
+            records = append(records, []string{ aor, b.url.String(), strconv.FormatFloat(b.q, 'f', -1, 64),
+                strconv.FormatInt(b.expires_at.Unix(), 10), b.call_id, strconv.Itoa(b.cseq),
+                net.JoinHostPort(b.source.Host.String(), b.source.Port.String()) })
+        }
+    }
+    self.lock.Unlock()
+    tmp := self.fname + ".tmp"
+    fd, err := os.Create(tmp)
+    if err != nil {
+        self.config.ErrorLogger().Error("Error saving the location database: " + err.Error())
+        return
+    }
+    writer := csv.NewWriter(fd)
+    writer.WriteAll(records)
+    err = writer.Error()
+    if cerr := fd.Close(); err == nil {
+        err = cerr
+    }
+    if err == nil {
+        err = os.Rename(tmp, self.fname)
+    }
+    if err != nil {
+        os.Remove(tmp)
+        self.config.ErrorLogger().Error("Error saving the location database: " + err.Error())
+    }
+}
+
+// Drop the expired bindings of the AOR and return the rest of them.
+func (self *locationService) purge(aor string, now time.Time) []*locBinding {
+    bindings := []*locBinding{}
+    for _, b := range self.bindings[aor] {
+        if b.expires_at.After(now) {
+            bindings = append(bindings, b)
+        }
+    }
+    if len(bindings) == 0 {
+        delete(self.bindings, aor)
+    } else {
+        self.bindings[aor] = bindings
+    }
+    return bindings
+}
+
+func (self *locationService) RecvRequest(req sippy_types.SipRequest, t sippy_types.ServerTransaction) *sippy_types.Ua_context {
+    if req.GetMethod() != "REGISTER" {
+        return &sippy_types.Ua_context{ Response : req.GenResponse(501, "Not Implemented", nil, nil) }
+    }
+    aor := req.GetTo().GetUrl().Username
+    if aor == "" {
+        return &sippy_types.Ua_context{ Response : req.GenResponse(400, "Bad Request", nil, nil) }
+    }
+    source := req.GetSource()
+    if acl := currentLive().acl.Match(source.Host.String()); acl != nil && ! acl.authRequired(true) {
+        // Trusted network
+        return &sippy_types.Ua_context{ Response : self.update(req, aor, source, time.Now()) }
+    }
+    realm := req.GetRURI().Host.String()
+    auth := req.GetSipAuthorization()
+    if auth == nil || auth.GetUsername() == "" {
+        resp := req.GenResponse(401, "Unauthorized", nil, nil)
+        resp.AppendHeader(global_digest_auth.Challenge(realm, false))
+        return &sippy_types.Ua_context{ Response : resp }
+    }
+    valid, stale := global_digest_auth.CheckNonce(auth, realm)
+    if ! valid || stale {
+        resp := req.GenResponse(401, "Unauthorized", nil, nil)
+        resp.AppendHeader(global_digest_auth.Challenge(realm, stale))
+        return &sippy_types.Ua_context{ Response : resp }
+    }
+    if auth.GetUsername() != aor {
+        return &sippy_types.Ua_context{ Response : req.GenResponse(403, "Forbidden", nil, nil) }
+    }
+    areq := &authRequest{
+        username        : aor,
+        remote_ip       : source.Host.String(),
+        cli             : aor,
+        cld             : aor,
+        method          : "REGISTER",
+        call_id         : req.GetCallId().CallId,
+        auth            : auth,
+    }
+    global_digest_auth.store.Authenticate(areq, func(result *authResult) {
+        var resp sippy_types.SipResponse
+        if result.ok && ! global_digest_auth.UpdateNonceCount(auth) {
+            // Replayed while the credentials were being verified
+            resp = req.GenResponse(401, "Unauthorized", nil, nil)
+            resp.AppendHeader(global_digest_auth.Challenge(realm, true))
+        } else if result.ok {
+            resp = self.update(req, aor, source, time.Now())
+        } else {
+            resp = req.GenResponse(403, "Forbidden", nil, nil)
+        }
+        self.sip_tm.SendResponse(resp, /*lock*/ true, nil)
+    })
+    return &sippy_types.Ua_context{}
+}
+
+// Apply the contacts of the authenticated REGISTER request to the bindings
+// of the AOR and generate the response listing the current bindings.
+func (self *locationService) update(req sippy_types.SipRequest, aor string, source *sippy_conf.HostPort, now time.Time) sippy_types.SipResponse {
+    default_expires := self.max_expires
+    if expires, ok := req.GetFirstHF("expires").(*sippy_header.SipExpires); ok {
+        default_expires = expires.Number
+    }
+    call_id, cseq := req.GetCallId().CallId, req.GetCSeq().CSeq
+    contacts := req.GetContacts()
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    bindings := self.purge(aor, now)
+    for _, contact := range contacts {
+        if ! contact.Asterisk {
+            continue
+        }
+        if len(contacts) != 1 || default_expires != 0 {
+            return req.GenResponse(400, "Bad Request", nil, nil)
+        }
+        for _, b := range bindings {
+            if b.call_id == call_id && cseq <= b.cseq {
+                return req.GenResponse(500, "Server Internal Error", nil, nil)
+            }
+        }
+        delete(self.bindings, aor)
+        self.save()
+        return req.GenResponse(200, "OK", nil, nil)
+    }
+    updated := make([]*locBinding, len(bindings))
+    copy(updated, bindings)
+    for _, contact := range contacts {
+        expires := default_expires
+        if s := contact.Address.GetParam("expires"); s != "" {
+            if v, err := strconv.Atoi(s); err == nil {
+                expires = v
+            }
+        }
+        if expires > 0 && expires < self.min_expires {
+            resp := req.GenResponse(423, "Interval Too Brief", nil, nil)
+            resp.AppendHeader(sippy_header.NewSipGenericHF("Min-Expires", strconv.Itoa(self.min_expires)))
+            return resp
+        }
+        if expires > self.max_expires {
+            expires = self.max_expires
+        }
+        q := 1.0
+        if s := contact.Address.GetParam("q"); s != "" {
+            var err error
+            q, err = strconv.ParseFloat(s, 64)
+            if err != nil || q < 0 || q > 1 {
+                return req.GenResponse(400, "Bad Request", nil, nil)
+            }
+        }
+        url := contact.Address.GetUrl()
+        idx := -1
+        for i, b := range updated {
+            if b.url.String() == url.String() {
+                idx = i
+                break
+            }
+        }
+        if idx >= 0 {
+            if updated[idx].call_id == call_id && cseq <= updated[idx].cseq {
+                return req.GenResponse(500, "Server Internal Error", nil, nil)
+            }
+            updated = append(updated[:idx], updated[idx + 1:]...)
+        }
+        if expires <= 0 {
+            continue
+        }
+        updated = append(updated, &locBinding{
+            url             : url.GetCopy(),
+            q               : q,
+            expires_at      : now.Add(time.Duration(expires) * time.Second),
+            call_id         : call_id,
+            cseq            : cseq,
+            source          : source.GetCopy(),
+        })
+    }
+    if len(updated) == 0 {
+        delete(self.bindings, aor)
+    } else {
+        self.bindings[aor] = updated
+    }
+    if len(contacts) > 0 {
+        self.save()
+    }
+    resp := req.GenResponse(200, "OK", nil, nil)
+    for _, b := range updated {
+        addr := sippy_header.NewSipAddress("", b.url.GetCopy())
+        addr.SetParam("expires", strconv.Itoa(int(b.expires_at.Sub(now).Seconds() + 0.5)))
+        addr.SetParam("q", strconv.FormatFloat(b.q, 'f', -1, 64))
+        resp.AppendHeader(sippy_header.NewSipContactFromAddress(addr))
+    }
+    return resp
+}
+
+// Returns the current bindings of the AOR ordered by the q-value with the
+// most preferred first.
+func (self *locationService) Lookup(aor string, now time.Time) []*locBinding {
+    self.lock.Lock()
+    bindings := append([]*locBinding{}, self.purge(aor, now)...)
+    self.lock.Unlock()
+    sort.SliceStable(bindings, func(i, j int) bool { return bindings[i].q > bindings[j].q })
+    return bindings
+}
+
+// Expand the route to the location service into the routes to the
+// registered contacts of the CLD. The contacts with the same q-value are
+// forked in parallel while the less preferred ones are tried in sequence.
+func (self *locationService) Resolve(oroute *B2BRoute, default_cld string, now time.Time) []*B2BRoute {
+    cld := default_cld
+    if oroute.cld_set {
+        cld = oroute.cld
+    }
+    res := []*B2BRoute{}
+    prev_q := 0.0
+    for _, b := range self.Lookup(cld, now) {
+        ip := net.ParseIP(b.source.Host.String())
+        if ip == nil {
+            continue
+        }
+        route := oroute.getCopy()
+        route.location = false
+        route.cld = b.url.Username
+        route.cld_set = true
+        route.hostport = net.JoinHostPort(ip.String(), b.source.Port.String())
+        route.hostonly = b.source.Host.String()
+        route.ainfo = []*ainfo_item{ &ainfo_item{ ip, b.source.Port.String() } }
+        if len(res) > 0 {
+            route.fork = b.q == prev_q
+        }
+        prev_q = b.q
+        res = append(res, route)
+    }
+    return res
+}
+
+type contactStatus struct {
+    Aor             string  `json:"aor"`
+    Contact         string  `json:"contact"`
+    Q               float64 `json:"q"`
+    Expires         int     `json:"expires"`
+    Source          string  `json:"source"`
+}
+
+// The reply of the "loc" command
+type locationStatus struct {
+    Contacts        []*contactStatus `json:"contacts"`
+    Total           int              `json:"total"`
+}
+
+func (self *locationStatus) String() string {
+    res := "Registered contacts:\n"
+    for _, c := range self.Contacts {
+        res += fmt.Sprintf("%s: %s q=%s expires=%d source=%s\n", c.Aor, c.Contact,
+          strconv.FormatFloat(c.Q, 'f', -1, 64), c.Expires, c.Source)
+    }
+    return res + fmt.Sprintf("Total: %d\n", self.Total)
+}
+
+func (self *locationService) Status(aor string) *locationStatus {
+    now := time.Now()
+    self.lock.Lock()
+    aors := []string{}
+    if aor != "" {
+        aors = append(aors, aor)
+    } else {
+        for aor := range self.bindings {
+            aors = append(aors, aor)
+        }
+        sort.Strings(aors)
+    }
+    res := &locationStatus{ Contacts : []*contactStatus{} }
+    for _, aor := range aors {
+        for _, b := range self.purge(aor, now) {
+            res.Contacts = append(res.Contacts, &contactStatus{
+                Aor             : aor,
+                Contact         : b.url.String(),
+                Q               : b.q,
+                Expires         : int(b.expires_at.Sub(now).Seconds()),
+                Source          : b.source.String(),
+            })
+        }
+    }
+    self.lock.Unlock()
+    res.Total = len(res.Contacts)
+    return res
+}
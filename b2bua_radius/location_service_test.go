@@ -0,0 +1,147 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "sippy"
+    "sippy/conf"
+    "sippy/log"
+    "sippy/types"
+    "sippy/time"
+)
+
+func testRegister(t *testing.T, config sippy_conf.Config, cseq int, contacts, expires string) sippy_types.SipRequest {
+    msg := "REGISTER sip:example.com SIP/2.0\r\n" +
+        "Via: SIP/2.0/UDP 10.0.0.1:5060;branch=z9hG4bKnashds7\r\n" +
+        "From: <sip:alice@example.com>;tag=456248\r\n" +
+        "To: <sip:alice@example.com>\r\n" +
+        "Call-ID: 843817637684230@998sdasdh09\r\n" +
+        fmt.Sprintf("CSeq: %d REGISTER\r\n", cseq)
+    if contacts != "" {
+        msg += "Contact: " + contacts + "\r\n"
+    }
+    if expires != "" {
+        msg += "Expires: " + expires + "\r\n"
+    }
+    msg += "Content-Length: 0\r\n\r\n"
+    rtime, _ := sippy_time.NewMonoTime()
+    req, err := sippy.ParseSipRequest([]byte(msg), rtime, config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return req
+}
+
+func TestLocationService(t *testing.T) {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+    dir, err := ioutil.TempDir("", "location")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    fname := filepath.Join(dir, "location.csv")
+    loc, err := NewLocationService(fname, 60, 3600, config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    source := sippy_conf.NewHostPort("192.0.2.1", "5062")
+    now := time.Now()
+
+    for _, tc := range []struct{ cseq int; contacts, expires string; scode, ncontacts int }{
+        { 1, "<sip:alice@10.0.0.1>;q=0.5, <sip:alice@10.0.0.2>;q=1", "", 200, 2 },
+        { 2, "<sip:alice@10.0.0.3>;q=0.5;expires=7200", "", 200, 3 },
+        { 3, "<sip:alice@10.0.0.4>", "30", 423, 0 },
+        { 3, "<sip:alice@10.0.0.4>", "", 200, 4 },
+        { 2, "<sip:alice@10.0.0.4>", "", 500, 0 },
+        { 4, "<sip:alice@10.0.0.4>;expires=0", "", 200, 3 },
+        { 5, "", "", 200, 3 },
+        { 6, "*", "60", 400, 0 },
+    } {
+        resp := loc.update(testRegister(t, config, tc.cseq, tc.contacts, tc.expires), "alice", source, now)
+        if resp.GetSCodeNum() != tc.scode {
+            t.Fatalf("CSeq %d: expected %d, got %d", tc.cseq, tc.scode, resp.GetSCodeNum())
+        }
+        if tc.scode == 200 && len(resp.GetContacts()) != tc.ncontacts {
+            t.Fatalf("CSeq %d: expected %d contacts, got %d", tc.cseq, tc.ncontacts, len(resp.GetContacts()))
+        }
+    }
+
+    loc.lock.Lock()
+    pending := loc.save_timer != nil
+    loc.lock.Unlock()
+    if ! pending {
+        t.Error("the bindings have not been scheduled for saving")
+    }
+    loc.Flush()
+    if _, err := os.Stat(fname + ".tmp"); ! os.IsNotExist(err) {
+        t.Error("the temporary file has been left behind")
+    }
+
+    oroute, err := NewB2BRoute("location;expires=60", config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if ! oroute.location {
+        t.Fatal("the location route has not been recognized")
+    }
+    routes := loc.Resolve(oroute, "alice", now)
+    if len(routes) != 3 {
+        t.Fatalf("expected 3 routes, got %d", len(routes))
+    }
+    if routes[0].fork || ! routes[2].fork || routes[0].hostport != "192.0.2.1:5062" || routes[0].cld != "alice" {
+        t.Error("bad routes to the registered contacts")
+    }
+    if len(loc.Resolve(oroute, "bob", now)) != 0 {
+        t.Error("resolved the unregistered user")
+    }
+    // The 3600 seconds capped registrations expire while the 7200 one
+    // is capped at the same lifetime too.
+    if len(loc.Lookup("alice", now.Add(3601 * time.Second))) != 0 {
+        t.Error("the bindings have not expired")
+    }
+
+    loc2, err := NewLocationService(fname, 60, 3600, config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(loc2.Lookup("alice", now)) != 3 {
+        t.Error("the bindings have not been persisted")
+    }
+
+    if resp := loc.update(testRegister(t, config, 7, "*", "0"), "alice", source, now); resp.GetSCodeNum() != 200 {
+        t.Fatalf("expected 200 to the wildcard unregistration, got %d", resp.GetSCodeNum())
+    }
+    if len(loc.Lookup("alice", now)) != 0 {
+        t.Error("the wildcard unregistration has not removed the bindings")
+    }
+}
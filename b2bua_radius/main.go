@@ -31,12 +31,20 @@ import (
 
     "sippy"
     "sippy/conf"
-    "sippy/types"
+    "sippy/hep"
+    "sippy/log"
+    "sippy/utils"
 )
 
-var global_static_route *B2BRoute
-var global_rtp_proxy_clients []sippy_types.RtpProxyClient
 var global_cmap *callMap
+var global_digest_auth *digestAuth
+var global_aaa_routing bool
+var global_trunks *trunkTable
+var global_location *locationService
+var global_limiter *callLimiter
+var global_hep *sippy_hep.Exporter
+var global_tracer *callTracer
+var global_cdr cdrSink
 /*
 from sippy.Timeout import Timeout
 from sippy.Signal import Signal
@@ -93,13 +101,6 @@ def re_replace(ptrn, s):
         ptrn = ptrn[3:]
     return s
 
-def reopen(signum, logfile):
-    print('Signal %d received, reopening logs' % signum)
-    fd = os.open(logfile, os.O_WRONLY | os.O_CREAT | os.O_APPEND)
-    os.dup2(fd, sys.__stdout__.fileno())
-    os.dup2(fd, sys.__stderr__.fileno())
-    os.close(fd)
-
 def usage(global_config, brief = false):
     print('usage: b2bua.py [--option1=value1] [--option2=value2] ... [--optionN==valueN]')
     if ! brief:
@@ -112,48 +113,110 @@ func main() {
     global_config := NewMyConfigParser()
     err := global_config.Parse()
     if err != nil {
-        println(err.Error())
+        sippy_log.NewErrorLogger().Error(err.Error())
         return
     }
+    logger := global_config.ErrorLogger()
 
-    if global_config.static_route != "" {
-        global_static_route, err = NewB2BRoute(global_config.static_route, global_config)
+    live, err := newLiveConfig(global_config, nil)
+    if err != nil {
+        logger.Error(err.Error())
+        return
+    }
+    if global_config.trunks != "" {
+        global_trunks, err = NewTrunkTable(global_config.trunks, global_config)
+        if err != nil {
+            logger.Error("Error loading the trunks: " + err.Error())
+            return
+        }
+    }
+    if global_config.auth_enable || live.acl.needsAuth() {
+        store, err := newCredentialStore(global_config.auth_store, global_config)
         if err != nil {
-            println("Error parsing the static route")
-            println(err.Error())
+            logger.Error("Cannot initialize the credential store: " + err.Error())
             return
         }
-    //} else if ! global_config.auth_enable {
-    } else if true { // radius is not implemented
-        println("ERROR: static route should be specified when Radius auth is disabled")
+        global_digest_auth, err = newDigestAuth(store, global_config.auth_nonce_lifetime, global_config.digest_auth_only, global_config.digest_auth_only_ips)
+        if err != nil {
+            logger.Error("Error parsing digest_auth_only_ips: " + err.Error())
+            return
+        }
+        // Radius and the HTTP routing webhook can supply the routes along with
+        // the authorisation, the credentials file cannot
+        switch store.(type) {
+        case *radiusAuthorisation, *httpAuthorisation:
+            global_aaa_routing = true
+        }
+    }
+    global_limiter, err = NewCallLimiter(global_config.max_calls, global_config.max_cps, global_config.source_limits,
+      global_config.limit_scode, global_config.limit_retry_after)
+    if err != nil {
+        logger.Error("Error setting up the call limits: " + err.Error())
         return
     }
-/*
-    if writeconf != nil:
-        global_config.write(open(writeconf, 'w'))
-
-    if ! global_config['foreground']:
-        daemonize(logfile = global_config['logfile'])
-*/
-    global_rtp_proxy_clients = make([]sippy_types.RtpProxyClient, len(global_config.rtp_proxy_clients))
-    for i, address := range global_config.rtp_proxy_clients {
-        opts := sippy.NewRtpProxyClientOpts()
-        opts.SetSocketPath(address)
-        opts.SetHeartbeatInterval(global_config.hrtb_ival)
-        opts.SetHeartbeatRetryInterval(global_config.hrtb_retr_ival)
-        rtpp, err := sippy.NewRtpProxyClient(opts, global_config, global_config.ErrorLogger())
+    if global_config.registrar {
+        if global_digest_auth == nil {
+            logger.Error("the registrar requires the authentication to be enabled")
+            return
+        }
+        global_location, err = NewLocationService(global_config.registrar_db, global_config.registrar_min_expires,
+          global_config.registrar_max_expires, global_config)
+        if err != nil {
+            logger.Error("Error loading the location database: " + err.Error())
+            return
+        }
+    }
+    if ! live.hasRoutes() {
+        logger.Error("static route or routing table should be specified when Radius auth is disabled")
+        return
+    }
+    if global_config.writeconf != "" {
+        if err = global_config.WriteConf(); err != nil {
+            logger.Error("Cannot write the configuration: " + err.Error())
+            return
+        }
+    }
+    if ! global_config.foreground {
+        if err = checkPidFile(global_config.pidfile); err != nil {
+            logger.Error(err.Error())
+            return
+        }
+        parent, err := sippy_utils.Daemonize(global_config.logfile)
         if err != nil {
-            println("Cannot initialize rtpproxy client: " + err.Error())
+            logger.Error("Cannot daemonize: " + err.Error())
+            return
+        }
+        if parent {
+            return
+        }
+        if err = global_config.error_logger.SetLogFile(global_config.logfile); err != nil {
+            logger.Error("Cannot open the log file: " + err.Error())
             return
         }
-        global_rtp_proxy_clients[i] = rtpp
     }
+    setLive(live)
 /*
     if global_config['auth_enable'] || global_config['acct_enable']:
         global_config['_radius_client'] = RadiusAuthorisation(global_config)
 */
     global_config.SetMyUAName("Sippy B2BUA (RADIUS)")
 
+    if global_config.hep_collector != "" {
+        global_hep, err = sippy_hep.NewExporter(global_config.hep_collector, uint32(global_config.hep_capture_id),
+          global_config.hep_auth_key, global_config.hep_queue_size, global_config.ErrorLogger())
+        if err != nil {
+            logger.Error("Cannot initialize the HEP exporter: " + err.Error())
+            return
+        }
+        global_config.SetSipCapture(global_hep)
+    }
+    global_cdr, err = newCdrSinks(global_config)
+    if err != nil {
+        logger.Error("Cannot initialize the CDR writer: " + err.Error())
+        return
+    }
+    global_tracer = newCallTracer(global_config.trace_dir, global_config.SipCapture(), global_config.ErrorLogger())
+    global_config.SetSipCapture(global_tracer)
     global_cmap = NewCallMap(global_config)
 /*
     if global_config.getdefault('xmpp_b2bua_id', nil) != nil:
@@ -161,10 +224,10 @@ func main() {
 */
     sip_tm, err := sippy.NewSipTransactionManager(global_config, global_cmap)
     if err != nil {
-        println("Cannot initialize SipTransactionManager: " + err.Error())
+        logger.Error("Cannot initialize SipTransactionManager: " + err.Error())
         return
     }
-    //sip_tm.nat_traversal = global_config.nat_traversal
+    sip_tm.SetNatTraversal(global_config.nat_traversal)
     global_cmap.sip_tm = sip_tm
     if global_config.sip_proxy != "" {
         var sip_proxy *sippy_conf.HostPort
@@ -176,21 +239,46 @@ func main() {
         }
         global_cmap.proxy = sippy.NewStatefulProxy(sip_tm, sip_proxy, global_config)
     }
+    if global_location != nil {
+        global_location.sip_tm = sip_tm
+    }
+    if global_trunks != nil {
+        global_trunks.Start(sip_tm)
+    }
 
     cmdfile := global_config.b2bua_socket
-    if strings.HasPrefix(cmdfile, "unix:") {
-        cmdfile = cmdfile[5:]
+    command_cb := syncCommandCb(global_cmap.recvCommand)
+    if strings.HasPrefix(cmdfile, "tcp:") {
+        cli_server, err := NewCli_server_tcp(command_cb, cmdfile[4:], global_config.cli_accept_list, global_config.cli_idle_timeout, global_config.ErrorLogger())
+        if err != nil {
+            logger.Error("Cannot initialize Cli_server: " + err.Error())
+            return
+        }
+        cli_server.Start()
+    } else {
+        if strings.HasPrefix(cmdfile, "unix:") {
+            cmdfile = cmdfile[5:]
+        }
+        cli_server, err := NewCli_server_local(command_cb, cmdfile, global_config.cli_idle_timeout, global_config.ErrorLogger())
+        if err != nil {
+            logger.Error("Cannot initialize Cli_server: " + err.Error())
+            return
+        }
+        cli_server.Start()
     }
-    cli_server, err := NewCli_server_local(global_cmap.recvCommand, cmdfile, global_config.ErrorLogger())
-    if err != nil {
-        println("Cannot initialize Cli_server: " + err.Error())
-        return
+    if global_config.http_api != "" {
+        http_api, err := NewHttpApi(global_cmap, global_config.http_api, global_config.http_api_token, global_config.ErrorLogger())
+        if err != nil {
+            logger.Error("Cannot initialize the HTTP API: " + err.Error())
+            return
+        }
+        http_api.Start()
+    }
+    if ! global_config.foreground {
+        if err = writePidFile(global_config.pidfile); err != nil {
+            logger.Error("Cannot write the pidfile: " + err.Error())
+            return
+        }
     }
-    cli_server.Start()
-/*
-    if ! global_config['foreground']:
-        file(global_config['pidfile'], 'w').write(str(os.getpid()) + '\n')
-        Signal(SIGUSR1, reopen, SIGUSR1, global_config['logfile'])
-*/
     sip_tm.Run()
 }
@@ -0,0 +1,237 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "sort"
+    "strconv"
+    "strings"
+
+    "sippy/types"
+)
+
+// metricsWriter renders the metrics in the Prometheus text exposition
+// format.
+type metricsWriter struct {
+    buf             bytes.Buffer
+}
+
+var metrics_label_escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (self *metricsWriter) family(name, mtype, help string) {
+    fmt.Fprintf(&self.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, mtype)
+}
+
+// The labels are given as the name, value pairs.
+func (self *metricsWriter) sample(name string, value float64, labels ...string) {
+    self.buf.WriteString(name)
+    if len(labels) > 0 {
+        self.buf.WriteByte('{')
+        for i := 0; i + 1 < len(labels); i += 2 {
+            if i > 0 {
+                self.buf.WriteByte(',')
+            }
+            self.buf.WriteString(labels[i] + `="` + metrics_label_escaper.Replace(labels[i + 1]) + `"`)
+        }
+        self.buf.WriteByte('}')
+    }
+    self.buf.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+func (self *metricsWriter) histogram(name string, h *histogram, labels ...string) {
+    cumulative := int64(0)
+    for i, bound := range h.bounds {
+        cumulative += h.counts[i]
+        self.sample(name + "_bucket", float64(cumulative), append(labels, "le", strconv.FormatFloat(bound, 'g', -1, 64))...)
+    }
+    self.sample(name + "_bucket", float64(h.count), append(labels, "le", "+Inf")...)
+    self.sample(name + "_sum", h.sum, labels...)
+    self.sample(name + "_count", float64(h.count), labels...)
+}
+
+func (self *metricsWriter) Bytes() []byte {
+    return self.buf.Bytes()
+}
+
+// Renders the call, SIP stack and rtpproxy metrics. Only the counters are
+// collected, the rates, ASR and ACD are left for the queries.
+func (self *callMap) metrics() *metricsWriter {
+    mw := &metricsWriter{}
+    stats := self.statsStatus()
+    mw.family("b2bua_uptime_seconds", "gauge", "Time since the start.")
+    mw.sample("b2bua_uptime_seconds", float64(stats.Uptime))
+    mw.family("b2bua_calls", "gauge", "Calls in progress by state.")
+    states := make([]string, 0, len(stats.States))
+    for state := range stats.States {
+        states = append(states, state)
+    }
+    sort.Strings(states)
+    for _, state := range states {
+        mw.sample("b2bua_calls", float64(stats.States[state]), "state", state)
+    }
+    mw.family("b2bua_calls_total", "counter", "Incoming calls.")
+    mw.sample("b2bua_calls_total", float64(stats.TotalCalls))
+    mw.family("b2bua_call_failures_total", "counter", "Failure responses sent to the callers by status code.")
+    scodes := make([]int, 0, len(stats.Failures))
+    for scode := range stats.Failures {
+        scodes = append(scodes, scode)
+    }
+    sort.Ints(scodes)
+    for _, scode := range scodes {
+        mw.sample("b2bua_call_failures_total", float64(stats.Failures[scode]), "code", strconv.Itoa(scode))
+    }
+
+    routes := self.stats.routesStatus()
+    mw.family("b2bua_route_attempts_total", "counter", "Outgoing call legs placed by route.")
+    for _, rs := range routes {
+        mw.sample("b2bua_route_attempts_total", float64(rs.attempts), "route", rs.route)
+    }
+    mw.family("b2bua_route_answers_total", "counter", "Outgoing call legs answered by route.")
+    for _, rs := range routes {
+        mw.sample("b2bua_route_answers_total", float64(rs.answers), "route", rs.route)
+    }
+    mw.family("b2bua_route_failures_total", "counter", "Outgoing call legs ended without an answer by route.")
+    for _, rs := range routes {
+        mw.sample("b2bua_route_failures_total", float64(rs.failures), "route", rs.route)
+    }
+    mw.family("b2bua_route_setup_seconds", "histogram", "Time from placing the outgoing call leg until it is answered.")
+    for _, rs := range routes {
+        mw.histogram("b2bua_route_setup_seconds", rs.setup_time, "route", rs.route)
+    }
+    mw.family("b2bua_route_call_duration_seconds", "histogram", "Duration of the answered outgoing call legs.")
+    for _, rs := range routes {
+        mw.histogram("b2bua_route_call_duration_seconds", rs.duration, "route", rs.route)
+    }
+
+    if self.sip_tm != nil {
+        sipMetrics(mw, self.sip_tm.GetStats())
+    }
+    rtppMetrics(mw, rtpProxyStatus())
+    if global_hep != nil {
+        mw.family("b2bua_hep_queue_length", "gauge", "SIP messages waiting to be sent to the HEP collector.")
+        mw.sample("b2bua_hep_queue_length", float64(global_hep.GetQueueLength()))
+        mw.family("b2bua_hep_dropped_total", "counter", "SIP messages not sent to the HEP collector because the queue was full.")
+        mw.sample("b2bua_hep_dropped_total", float64(global_hep.GetDropped()))
+    }
+    return mw
+}
+
+func sipMetrics(mw *metricsWriter, stats *sippy_types.SipStats) {
+    for _, it := range []struct {
+        name        string
+        help        string
+        counts      map[string]int64
+    }{
+        { "b2bua_sip_requests_received_total", "SIP requests received by method.", stats.RequestsIn },
+        { "b2bua_sip_requests_sent_total", "SIP requests sent by method, including the retransmissions.", stats.RequestsOut },
+    } {
+        mw.family(it.name, "counter", it.help)
+        methods := make([]string, 0, len(it.counts))
+        for method := range it.counts {
+            methods = append(methods, method)
+        }
+        sort.Strings(methods)
+        for _, method := range methods {
+            mw.sample(it.name, float64(it.counts[method]), "method", method)
+        }
+    }
+    for _, it := range []struct {
+        name        string
+        help        string
+        counts      map[sippy_types.SipResponseKey]int64
+    }{
+        { "b2bua_sip_responses_received_total", "SIP responses received by method and status code.", stats.ResponsesIn },
+        { "b2bua_sip_responses_sent_total", "SIP responses sent by method and status code, including the retransmissions.", stats.ResponsesOut },
+    } {
+        mw.family(it.name, "counter", it.help)
+        keys := make([]sippy_types.SipResponseKey, 0, len(it.counts))
+        for key := range it.counts {
+            keys = append(keys, key)
+        }
+        sort.Slice(keys, func(i, j int) bool {
+            if keys[i].Method != keys[j].Method {
+                return keys[i].Method < keys[j].Method
+            }
+            return keys[i].Code < keys[j].Code
+        })
+        for _, key := range keys {
+            mw.sample(it.name, float64(it.counts[key]), "method", key.Method, "code", strconv.Itoa(key.Code))
+        }
+    }
+    mw.family("b2bua_sip_retransmissions_received_total", "counter", "Retransmitted SIP messages received.")
+    mw.sample("b2bua_sip_retransmissions_received_total", float64(stats.RetransmissionsIn))
+    mw.family("b2bua_sip_retransmissions_sent_total", "counter", "SIP messages retransmitted.")
+    mw.sample("b2bua_sip_retransmissions_sent_total", float64(stats.RetransmissionsOut))
+    mw.family("b2bua_sip_transactions", "gauge", "SIP transactions in progress.")
+    mw.sample("b2bua_sip_transactions", float64(stats.ClientTransactions), "type", "client")
+    mw.sample("b2bua_sip_transactions", float64(stats.ServerTransactions), "type", "server")
+
+    mw.family("b2bua_udp_packets_received_total", "counter", "UDP packets received by local address.")
+    for _, us := range stats.UdpServers {
+        mw.sample("b2bua_udp_packets_received_total", float64(us.PacketsRecvd), "laddress", us.Laddress)
+    }
+    mw.family("b2bua_udp_packets_sent_total", "counter", "UDP packets sent by local address.")
+    for _, us := range stats.UdpServers {
+        mw.sample("b2bua_udp_packets_sent_total", float64(us.PacketsSent), "laddress", us.Laddress)
+    }
+    mw.family("b2bua_udp_packets_queued_total", "counter", "UDP packets that could not be sent at the first attempt by local address.")
+    for _, us := range stats.UdpServers {
+        mw.sample("b2bua_udp_packets_queued_total", float64(us.PacketsQueued), "laddress", us.Laddress)
+    }
+    mw.family("b2bua_udp_send_queue_length", "gauge", "UDP packets waiting to be sent by local address.")
+    for _, us := range stats.UdpServers {
+        mw.sample("b2bua_udp_send_queue_length", float64(us.SendQueue), "laddress", us.Laddress)
+    }
+    mw.family("b2bua_udp_resolve_queue_length", "gauge", "UDP packets waiting for the destination to be resolved by local address.")
+    for _, us := range stats.UdpServers {
+        mw.sample("b2bua_udp_resolve_queue_length", float64(us.ResolveQueue), "laddress", us.Laddress)
+    }
+}
+
+func rtppMetrics(mw *metricsWriter, rtpps *rtppList) {
+    mw.family("b2bua_rtpproxy_up", "gauge", "Whether the rtpproxy is online.")
+    for _, rtpp := range rtpps.Rtpproxies {
+        up := 0.0
+        if rtpp.Online {
+            up = 1
+        }
+        mw.sample("b2bua_rtpproxy_up", up, "address", rtpp.Address)
+    }
+    mw.family("b2bua_rtpproxy_active_sessions", "gauge", "Sessions reported by the rtpproxy.")
+    for _, rtpp := range rtpps.Rtpproxies {
+        mw.sample("b2bua_rtpproxy_active_sessions", float64(rtpp.ActiveSessions), "address", rtpp.Address)
+    }
+    mw.family("b2bua_rtpproxy_active_streams", "gauge", "Streams reported by the rtpproxy.")
+    for _, rtpp := range rtpps.Rtpproxies {
+        mw.sample("b2bua_rtpproxy_active_streams", float64(rtpp.ActiveStreams), "address", rtpp.Address)
+    }
+    mw.family("b2bua_rtpproxy_latency_seconds", "gauge", "Average command round trip time of the rtpproxy.")
+    for _, rtpp := range rtpps.Rtpproxies {
+        mw.sample("b2bua_rtpproxy_latency_seconds", rtpp.Latency, "address", rtpp.Address)
+    }
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestHistogram(t *testing.T) {
+    h := newHistogram([]float64{ 1, 5 })
+    for _, v := range []float64{ 0.5, 1, 3, 10 } {
+        h.observe(v)
+    }
+    mw := &metricsWriter{}
+    mw.histogram("test_seconds", h, "route", `a"b`)
+    expected := `test_seconds_bucket{route="a\"b",le="1"} 2
+test_seconds_bucket{route="a\"b",le="5"} 3
+test_seconds_bucket{route="a\"b",le="+Inf"} 4
+test_seconds_sum{route="a\"b"} 14.5
+test_seconds_count{route="a\"b"} 4
+`
+    if string(mw.Bytes()) != expected {
+        t.Errorf("unexpected histogram:\n%s", mw.Bytes())
+    }
+}
+
+func TestMetrics(t *testing.T) {
+    cfg := newTestConfig(t, "-s", "192.0.2.1")
+    live, err := newLiveConfig(cfg, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    setLive(live)
+    cmap := &callMap{
+        global_config   : cfg,
+        ccmap           : map[int64]*callController{},
+        stats           : newCallStats(time.Now()),
+    }
+    cmap.stats.newCall(time.Now())
+    cmap.stats.failed(486)
+    answered := newLegStats(cmap.stats, "192.0.2.2:5060")
+    answered.conn(nil, "")
+    answered.disc(nil, "", 0, nil)
+    answered.disc(nil, "", 0, nil)
+    failed := newLegStats(cmap.stats, "192.0.2.2:5060")
+    failed.fail(nil, "", 486)
+    failed.disc(nil, "", 0, nil)
+    newLegStats(cmap.stats, "192.0.2.3:5060").disc(nil, "", 0, nil)
+
+    res := string(cmap.metrics().Bytes())
+    for _, line := range []string{
+        "# TYPE b2bua_calls_total counter",
+        "b2bua_calls_total 1",
+        `b2bua_call_failures_total{code="486"} 1`,
+        `b2bua_route_attempts_total{route="192.0.2.2:5060"} 2`,
+        `b2bua_route_answers_total{route="192.0.2.2:5060"} 1`,
+        `b2bua_route_failures_total{route="192.0.2.2:5060"} 1`,
+        `b2bua_route_failures_total{route="192.0.2.3:5060"} 1`,
+        `b2bua_route_setup_seconds_count{route="192.0.2.2:5060"} 1`,
+        `b2bua_route_call_duration_seconds_count{route="192.0.2.2:5060"} 1`,
+        `b2bua_route_call_duration_seconds_count{route="192.0.2.3:5060"} 0`,
+        "# TYPE b2bua_rtpproxy_up gauge",
+    } {
+        if ! strings.Contains(res, line + "\n") {
+            t.Errorf("%q is missing in the metrics:\n%s", line, res)
+        }
+    }
+}
@@ -29,6 +29,10 @@ package main
 import (
     "errors"
     "flag"
+    "io"
+    "math"
+    "net"
+    "os"
     "strconv"
     "strings"
     "time"
@@ -37,17 +41,88 @@ import (
     "sippy/log"
 )
 
+// The loggers that write into files and can reopen them after rotation
+type errorLogFile interface {
+    SetLogFile(string) error
+    Reopen() error
+}
+
+type sipLogFile interface {
+    Reopen() error
+}
+
 type myConfigParser struct {
     sippy_conf.Config
-    accept_ips          map[string]bool
+    error_logger        errorLogFile
+    sip_logger          sipLogFile
+    flags               *flag.FlagSet
+    foreground          bool
+    pidfile             string
+    logfile             string
+    sip_address         string
+    sip_port            int
+    writeconf           string
+    acct_enable         bool
+    start_acct_enable   bool
+    precise_acct        bool
+    alive_acct_int      time.Duration
+    max_credit_time     time.Duration
+    credit_warning      time.Duration
+    credit_warning_prompt string
+    hide_call_id        bool
+    allowed_pts         []int
+    nat_traversal       bool
+    xmpp_b2bua_id       int
+    accept_ips          []string
+    acl                 string
     static_route        string
+    routing_table       string
+    trunks              string
+    static_tr_in        *trRules
+    static_tr_out       *trRules
     sip_proxy           string
-    //auth_enable         bool
+    auth_enable         bool
+    digest_auth         bool
+    digest_auth_only    bool
+    digest_auth_only_ips string
+    auth_store          string
+    auth_http_timeout   time.Duration
+    auth_fallback_route string
+    auth_nonce_lifetime time.Duration
+    max_calls           int64
+    max_cps             float64
+    source_limits       string
+    limit_scode         int
+    limit_retry_after   int
+    registrar           bool
+    registrar_db        string
+    registrar_min_expires int
+    registrar_max_expires int
+    radiusclient        string
+    radiusclient_conf   string
+    max_radiusclients   int
     rtp_proxy_clients   []string
     pass_headers        []string
     keepalive_ans       time.Duration
     keepalive_orig      time.Duration
     b2bua_socket        string
+    cli_accept_list     []*net.IPNet
+    cli_idle_timeout    time.Duration
+    http_api            string
+    http_api_token      string
+    hep_collector       string
+    hep_capture_id      int
+    hep_auth_key        string
+    hep_queue_size      int
+    trace_dir           string
+    log_level           sippy_log.Level
+    log_format          string
+    log_syslog          string
+    cdr_csv             string
+    cdr_json            string
+    cdr_syslog          string
+    cdr_max_size        int
+    cdr_max_files       int
     hrtb_retr_ival      time.Duration
     hrtb_ival           time.Duration
 }
@@ -55,13 +130,14 @@ type myConfigParser struct {
 func NewMyConfigParser() *myConfigParser {
     return &myConfigParser{
         rtp_proxy_clients   : make([]string, 0),
-        accept_ips          : make(map[string]bool),
-        //auth_enable         : false,
+        accept_ips          : make([]string, 0),
+        auth_enable         : false,
         pass_headers        : make([]string, 0),
     }
 }
 
-func (self *myConfigParser) Parse() error {
+func (self *myConfigParser) parse(fs *flag.FlagSet, args []string) error {
+    self.flags = fs
 /*
     global_config.digest_auth = true
     global_config.start_acct_enable = false
@@ -77,142 +153,278 @@ func (self *myConfigParser) Parse() error {
           global_config.get_longopts())
     except getopt.GetoptError:
         usage(global_config)
-    global_config['foreground'] = false
-    global_config['pidfile'] = '/var/run/b2bua.pid'
-    global_config['logfile'] = '/var/log/b2bua.log'
-    global_config['b2bua_socket'] = '/var/run/b2bua.sock'
     global_config['_sip_address'] = SipConf.my_address
     global_config['_sip_port'] = SipConf.my_port
     rtp_proxy_clients = []
-    writeconf = nil
-    for o, a in opts:
-        if o == '-f':
-            global_config['foreground'] = true
-            continue
-        if o == '-l':
-            global_config.check_and_set('sip_address', a)
-            continue
-        if o == '-P':
-            global_config.check_and_set('pidfile', a)
-            continue
-            */
-    var logfile string
-    flag.StringVar(&logfile, "L", "/var/log/sip.log", "logfile")
-    flag.StringVar(&logfile, "logfile", "/var/log/sip.log", "path to the B2BUA log file")
+*/
+    var config_file string
+    fs.StringVar(&config_file, "C", "", "config")
+    fs.StringVar(&config_file, "config", "", "load configuration from file (path to file)")
+    fs.StringVar(&self.writeconf, "W", "", "write the effective configuration to the file (path to file)")
+    fs.BoolVar(&self.foreground, "f", false, "foreground")
+    fs.BoolVar(&self.foreground, "foreground", false, "run in foreground")
+    fs.StringVar(&self.sip_address, "l", "*", "sip_address")
+    fs.StringVar(&self.sip_address, "sip_address", "*", "local SIP address to listen for incoming SIP requests " +
+                                "(\"*\", \"0.0.0.0\" or \"::\" to listen on all IPv4 " +
+                                "or IPv6 interfaces)")
+    fs.StringVar(&self.pidfile, "P", "/var/run/b2bua.pid", "pidfile")
+    fs.StringVar(&self.pidfile, "pidfile", "/var/run/b2bua.pid", "path to the B2BUA PID file")
+    fs.StringVar(&self.logfile, "L", "/var/log/sip.log", "logfile")
+    fs.StringVar(&self.logfile, "logfile", "/var/log/sip.log", "path to the B2BUA log file")
 
-    flag.StringVar(&self.static_route, "s", "", "static route for all SIP calls")
-    flag.StringVar(&self.static_route, "static_route", "", "static route for all SIP calls")
+    fs.StringVar(&self.static_route, "s", "", "static route for all SIP calls")
+    fs.StringVar(&self.static_route, "static_route", "", "static route for all SIP calls")
+    fs.StringVar(&self.routing_table, "routing_table", "", "path to the CSV file with the routing table. " +
+                                "The static route is used when no matching entry is found " +
+                                "in the table")
+    fs.StringVar(&self.trunks, "trunks", "", "path to the CSV file with the upstream trunks " +
+                                "to register with. The incoming calls sent to the Contact " +
+                                "of a registered trunk are routed with the route of the trunk")
 
     var accept_ips string
-    flag.StringVar(&accept_ips, "a", "", "accept_ips")
-    flag.StringVar(&accept_ips, "accept_ips", "", "IP addresses that we will only be accepting incoming " +
+    fs.StringVar(&accept_ips, "a", "", "accept_ips")
+    fs.StringVar(&accept_ips, "accept_ips", "", "IP addresses or networks that we will only be accepting incoming " +
                                 "calls from (comma-separated list). If the parameter " +
                                 "is not specified, we will accept from any IP and " +
                                 "then either try to authenticate if authentication " +
                                 "is enabled, or just let them to pass through")
+    fs.StringVar(&self.acl, "acl", "", "path to the CSV file with the access list, checked after " +
+                                "the accept_ips")
 
     var hrtb_ival int
-    flag.IntVar(&hrtb_ival, "rtpp_hrtb_ival", 10, "rtpproxy hearbeat interval (seconds)")
+    fs.IntVar(&hrtb_ival, "rtpp_hrtb_ival", 10, "rtpproxy hearbeat interval (seconds)")
     var hrtb_retr_ival int
-    flag.IntVar(&hrtb_retr_ival, "rtpp_hrtb_retr_ival", 60, "rtpproxy hearbeat retry interval (seconds)")
-/*
-        if o == '-a':
-            global_config.check_and_set('accept_ips', a)
-            continue
-        if o == '-D':
-            global_config['digest_auth'] = false
-            continue
-        if o == '-A':
-            acct_level = int(a.strip())
-            if acct_level == 0:
-                global_config['acct_enable'] = false
-                global_config['start_acct_enable'] = false
-            elif acct_level == 1:
-                global_config['acct_enable'] = true
-                global_config['start_acct_enable'] = false
-            elif acct_level == 2:
-                global_config['acct_enable'] = true
-                global_config['start_acct_enable'] = true
-            else:
-                sys.__stderr__.write('ERROR: -A argument not in the range 0-2\n')
-                usage(global_config, true)
-            continue
-        if o == '-t':
-            global_config.check_and_set('static_tr_in', a)
-            continue
-        if o == '-T':
-            global_config.check_and_set('static_tr_out', a)
-            continue
-*/
+    fs.IntVar(&hrtb_retr_ival, "rtpp_hrtb_retr_ival", 60, "rtpproxy hearbeat retry interval (seconds)")
+    acct_level := -1
+    fs.IntVar(&acct_level, "A", -1, "accounting level: 0 - disabled, 1 - stop only, 2 - start and stop")
+    fs.BoolVar(&self.acct_enable, "acct_enable", true, "enable or disable Radius accounting")
+    fs.BoolVar(&self.start_acct_enable, "start_acct_enable", false, "enable start Radius accounting")
+    fs.BoolVar(&self.precise_acct, "precise_acct", false, "do Radius accounting with millisecond precision")
+    var alive_acct_int int
+    fs.IntVar(&alive_acct_int, "alive_acct_int", 0, "interval for sending alive Radius accounting in " +
+                                "second (0 to disable alive accounting)")
+    var static_tr_in, static_tr_out string
+    fs.StringVar(&static_tr_in, "t", "", "static_tr_in")
+    fs.StringVar(&static_tr_in, "static_tr_in", "", "translation rule (regexp) to apply to all incoming " +
+                                "(ingress) destination numbers")
+    fs.StringVar(&static_tr_out, "T", "", "static_tr_out")
+    fs.StringVar(&static_tr_out, "static_tr_out", "", "translation rule (regexp) to apply to all outgoing " +
+                                "(egress) destination numbers")
     var ka_level, keepalive_ans, keepalive_orig int
-    flag.IntVar(&ka_level, "k", 0, "keepalive level")
-    flag.IntVar(&keepalive_ans, "keepalive_ans", 0, "send periodic \"keep-alive\" re-INVITE requests on " +
+    fs.IntVar(&ka_level, "k", 0, "keepalive level")
+    fs.IntVar(&keepalive_ans, "keepalive_ans", 0, "send periodic \"keep-alive\" re-INVITE requests on " +
                                 "answering (ingress) call leg and disconnect a call " +
                                 "if the re-INVITE fails (period in seconds, 0 to disable)")
-    flag.IntVar(&keepalive_orig, "keepalive_orig", 0, "send periodic \"keep-alive\" re-INVITE requests on " +
+    fs.IntVar(&keepalive_orig, "keepalive_orig", 0, "send periodic \"keep-alive\" re-INVITE requests on " +
                              "originating (egress) call leg and disconnect a call " +
                              "if the re-INVITE fails (period in seconds, 0 to disable)")
-/*
-        if o == '-m':
-            global_config.check_and_set('max_credit_time', a)
-            continue
-*/
-    //flag.BoolVar(&self.auth_enable, "a", false, "auth_enable")
-    //flag.BoolVar(&self.auth_enable, "auth_enable", false, "enable or disable Radius authentication")
-/*
-        if o == '-r':
-            global_config.check_and_set('rtp_proxy_client', a)
-            continue
-        if o == '-F':
-            global_config.check_and_set('allowed_pts', a)
-            continue
-        if o == '-R':
-            global_config.check_and_set('radiusclient.conf', a)
-            continue
-*/
+    var max_credit_time int
+    fs.IntVar(&max_credit_time, "m", 0, "max_credit_time")
+    fs.IntVar(&max_credit_time, "max_credit_time", 0, "upper limit of session time for all calls in " +
+                                "seconds (0 for no limit)")
+    var credit_warning int
+    fs.IntVar(&credit_warning, "credit_warning", 0, "play the credit_warning_prompt to both parties this " +
+                                "many seconds before the credit time runs out (0 to disable)")
+    fs.StringVar(&self.credit_warning_prompt, "credit_warning_prompt", "", "name of the rtpproxy prompt to play " +
+                                "as the credit time warning")
+    //fs.BoolVar(&self.auth_enable, "a", false, "auth_enable")
+    fs.BoolVar(&self.auth_enable, "auth_enable", false, "enable or disable Radius authentication")
+    var no_digest_auth bool
+    fs.BoolVar(&no_digest_auth, "D", false, "disable SIP Digest authentication")
+    fs.BoolVar(&self.digest_auth, "digest_auth", true, "enable or disable SIP Digest authentication of " +
+                                "incoming INVITE requests")
+    fs.BoolVar(&self.digest_auth_only, "digest_auth_only", false, "only use SIP Digest method to authenticate " +
+                                "incoming INVITE requests. If the option is not " +
+                                "specified or set to \"off\" then B2BUA will try to " +
+                                "do remote IP authentication first and if that fails " +
+                                "then send a challenge and re-authenticate when " +
+                                "challenge response comes in")
+    fs.StringVar(&self.digest_auth_only_ips, "digest_auth_only_ips", "", "IP addresses or networks the requests from " +
+                                "which are always challenged right away as if the " +
+                                "digest_auth_only was set (comma-separated list)")
+    fs.StringVar(&self.auth_store, "auth_store", "radius", "credential store to authenticate the incoming requests " +
+                                "against: \"radius\", \"file:/path/to/file\" or the URL of the HTTP " +
+                                "routing webhook")
+    var auth_http_timeout float64
+    fs.Float64Var(&auth_http_timeout, "auth_http_timeout", 3, "time to wait for the reply of the HTTP routing " +
+                                "webhook (seconds)")
+    fs.StringVar(&self.auth_fallback_route, "auth_http_fallback_route", "", "route for the calls when the " +
+                                "HTTP routing webhook fails, the calls are rejected if not specified")
+    var auth_nonce_lifetime int
+    fs.IntVar(&auth_nonce_lifetime, "auth_nonce_lifetime", 300, "lifetime of the SIP Digest nonce in seconds, the " +
+                                "expired nonces are challenged with stale=true")
+    fs.Int64Var(&self.max_calls, "max_calls", 0, "maximum number of the concurrent incoming calls, 0 for no limit")
+    fs.Float64Var(&self.max_cps, "max_cps", 0, "maximum rate of the new incoming calls per second, 0 for no limit")
+    fs.StringVar(&self.source_limits, "source_limits", "", "limits of the concurrent calls and the calls per second " +
+                                "by the source IP address or network (comma-separated list " +
+                                "of \"<IP or CIDR>=<calls>/<cps>\" entries)")
+    fs.IntVar(&self.limit_scode, "limit_scode", 503, "SIP status code to reject the calls exceeding the limits " +
+                                "with: 503 or 486")
+    fs.IntVar(&self.limit_retry_after, "limit_retry_after", 5, "value of the Retry-After header in seconds sent along " +
+                                "with the 503 to the calls exceeding the limits")
+    fs.BoolVar(&self.registrar, "registrar", false, "accept the SIP registrations from the users authenticated " +
+                                "with the credential store. Use \"location\" as the route " +
+                                "host to send the calls to the registered users")
+    fs.StringVar(&self.registrar_db, "registrar_db", "", "path to the file to persist the registrations in")
+    fs.IntVar(&self.registrar_min_expires, "registrar_min_expires", 60, "minimum registration lifetime in seconds")
+    fs.IntVar(&self.registrar_max_expires, "registrar_max_expires", 3600, "maximum registration lifetime in seconds, " +
+                                "also used when the client does not request any")
+    fs.StringVar(&self.radiusclient, "radiusclient", "/usr/local/sbin/radiusclient", "path to the radiusclient executable")
+    var allowed_pts string
+    fs.StringVar(&allowed_pts, "F", "", "allowed_pts")
+    fs.StringVar(&allowed_pts, "allowed_pts", "", "list of allowed media (RTP) IANA-assigned payload " +
+                                "types that the B2BUA will pass from input to " +
+                                "output, payload types not in this list will be " +
+                                "filtered out (comma separated list)")
+    fs.StringVar(&self.radiusclient_conf, "R", "", "radiusclient.conf")
+    fs.StringVar(&self.radiusclient_conf, "radiusclient.conf", "", "path to the radiusclient.conf file")
     var pass_header, pass_headers string
-    flag.StringVar(&pass_header, "h", "", "pass_header")
-    flag.StringVar(&pass_headers, "pass_headers", "", "list of SIP header field names that the B2BUA will " +
+    fs.StringVar(&pass_header, "h", "", "pass_header")
+    fs.StringVar(&pass_header, "pass_header", "", "SIP header field name that the B2BUA will pass from " +
+                                "ingress call leg to egress call leg unmodified")
+    fs.StringVar(&pass_headers, "pass_headers", "", "list of SIP header field names that the B2BUA will " +
                                 "pass from ingress call leg to egress call leg " +
                                 "unmodified (comma-separated list)")
-    flag.StringVar(&self.b2bua_socket, "c", "/var/run/b2bua.sock", "b2bua_socket")
-    flag.StringVar(&self.b2bua_socket, "b2bua_socket", "/var/run/b2bua.sock", "path to the B2BUA command socket or address to listen " +
-                                        "for commands in the format \"udp:host[:port]\"")
-/*
-        if o == '-M':
-            global_config.check_and_set('max_radiusclients', a)
-            continue
-        if o == '-H':
-            global_config['hide_call_id'] = true
-            continue
-        if o in ('-C', '--config'):
-            global_config.read(a.strip())
-            continue
-        if o.startswith('--'):
-            global_config.check_and_set(o[2:], a)
-            continue
-        if o == '-W':
-            writeconf = a.strip()
-            continue
-*/
+    fs.StringVar(&self.b2bua_socket, "c", "/var/run/b2bua.sock", "b2bua_socket")
+    fs.StringVar(&self.b2bua_socket, "b2bua_socket", "/var/run/b2bua.sock", "path to the B2BUA command socket or address to listen " +
+                                        "for commands in the format \"tcp:host:port\"")
+    var cli_accept_list string
+    fs.StringVar(&cli_accept_list, "cli_accept_list", "", "IP addresses or networks that the TCP command socket " +
+                                "accepts connections from (comma-separated list). If the " +
+                                "parameter is not specified, connections from any IP are accepted")
+    var cli_idle_timeout int
+    fs.IntVar(&cli_idle_timeout, "cli_idle_timeout", 300, "time after which an idle command socket session is " +
+                                "closed, 0 to disable (seconds)")
+    fs.StringVar(&self.http_api, "http_api", "", "address to listen for the HTTP management API requests " +
+                                "in the format \"host:port\" (disabled if not specified)")
+    fs.StringVar(&self.http_api_token, "http_api_token", "", "token the HTTP management API clients " +
+                                "authenticate with (\"Authorization: Bearer <token>\")")
+    fs.StringVar(&self.hep_collector, "hep_collector", "", "address of the HEPv3 (Homer) collector to send the " +
+                                "copies of all SIP messages to in the format \"host:port\" " +
+                                "(disabled if not specified)")
+    fs.IntVar(&self.hep_capture_id, "hep_capture_id", 0, "capture agent ID sent to the HEPv3 collector")
+    fs.StringVar(&self.hep_auth_key, "hep_auth_key", "", "authentication key sent to the HEPv3 collector")
+    fs.StringVar(&self.trace_dir, "trace_dir", "/var/tmp", "directory to write the per call SIP traces armed " +
+                                "with the \"trace\" command to")
+    var log_level string
+    fs.StringVar(&log_level, "log_level", "debug", "minimal level of the messages written to the error log " +
+                                "(debug, info, warning or error)")
+    fs.StringVar(&self.log_format, "log_format", "text", "format of the error log and the SIP log records, " +
+                                "either \"text\" or \"json\"")
+    fs.StringVar(&self.log_syslog, "log_syslog", "", "syslog facility to send the error log to instead of " +
+                                "the log file, e.g. \"local0\" (disabled if not specified)")
+    fs.StringVar(&self.cdr_csv, "cdr_csv", "", "file to write the CDRs in the CSV format to (disabled if " +
+                                "not specified)")
+    fs.StringVar(&self.cdr_json, "cdr_json", "", "file to write the CDRs in the JSON lines format to " +
+                                "(disabled if not specified)")
+    fs.StringVar(&self.cdr_syslog, "cdr_syslog", "", "syslog facility to send the CDRs in the JSON format " +
+                                "to, e.g. \"local1\" (disabled if not specified)")
+    fs.IntVar(&self.cdr_max_size, "cdr_max_size", 0, "size of a CDR file at which it is rotated, 0 to " +
+                                "disable the rotation (megabytes)")
+    fs.IntVar(&self.cdr_max_files, "cdr_max_files", 10, "number of the rotated CDR files to keep")
+    fs.IntVar(&self.hep_queue_size, "hep_queue_size", 10000, "maximum number of SIP messages waiting to be sent " +
+                                "to the HEPv3 collector, the messages over the limit are dropped")
+    fs.IntVar(&self.max_radiusclients, "M", 20, "max_radiusclients")
+    fs.IntVar(&self.max_radiusclients, "max_radiusclients", 20, "maximum number of Radius Client helper " +
+                                "processes to start")
+    fs.BoolVar(&self.hide_call_id, "H", false, "hide_call_id")
+    fs.BoolVar(&self.hide_call_id, "hide_call_id", false, "do not pass Call-ID header value from ingress call " +
+                                "leg to egress call leg")
+    fs.BoolVar(&self.nat_traversal, "nat_traversal", false, "enable NAT traversal for signalling")
+    fs.IntVar(&self.xmpp_b2bua_id, "xmpp_b2bua_id", 0, "ID passed to the XMPP socket server")
     var rtp_proxy_clients, rtp_proxy_client string
-    flag.StringVar(&rtp_proxy_clients, "rtp_proxy_clients", "", "comma-separated list of paths or addresses of the " +
+    fs.StringVar(&rtp_proxy_clients, "rtp_proxy_clients", "", "comma-separated list of paths or addresses of the " +
                                                                 "RTPproxy control socket. Address in the format " +
                                                                 "\"udp:host[:port]\" (comma-separated list)")
-    flag.StringVar(&rtp_proxy_client, "rtp_proxy_client", "", "RTPproxy control socket. Address in the format \"udp:host[:port]\"")
-    flag.StringVar(&self.sip_proxy, "sip_proxy", "", "address of the helper proxy to handle \"REGISTER\" " +
+    fs.StringVar(&rtp_proxy_client, "r", "", "rtp_proxy_client")
+    fs.StringVar(&rtp_proxy_client, "rtp_proxy_client", "", "RTPproxy control socket. Address in the format \"udp:host[:port]\"")
+    fs.StringVar(&self.sip_proxy, "sip_proxy", "", "address of the helper proxy to handle \"REGISTER\" " +
                                  "and \"SUBSCRIBE\" messages. Address in the format \"host[:port]\"")
-    var sip_port int
-    flag.IntVar(&sip_port, "p", 5060, "sip_port")
-    flag.IntVar(&sip_port, "sip_port", 5060, "local UDP port to listen for incoming SIP requests")
-    flag.Parse()
+    fs.IntVar(&self.sip_port, "p", 5060, "sip_port")
+    fs.IntVar(&self.sip_port, "sip_port", 5060, "local UDP port to listen for incoming SIP requests")
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
 
-    if sip_port <= 0 || sip_port > 65535 {
+    if config_file != "" {
+        if err := loadConfigFile(fs, config_file); err != nil {
+            return err
+        }
+    }
+    switch acct_level {
+    case -1:
+        // not specified
+    case 0:
+        self.acct_enable, self.start_acct_enable = false, false
+    case 1:
+        self.acct_enable, self.start_acct_enable = true, false
+    case 2:
+        self.acct_enable, self.start_acct_enable = true, true
+    default:
+        return errors.New("-A argument not in the range 0-2")
+    }
+    if alive_acct_int < 0 {
+        return errors.New("alive_acct_int should be non-negative")
+    }
+    self.alive_acct_int = time.Duration(alive_acct_int) * time.Second
+    if max_credit_time < 0 {
+        return errors.New("max_credit_time should be non-negative")
+    }
+    self.max_credit_time = time.Duration(max_credit_time) * time.Second
+    if credit_warning < 0 {
+        return errors.New("credit_warning should be non-negative")
+    }
+    if credit_warning > 0 && self.credit_warning_prompt == "" {
+        return errors.New("credit_warning requires credit_warning_prompt to be specified")
+    }
+    self.credit_warning = time.Duration(credit_warning) * time.Second
+    if keepalive_ans < 0 || keepalive_orig < 0 {
+        return errors.New("keepalive_ans and keepalive_orig should be non-negative")
+    }
+    for _, s := range strings.Split(allowed_pts, ",") {
+        s = strings.TrimSpace(s)
+        if s == "" {
+            continue
+        }
+        pt, err := strconv.Atoi(s)
+        if err != nil || pt < 0 || pt > 127 {
+            return errors.New("allowed_pts: bad payload type '" + s + "'")
+        }
+        self.allowed_pts = append(self.allowed_pts, pt)
+    }
+    if self.sip_port <= 0 || self.sip_port > 65535 {
         return errors.New("sip_port should be in the range 1-65535")
     }
+    if no_digest_auth {
+        self.digest_auth = false
+    }
+    if auth_nonce_lifetime <= 0 {
+        return errors.New("auth_nonce_lifetime should be positive")
+    }
+    self.auth_nonce_lifetime = time.Duration(auth_nonce_lifetime) * time.Second
+    if auth_http_timeout <= 0 {
+        return errors.New("auth_http_timeout should be positive")
+    }
+    self.auth_http_timeout = time.Duration(auth_http_timeout * float64(time.Second))
+    if self.registrar_min_expires <= 0 || self.registrar_max_expires < self.registrar_min_expires {
+        return errors.New("registrar_max_expires should not be less than positive registrar_min_expires")
+    }
+    if self.max_radiusclients <= 0 {
+        return errors.New("max_radiusclients should be positive")
+    }
+    var err error
+    if static_tr_in != "" {
+        if self.static_tr_in, err = parseTrRules(static_tr_in); err != nil {
+            return err
+        }
+    }
+    if static_tr_out != "" {
+        if self.static_tr_out, err = parseTrRules(static_tr_out); err != nil {
+            return err
+        }
+    }
 
-    rtp_proxy_clients += "," + rtp_proxy_client
-    arr := strings.Split(rtp_proxy_clients, ",")
+    arr := strings.Split(rtp_proxy_clients + "," + rtp_proxy_client, ",")
     for _, s := range arr {
         s = strings.TrimSpace(s)
         if s != "" {
@@ -223,11 +435,57 @@ func (self *myConfigParser) Parse() error {
     for _, s := range arr {
         s = strings.TrimSpace(s)
         if s != "" {
-            self.accept_ips[s] = true
+            self.accept_ips = append(self.accept_ips, s)
         }
     }
-    pass_headers += "," + pass_header
-    arr = strings.Split(pass_headers, ",")
+    arr = strings.Split(cli_accept_list, ",")
+    for _, s := range arr {
+        s = strings.TrimSpace(s)
+        if s == "" {
+            continue
+        }
+        ipnet, err := parseIPNet(s)
+        if err != nil {
+            return errors.New("cli_accept_list: " + err.Error())
+        }
+        self.cli_accept_list = append(self.cli_accept_list, ipnet)
+    }
+    if cli_idle_timeout < 0 {
+        return errors.New("cli_idle_timeout should not be negative")
+    }
+    if self.log_level, err = sippy_log.ParseLevel(log_level); err != nil {
+        return err
+    }
+    if self.log_format != "text" && self.log_format != "json" {
+        return errors.New("log_format should be either text or json")
+    }
+    if self.log_syslog != "" {
+        if _, err = sippy_log.ParseSyslogFacility(self.log_syslog); err != nil {
+            return err
+        }
+    }
+    if self.cdr_syslog != "" {
+        if _, err = sippy_log.ParseSyslogFacility(self.cdr_syslog); err != nil {
+            return errors.New("cdr_syslog: " + err.Error())
+        }
+    }
+    if self.cdr_max_size < 0 {
+        return errors.New("cdr_max_size should not be negative")
+    }
+    if self.cdr_max_files <= 0 {
+        return errors.New("cdr_max_files should be positive")
+    }
+    self.cli_idle_timeout = time.Duration(cli_idle_timeout) * time.Second
+    if self.http_api != "" && self.http_api_token == "" {
+        return errors.New("http_api requires http_api_token to be specified")
+    }
+    if self.hep_capture_id < 0 || self.hep_capture_id > math.MaxUint32 {
+        return errors.New("hep_capture_id is out of range")
+    }
+    if self.hep_queue_size <= 0 {
+        return errors.New("hep_queue_size should be positive")
+    }
+    arr = strings.Split(pass_headers + "," + pass_header, ",")
     for _, s := range arr {
         s = strings.TrimSpace(s)
         if s != "" {
@@ -253,17 +511,118 @@ func (self *myConfigParser) Parse() error {
     if keepalive_orig > 0 {
         self.keepalive_orig = time.Duration(keepalive_orig) * time.Second
     }
+    self.hrtb_ival = time.Duration(hrtb_ival) * time.Second
+    self.hrtb_retr_ival = time.Duration(hrtb_retr_ival) * time.Second
+    return nil
+}
+
+func (self *myConfigParser) Parse() error {
+    if err := self.parse(flag.CommandLine, os.Args[1:]); err != nil {
+        return err
+    }
     error_logger := sippy_log.NewErrorLogger()
-    sip_logger, err := sippy_log.NewSipLogger("b2bua", logfile)
+    error_logger.SetLevel(self.log_level)
+    if err := error_logger.SetFormat(self.log_format); err != nil {
+        return err
+    }
+    if self.log_syslog != "" {
+        if err := error_logger.SetSyslog(self.log_syslog, "b2bua"); err != nil {
+            return errors.New("Cannot connect to the syslog: " + err.Error())
+        }
+    }
+    sip_logger, err := sippy_log.NewSipLogger("b2bua", self.logfile)
     if err != nil {
         return err
     }
-    self.hrtb_ival = time.Duration(hrtb_ival) * time.Second
-    self.hrtb_retr_ival = time.Duration(hrtb_retr_ival) * time.Second
+    if err = sip_logger.SetFormat(self.log_format); err != nil {
+        return err
+    }
+    self.error_logger, self.sip_logger = error_logger, sip_logger
     self.Config = sippy_conf.NewConfig(error_logger, sip_logger)
-    self.SetMyPort(sippy_conf.NewMyPort(strconv.Itoa(sip_port)))
+    self.SetMyPort(sippy_conf.NewMyPort(strconv.Itoa(self.sip_port)))
+    switch self.sip_address {
+    case "*", "0.0.0.0", "::":
+        // listen on all interfaces
+    default:
+        self.SetMyAddress(sippy_conf.NewMyAddress(self.sip_address))
+        self.SetSipAddress(self.GetMyAddress())
+    }
+    self.SetAllowFormats(self.allowed_pts)
     return nil
 }
+
+// Reload parses the command line and the config file again. The result
+// shares the SIP stack configuration and the loggers with the current one.
+func (self *myConfigParser) Reload() (*myConfigParser, error) {
+    fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+    fs.SetOutput(io.Discard)
+    cfg := NewMyConfigParser()
+    if err := cfg.parse(fs, os.Args[1:]); err != nil {
+        return nil, err
+    }
+    cfg.Config = self.Config
+    cfg.error_logger, cfg.sip_logger = self.error_logger, self.sip_logger
+    return cfg, nil
+}
+
+// ReopenLogs reopens the log files, e.g. after they have been rotated.
+func (self *myConfigParser) ReopenLogs() error {
+    if err := self.sip_logger.Reopen(); err != nil {
+        return err
+    }
+    return self.error_logger.Reopen()
+}
+
+// keepStartupOptions copies the values of the options that are only used
+// at startup, see restart_options.
+func (self *myConfigParser) keepStartupOptions(old *myConfigParser) {
+    self.foreground = old.foreground
+    self.pidfile = old.pidfile
+    self.logfile = old.logfile
+    self.sip_address = old.sip_address
+    self.sip_port = old.sip_port
+    self.nat_traversal = old.nat_traversal
+    self.xmpp_b2bua_id = old.xmpp_b2bua_id
+    self.trunks = old.trunks
+    self.sip_proxy = old.sip_proxy
+    self.auth_enable = old.auth_enable
+    self.digest_auth_only = old.digest_auth_only
+    self.digest_auth_only_ips = old.digest_auth_only_ips
+    self.auth_store = old.auth_store
+    self.auth_http_timeout = old.auth_http_timeout
+    self.auth_fallback_route = old.auth_fallback_route
+    self.auth_nonce_lifetime = old.auth_nonce_lifetime
+    self.max_calls = old.max_calls
+    self.max_cps = old.max_cps
+    self.source_limits = old.source_limits
+    self.limit_scode = old.limit_scode
+    self.limit_retry_after = old.limit_retry_after
+    self.registrar = old.registrar
+    self.registrar_db = old.registrar_db
+    self.registrar_min_expires = old.registrar_min_expires
+    self.registrar_max_expires = old.registrar_max_expires
+    self.radiusclient = old.radiusclient
+    self.radiusclient_conf = old.radiusclient_conf
+    self.max_radiusclients = old.max_radiusclients
+    self.b2bua_socket = old.b2bua_socket
+    self.cli_accept_list = old.cli_accept_list
+    self.cli_idle_timeout = old.cli_idle_timeout
+    self.http_api = old.http_api
+    self.hep_collector = old.hep_collector
+    self.hep_capture_id = old.hep_capture_id
+    self.hep_auth_key = old.hep_auth_key
+    self.hep_queue_size = old.hep_queue_size
+    self.trace_dir = old.trace_dir
+    self.log_level = old.log_level
+    self.log_format = old.log_format
+    self.log_syslog = old.log_syslog
+    self.cdr_csv = old.cdr_csv
+    self.cdr_json = old.cdr_json
+    self.cdr_syslog = old.cdr_syslog
+    self.cdr_max_size = old.cdr_max_size
+    self.cdr_max_files = old.cdr_max_files
+    self.http_api_token = old.http_api_token
+}
 /*
 from ConfigParser import RawConfigParser
 from SipConf import SipConf
@@ -484,11 +843,3 @@ if __name__ == '__main__':
     assert m['_accept_ips'][0] == '1.2.3.4'
     assert m['_accept_ips'][1] == '5.6.7.8'
 */
-
-func (self *myConfigParser) checkIP(ip string) bool {
-    if len(self.accept_ips) == 0 {
-        return true
-    }
-    _, ok := self.accept_ips[ip]
-    return ok
-}
@@ -0,0 +1,143 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "encoding/binary"
+    "errors"
+    "io"
+    "net"
+    "time"
+)
+
+// The pcap files carry the raw IP packets, so that both IPv4 and IPv6
+// can be stored in the same file.
+const pcap_linktype_raw = 101
+
+func writePcapHeader(w io.Writer) error {
+    var hdr [24]byte
+    binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+    binary.LittleEndian.PutUint16(hdr[4:], 2)
+    binary.LittleEndian.PutUint16(hdr[6:], 4)
+    binary.LittleEndian.PutUint32(hdr[16:], 65535)
+    binary.LittleEndian.PutUint32(hdr[20:], pcap_linktype_raw)
+    _, err := w.Write(hdr[:])
+    return err
+}
+
+func splitTraceAddr(addr net.Addr) (net.IP, int, error) {
+    switch a := addr.(type) {
+    case *net.UDPAddr:
+        return a.IP, a.Port, nil
+    case *net.TCPAddr:
+        return a.IP, a.Port, nil
+    }
+    return nil, 0, errors.New("unsupported address type")
+}
+
+func ipChecksum(sum uint32, data []byte) uint32 {
+    for i := 0; i + 1 < len(data); i += 2 {
+        sum += uint32(binary.BigEndian.Uint16(data[i:]))
+    }
+    if len(data) % 2 == 1 {
+        sum += uint32(data[len(data) - 1]) << 8
+    }
+    return sum
+}
+
+func foldChecksum(sum uint32) uint16 {
+    for sum > 0xffff {
+        sum = (sum >> 16) + (sum & 0xffff)
+    }
+    return ^uint16(sum)
+}
+
+// Writes the SIP message as a UDP datagram, the IP and UDP headers are
+// synthesized from the addresses since the socket doesn't provide them.
+func writePcapPacket(w io.Writer, data []byte, src, dst net.Addr, ts time.Time) error {
+    src_ip, src_port, err := splitTraceAddr(src)
+    if err != nil {
+        return err
+    }
+    dst_ip, dst_port, err := splitTraceAddr(dst)
+    if err != nil {
+        return err
+    }
+    udp := make([]byte, 8, 8 + len(data))
+    binary.BigEndian.PutUint16(udp[0:], uint16(src_port))
+    binary.BigEndian.PutUint16(udp[2:], uint16(dst_port))
+    binary.BigEndian.PutUint16(udp[4:], uint16(8 + len(data)))
+    udp = append(udp, data...)
+    var ip []byte
+    src4, dst4 := src_ip.To4(), dst_ip.To4()
+    if src4 != nil && dst4 != nil {
+        ip = make([]byte, 20)
+        ip[0] = 0x45
+        binary.BigEndian.PutUint16(ip[2:], uint16(20 + len(udp)))
+        binary.BigEndian.PutUint16(ip[6:], 0x4000) // DF
+        ip[8] = 64
+        ip[9] = 17
+        copy(ip[12:], src4)
+        copy(ip[16:], dst4)
+        binary.BigEndian.PutUint16(ip[10:], foldChecksum(ipChecksum(0, ip)))
+        // The UDP checksum is optional over IPv4
+    } else {
+        src6, dst6 := src_ip.To16(), dst_ip.To16()
+        if src6 == nil {
+            src6 = net.IPv6unspecified
+        }
+        if dst6 == nil {
+            dst6 = net.IPv6unspecified
+        }
+        ip = make([]byte, 40)
+        ip[0] = 0x60
+        binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+        ip[6] = 17
+        ip[7] = 64
+        copy(ip[8:], src6)
+        copy(ip[24:], dst6)
+        sum := ipChecksum(0, ip[8:40])
+        sum += uint32(len(udp)) + 17
+        csum := foldChecksum(ipChecksum(sum, udp))
+        if csum == 0 {
+            csum = 0xffff
+        }
+        binary.BigEndian.PutUint16(udp[6:], csum)
+    }
+    var hdr [16]byte
+    binary.LittleEndian.PutUint32(hdr[0:], uint32(ts.Unix()))
+    binary.LittleEndian.PutUint32(hdr[4:], uint32(ts.Nanosecond() / 1000))
+    binary.LittleEndian.PutUint32(hdr[8:], uint32(len(ip) + len(udp)))
+    binary.LittleEndian.PutUint32(hdr[12:], uint32(len(ip) + len(udp)))
+    if _, err = w.Write(hdr[:]); err != nil {
+        return err
+    }
+    if _, err = w.Write(ip); err != nil {
+        return err
+    }
+    _, err = w.Write(udp)
+    return err
+}
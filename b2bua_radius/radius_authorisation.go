@@ -24,6 +24,83 @@
 // (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
 // SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package main
+
+import (
+    "fmt"
+    "time"
+)
+
+type radiusAuthorisation struct {
+    *radiusClient
+    global_config   *myConfigParser
+}
+
+func newRadiusAuthorisation(global_config *myConfigParser) *radiusAuthorisation {
+    return &radiusAuthorisation{
+        radiusClient    : newRadiusClient(global_config),
+        global_config   : global_config,
+    }
+}
+
+func (self *radiusAuthorisation) Authenticate(req *authRequest, result_cb func(*authResult)) {
+    var attributes [][2]string
+    if req.auth != nil {
+        attributes = radiusDigestAttributes(req)
+    } else {
+        attributes = [][2]string{ { "User-Name", req.remote_ip }, { "Password", "cisco" } }
+    }
+    h323_cid := ""
+    if req.cGUID != nil {
+        h323_cid = req.cGUID.Body()
+    }
+    attributes = append(attributes, [][2]string{
+        { "Calling-Station-Id", req.cli }, { "Called-Station-Id", req.cld }, { "h323-conf-id", h323_cid },
+        { "call-id", req.call_id }, { "h323-remote-address", req.remote_ip }, { "h323-session-protocol", "sipv2" },
+    }...)
+    message := "sending AAA request:\n"
+    for _, av := range attributes {
+        message += fmt.Sprintf("%-32s = '%s'\n", av[0], av[1])
+    }
+    self.global_config.SipLogger().Write(nil, req.call_id, message)
+    btime := time.Now()
+    self.do_auth(attributes, func(results [][2]string, rcode int) { self._process_result(results, rcode, result_cb, req.call_id, btime) })
+}
+
+// The RFC 5090 attributes that allow the server to verify the digest
+// response. The qop, nonce count and client nonce take part in the
+// response calculation whenever the client has used the qop.
+func radiusDigestAttributes(req *authRequest) [][2]string {
+    attributes := [][2]string{
+        { "User-Name", req.username }, { "Digest-Realm", req.auth.GetRealm() },
+        { "Digest-Nonce", req.auth.GetNonce() }, { "Digest-Method", req.method }, { "Digest-URI", req.auth.GetUri() },
+        { "Digest-Algorithm", req.digestAlgorithm() }, { "Digest-User-Name", req.username }, { "Digest-Response", req.auth.GetResponse() },
+    }
+    if qop := req.auth.GetQop(); qop != "" {
+        attributes = append(attributes, [][2]string{
+            { "Digest-Qop", qop }, { "Digest-Nonce-Count", req.auth.GetNc() }, { "Digest-CNonce", req.auth.GetCnonce() },
+        }...)
+    }
+    return attributes
+}
+
+func (self *radiusAuthorisation) _process_result(results [][2]string, rcode int, result_cb func(*authResult), sip_cid string, btime time.Time) {
+    delay := time.Now().Sub(btime).Seconds()
+    var message string
+    if rcode == 0 || rcode == 1 {
+        if rcode == 0 {
+            message = fmt.Sprintf("AAA request accepted (delay is %.3f), processing response:\n", delay)
+        } else {
+            message = fmt.Sprintf("AAA request rejected (delay is %.3f), processing response:\n", delay)
+        }
+        for _, av := range results {
+            message += fmt.Sprintf("%-32s = '%s'\n", av[0], av[1])
+        }
+    } else {
+        message = fmt.Sprintf("Error sending AAA request (delay is %.3f)\n", delay)
+    }
+    self.global_config.SipLogger().Write(nil, sip_cid, message)
+    result_cb(&authResult{ ok : rcode == 0, attributes : results })
+}
 /*
 from Radius_client import Radius_client
 from time import time
@@ -25,6 +25,98 @@
 // (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
 // SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+)
+
+var _avpair_names = map[string]bool{
+    "call-id" : true, "h323-session-protocol" : true, "h323-ivr-out" : true, "h323-incoming-conf-id" : true,
+    "release-source" : true, "alert-timepoint" : true, "provisional-timepoint" : true,
+}
+
+var _cisco_vsa_names = map[string]bool{
+    "h323-remote-address" : true, "h323-conf-id" : true, "h323-setup-time" : true, "h323-call-origin" : true,
+    "h323-call-type" : true, "h323-connect-time" : true, "h323-disconnect-time" : true, "h323-disconnect-cause" : true,
+    "h323-voice-quality" : true, "h323-credit-time" : true, "h323-return-code" : true, "h323-redirect-number" : true,
+    "h323-preferred-lang" : true, "h323-billing-model" : true, "h323-currency" : true,
+}
+
+type radiusClient struct {
+    *externalCommand
+}
+
+func newRadiusClient(global_config *myConfigParser) *radiusClient {
+    command := []string{ global_config.radiusclient }
+    if global_config.radiusclient_conf != "" {
+        command = append(command, "-f", global_config.radiusclient_conf)
+    }
+    command = append(command, "-s")
+    return &radiusClient{
+        externalCommand : newExternalCommand(command, global_config.max_radiusclients, global_config.ErrorLogger()),
+    }
+}
+
+func (self *radiusClient) _prepare_attributes(_type string, attributes [][2]string) []string {
+    data := []string{ _type }
+    for _, av := range attributes {
+        a, v := av[0], av[1]
+        if _avpair_names[a] {
+            v = a + "=" + v
+            a = "Cisco-AVPair"
+        } else if _cisco_vsa_names[a] {
+            v = a + "=" + v
+        }
+        data = append(data, fmt.Sprintf("%s=\"%s\"", a, v))
+    }
+    return data
+}
+
+// The result_cb receives the reply attributes and the return code, which
+// is 0 when the request has been accepted, 1 when it has been rejected and
+// -1 on error.
+func (self *radiusClient) do_auth(attributes [][2]string, result_cb func([][2]string, int)) {
+    self.processCommand(self._prepare_attributes("AUTH", attributes), func(result []string) { self.process_result(result_cb, result) })
+}
+
+func (self *radiusClient) do_acct(attributes [][2]string, result_cb func([][2]string, int)) {
+    self.processCommand(self._prepare_attributes("ACCT", attributes), func(result []string) { self.process_result(result_cb, result) })
+}
+
+func (self *radiusClient) process_result(result_cb func([][2]string, int), result []string) {
+    if result_cb == nil {
+        return
+    }
+    if len(result) == 0 {
+        result_cb(nil, -1)
+        return
+    }
+    rcode, err := strconv.Atoi(result[len(result) - 1])
+    if err != nil {
+        result_cb(nil, -1)
+        return
+    }
+    nav := [][2]string{}
+    for _, av := range result[:len(result) - 1] {
+        tmp := strings.SplitN(av, " = ", 2)
+        if len(tmp) != 2 {
+            continue
+        }
+        a, v := strings.TrimSpace(tmp[0]), strings.Trim(strings.TrimSpace(tmp[1]), "'")
+        if a == "Cisco-AVPair" || _cisco_vsa_names[a] {
+            t := strings.SplitN(v, "=", 2)
+            if len(t) > 1 {
+                a, v = t[0], t[1]
+            }
+        } else if strings.HasPrefix(v, a + "=") {
+            v = v[len(a) + 1:]
+        }
+        nav = append(nav, [2]string{ a, v })
+    }
+    result_cb(nav, rcode)
+}
 /*
 from External_command import External_command
 
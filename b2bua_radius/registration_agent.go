@@ -0,0 +1,429 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "encoding/csv"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "sippy"
+    "sippy/conf"
+    "sippy/headers"
+    "sippy/types"
+)
+
+// The trunks file is a CSV file with the following columns:
+//
+//     name,registrar,username,password,expires,route
+//
+// The name identifies the trunk in the CLI output, the registrar is the
+// "host[:port]" of the upstream registrar and the username and password are
+// the credentials to register with. The expires is the registration
+// lifetime to request in seconds (3600 when empty). The route is an
+// optional B2BRoute string to be used for the calls coming in from the
+// trunk. Lines starting with "#" are ignored.
+//
+// Each trunk is registered with the Contact of "sip:<username>@<our address>"
+// and the registration is refreshed before the granted lifetime runs out.
+// The failed registrations are retried with the exponential back off.
+
+const (
+    reg_default_expires = 3600
+    reg_min_backoff     = 30 * time.Second
+    reg_max_backoff     = 30 * time.Minute
+    reg_max_auth_tries  = 3
+)
+
+type regAgent struct {
+    name            string
+    username        string
+    password        string
+    registrar       string
+    expires         int
+    route           *B2BRoute
+    config          sippy_conf.Config
+    sip_tm          sippy_types.SipTransactionManager
+    lock            sync.Mutex
+    ruri            *sippy_header.SipURL
+    from            *sippy_header.SipFrom
+    to              *sippy_header.SipTo
+    contact         *sippy_header.SipContact
+    call_id         *sippy_header.SipCallId
+    cseq            int
+    nonce_counts    *sippy_header.NonceCounter
+    auth_tries      int
+    status          string
+    expires_at      time.Time
+    backoff         time.Duration
+    raddr           string
+    timer           *sippy.Timeout
+    stopped         bool
+}
+
+func newRegAgent(name, registrar, username, password string, expires int, route *B2BRoute, config sippy_conf.Config) (*regAgent, error) {
+    if username == "" {
+        return nil, errors.New("empty username")
+    }
+    host_port := strings.SplitN(registrar, ":", 2)
+    if host_port[0] == "" {
+        return nil, errors.New("empty registrar")
+    }
+    var port *sippy_conf.MyPort
+    if len(host_port) == 2 {
+        if n, err := strconv.Atoi(host_port[1]); err != nil || n <= 0 || n > 65535 {
+            return nil, fmt.Errorf("bad registrar port '%s'", host_port[1])
+        }
+        port = sippy_conf.NewMyPort(host_port[1])
+    }
+    aor := sippy_header.NewSipURL(username, sippy_conf.NewMyAddress(host_port[0]), nil, false)
+    from := sippy_header.NewSipFrom(sippy_header.NewSipAddress("", aor), config)
+    from.GenTag()
+    self := &regAgent{
+        name            : name,
+        username        : username,
+        password        : password,
+        registrar       : registrar,
+        expires         : expires,
+        route           : route,
+        config          : config,
+        ruri            : sippy_header.NewSipURL("", sippy_conf.NewMyAddress(host_port[0]), port, false),
+        from            : from,
+        to              : sippy_header.NewSipTo(sippy_header.NewSipAddress("", aor.GetCopy()), config),
+        contact         : sippy_header.NewSipContactFromAddress(sippy_header.NewSipAddress("",
+                                sippy_header.NewSipURL(username, config.GetMyAddress(), config.GetMyPort(), false))),
+        call_id         : sippy_header.GenerateSipCallId(config),
+        nonce_counts    : sippy_header.NewNonceCounter(),
+        status          : "not registered",
+        backoff         : reg_min_backoff,
+    }
+    return self, nil
+}
+
+func (self *regAgent) start(sip_tm sippy_types.SipTransactionManager) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.sip_tm = sip_tm
+    self.sendRegister(nil, nil)
+}
+
+// Cancel the refreshes and remove our binding from the registrar so that
+// it doesn't send the calls to us anymore.
+func (self *regAgent) stop() {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if self.timer != nil {
+        self.timer.Cancel()
+        self.timer = nil
+    }
+    registered := self.isRegistered(time.Now())
+    self.stopped = true
+    self.status = "stopped"
+    self.expires_at = time.Time{}
+    if registered && self.sip_tm != nil {
+        self.auth_tries = 0
+        self.sendRegister(nil, nil)
+    } else {
+        // Ignore the responses to the requests in flight
+        self.cseq++
+    }
+}
+
+func (self *regAgent) refresh() {
+    self.timer = nil
+    self.auth_tries = 0
+    self.sendRegister(nil, nil)
+}
+
+func (self *regAgent) sendRegister(challenge *sippy_header.SipWWWAuthenticate, auth_func sippy_header.NewSipXXXAuthorizationFunc) {
+    self.cseq++
+    expires := sippy_header.NewSipExpires()
+    expires.Number = self.expires
+    if self.stopped {
+        expires.Number = 0
+    }
+    var req sippy_types.SipRequest = sippy.NewSipRequest(/*method*/ "REGISTER", /*ruri*/ self.ruri.GetCopy(), /*sipver*/ "",
+                    /*to*/ self.to.GetCopy(), /*fr0m*/ self.from.GetCopy(), /*via*/ nil, /*cseq*/ self.cseq,
+                    /*callid*/ self.call_id.GetCopy(), /*maxforwards*/ nil, /*body*/ nil, /*contact*/ self.contact.GetCopy(),
+                    /*routes*/ nil, /*target*/ nil, /*cguid*/ nil, /*user_agent*/ nil, /*expires*/ expires, self.config)
+    if challenge != nil {
+        req.AppendHeader(auth_func(/*challenge*/ challenge, /*method*/ "REGISTER", /*uri*/ self.ruri.String(),
+          /*username*/ self.username, /*password*/ self.password, /*nc*/ self.nonce_counts.Next(challenge), ""))
+    }
+    _, err := self.sip_tm.BeginNewClientTransaction(req, self, &self.lock, nil, nil, nil)
+    if err != nil {
+        self.failed("cannot send REGISTER: " + err.Error())
+    }
+}
+
+func (self *regAgent) RecvResponse(resp sippy_types.SipResponse, t sippy_types.ClientTransaction) {
+    code, reason := resp.GetSCode()
+    if code < 200 || resp.GetCSeq().CSeq != self.cseq {
+        return
+    }
+    if (code == 401 || code == 407) && self.password != "" && self.auth_tries < reg_max_auth_tries {
+        var challenge *sippy_header.SipWWWAuthenticate
+        auth_func := sippy_header.NewSipWWWAuthorization
+        if code == 401 {
+            challenge = sippy_header.BestChallenge(resp.GetSipWWWAuthenticates())
+        } else {
+            challenge = sippy_header.BestProxyChallenge(resp.GetSipProxyAuthenticates())
+            auth_func = sippy_header.NewSipProxyAuthorization
+        }
+        // Repeated challenge means the credentials have been rejected
+        // unless the registrar says that just the nonce is stale.
+        if challenge != nil && (self.auth_tries == 0 || challenge.GetStale()) {
+            self.auth_tries++
+            self.sendRegister(challenge, auth_func)
+            return
+        }
+    }
+    if self.stopped {
+        return
+    }
+    if code >= 300 {
+        self.failed(fmt.Sprintf("%d %s", code, reason))
+        return
+    }
+    granted := self.grantedExpires(resp)
+    if granted <= 0 {
+        self.failed(fmt.Sprintf("%d %s (no binding granted)", code, reason))
+        return
+    }
+    self.status = fmt.Sprintf("%d %s", code, reason)
+    self.expires_at = time.Now().Add(time.Duration(granted) * time.Second)
+    self.backoff = reg_min_backoff
+    self.auth_tries = 0
+    self.raddr = resp.GetSource().Host.String()
+    // Refresh when the 80% of the lifetime has passed
+    self.timer = sippy.StartTimeout(self.refresh, &self.lock, time.Duration(granted) * 800 * time.Millisecond, 1, self.config.ErrorLogger())
+}
+
+// Returns the lifetime of our binding from the 2xx response. The expires
+// parameter of our Contact takes precedence over the Expires header.
+func (self *regAgent) grantedExpires(resp sippy_types.SipResponse) int {
+    for _, contact := range resp.GetContacts() {
+        if ! self.isOurContact(contact) {
+            continue
+        }
+        if expires, err := strconv.Atoi(contact.Address.GetParam("expires")); err == nil {
+            return expires
+        }
+    }
+    if expires, ok := resp.GetFirstHF("expires").(*sippy_header.SipExpires); ok {
+        return expires.Number
+    }
+    return self.expires
+}
+
+// Whether the Contact listed by the registrar is the one we have
+// registered, the other bindings of the same user may be listed too.
+func (self *regAgent) isOurContact(contact *sippy_header.SipContact) bool {
+    if contact.Asterisk {
+        return false
+    }
+    url, our_url := contact.Address.GetUrl(), self.contact.Address.GetUrl()
+    return url.Username == our_url.Username &&
+      strings.EqualFold(url.GetAddr(self.config).String(), our_url.GetAddr(self.config).String())
+}
+
+func (self *regAgent) failed(status string) {
+    if self.stopped {
+        self.status = status
+        return
+    }
+    self.status = status
+    self.config.ErrorLogger().Error(fmt.Sprintf("trunk %s: registration at %s failed: %s, retrying in %s",
+      self.name, self.registrar, status, self.backoff.String()))
+    self.timer = sippy.StartTimeout(self.refresh, &self.lock, self.backoff, 1, self.config.ErrorLogger())
+    self.backoff *= 2
+    if self.backoff > reg_max_backoff {
+        self.backoff = reg_max_backoff
+    }
+}
+
+func (self *regAgent) isRegistered(now time.Time) bool {
+    return now.Before(self.expires_at)
+}
+
+type trunkTable struct {
+    fname           string
+    agents          []*regAgent
+}
+
+func NewTrunkTable(fname string, config sippy_conf.Config) (*trunkTable, error) {
+    fd, err := os.Open(fname)
+    if err != nil {
+        return nil, err
+    }
+    defer fd.Close()
+    agents, err := parseTrunks(fd, config)
+    if err != nil {
+        return nil, errors.New(fname + ": " + err.Error())
+    }
+    return &trunkTable{
+        fname   : fname,
+        agents  : agents,
+    }, nil
+}
+
+func parseTrunks(r io.Reader, config sippy_conf.Config) ([]*regAgent, error) {
+    reader := csv.NewReader(r)
+    reader.Comment = '#'
+    reader.FieldsPerRecord = 6
+    reader.TrimLeadingSpace = true
+    agents := []*regAgent{}
+    names := make(map[string]bool)
+    for {
+        record, err := reader.Read()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, err
+        }
+        line, _ := reader.FieldPos(0)
+        for i := range record {
+            record[i] = strings.TrimSpace(record[i])
+        }
+        name, registrar, username, password, sexpires, sroute := record[0], record[1], record[2], record[3], record[4], record[5]
+        if name == "" || names[name] {
+            return nil, fmt.Errorf("line %d: empty or duplicate trunk name '%s'", line, name)
+        }
+        names[name] = true
+        expires := reg_default_expires
+        if sexpires != "" {
+            expires, err = strconv.Atoi(sexpires)
+            if err != nil || expires <= 0 {
+                return nil, fmt.Errorf("line %d: bad expires '%s'", line, sexpires)
+            }
+        }
+        var route *B2BRoute
+        if sroute != "" {
+            route, err = NewB2BRoute(sroute, config)
+            if err != nil {
+                return nil, fmt.Errorf("line %d: %s", line, err.Error())
+            }
+        }
+        agent, err := newRegAgent(name, registrar, username, password, expires, route, config)
+        if err != nil {
+            return nil, fmt.Errorf("line %d: %s", line, err.Error())
+        }
+        agents = append(agents, agent)
+    }
+    return agents, nil
+}
+
+func (self *trunkTable) Start(sip_tm sippy_types.SipTransactionManager) {
+    for _, agent := range self.agents {
+        agent.start(sip_tm)
+    }
+}
+
+func (self *trunkTable) Stop() {
+    for _, agent := range self.agents {
+        agent.stop()
+    }
+}
+
+// Find the registered trunk the incoming request has been sent to, i.e.
+// the one whose Contact user matches the user part of the Request-URI.
+// When several trunks share the username the one which registration has
+// been accepted from the request source wins.
+func (self *trunkTable) Match(ruri *sippy_header.SipURL, source string) *regAgent {
+    var res *regAgent
+    now := time.Now()
+    for _, agent := range self.agents {
+        agent.lock.Lock()
+        ok := agent.username == ruri.Username && agent.isRegistered(now)
+        raddr := agent.raddr
+        agent.lock.Unlock()
+        if ! ok {
+            continue
+        }
+        if raddr == source {
+            return agent
+        }
+        if res == nil {
+            res = agent
+        }
+    }
+    return res
+}
+
+type trunkStatus struct {
+    Name            string  `json:"name"`
+    Username        string  `json:"username"`
+    Registrar       string  `json:"registrar"`
+    Registered      bool    `json:"registered"`
+    Expires         int     `json:"expires"`
+    Status          string  `json:"status"`
+}
+
+// The reply of the "reg" command
+type trunksStatus struct {
+    Trunks          []*trunkStatus `json:"trunks"`
+    Total           int            `json:"total"`
+}
+
+func (self *trunksStatus) String() string {
+    res := "Trunks:\n"
+    for _, trunk := range self.Trunks {
+        state := "unregistered"
+        if trunk.Registered {
+            state = fmt.Sprintf("registered, expires in %ds", trunk.Expires)
+        }
+        res += fmt.Sprintf("%s: %s@%s %s (%s)\n", trunk.Name, trunk.Username, trunk.Registrar, state, trunk.Status)
+    }
+    return res + fmt.Sprintf("Total: %d\n", self.Total)
+}
+
+func (self *trunkTable) Status() *trunksStatus {
+    res := &trunksStatus{ Trunks : []*trunkStatus{}, Total : len(self.agents) }
+    now := time.Now()
+    for _, agent := range self.agents {
+        agent.lock.Lock()
+        trunk := &trunkStatus{
+            Name            : agent.name,
+            Username        : agent.username,
+            Registrar       : agent.registrar,
+            Registered      : agent.isRegistered(now),
+            Status          : agent.status,
+        }
+        if trunk.Registered {
+            trunk.Expires = int(agent.expires_at.Sub(now).Seconds())
+        }
+        agent.lock.Unlock()
+        res.Trunks = append(res.Trunks, trunk)
+    }
+    return res
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+
+    "sippy"
+    "sippy/conf"
+    "sippy/log"
+    "sippy/time"
+)
+
+const test_trunks = `
+# name,registrar,username,password,expires,route
+carrier1,sip.example.com,1001,secret,,192.0.2.1
+carrier2,192.0.2.2:5080,1002,secret,600,
+carrier3,192.0.2.3,1001,secret,600,
+`
+
+const test_register_200 = "SIP/2.0 200 OK\r\n" +
+    "Via: SIP/2.0/UDP 192.0.2.100:5060;branch=z9hG4bK776asdhds\r\n" +
+    "From: <sip:1002@192.0.2.2>;tag=1928301774\r\n" +
+    "To: <sip:1002@192.0.2.2>;tag=a6c85cf\r\n" +
+    "Call-ID: a84b4c76e66710@192.0.2.100\r\n" +
+    "CSeq: 1 REGISTER\r\n" +
+    "Contact: <sip:1002@198.51.100.1>;expires=3600, <sip:1002@192.0.2.100:5080>;expires=60, " +
+      "<sip:1002@192.0.2.100:5060>;expires=120\r\n" +
+    "Expires: 600\r\n" +
+    "Content-Length: 0\r\n\r\n"
+
+func TestParseTrunks(t *testing.T) {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+    config.SetMyAddress(sippy_conf.NewMyAddress("192.0.2.100"))
+    config.SetMyPort(sippy_conf.NewMyPort("5060"))
+    agents, err := parseTrunks(strings.NewReader(test_trunks), config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(agents) != 3 {
+        t.Fatalf("expected 3 trunks, got %d", len(agents))
+    }
+    if agents[0].expires != reg_default_expires || agents[0].route == nil || agents[1].route != nil {
+        t.Fatal("bad trunk parameters")
+    }
+    if agents[1].ruri.String() != "sip:192.0.2.2:5080" {
+        t.Fatalf("bad registrar URI: %s", agents[1].ruri.String())
+    }
+    for _, bad := range []string{
+        "carrier1,sip.example.com,1001,secret,,\ncarrier1,sip.example.com,1002,secret,,\n",
+        "carrier1,,1001,secret,,\n",
+        "carrier1,sip.example.com,,secret,,\n",
+        "carrier1,sip.example.com:0,1001,secret,,\n",
+        "carrier1,sip.example.com,1001,secret,-1,\n",
+    } {
+        if _, err = parseTrunks(strings.NewReader(bad), config); err == nil {
+            t.Errorf("no error parsing %q", bad)
+        }
+    }
+
+    rtime, _ := sippy_time.NewMonoTime()
+    resp, err := sippy.ParseSipResponse([]byte(test_register_200), rtime, config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if expires := agents[1].grantedExpires(resp); expires != 120 {
+        t.Errorf("expected granted expires of 120, got %d", expires)
+    }
+    if expires := agents[0].grantedExpires(resp); expires != 600 {
+        t.Errorf("expected granted expires of 600, got %d", expires)
+    }
+
+    trunks := &trunkTable{ agents : agents }
+    ruri := agents[0].contact.Address.GetUrl()
+    if trunks.Match(ruri, "192.0.2.3") != nil {
+        t.Error("matched an unregistered trunk")
+    }
+    agents[0].expires_at = time.Now().Add(time.Minute)
+    agents[2].expires_at = time.Now().Add(time.Minute)
+    agents[2].raddr = "192.0.2.3"
+    if agent := trunks.Match(ruri, "192.0.2.3"); agent != agents[2] {
+        t.Error("the trunk registered from the source has not been preferred")
+    }
+    if agent := trunks.Match(ruri, "192.0.2.4"); agent != agents[0] {
+        t.Error("the first registered trunk has not been matched")
+    }
+}
+
+// Reply 200 OK to the REGISTER listing the bindings.
+func (self *testSipPeer) replyWithContacts(req *testSipMsg, contacts string) {
+    msg := "SIP/2.0 200 OK\r\n"
+    for _, via := range req.allHeaders("via") {
+        msg += "Via: " + via + "\r\n"
+    }
+    msg += "From: " + req.header("from") + "\r\n" +
+        "To: " + req.header("to") + ";tag=registrar-tag\r\n" +
+        "Call-ID: " + req.header("call-id") + "\r\n" +
+        "CSeq: " + req.header("cseq") + "\r\n"
+    if contacts != "" {
+        msg += "Contact: " + contacts + "\r\n"
+    }
+    via_hp := strings.Fields(strings.SplitN(req.header("via"), ";", 2)[0])
+    self.send(via_hp[len(via_hp) - 1], withBody(msg, ""))
+}
+
+func TestRegAgentStop(t *testing.T) {
+    registrar := newTestSipPeer(t, "registrar")
+    defer registrar.close()
+    tmpdir, err := ioutil.TempDir("", "regtest")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(tmpdir)
+    sip_logger, err := sippy_log.NewSipLogger("test", filepath.Join(tmpdir, "sip.log"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), sip_logger)
+    port := freeUdpPort(t)
+    config.SetMyAddress(sippy_conf.NewMyAddress("127.0.0.1"))
+    config.SetSipAddress(config.GetMyAddress())
+    config.SetMyPort(sippy_conf.NewMyPort(port))
+    sip_tm, err := sippy.NewSipTransactionManager(config, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    go sip_tm.Run()
+    defer sip_tm.Shutdown()
+    agent, err := newRegAgent("test", registrar.hostport(), "1001", "secret", 600, nil, config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    agent.start(sip_tm)
+    req := registrar.expectRequest("REGISTER")
+    if req.header("expires") != "600" {
+        t.Errorf("Unexpected Expires: %s", req.header("expires"))
+    }
+    // The binding of the other instance of the same user is ignored
+    registrar.replyWithContacts(req, "<sip:1001@127.0.0.2:" + port + ">;expires=3600, <" + req.contact() + ">;expires=300")
+    if ! waitFor(func() bool { agent.lock.Lock(); defer agent.lock.Unlock(); return agent.isRegistered(time.Now()) }, 3 * time.Second) {
+        t.Fatalf("The trunk has not been registered: %s", agent.status)
+    }
+    agent.lock.Lock()
+    expires_in := agent.expires_at.Sub(time.Now())
+    agent.lock.Unlock()
+    if expires_in > 300 * time.Second || expires_in < 290 * time.Second {
+        t.Errorf("Unexpected registration lifetime: %s", expires_in)
+    }
+    // The binding is removed on stop
+    agent.stop()
+    req = registrar.expectRequest("REGISTER")
+    if req.header("expires") != "0" {
+        t.Errorf("Unexpected Expires of the unregister: %s", req.header("expires"))
+    }
+    registrar.replyWithContacts(req, "")
+    registrar.expectNoRequest("REGISTER", 200 * time.Millisecond)
+    agent.lock.Lock()
+    defer agent.lock.Unlock()
+    if agent.isRegistered(time.Now()) || agent.timer != nil || agent.status != "stopped" {
+        t.Errorf("The trunk is still active after stop: %s", agent.status)
+    }
+}
@@ -0,0 +1,373 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "encoding/csv"
+    "errors"
+    "fmt"
+    "io"
+    "math/rand"
+    "net"
+    "os"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "sippy/conf"
+)
+
+// The routing table is a CSV file with the following columns:
+//
+//     cld_prefix,cli_prefix,source,tod,priority,weight,route
+//
+// The cld_prefix and cli_prefix are the number prefixes to match the CLD
+// and CLI against, the source is an IP address or a CIDR network of the
+// call originator and the tod is a time of day rule in the form
+// "[days] [HH:MM-HH:MM]", e.g. "Mon-Fri 08:00-18:00" or "Sat,Sun". Empty
+// value or "*" in any of these columns matches everything. The route is
+// a B2BRoute string as accepted by the -static_route option. Lines
+// starting with "#" are ignored.
+//
+// The entry with the longest matching CLD prefix wins. When there are
+// several of them the longest CLI prefix and then the most specific source
+// are preferred. All routes of the winning entry that are active at the
+// current time are returned ordered by the priority (lower first) while
+// the routes of the same priority are shuffled according to their weights.
+
+type rt_tod_rule struct {
+    days        [7]bool
+    start       int // minutes since midnight
+    end         int
+}
+
+type rt_route struct {
+    priority    int
+    weight      int
+    tod         *rt_tod_rule
+    route       *B2BRoute
+}
+
+type rt_entry struct {
+    cld_prefix  string
+    cli_prefix  string
+    source      *net.IPNet
+    routes      []*rt_route
+}
+
+type routingTable struct {
+    fname       string
+    entries     []*rt_entry
+    lock        sync.Mutex
+    config      sippy_conf.Config
+}
+
+func NewRoutingTable(fname string, config sippy_conf.Config) (*routingTable, error) {
+    self := &routingTable{
+        fname   : fname,
+        config  : config,
+    }
+    err := self.Reload()
+    if err != nil {
+        return nil, err
+    }
+    return self, nil
+}
+
+// Re-read the routing table file. The old table remains in effect when
+// there is an error.
+func (self *routingTable) Reload() error {
+    fd, err := os.Open(self.fname)
+    if err != nil {
+        return err
+    }
+    defer fd.Close()
+    entries, err := parseRoutingTable(fd, self.config)
+    if err != nil {
+        return errors.New(self.fname + ": " + err.Error())
+    }
+    self.lock.Lock()
+    self.entries = entries
+    self.lock.Unlock()
+    return nil
+}
+
+func parseRoutingTable(r io.Reader, config sippy_conf.Config) ([]*rt_entry, error) {
+    reader := csv.NewReader(r)
+    reader.Comment = '#'
+    reader.FieldsPerRecord = 7
+    reader.TrimLeadingSpace = true
+    entries := []*rt_entry{}
+    entry_map := make(map[string]*rt_entry)
+    for {
+        record, err := reader.Read()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return nil, err
+        }
+        line, _ := reader.FieldPos(0)
+        for i := range record {
+            record[i] = strings.TrimSpace(record[i])
+            if record[i] == "*" {
+                record[i] = ""
+            }
+        }
+        cld_prefix, cli_prefix, source, tod, priority, weight, sroute := record[0], record[1], record[2], record[3], record[4], record[5], record[6]
+        rroute := &rt_route{ weight : 1 }
+        if priority != "" {
+            rroute.priority, err = strconv.Atoi(priority)
+            if err != nil {
+                return nil, fmt.Errorf("line %d: bad priority '%s'", line, priority)
+            }
+        }
+        if weight != "" {
+            rroute.weight, err = strconv.Atoi(weight)
+            if err != nil || rroute.weight <= 0 {
+                return nil, fmt.Errorf("line %d: bad weight '%s'", line, weight)
+            }
+        }
+        if tod != "" {
+            rroute.tod, err = parseTodRule(tod)
+            if err != nil {
+                return nil, fmt.Errorf("line %d: %s", line, err.Error())
+            }
+        }
+        if sroute == "" {
+            return nil, fmt.Errorf("line %d: empty route", line)
+        }
+        rroute.route, err = NewB2BRoute(sroute, config)
+        if err != nil {
+            return nil, fmt.Errorf("line %d: %s", line, err.Error())
+        }
+        var src_net *net.IPNet
+        if source != "" {
+            src_net, err = parseIPNet(source)
+            if err != nil {
+                return nil, fmt.Errorf("line %d: %s", line, err.Error())
+            }
+        }
+        key := cld_prefix + "," + cli_prefix + "," + source
+        entry, ok := entry_map[key]
+        if ! ok {
+            entry = &rt_entry{
+                cld_prefix  : cld_prefix,
+                cli_prefix  : cli_prefix,
+                source      : src_net,
+                routes      : []*rt_route{},
+            }
+            entry_map[key] = entry
+            entries = append(entries, entry)
+        }
+        entry.routes = append(entry.routes, rroute)
+    }
+    for _, entry := range entries {
+        sort.SliceStable(entry.routes, func(i, j int) bool { return entry.routes[i].priority < entry.routes[j].priority })
+    }
+    return entries, nil
+}
+
+// Parse the IP address or the CIDR network. The single address is treated
+// as the host network.
+func parseIPNet(s string) (*net.IPNet, error) {
+    if strings.IndexByte(s, '/') >= 0 {
+        _, ipnet, err := net.ParseCIDR(s)
+        if err != nil {
+            return nil, errors.New("bad network '" + s + "'")
+        }
+        return ipnet, nil
+    }
+    ip := net.ParseIP(strings.Trim(s, "[]"))
+    if ip == nil {
+        return nil, errors.New("bad IP address '" + s + "'")
+    }
+    if ip4 := ip.To4(); ip4 != nil {
+        return &net.IPNet{ IP : ip4, Mask : net.CIDRMask(32, 32) }, nil
+    }
+    return &net.IPNet{ IP : ip, Mask : net.CIDRMask(128, 128) }, nil
+}
+
+var rt_weekdays = map[string]time.Weekday{
+    "sun" : time.Sunday, "mon" : time.Monday, "tue" : time.Tuesday, "wed" : time.Wednesday,
+    "thu" : time.Thursday, "fri" : time.Friday, "sat" : time.Saturday,
+}
+
+func parseTodRule(s string) (*rt_tod_rule, error) {
+    self := &rt_tod_rule{ start : 0, end : 24 * 60 }
+    days_set := false
+    for _, part := range strings.Fields(s) {
+        if strings.IndexByte(part, ':') >= 0 {
+            times := strings.SplitN(part, "-", 2)
+            if len(times) != 2 {
+                return nil, errors.New("bad time range '" + part + "'")
+            }
+            var err error
+            self.start, err = parseTodTime(times[0])
+            if err == nil {
+                self.end, err = parseTodTime(times[1])
+            }
+            if err != nil {
+                return nil, err
+            }
+            continue
+        }
+        for _, drange := range strings.Split(part, ",") {
+            days := strings.SplitN(strings.ToLower(drange), "-", 2)
+            first, ok := rt_weekdays[days[0]]
+            if ! ok {
+                return nil, errors.New("bad week day '" + days[0] + "'")
+            }
+            last := first
+            if len(days) == 2 {
+                last, ok = rt_weekdays[days[1]]
+                if ! ok {
+                    return nil, errors.New("bad week day '" + days[1] + "'")
+                }
+            }
+            for d := first; ; d = (d + 1) % 7 {
+                self.days[d] = true
+                if d == last {
+                    break
+                }
+            }
+            days_set = true
+        }
+    }
+    if ! days_set {
+        for i := range self.days {
+            self.days[i] = true
+        }
+    }
+    return self, nil
+}
+
+func parseTodTime(s string) (int, error) {
+    hm := strings.SplitN(s, ":", 2)
+    if len(hm) == 2 {
+        h, err1 := strconv.Atoi(hm[0])
+        m, err2 := strconv.Atoi(hm[1])
+        if err1 == nil && err2 == nil && h >= 0 && h <= 24 && m >= 0 && m < 60 && h * 60 + m <= 24 * 60 {
+            return h * 60 + m, nil
+        }
+    }
+    return 0, errors.New("bad time '" + s + "'")
+}
+
+// The time range may wrap over midnight, e.g. 22:00-06:00. In that case
+// the day of week is checked against the day when the range has started.
+func (self *rt_tod_rule) matches(now time.Time) bool {
+    mins := now.Hour() * 60 + now.Minute()
+    wday := now.Weekday()
+    if self.start <= self.end {
+        return self.days[wday] && mins >= self.start && mins < self.end
+    }
+    if mins >= self.start {
+        return self.days[wday]
+    }
+    return mins < self.end && self.days[(wday + 6) % 7]
+}
+
+func (self *rt_entry) matches(cld, cli string, source net.IP) bool {
+    if ! strings.HasPrefix(cld, self.cld_prefix) || ! strings.HasPrefix(cli, self.cli_prefix) {
+        return false
+    }
+    return self.source == nil || (source != nil && self.source.Contains(source))
+}
+
+func (self *rt_entry) better_than(other *rt_entry) bool {
+    if len(self.cld_prefix) != len(other.cld_prefix) {
+        return len(self.cld_prefix) > len(other.cld_prefix)
+    }
+    if len(self.cli_prefix) != len(other.cli_prefix) {
+        return len(self.cli_prefix) > len(other.cli_prefix)
+    }
+    if other.source == nil {
+        return self.source != nil
+    }
+    if self.source == nil {
+        return false
+    }
+    self_ones, _ := self.source.Mask.Size()
+    other_ones, _ := other.source.Mask.Size()
+    return self_ones > other_ones
+}
+
+// Find the routes for the call. The returned routes are copies that can
+// be customized by the caller.
+func (self *routingTable) Lookup(cld, cli, source string, now time.Time) []*B2BRoute {
+    self.lock.Lock()
+    entries := self.entries
+    self.lock.Unlock()
+
+    src_ip := net.ParseIP(strings.Trim(source, "[]"))
+    var best *rt_entry
+    var best_routes []*rt_route
+    for _, entry := range entries {
+        if ! entry.matches(cld, cli, src_ip) {
+            continue
+        }
+        if best != nil && ! entry.better_than(best) {
+            continue
+        }
+        active := []*rt_route{}
+        for _, r := range entry.routes {
+            if r.tod == nil || r.tod.matches(now) {
+                active = append(active, r)
+            }
+        }
+        if len(active) > 0 {
+            best, best_routes = entry, active
+        }
+    }
+    ret := []*B2BRoute{}
+    for len(best_routes) > 0 {
+        // collect the routes of the same priority
+        n := 1
+        for n < len(best_routes) && best_routes[n].priority == best_routes[0].priority {
+            n++
+        }
+        group := make([]*rt_route, n)
+        copy(group, best_routes[:n])
+        best_routes = best_routes[n:]
+        for len(group) > 0 {
+            total := 0
+            for _, r := range group {
+                total += r.weight
+            }
+            idx, w := 0, rand.Intn(total)
+            for w >= group[idx].weight {
+                w -= group[idx].weight
+                idx++
+            }
+            ret = append(ret, group[idx].route.getCopy())
+            group = append(group[:idx], group[idx + 1:]...)
+        }
+    }
+    return ret
+}
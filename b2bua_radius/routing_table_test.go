@@ -0,0 +1,123 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "strings"
+    "testing"
+    "time"
+
+    "sippy/conf"
+    "sippy/log"
+)
+
+const test_routing_table = `
+# cld_prefix,cli_prefix,source,tod,priority,weight,route
+*,*,*,*,0,1,192.0.2.1
+44,*,*,*,0,1,192.0.2.44
+4420,*,*,*,0,1,192.0.2.20
+4420,*,*,*,1,1,"192.0.2.21;hs_scodes=404,486"
+4420,7,*,*,0,1,192.0.2.27
+4420,*,10.0.0.0/8,*,0,1,192.0.2.10
+4420,*,10.1.0.0/16,*,0,1,192.0.2.11
+49,*,*,Mon-Fri 08:00-18:00,0,1,192.0.2.49
+49,*,*,Sat-Sun,0,1,192.0.2.50
+49,*,*,Mon-Fri 18:00-08:00,0,1,192.0.2.51
+`
+
+func TestRoutingTableLookup(t *testing.T) {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+    entries, err := parseRoutingTable(strings.NewReader(test_routing_table), config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    rtable := &routingTable{ entries : entries, config : config }
+    // Wednesday
+    noon := time.Date(2017, 10, 4, 12, 0, 0, 0, time.Local)
+    night := time.Date(2017, 10, 4, 23, 0, 0, 0, time.Local)
+    early := time.Date(2017, 10, 3, 7, 0, 0, 0, time.Local) // Tuesday morning, the Monday night range
+    saturday := time.Date(2017, 10, 7, 12, 0, 0, 0, time.Local)
+
+    for _, tc := range []struct{ cld, cli, source string; now time.Time; hosts string }{
+        { "1234", "", "", noon, "192.0.2.1" },
+        { "4412", "", "", noon, "192.0.2.44" },
+        { "442012", "555", "192.168.0.1", noon, "192.0.2.20,192.0.2.21" },
+        { "442012", "7123", "192.168.0.1", noon, "192.0.2.27" },
+        { "442012", "555", "10.2.0.1", noon, "192.0.2.10" },
+        { "442012", "555", "10.1.0.1", noon, "192.0.2.11" },
+        { "4930", "", "", noon, "192.0.2.49" },
+        { "4930", "", "", night, "192.0.2.51" },
+        { "4930", "", "", early, "192.0.2.51" },
+        { "4930", "", "", saturday, "192.0.2.50" },
+    } {
+        hosts := []string{}
+        for _, r := range rtable.Lookup(tc.cld, tc.cli, tc.source, tc.now) {
+            hosts = append(hosts, r.hostonly)
+        }
+        if strings.Join(hosts, ",") != tc.hosts {
+            t.Errorf("Lookup(%s, %s, %s, %s) returned '%s', expected '%s'", tc.cld, tc.cli, tc.source, tc.now, strings.Join(hosts, ","), tc.hosts)
+        }
+    }
+}
+
+func TestRoutingTableWeights(t *testing.T) {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+    entries, err := parseRoutingTable(strings.NewReader("1,,,,0,9,192.0.2.1\n1,,,,0,1,192.0.2.2\n"), config)
+    if err != nil {
+        t.Fatal(err)
+    }
+    rtable := &routingTable{ entries : entries, config : config }
+    first := 0
+    for i := 0; i < 1000; i++ {
+        routes := rtable.Lookup("1", "", "", time.Now())
+        if len(routes) != 2 {
+            t.Fatalf("Expected 2 routes, got %d", len(routes))
+        }
+        if routes[0].hostonly == "192.0.2.1" {
+            first++
+        }
+    }
+    if first < 800 || first > 980 {
+        t.Errorf("The route with weight 9 has been selected first %d times out of 1000", first)
+    }
+}
+
+func TestRoutingTableErrors(t *testing.T) {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+    for _, s := range []string{
+        "1,,,,x,1,192.0.2.1\n",
+        "1,,,,0,0,192.0.2.1\n",
+        "1,,,Funday,0,1,192.0.2.1\n",
+        "1,,,25:00-26:00,0,1,192.0.2.1\n",
+        "1,,300.1.1.1,,0,1,192.0.2.1\n",
+        "1,,,,0,1,\n",
+        "1,,,0,1,192.0.2.1\n",
+    } {
+        if _, err := parseRoutingTable(strings.NewReader(s), config); err == nil {
+            t.Errorf("No error parsing '%s'", strings.TrimSpace(s))
+        }
+    }
+}
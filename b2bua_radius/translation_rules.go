@@ -0,0 +1,269 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "errors"
+    "fmt"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// The translation rules are the sed-style substitutions applied to the CLD
+// and CLI of the call in the order they are listed:
+//
+//     [cld:|cli:]s/pattern/replacement/[flags][;...]
+//
+// Any non-alphanumeric character following the "s" can be used as the
+// delimiter, the delimiter can be escaped with a backslash inside of the
+// pattern and the replacement. The pattern is a regular expression in the
+// RE2 syntax, the replacement can refer to the capture groups as \1..\9,
+// \g<name> or ${name} and to the whole match as &. The "g" flag replaces
+// all matches instead of the first one and the "i" flag makes the match
+// case insensitive. The rule applies to the CLD unless prefixed with
+// "cli:". The "#" in place of the next rule, i.e. at the start of the
+// string or after the whitespace or ";" following the previous rule,
+// starts a comment running to the end of the string. Inside of the rule
+// the "#" has no special meaning, e.g.
+//
+//     s/^00/+/;s/^0([1-9])/+44\1/;cli:s/^\+?44/0/ # national format
+//     s/^#31#// # strip the CLIR prefix
+
+type trRule struct {
+    field           string
+    src             string
+    re              *regexp.Regexp
+    repl            string
+    global          bool
+}
+
+type trRules struct {
+    src             string
+    rules           []*trRule
+}
+
+func parseTrRules(s string) (*trRules, error) {
+    self := &trRules{
+        src             : strings.TrimSpace(s),
+        rules           : make([]*trRule, 0),
+    }
+    for {
+        s = strings.TrimLeft(s, " \t;")
+        if s == "" || s[0] == '#' {
+            break
+        }
+        rule, rest, err := parseTrRule(s)
+        if err != nil {
+            return nil, err
+        }
+        self.rules = append(self.rules, rule)
+        s = rest
+    }
+    return self, nil
+}
+
+func parseTrRule(s string) (*trRule, string, error) {
+    self := &trRule{ field : "cld" }
+    orig := s
+    if strings.HasPrefix(s, "cld:") || strings.HasPrefix(s, "cli:") {
+        self.field = s[:3]
+        s = s[4:]
+    }
+    if len(s) < 2 || s[0] != 's' {
+        return nil, "", errors.New("Error parsing the translation rule '" + orig + "': the rule should start with 's'")
+    }
+    delim := s[1]
+    if (delim >= '0' && delim <= '9') || (delim >= 'a' && delim <= 'z') || (delim >= 'A' && delim <= 'Z') ||
+      delim == '\\' || delim == ' ' || delim == '\t' || delim == ';' {
+        return nil, "", errors.New("Error parsing the translation rule '" + orig + "': invalid delimiter")
+    }
+    pattern, s, ok := trSplitPart(s[2:], delim)
+    if ! ok {
+        return nil, "", errors.New("Error parsing the translation rule '" + orig + "': unterminated pattern")
+    }
+    repl, s, ok := trSplitPart(s, delim)
+    if ! ok {
+        return nil, "", errors.New("Error parsing the translation rule '" + orig + "': unterminated replacement")
+    }
+    flags := ""
+    for s != "" && s[0] != ';' && s[0] != ' ' && s[0] != '\t' {
+        switch s[0] {
+        case 'g':
+            self.global = true
+        case 'i':
+            flags = "(?i)"
+        default:
+            return nil, "", errors.New("Error parsing the translation rule '" + orig + "': unknown flag '" + s[:1] + "'")
+        }
+        s = s[1:]
+    }
+    var err error
+    self.re, err = regexp.Compile(flags + pattern)
+    if err != nil {
+        return nil, "", errors.New("Error parsing the translation rule '" + orig + "': " + err.Error())
+    }
+    self.repl = trConvertRepl(repl)
+    self.src = strings.TrimSpace(orig[:len(orig) - len(s)])
+    return self, s, nil
+}
+
+// Split the part of the rule up to the unescaped delimiter. The escaped
+// delimiter is unescaped while all other escapes are kept intact.
+func trSplitPart(s string, delim byte) (string, string, bool) {
+    res := make([]byte, 0, len(s))
+    for i := 0; i < len(s); i++ {
+        switch {
+        case s[i] == '\\' && i + 1 < len(s) && s[i + 1] == delim:
+            res = append(res, delim)
+            i++
+        case s[i] == '\\' && i + 1 < len(s):
+            res = append(res, s[i], s[i + 1])
+            i++
+        case s[i] == delim:
+            return string(res), s[i + 1:], true
+        default:
+            res = append(res, s[i])
+        }
+    }
+    return "", "", false
+}
+
+// Convert the sed/python style replacement into the template understood
+// by the regexp.Expand().
+func trConvertRepl(s string) string {
+    res := ""
+    for i := 0; i < len(s); i++ {
+        switch s[i] {
+        case '\\':
+            if i + 1 == len(s) {
+                res += "\\"
+                break
+            }
+            i++
+            switch {
+            case s[i] >= '0' && s[i] <= '9':
+                res += "${" + s[i:i + 1] + "}"
+            case s[i] == 'g' && i + 1 < len(s) && s[i + 1] == '<':
+                end := strings.IndexByte(s[i:], '>')
+                if end == -1 {
+                    res += "g"
+                    break
+                }
+                res += "${" + s[i + 2:i + end] + "}"
+                i += end
+            case s[i] == '$':
+                res += "$$"
+            default:
+                res += s[i:i + 1]
+            }
+        case '&':
+            res += "${0}"
+        case '$':
+            if i + 1 < len(s) && s[i + 1] == '{' {
+                res += "$"
+            } else {
+                res += "$$"
+            }
+        default:
+            res += s[i:i + 1]
+        }
+    }
+    return res
+}
+
+func (self *trRule) apply(s string) string {
+    if self.global {
+        return self.re.ReplaceAllString(s, self.repl)
+    }
+    m := self.re.FindStringSubmatchIndex(s)
+    if m == nil {
+        return s
+    }
+    return s[:m[0]] + string(self.re.ExpandString(nil, self.repl, s, m)) + s[m[1]:]
+}
+
+func (self *trRules) String() string {
+    return self.src
+}
+
+// Apply all rules in order and return the translated CLD and CLI.
+func (self *trRules) Apply(cld, cli string) (string, string) {
+    if self == nil {
+        return cld, cli
+    }
+    for _, rule := range self.rules {
+        if rule.field == "cli" {
+            cli = rule.apply(cli)
+        } else {
+            cld = rule.apply(cld)
+        }
+    }
+    return cld, cli
+}
+
+type trStep struct {
+    Rule            string  `json:"rule"`
+    From            string  `json:"from"`
+    To              string  `json:"to"`
+}
+
+// The reply of the "tr" command
+type trDryRun struct {
+    Steps           []*trStep `json:"steps"`
+    CLD             string    `json:"cld"`
+    CLI             string    `json:"cli"`
+}
+
+func (self *trDryRun) String() string {
+    res := ""
+    for _, step := range self.Steps {
+        res += fmt.Sprintf("%s: %s -> %s\n", step.Rule, strconv.Quote(step.From), strconv.Quote(step.To))
+    }
+    return res + fmt.Sprintf("Result: cld=%s cli=%s\n", strconv.Quote(self.CLD), strconv.Quote(self.CLI))
+}
+
+// Same as Apply() but also reports every step for the "tr" command.
+func (self *trRules) DryRun(cld, cli string) *trDryRun {
+    res := &trDryRun{ Steps : []*trStep{} }
+    if self != nil {
+        for _, rule := range self.rules {
+            step := &trStep{ Rule : rule.src }
+            if rule.field == "cli" {
+                step.From = cli
+                cli = rule.apply(cli)
+                step.To = cli
+            } else {
+                step.From = cld
+                cld = rule.apply(cld)
+                step.To = cld
+            }
+            res.Steps = append(res.Steps, step)
+        }
+    }
+    res.CLD, res.CLI = cld, cli
+    return res
+}
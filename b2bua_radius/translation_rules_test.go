@@ -0,0 +1,83 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package main
+
+import (
+    "testing"
+)
+
+func TestTrRulesApply(t *testing.T) {
+    for _, tc := range []struct{ rules, cld, cli, res_cld, res_cli string }{
+        { "s/^00/+/", "0044123", "", "+44123", "" },
+        { "s/^0([1-9])/+44\\1/", "0207", "", "+44207", "" },
+        { "s/^0(?P<rest>[1-9].*)$/+44\\g<rest>/", "0207", "", "+44207", "" },
+        { "s/^0(?P<rest>[1-9].*)$/+44${rest}/", "0207", "", "+44207", "" },
+        { "s/1/x/", "1212", "", "x212", "" },
+        { "s/1/x/g", "1212", "", "x2x2", "" },
+        { "s/ABC/&&/i", "abc", "", "abcabc", "" },
+        { "s|^/|\\||", "/12", "", "|12", "" },
+        { "s/\\//-/g", "1/2/3", "", "1-2-3", "" },
+        { "s/^/$/", "12", "", "$12", "" },
+        { "s/^00/+/;cli:s/^\\+?44/0/ # comment", "0044", "+44207", "+44", "0207" },
+        { "s/^9//; s/^0/44/g;s/^44$//", "90", "", "", "" },
+        { "cld:s/x/y/;cli:s/x/z/", "x", "x", "y", "z" },
+        { "s/^#31#//", "#31#0207", "", "0207", "" },
+        { "s/^#31#// # strip CLIR;s/^0/44/", "#31#0207", "", "0207", "" },
+        { "s#^\\*67#+#;s/^9/0/ #s/^0/44/", "*6790", "", "+90", "" },
+        { "# disabled s/^0/44/", "0207", "", "0207", "" },
+    } {
+        rules, err := parseTrRules(tc.rules)
+        if err != nil {
+            t.Errorf("%s: %s", tc.rules, err.Error())
+            continue
+        }
+        cld, cli := rules.Apply(tc.cld, tc.cli)
+        if cld != tc.res_cld || cli != tc.res_cli {
+            t.Errorf("%s: expected %q/%q, got %q/%q", tc.rules, tc.res_cld, tc.res_cli, cld, cli)
+        }
+    }
+    var rules *trRules
+    if cld, cli := rules.Apply("123", "456"); cld != "123" || cli != "456" {
+        t.Errorf("nil rules should not change the numbers")
+    }
+}
+
+func TestTrRulesErrors(t *testing.T) {
+    for _, s := range []string{
+        "x/a/b/",
+        "sxaxbx",
+        "s/a/b",
+        "s/a",
+        "s/a/b/q",
+        "s/(/b/",
+        "clx:s/a/b/",
+        "s/a/b/#comment",
+    } {
+        if _, err := parseTrRules(s); err == nil {
+            t.Errorf("%s: error expected", s)
+        }
+    }
+}
@@ -33,6 +33,7 @@ import (
     "sippy/conf"
     "sippy/headers"
     "sippy/log"
+    "sippy/time"
     "sippy/types"
 )
 
@@ -70,10 +71,13 @@ type baseTransaction struct {
     tout            time.Duration
     data            []byte
     logger          sippy_log.ErrorLogger
+    ctime           *sippy_time.MonoTime
 }
 
 func newBaseTransaction(lock sync.Locker, tid *sippy_header.TID, userv sippy_types.UdpServer, sip_tm *sipTransactionManager, address *sippy_conf.HostPort, data []byte, needack bool, logger sippy_log.ErrorLogger) *baseTransaction {
+    ctime, _ := sippy_time.NewMonoTime()
     return &baseTransaction{
+        ctime   : ctime,
         tout    : time.Duration(0.5 * float64(time.Second)),
         userv   : userv,
         tid     : tid,
@@ -114,11 +118,29 @@ func (self *baseTransaction) timerA() {
     if self.sip_tm == nil {
         return
     }
-    self.sip_tm.transmitData(self.userv, self.data, self.address, /*cachesum*/ "", /*call_id*/ self.tid.CallId, 0)
+    self.sip_tm.retransmitData(self.userv, self.data, self.address, /*cachesum*/ "", /*call_id*/ self.tid.CallId)
     self.tout *= 2
     self.teA = StartTimeout(self.timerA, self.lock, self.tout, 1, self.logger)
 }
 
+// getInfo must be called with the transaction locked. Returns nil if the
+// transaction has been terminated already.
+func (self *baseTransaction) getInfo(now *sippy_time.MonoTime, remote *sippy_conf.HostPort) *sippy_types.TransactionInfo {
+    if self.tid == nil {
+        return nil
+    }
+    ret := &sippy_types.TransactionInfo{
+        TID     : *self.tid,
+        Method  : self.tid.CSeqMethod,
+        State   : self.state.String(),
+        Age     : now.Sub(self.ctime),
+    }
+    if remote != nil {
+        ret.Remote = remote.String()
+    }
+    return ret
+}
+
 func (self *baseTransaction) GetHost() string {
     return self.address.Host.String()
 }
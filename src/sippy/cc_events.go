@@ -190,6 +190,7 @@ type CCEventConnect struct {
 }
 
 func (self *CCEventRing) GetScode() int { return self.scode }
+func (self *CCEventRing) GetScodeReason() string { return self.scode_reason }
 func (self *CCEventRing) GetBody() sippy_types.MsgBody { return self.body }
 
 func NewCCEventConnect(scode int, scode_reason string, msg_body sippy_types.MsgBody, rtime *sippy_time.MonoTime, origin string, extra_headers ...sippy_header.SipHeader) *CCEventConnect {
@@ -33,8 +33,16 @@ import (
     "os"
 
     "sippy/log"
+    "sippy/time"
 )
 
+// SipCapture receives a copy of every SIP message the transports send or
+// receive along with the addresses of both ends. The implementation must
+// not block nor keep the data slice as it may be reused.
+type SipCapture interface {
+    Capture(data []byte, src, dst net.Addr, ts *sippy_time.MonoTime)
+}
+
 type Config interface {
     SipAddress()    *MyAddress
     SipPort()       *MyPort
@@ -55,6 +63,9 @@ type Config interface {
 
     AutoConvertTelUrl() bool
     SetAutoConvertTelUrl(bool)
+
+    SipCapture() SipCapture
+    SetSipCapture(SipCapture)
 }
 
 type config struct {
@@ -69,6 +80,7 @@ type config struct {
     my_uaname       string
     allow_formats   []int
     autoconvert_tel_url bool
+    sip_capture     SipCapture
 }
 
 func NewConfig(error_logger sippy_log.ErrorLogger, sip_logger sippy_log.SipLogger) Config {
@@ -163,3 +175,11 @@ func (self *config) AutoConvertTelUrl() bool {
 func (self *config) SetAutoConvertTelUrl(v bool) {
     self.autoconvert_tel_url = v
 }
+
+func (self *config) SipCapture() SipCapture {
+    return self.sip_capture
+}
+
+func (self *config) SetSipCapture(sip_capture SipCapture) {
+    self.sip_capture = sip_capture
+}
@@ -28,6 +28,9 @@ package sippy_header
 
 import (
     "crypto/md5"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/sha512"
     "errors"
     "fmt"
     "strings"
@@ -36,7 +39,7 @@ import (
     "sippy/utils"
 )
 
-type NewSipXXXAuthorizationFunc func(realm, nonce, method, uri, username, password string) SipHeader
+type NewSipXXXAuthorizationFunc func(challenge *SipWWWAuthenticate, method, uri, username, password string, nc int, entity_body string) SipHeader
 
 type SipAuthorization struct {
     normalName
@@ -48,6 +51,8 @@ type SipAuthorization struct {
     qop         string
     nc          string
     cnonce      string
+    algorithm   string
+    opaque      string
     otherparams string
 }
 
@@ -55,7 +60,7 @@ var _sip_authorization_name normalName = newNormalName("Authorization")
 
 func NewSipAuthorization(realm, nonce, method, uri, username, password string) *SipAuthorization {
     HA1 := DigestCalcHA1("md5", username, realm, password, nonce, "")
-    response := DigestCalcResponse(HA1, nonce, "", "", "", method, uri, "")
+    response := DigestCalcResponse("md5", HA1, nonce, "", "", "", method, uri, "")
     return &SipAuthorization{
         normalName : _sip_authorization_name,
         realm   : realm,
@@ -66,6 +71,42 @@ func NewSipAuthorization(realm, nonce, method, uri, username, password string) *
     }
 }
 
+// Build the credentials in response to the challenge using the algorithm
+// and the qop offered by the server. The nc is the nonce count, i.e. the
+// number of requests sent with this nonce including this one.
+func NewSipAuthorizationFromChallenge(challenge *SipWWWAuthenticate, method, uri, username, password string, nc int, entity_body string) *SipAuthorization {
+    self := &SipAuthorization{
+        normalName  : _sip_authorization_name,
+        realm       : challenge.GetRealm(),
+        nonce       : challenge.nonce,
+        uri         : uri,
+        username    : username,
+        qop         : challenge.pickQop(),
+        algorithm   : challenge.algorithm,
+        opaque      : challenge.opaque,
+    }
+    if self.qop != "" {
+        buf := make([]byte, 8)
+        rand.Read(buf)
+        self.cnonce = fmt.Sprintf("%x", buf)
+        self.nc = fmt.Sprintf("%08x", nc)
+    }
+    HA1 := DigestCalcHA1(self.algorithm, username, self.realm, password, self.nonce, self.cnonce)
+    HEntity := ""
+    if self.qop == "auth-int" {
+        HEntity = digestHash(self.algorithm, entity_body)
+    }
+    self.response = DigestCalcResponse(self.algorithm, HA1, self.nonce, self.nc, self.cnonce, self.qop, method, uri, HEntity)
+    return self
+}
+
+func newSipAuthorizationFromChallengeAsIface(challenge *SipWWWAuthenticate, method, uri, username, password string, nc int, entity_body string) SipHeader {
+    return NewSipAuthorizationFromChallenge(challenge, method, uri, username, password, nc, entity_body)
+}
+
+// The default NewSipXXXAuthorizationFunc producing the Authorization header
+var NewSipWWWAuthorization NewSipXXXAuthorizationFunc = newSipAuthorizationFromChallengeAsIface
+
 func ParseSipAuthorization(body string, config sippy_conf.Config) ([]SipHeader, error) {
     self, err := NewSipAuthorizationFromString(body)
     if err != nil { return nil, err }
@@ -80,13 +121,13 @@ func NewSipAuthorizationFromString(body string) (*SipAuthorization, error) {
     if len(arr) != 2 {
         return nil, errors.New("Error parsing authorization (1)")
     }
-    for _, param := range strings.Split(arr[1], ",") {
+    for _, param := range splitDigestParams(arr[1]) {
         kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
         if len(kv) != 2 {
             return nil, errors.New("Error parsing authorization (2)")
         }
-        name, value := kv[0], kv[1]
-        switch name {
+        name, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+        switch strings.ToLower(name) {
         case "username":
             self.username = strings.Trim(value, "\"")
         case "uri":
@@ -103,6 +144,10 @@ func NewSipAuthorizationFromString(body string) (*SipAuthorization, error) {
             self.cnonce = strings.Trim(value, "\"")
         case "nc":
             self.nc = strings.Trim(value, "\"")
+        case "algorithm":
+            self.algorithm = strings.Trim(value, "\"")
+        case "opaque":
+            self.opaque = strings.Trim(value, "\"")
         default:
             self.otherparams += "," + param
         }
@@ -121,8 +166,14 @@ func (self *SipAuthorization) LocalStr(*sippy_conf.HostPort, bool) string {
 func (self *SipAuthorization) Body() string {
     rval := "Digest username=\"" + self.username + "\",realm=\"" + self.realm + "\",nonce=\"" + self.nonce +
         "\",uri=\"" + self.uri + "\",response=\"" + self.response + "\""
+    if self.algorithm != "" {
+        rval += ",algorithm=" + self.algorithm
+    }
+    if self.opaque != "" {
+        rval += ",opaque=\"" + self.opaque + "\""
+    }
     if self.qop != "" {
-        rval += ",nc=\"" + self.nc + "\",cnonce=\"" + self.cnonce + "\",qop=" + self.qop
+        rval += ",nc=" + self.nc + ",cnonce=\"" + self.cnonce + "\",qop=" + self.qop
     }
     return rval + self.otherparams
 }
@@ -139,39 +190,97 @@ func (self *SipAuthorization) GetUsername() string {
     return self.username
 }
 
+func (self *SipAuthorization) GetRealm() string {
+    return self.realm
+}
+
+func (self *SipAuthorization) GetNonce() string {
+    return self.nonce
+}
+
+func (self *SipAuthorization) GetUri() string {
+    return self.uri
+}
+
+func (self *SipAuthorization) GetResponse() string {
+    return self.response
+}
+
+func (self *SipAuthorization) GetQop() string {
+    return self.qop
+}
+
+func (self *SipAuthorization) GetNc() string {
+    return self.nc
+}
+
+func (self *SipAuthorization) GetCnonce() string {
+    return self.cnonce
+}
+
+func (self *SipAuthorization) GetAlgorithm() string {
+    return self.algorithm
+}
+
 func (self *SipAuthorization) GetCopyAsIface() SipHeader {
     return self.GetCopy()
 }
 
+// Returns the relative strength of the digest algorithm or -1 if the
+// algorithm is not supported. The missing algorithm means MD5.
+func digestAlgStrength(pszAlg string) int {
+    switch strings.TrimSuffix(strings.ToLower(pszAlg), "-sess") {
+    case "", "md5":
+        return 0
+    case "sha-256":
+        return 1
+    case "sha-512-256":
+        return 2
+    }
+    return -1
+}
+
+func digestHash(pszAlg, s string) string {
+    switch strings.TrimSuffix(strings.ToLower(pszAlg), "-sess") {
+    case "sha-256":
+        return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+    case "sha-512-256":
+        return fmt.Sprintf("%x", sha512.Sum512_256([]byte(s)))
+    }
+    return fmt.Sprintf("%x", md5.Sum([]byte(s)))
+}
+
 func DigestCalcHA1(pszAlg, pszUserName, pszRealm, pszPassword, pszNonce, pszCNonce string) string {
-    s := pszUserName + ":" + pszRealm + ":" + pszPassword
-    HA1 := md5.Sum([]byte(s))
-    if pszAlg == "md5-sess" {
-        s2 := make([]byte, len(HA1))
-        for i, b := range HA1 {
-            s2[i] = b
-        }
-        s2 = append(s2, []byte(":" + pszNonce + ":" + pszCNonce)...)
-        HA1 = md5.Sum(s2)
+    HA1 := digestHash(pszAlg, pszUserName + ":" + pszRealm + ":" + pszPassword)
+    if strings.HasSuffix(strings.ToLower(pszAlg), "-sess") {
+        HA1 = digestHash(pszAlg, HA1 + ":" + pszNonce + ":" + pszCNonce)
     }
-    return fmt.Sprintf("%x", HA1)
+    return HA1
 }
 
-func DigestCalcResponse(HA1, pszNonce string, pszNonceCount, pszCNonce, pszQop, pszMethod, pszDigestUri, pszHEntity string) string {
+func DigestCalcResponse(pszAlg, HA1, pszNonce string, pszNonceCount, pszCNonce, pszQop, pszMethod, pszDigestUri, pszHEntity string) string {
     s := pszMethod + ":" + pszDigestUri
     if pszQop == "auth-int" {
         s += ":" + pszHEntity
     }
-    HA2 := fmt.Sprintf("%x", md5.Sum([]byte(s)))
+    HA2 := digestHash(pszAlg, s)
     s = HA1 + ":" + pszNonce + ":"
     if pszNonceCount != "" && pszCNonce != "" { // pszQop:
         s += pszNonceCount + ":" + pszCNonce + ":" + pszQop + ":"
     }
     s += HA2
-    return fmt.Sprintf("%x", md5.Sum([]byte(s)))
+    return digestHash(pszAlg, s)
+}
+
+func (self *SipAuthorization) Verify(password, method string) bool {
+    HA1 := DigestCalcHA1(self.algorithm, self.username, self.realm, password, self.nonce, self.cnonce)
+    return self.VerifyHA1(HA1, method)
 }
 
 func (self *SipAuthorization) VerifyHA1(HA1, method string) bool {
-    response := DigestCalcResponse(HA1, self.nonce, self.nc, self.cnonce, self.qop, method, self.uri, "")
+    if digestAlgStrength(self.algorithm) < 0 {
+        return false
+    }
+    response := DigestCalcResponse(self.algorithm, HA1, self.nonce, self.nc, self.cnonce, self.qop, method, self.uri, "")
     return response == self.response
 }
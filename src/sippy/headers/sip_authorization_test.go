@@ -0,0 +1,109 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package sippy_header
+
+import (
+    "testing"
+)
+
+// The test vectors from RFC 7616 section 3.9.1
+func TestDigestCalcResponse(t *testing.T) {
+    nonce := "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v"
+    cnonce := "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ"
+    for _, tc := range []struct{ alg, response string }{
+        { "MD5", "8ca523f5e9506fed4657c9700eebdbec" },
+        { "SHA-256", "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1" },
+    } {
+        HA1 := DigestCalcHA1(tc.alg, "Mufasa", "http-auth@example.org", "Circle of Life", nonce, cnonce)
+        response := DigestCalcResponse(tc.alg, HA1, nonce, "00000001", cnonce, "auth", "GET", "/dir/index.html", "")
+        if response != tc.response {
+            t.Errorf("%s: expected %s, got %s", tc.alg, tc.response, response)
+        }
+    }
+}
+
+func TestDigestChallengeResponse(t *testing.T) {
+    challenges := []*SipWWWAuthenticate{}
+    for _, s := range []string{
+        "Digest realm=\"example.com\",nonce=\"abc\",qop=\"auth,auth-int\",algorithm=MD5",
+        "Digest realm=\"example.com\",nonce=\"abc\",qop=\"auth-int\",algorithm=SHA-512-256,opaque=\"xyz\"",
+        "Digest realm=\"example.com\",nonce=\"abc\",algorithm=SHA-384",
+    } {
+        challenge, err := newSipWWWAuthenticateFromString(s)
+        if err != nil {
+            t.Fatal(err)
+        }
+        challenges = append(challenges, challenge)
+    }
+    best := BestChallenge(challenges)
+    if best != challenges[1] {
+        t.Fatalf("wrong challenge picked: %s", best.Body())
+    }
+    if BestChallenge(challenges[2:]) != nil {
+        t.Errorf("unsupported algorithm picked")
+    }
+    for i, challenge := range challenges[:2] {
+        auth := NewSipAuthorizationFromChallenge(challenge, "INVITE", "sip:123@example.com", "alice", "secret", i + 1, "v=0\r\n")
+        parsed, err := NewSipAuthorizationFromString(auth.Body())
+        if err != nil {
+            t.Fatal(err)
+        }
+        if parsed.GetAlgorithm() != challenge.GetAlgorithm() || parsed.GetNonce() != "abc" || parsed.opaque != challenge.GetOpaque() {
+            t.Errorf("%s: parameters mismatch: %s", challenge.GetAlgorithm(), auth.Body())
+        }
+        if parsed.GetNc() != []string{ "00000001", "00000002" }[i] || parsed.GetCnonce() == "" {
+            t.Errorf("%s: wrong nc/cnonce: %s", challenge.GetAlgorithm(), auth.Body())
+        }
+        if parsed.GetQop() != []string{ "auth", "auth-int" }[i] {
+            t.Errorf("%s: wrong qop: %s", challenge.GetAlgorithm(), auth.Body())
+        }
+        if parsed.GetQop() == "auth" && ! parsed.Verify("secret", "INVITE") {
+            t.Errorf("%s: verification failed: %s", challenge.GetAlgorithm(), auth.Body())
+        }
+        if parsed.Verify("wrong", "INVITE") {
+            t.Errorf("%s: wrong password accepted", challenge.GetAlgorithm())
+        }
+    }
+}
+
+func TestNonceCounter(t *testing.T) {
+    nc := NewNonceCounter()
+    challenge := NewSipWWWAuthenticateWithNonce("example.com", "abc")
+    other := NewSipWWWAuthenticateWithNonce("example.org", "xyz")
+    for i, tc := range []struct{ challenge *SipWWWAuthenticate; nc int }{
+        { challenge, 1 },
+        { challenge, 2 },
+        { other, 1 },
+        { challenge, 3 },
+        // The new nonce restarts the count
+        { NewSipWWWAuthenticateWithNonce("example.com", "def"), 1 },
+    } {
+        if n := nc.Next(tc.challenge); n != tc.nc {
+            t.Errorf("%d: expected nc %d, got %d", i, tc.nc, n)
+        }
+    }
+}
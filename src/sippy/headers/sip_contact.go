@@ -57,6 +57,12 @@ func NewSipContactFromAddress(addr *sipAddress) *SipContact {
 }
 
 func (self *SipContact) GetCopy() *SipContact {
+    if self.Asterisk {
+        return &SipContact{
+            compactName  : _sip_contact_name,
+            Asterisk     : true,
+        }
+    }
     return &SipContact{
         compactName  : _sip_contact_name,
         sipAddressHF : self.sipAddressHF.getCopy(),
@@ -38,8 +38,8 @@ var _sip_proxy_authenticate_name normalName = newNormalName("Proxy-Authenticate"
 
 func ParseSipProxyAuthenticate(body string, config sippy_conf.Config) ([]SipHeader, error) {
     super, err := newSipWWWAuthenticateFromString(body)
-    super.normalName = _sip_proxy_authenticate_name
     if err != nil { return nil, err }
+    super.normalName = _sip_proxy_authenticate_name
     return []SipHeader{ &SipProxyAuthenticate{
                                         SipWWWAuthenticate : super,
                                       },
@@ -65,3 +65,12 @@ func (self *SipProxyAuthenticate) GetCopy() *SipProxyAuthenticate {
 func (self *SipProxyAuthenticate) GetCopyAsIface() SipHeader {
     return self.GetCopy()
 }
+
+// Same as BestChallenge() but for the proxy challenges
+func BestProxyChallenge(challenges []*SipProxyAuthenticate) *SipWWWAuthenticate {
+    tmp := make([]*SipWWWAuthenticate, len(challenges))
+    for i, challenge := range challenges {
+        tmp[i] = challenge.SipWWWAuthenticate
+    }
+    return BestChallenge(tmp)
+}
@@ -37,10 +37,10 @@ type SipProxyAuthorization struct {
 
 var _sip_proxy_authorization_name normalName = newNormalName("Proxy-Authorization")
 
-func NewSipProxyAuthorization(realm, nonce, method, uri, username, password string) SipHeader {
+func NewSipProxyAuthorization(challenge *SipWWWAuthenticate, method, uri, username, password string, nc int, entity_body string) SipHeader {
     return &SipProxyAuthorization{
         normalName       : _sip_proxy_authorization_name,
-        SipAuthorization : NewSipAuthorization(realm, nonce, method, uri, username, password),
+        SipAuthorization : NewSipAuthorizationFromChallenge(challenge, method, uri, username, password, nc, entity_body),
     }
 }
 
@@ -40,6 +40,10 @@ type SipWWWAuthenticate struct {
     normalName
     realm *sippy_conf.MyAddress
     nonce string
+    qop   string
+    stale bool
+    algorithm string
+    opaque string
 }
 
 var _sip_www_authenticate_name normalName = newNormalName("WWW-Authenticate")
@@ -60,6 +64,14 @@ func NewSipWWWAuthenticateWithRealm(realm string) *SipWWWAuthenticate {
     }
 }
 
+func NewSipWWWAuthenticateWithNonce(realm, nonce string) *SipWWWAuthenticate {
+    return &SipWWWAuthenticate{
+        normalName : _sip_www_authenticate_name,
+        realm : sippy_conf.NewMyAddress(realm),
+        nonce : nonce,
+    }
+}
+
 func newSipWWWAuthenticateFromString(body string) (*SipWWWAuthenticate, error) {
     tmp := sippy_utils.FieldsN(body, 2)
     if len(tmp) != 2 {
@@ -68,16 +80,27 @@ func newSipWWWAuthenticateFromString(body string) (*SipWWWAuthenticate, error) {
     self := &SipWWWAuthenticate{
         normalName : _sip_www_authenticate_name,
     }
-    for _, part := range strings.Split(tmp[1], ",") {
+    for _, part := range splitDigestParams(tmp[1]) {
         arr := strings.SplitN(strings.TrimSpace(part), "=", 2)
         if len(arr) != 2 { continue }
-        switch arr[0] {
+        switch strings.ToLower(strings.TrimSpace(arr[0])) {
         case "realm":
             self.realm = sippy_conf.NewMyAddress(strings.Trim(arr[1], "\""))
         case "nonce":
             self.nonce = strings.Trim(arr[1], "\"")
+        case "qop":
+            self.qop = strings.Trim(arr[1], "\"")
+        case "stale":
+            self.stale = strings.ToLower(strings.Trim(arr[1], "\"")) == "true"
+        case "algorithm":
+            self.algorithm = strings.Trim(arr[1], "\"")
+        case "opaque":
+            self.opaque = strings.Trim(arr[1], "\"")
         }
     }
+    if self.realm == nil {
+        self.realm = sippy_conf.NewMyAddress("")
+    }
     return self, nil
 }
 
@@ -94,10 +117,25 @@ func (self *SipWWWAuthenticate) LocalStr(hostport *sippy_conf.HostPort, compact
 }
 
 func (self *SipWWWAuthenticate) LocalBody(hostport *sippy_conf.HostPort) string {
+    var rval string
     if hostport != nil && self.realm.IsSystemDefault() {
-        return "Digest realm=\"" + hostport.Host.String() + "\",nonce=\"" + self.nonce + "\""
+        rval = "Digest realm=\"" + hostport.Host.String() + "\",nonce=\"" + self.nonce + "\""
+    } else {
+        rval = "Digest realm=\"" + self.realm.String() + "\",nonce=\"" + self.nonce + "\""
+    }
+    if self.opaque != "" {
+        rval += ",opaque=\"" + self.opaque + "\""
+    }
+    if self.algorithm != "" {
+        rval += ",algorithm=" + self.algorithm
     }
-    return "Digest realm=\"" + self.realm.String() + "\",nonce=\"" + self.nonce + "\""
+    if self.qop != "" {
+        rval += ",qop=\"" + self.qop + "\""
+    }
+    if self.stale {
+        rval += ",stale=true"
+    }
+    return rval
 }
 
 func (self *SipWWWAuthenticate) GetRealm() string {
@@ -108,6 +146,52 @@ func (self *SipWWWAuthenticate) GetNonce() string {
     return self.nonce
 }
 
+func (self *SipWWWAuthenticate) GetQop() string {
+    return self.qop
+}
+
+func (self *SipWWWAuthenticate) SetQop(qop string) {
+    self.qop = qop
+}
+
+func (self *SipWWWAuthenticate) GetStale() bool {
+    return self.stale
+}
+
+func (self *SipWWWAuthenticate) SetStale(stale bool) {
+    self.stale = stale
+}
+
+func (self *SipWWWAuthenticate) GetAlgorithm() string {
+    return self.algorithm
+}
+
+func (self *SipWWWAuthenticate) SetAlgorithm(algorithm string) {
+    self.algorithm = algorithm
+}
+
+func (self *SipWWWAuthenticate) GetOpaque() string {
+    return self.opaque
+}
+
+// Returns the qop the client should use in response to the challenge or
+// empty string if the challenge is RFC 2069 style.
+func (self *SipWWWAuthenticate) pickQop() string {
+    has_auth_int := false
+    for _, qop := range strings.Split(self.qop, ",") {
+        switch strings.TrimSpace(qop) {
+        case "auth":
+            return "auth"
+        case "auth-int":
+            has_auth_int = true
+        }
+    }
+    if has_auth_int {
+        return "auth-int"
+    }
+    return ""
+}
+
 func (self *SipWWWAuthenticate) GetCopy() *SipWWWAuthenticate {
     tmp := *self
     return &tmp
@@ -116,3 +200,72 @@ func (self *SipWWWAuthenticate) GetCopy() *SipWWWAuthenticate {
 func (self *SipWWWAuthenticate) GetCopyAsIface() SipHeader {
     return self.GetCopy()
 }
+
+// Pick the challenge with the strongest supported algorithm out of the
+// several ones the server may offer (RFC 8760). Returns nil if none of the
+// algorithms is supported.
+func BestChallenge(challenges []*SipWWWAuthenticate) *SipWWWAuthenticate {
+    var best *SipWWWAuthenticate
+    best_strength := -1
+    for _, challenge := range challenges {
+        strength := digestAlgStrength(challenge.algorithm)
+        if strength > best_strength {
+            best, best_strength = challenge, strength
+        }
+    }
+    return best
+}
+
+// The nonce counts of the last nonces received from each realm. The
+// access is expected to be serialized by the owner.
+type NonceCounter struct {
+    counts          map[string]*nonceCount
+}
+
+type nonceCount struct {
+    nonce           string
+    nc              int
+}
+
+func NewNonceCounter() *NonceCounter {
+    return &NonceCounter{
+        counts          : make(map[string]*nonceCount),
+    }
+}
+
+// Returns the nonce count to be used with the challenge. The count is
+// tracked per realm and restarts whenever the realm issues a new nonce.
+func (self *NonceCounter) Next(challenge *SipWWWAuthenticate) int {
+    realm := challenge.GetRealm()
+    nc, ok := self.counts[realm]
+    if ! ok || nc.nonce != challenge.GetNonce() {
+        nc = &nonceCount{ nonce : challenge.GetNonce() }
+        self.counts[realm] = nc
+    }
+    nc.nc++
+    return nc.nc
+}
+
+// Split the comma separated list of the digest parameters honoring the
+// quoted strings, i.e. qop="auth,auth-int".
+func splitDigestParams(s string) []string {
+    res := []string{}
+    quoted := false
+    start := 0
+    for i := 0; i < len(s); i++ {
+        switch s[i] {
+        case '"':
+            quoted = ! quoted
+        case '\\':
+            if quoted {
+                i++
+            }
+        case ',':
+            if ! quoted {
+                res = append(res, s[start:i])
+                start = i + 1
+            }
+        }
+    }
+    return append(res, s[start:])
+}
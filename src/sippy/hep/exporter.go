@@ -0,0 +1,138 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy_hep
+
+import (
+    "net"
+    "sync/atomic"
+    "time"
+
+    "sippy/log"
+    "sippy/time"
+)
+
+// Exporter sends the captured SIP messages to a HEPv3 collector (Homer)
+// over UDP. The messages are queued and sent by a separate goroutine,
+// the ones that don't fit into the queue are dropped so that the capture
+// never blocks the signalling.
+type Exporter struct {
+    conn            net.Conn
+    capture_id      uint32
+    auth_key        string
+    queue           chan *Packet
+    shutdown_ch     chan int
+    done_ch         chan int
+    dropped         int64
+    logger          sippy_log.ErrorLogger
+}
+
+func NewExporter(address string, capture_id uint32, auth_key string, queue_size int, logger sippy_log.ErrorLogger) (*Exporter, error) {
+    conn, err := net.Dial("udp", address)
+    if err != nil {
+        return nil, err
+    }
+    self := &Exporter{
+        conn            : conn,
+        capture_id      : capture_id,
+        auth_key        : auth_key,
+        queue           : make(chan *Packet, queue_size),
+        shutdown_ch     : make(chan int),
+        done_ch         : make(chan int),
+        logger          : logger,
+    }
+    go self.run()
+    return self, nil
+}
+
+// Capture implements the sippy_conf.SipCapture interface.
+func (self *Exporter) Capture(data []byte, src, dst net.Addr, ts *sippy_time.MonoTime) {
+    now := time.Now()
+    if ts != nil {
+        now = ts.Realt()
+    }
+    pkt := &Packet{
+        Src             : src,
+        Dst             : dst,
+        Time            : now,
+        CaptureId       : self.capture_id,
+        AuthKey         : self.auth_key,
+        Payload         : append([]byte{}, data...),
+    }
+    select {
+    case self.queue <- pkt:
+    default:
+        atomic.AddInt64(&self.dropped, 1)
+    }
+}
+
+func (self *Exporter) run() {
+    defer close(self.done_ch)
+    failing := false
+    for {
+        var pkt *Packet
+        select {
+        case <-self.shutdown_ch:
+            return
+        case pkt = <-self.queue:
+        }
+        // The Call-ID is looked up here to keep the capture itself cheap
+        pkt.CorrelationId = CallId(pkt.Payload)
+        data, err := pkt.Encode()
+        if err != nil {
+            self.logger.Error("HEP: cannot encode the packet: " + err.Error())
+            continue
+        }
+        // Report the collector going away once and not on every packet
+        if _, err = self.conn.Write(data); err != nil {
+            if ! failing {
+                self.logger.Error("HEP: cannot send to the collector: " + err.Error())
+            }
+            failing = true
+        } else {
+            failing = false
+        }
+    }
+}
+
+// Shutdown stops the exporter, the messages still in the queue are
+// discarded.
+func (self *Exporter) Shutdown() {
+    close(self.shutdown_ch)
+    <-self.done_ch
+    self.conn.Close()
+}
+
+// GetDropped returns the number of the messages dropped because the queue
+// was full.
+func (self *Exporter) GetDropped() int64 {
+    return atomic.LoadInt64(&self.dropped)
+}
+
+// GetQueueLength returns the number of the messages waiting to be sent.
+func (self *Exporter) GetQueueLength() int {
+    return len(self.queue)
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy_hep
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "net"
+    "time"
+)
+
+// The HEPv3 chunk types, the vendor is always the generic one (0).
+const (
+    chunk_ip_family     = 0x0001
+    chunk_ip_proto      = 0x0002
+    chunk_ipv4_src      = 0x0003
+    chunk_ipv4_dst      = 0x0004
+    chunk_ipv6_src      = 0x0005
+    chunk_ipv6_dst      = 0x0006
+    chunk_src_port      = 0x0007
+    chunk_dst_port      = 0x0008
+    chunk_ts_sec        = 0x0009
+    chunk_ts_usec       = 0x000a
+    chunk_proto_type    = 0x000b
+    chunk_capture_id    = 0x000c
+    chunk_auth_key      = 0x000e
+    chunk_payload       = 0x000f
+    chunk_correlation   = 0x0011
+)
+
+const (
+    family_ipv4         = 2
+    family_ipv6         = 10
+    proto_type_sip      = 1
+)
+
+// Packet is a single captured SIP message.
+type Packet struct {
+    Src             net.Addr
+    Dst             net.Addr
+    Time            time.Time
+    CaptureId       uint32
+    AuthKey         string
+    CorrelationId   string
+    Payload         []byte
+}
+
+type chunkWriter struct {
+    buf             bytes.Buffer
+}
+
+func (self *chunkWriter) chunk(ctype uint16, data []byte) {
+    var hdr [6]byte
+    binary.BigEndian.PutUint16(hdr[2:], ctype)
+    binary.BigEndian.PutUint16(hdr[4:], uint16(len(hdr) + len(data)))
+    self.buf.Write(hdr[:])
+    self.buf.Write(data)
+}
+
+func (self *chunkWriter) uint8(ctype uint16, v uint8) {
+    self.chunk(ctype, []byte{ v })
+}
+
+func (self *chunkWriter) uint16(ctype uint16, v uint16) {
+    var data [2]byte
+    binary.BigEndian.PutUint16(data[:], v)
+    self.chunk(ctype, data[:])
+}
+
+func (self *chunkWriter) uint32(ctype uint16, v uint32) {
+    var data [4]byte
+    binary.BigEndian.PutUint32(data[:], v)
+    self.chunk(ctype, data[:])
+}
+
+// Returns the IP address, the port and the IP protocol number of the
+// transport address.
+func splitAddr(addr net.Addr) (net.IP, int, uint8, error) {
+    switch a := addr.(type) {
+    case *net.UDPAddr:
+        return a.IP, a.Port, 17, nil
+    case *net.TCPAddr:
+        return a.IP, a.Port, 6, nil
+    }
+    return nil, 0, 0, errors.New("unsupported address type")
+}
+
+// Encode returns the packet in the HEPv3 wire format.
+func (self *Packet) Encode() ([]byte, error) {
+    src_ip, src_port, proto, err := splitAddr(self.Src)
+    if err != nil {
+        return nil, err
+    }
+    dst_ip, dst_port, _, err := splitAddr(self.Dst)
+    if err != nil {
+        return nil, err
+    }
+    w := &chunkWriter{}
+    w.buf.WriteString("HEP3")
+    w.buf.Write([]byte{ 0, 0 }) // the total length is filled in later
+    src4, dst4 := src_ip.To4(), dst_ip.To4()
+    if src4 != nil && dst4 != nil {
+        w.uint8(chunk_ip_family, family_ipv4)
+        w.uint8(chunk_ip_proto, proto)
+        w.chunk(chunk_ipv4_src, src4)
+        w.chunk(chunk_ipv4_dst, dst4)
+    } else {
+        src6, dst6 := src_ip.To16(), dst_ip.To16()
+        if src6 == nil {
+            src6 = net.IPv6unspecified
+        }
+        if dst6 == nil {
+            dst6 = net.IPv6unspecified
+        }
+        w.uint8(chunk_ip_family, family_ipv6)
+        w.uint8(chunk_ip_proto, proto)
+        w.chunk(chunk_ipv6_src, src6)
+        w.chunk(chunk_ipv6_dst, dst6)
+    }
+    w.uint16(chunk_src_port, uint16(src_port))
+    w.uint16(chunk_dst_port, uint16(dst_port))
+    w.uint32(chunk_ts_sec, uint32(self.Time.Unix()))
+    w.uint32(chunk_ts_usec, uint32(self.Time.Nanosecond() / 1000))
+    w.uint8(chunk_proto_type, proto_type_sip)
+    w.uint32(chunk_capture_id, self.CaptureId)
+    if self.AuthKey != "" {
+        w.chunk(chunk_auth_key, []byte(self.AuthKey))
+    }
+    if self.CorrelationId != "" {
+        w.chunk(chunk_correlation, []byte(self.CorrelationId))
+    }
+    w.chunk(chunk_payload, self.Payload)
+    data := w.buf.Bytes()
+    if len(data) > 0xffff {
+        return nil, errors.New("the packet is too big")
+    }
+    binary.BigEndian.PutUint16(data[4:], uint16(len(data)))
+    return data, nil
+}
+
+// CallId returns the Call-ID of the SIP message in the wire format or an
+// empty string if there is none.
+func CallId(data []byte) string {
+    for len(data) > 0 {
+        line := data
+        if eol := bytes.IndexByte(data, '\n'); eol >= 0 {
+            line, data = data[:eol], data[eol + 1:]
+        } else {
+            data = nil
+        }
+        line = bytes.TrimRight(line, "\r")
+        if len(line) == 0 {
+            // The end of the headers
+            break
+        }
+        colon := bytes.IndexByte(line, ':')
+        if colon < 0 {
+            continue
+        }
+        name := bytes.TrimSpace(line[:colon])
+        if bytes.EqualFold(name, []byte("Call-ID")) || bytes.EqualFold(name, []byte("i")) {
+            return string(bytes.TrimSpace(line[colon + 1:]))
+        }
+    }
+    return ""
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy_hep
+
+import (
+    "encoding/binary"
+    "net"
+    "testing"
+    "time"
+
+    "sippy/log"
+    "sippy/time"
+)
+
+const test_msg = "INVITE sip:123@192.0.2.2 SIP/2.0\r\n" +
+    "Via: SIP/2.0/UDP 192.0.2.1:5060;branch=z9hG4bK1\r\n" +
+    "i: abc@192.0.2.1\r\n" +
+    "CSeq: 1 INVITE\r\n" +
+    "\r\n" +
+    "Call-ID: not-a-header\r\n"
+
+// Splits the HEPv3 packet into the chunks by the type.
+func parseChunks(t *testing.T, data []byte) map[uint16][]byte {
+    if string(data[:4]) != "HEP3" || int(binary.BigEndian.Uint16(data[4:])) != len(data) {
+        t.Fatalf("bad HEP header: %q", data[:6])
+    }
+    ret := make(map[uint16][]byte)
+    for data = data[6:]; len(data) > 0; {
+        clen := int(binary.BigEndian.Uint16(data[4:]))
+        if clen < 6 || clen > len(data) {
+            t.Fatalf("bad chunk length %d", clen)
+        }
+        ret[binary.BigEndian.Uint16(data[2:])] = data[6:clen]
+        data = data[clen:]
+    }
+    return ret
+}
+
+func TestEncode(t *testing.T) {
+    ts := time.Unix(1500000000, 123456789)
+    pkt := &Packet{
+        Src             : &net.UDPAddr{ IP : net.ParseIP("192.0.2.1"), Port : 5060 },
+        Dst             : &net.UDPAddr{ IP : net.ParseIP("192.0.2.2"), Port : 5070 },
+        Time            : ts,
+        CaptureId       : 2001,
+        CorrelationId   : CallId([]byte(test_msg)),
+        Payload         : []byte(test_msg),
+    }
+    data, err := pkt.Encode()
+    if err != nil {
+        t.Fatal(err)
+    }
+    chunks := parseChunks(t, data)
+    if chunks[chunk_ip_family][0] != family_ipv4 || chunks[chunk_ip_proto][0] != 17 {
+        t.Errorf("bad family/protocol: %v %v", chunks[chunk_ip_family], chunks[chunk_ip_proto])
+    }
+    if ! net.IP(chunks[chunk_ipv4_src]).Equal(net.ParseIP("192.0.2.1")) || ! net.IP(chunks[chunk_ipv4_dst]).Equal(net.ParseIP("192.0.2.2")) {
+        t.Errorf("bad addresses: %v %v", chunks[chunk_ipv4_src], chunks[chunk_ipv4_dst])
+    }
+    if binary.BigEndian.Uint16(chunks[chunk_src_port]) != 5060 || binary.BigEndian.Uint16(chunks[chunk_dst_port]) != 5070 {
+        t.Errorf("bad ports")
+    }
+    if binary.BigEndian.Uint32(chunks[chunk_ts_sec]) != 1500000000 || binary.BigEndian.Uint32(chunks[chunk_ts_usec]) != 123456 {
+        t.Errorf("bad timestamp")
+    }
+    if binary.BigEndian.Uint32(chunks[chunk_capture_id]) != 2001 || chunks[chunk_proto_type][0] != proto_type_sip {
+        t.Errorf("bad capture id or protocol type")
+    }
+    if string(chunks[chunk_correlation]) != "abc@192.0.2.1" || string(chunks[chunk_payload]) != test_msg {
+        t.Errorf("bad correlation id or payload: %q", chunks[chunk_correlation])
+    }
+    if _, ok := chunks[chunk_auth_key]; ok {
+        t.Errorf("unexpected auth key")
+    }
+
+    pkt.Src = &net.TCPAddr{ IP : net.ParseIP("2001:db8::1"), Port : 5060 }
+    if data, err = pkt.Encode(); err != nil {
+        t.Fatal(err)
+    }
+    chunks = parseChunks(t, data)
+    if chunks[chunk_ip_family][0] != family_ipv6 || chunks[chunk_ip_proto][0] != 6 ||
+      ! net.IP(chunks[chunk_ipv6_src]).Equal(net.ParseIP("2001:db8::1")) || ! net.IP(chunks[chunk_ipv6_dst]).Equal(net.ParseIP("192.0.2.2")) {
+        t.Errorf("bad IPv6 chunks: %v", chunks)
+    }
+}
+
+func TestExporter(t *testing.T) {
+    collector, err := net.ListenUDP("udp", &net.UDPAddr{ IP : net.ParseIP("127.0.0.1") })
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer collector.Close()
+    exp, err := NewExporter(collector.LocalAddr().String(), 1, "secret", 10, sippy_log.NewErrorLogger())
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer exp.Shutdown()
+    rtime, _ := sippy_time.NewMonoTime()
+    data := []byte(test_msg)
+    exp.Capture(data, &net.UDPAddr{ IP : net.ParseIP("192.0.2.1"), Port : 5060 }, &net.UDPAddr{ IP : net.ParseIP("192.0.2.2"), Port : 5060 }, rtime)
+    // The capture must not keep the buffer
+    data[0] = 'X'
+    buf := make([]byte, 65536)
+    collector.SetReadDeadline(time.Now().Add(3 * time.Second))
+    n, err := collector.Read(buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    chunks := parseChunks(t, buf[:n])
+    if string(chunks[chunk_payload]) != test_msg || string(chunks[chunk_auth_key]) != "secret" ||
+      string(chunks[chunk_correlation]) != "abc@192.0.2.1" {
+        t.Errorf("unexpected packet: %v", chunks)
+    }
+    if binary.BigEndian.Uint32(chunks[chunk_ts_sec]) != uint32(rtime.Realt().Unix()) {
+        t.Errorf("the timestamp is not taken from the capture time")
+    }
+}
+
+func TestExporterQueueFull(t *testing.T) {
+    // No sender is running so the queue is never drained
+    exp := &Exporter{ queue : make(chan *Packet, 2) }
+    for i := 0; i < 5; i++ {
+        exp.Capture([]byte(test_msg), nil, nil, nil)
+    }
+    if exp.GetQueueLength() != 2 || exp.GetDropped() != 3 {
+        t.Errorf("queue length %d, dropped %d", exp.GetQueueLength(), exp.GetDropped())
+    }
+}
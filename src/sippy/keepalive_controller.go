@@ -57,9 +57,9 @@ func (self *keepaliveController) RecvResponse(resp sippy_types.SipResponse, tr s
         return
     }
     code, _ := resp.GetSCode()
-    if code == 401 && resp.GetSipWWWAuthenticate() != nil && self.ua.GetUsername() != "" && self.ua.GetPassword() != "" && ! self.triedauth {
-        challenge := resp.GetSipWWWAuthenticate()
-        req := self.ua.GenRequest("INVITE", self.ua.GetLSDP(), challenge.GetNonce(), challenge.GetRealm(), nil)
+    if code == 401 && sippy_header.BestChallenge(resp.GetSipWWWAuthenticates()) != nil && self.ua.GetUsername() != "" && self.ua.GetPassword() != "" && ! self.triedauth {
+        challenge := sippy_header.BestChallenge(resp.GetSipWWWAuthenticates())
+        req := self.ua.GenRequest("INVITE", self.ua.GetLSDP(), challenge, nil)
         self.ua.IncLCSeq()
         self.ka_tr, err = self.ua.PrepTr(req)
         if err == nil {
@@ -68,9 +68,9 @@ func (self *keepaliveController) RecvResponse(resp sippy_types.SipResponse, tr s
         self.ua.SipTM().BeginClientTransaction(req, self.ka_tr)
         return
     }
-    if code == 407 && resp.GetSipProxyAuthenticate() != nil && self.ua.GetUsername() != "" && self.ua.GetPassword() != "" && ! self.triedauth {
-        challenge := resp.GetSipProxyAuthenticate()
-        req := self.ua.GenRequest("INVITE", self.ua.GetLSDP(), challenge.GetNonce(), challenge.GetRealm(), sippy_header.NewSipProxyAuthorization)
+    if code == 407 && sippy_header.BestProxyChallenge(resp.GetSipProxyAuthenticates()) != nil && self.ua.GetUsername() != "" && self.ua.GetPassword() != "" && ! self.triedauth {
+        challenge := sippy_header.BestProxyChallenge(resp.GetSipProxyAuthenticates())
+        req := self.ua.GenRequest("INVITE", self.ua.GetLSDP(), challenge, sippy_header.NewSipProxyAuthorization)
         self.ua.IncLCSeq()
         self.ka_tr, err = self.ua.PrepTr(req)
         if err == nil {
@@ -102,7 +102,7 @@ func (self *keepaliveController) keepAlive() {
     if _, ok := self.ua.GetState().(*UaStateConnected); ! ok {
         return
     }
-    req := self.ua.GenRequest("INVITE", self.ua.GetLSDP(), "", "", nil)
+    req := self.ua.GenRequest("INVITE", self.ua.GetLSDP(), nil, nil)
     self.ua.IncLCSeq()
     self.triedauth = false
     self.ka_tr, err = self.ua.PrepTr(req)
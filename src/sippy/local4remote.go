@@ -28,6 +28,8 @@ package sippy
 
 import (
     "net"
+    "sort"
+    "sync"
 
     "sippy/conf"
 )
@@ -39,6 +41,7 @@ type local4remote struct {
     cache_l2s       map[string]*udpServer
     handleIncoming  UdpPacketReceiver
     fixed           bool
+    lock            sync.Mutex
 }
 
 func NewLocal4Remote(config sippy_conf.Config, handleIncoming UdpPacketReceiver) (*local4remote, error) {
@@ -84,6 +87,9 @@ func (self *local4remote) getServer(address *sippy_conf.HostPort, is_local bool
     var laddress *sippy_conf.HostPort
     var ok bool
 
+    self.lock.Lock()
+    defer self.lock.Unlock()
+
     if self.fixed {
         for _, server := range self.cache_l2s {
             return server
@@ -150,14 +156,30 @@ func (self *local4remote) getServer(address *sippy_conf.HostPort, is_local bool
 }
 
 func (self *local4remote) rotateCache() {
+    self.lock.Lock()
+    defer self.lock.Unlock()
     self.cache_r2l_old = self.cache_r2l
     self.cache_r2l = make(map[string]*sippy_conf.HostPort)
 }
 
 func (self *local4remote) shutdown() {
+    self.lock.Lock()
+    defer self.lock.Unlock()
     for _, userv := range self.cache_l2s {
         userv.Shutdown()
     }
     self.cache_l2s = make(map[string]*udpServer)
 }
 
+
+// servers returns the listening sockets sorted by the local address.
+func (self *local4remote) servers() []*udpServer {
+    self.lock.Lock()
+    ret := make([]*udpServer, 0, len(self.cache_l2s))
+    for _, userv := range self.cache_l2s {
+        ret = append(ret, userv)
+    }
+    self.lock.Unlock()
+    sort.Slice(ret, func(i, j int) bool { return ret[i].uopts.laddress.String() < ret[j].uopts.laddress.String() })
+    return ret
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy_log
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+    "unicode"
+)
+
+type Level int
+
+const (
+    LevelDebug = Level(iota)
+    LevelInfo
+    LevelWarning
+    LevelError
+)
+
+var level_names = []string{ "debug", "info", "warning", "error" }
+
+func (self Level) String() string {
+    if self < LevelDebug || self > LevelError {
+        return "level" + strconv.Itoa(int(self))
+    }
+    return level_names[self]
+}
+
+func ParseLevel(s string) (Level, error) {
+    s = strings.ToLower(s)
+    if s == "warn" {
+        s = "warning"
+    }
+    for i, name := range level_names {
+        if name == s {
+            return Level(i), nil
+        }
+    }
+    return LevelDebug, errors.New("unknown log level: " + s)
+}
+
+// Field is a key/value pair attached to a log record. A Field passed
+// among the parameters of Error(), Debug() etc. is not a part of the
+// message text but goes to the record fields.
+type Field struct {
+    Key     string
+    Value   interface{}
+}
+
+func F(key string, value interface{}) Field {
+    return Field{ Key : key, Value : value }
+}
+
+type Record struct {
+    Time    time.Time
+    Level   Level
+    Message string
+    Fields  []Field
+}
+
+type Encoder interface {
+    Encode(*Record) []byte
+}
+
+// TextEncoder produces the classic "2006-01-02 15:04:05+00 ERROR: message"
+// lines with the fields appended as key=value. The Bare encoder omits
+// the time and the level, e.g. for the syslog that records them itself.
+type TextEncoder struct {
+    Bare    bool
+}
+
+func (self TextEncoder) Encode(r *Record) []byte {
+    buf := &bytes.Buffer{}
+    if ! self.Bare {
+        t := r.Time.UTC()
+        fmt.Fprintf(buf, "%d-%02d-%02d %02d:%02d:%02d+00 %s: ", t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(),
+            strings.ToUpper(r.Level.String()))
+    }
+    buf.WriteString(r.Message)
+    for _, f := range r.Fields {
+        if buf.Len() > 0 {
+            buf.WriteByte(' ')
+        }
+        buf.WriteString(f.Key)
+        buf.WriteByte('=')
+        buf.WriteString(quoteValue(fmt.Sprint(f.Value)))
+    }
+    if ! self.Bare {
+        buf.WriteByte('\n')
+    }
+    return buf.Bytes()
+}
+
+func quoteValue(s string) string {
+    if s == "" {
+        return `""`
+    }
+    for _, r := range s {
+        if r == '"' || r == '=' || r == '\\' || unicode.IsSpace(r) || ! unicode.IsPrint(r) {
+            return strconv.Quote(s)
+        }
+    }
+    return s
+}
+
+// JSONEncoder produces one JSON object per line with the "time", "level"
+// and "msg" keys followed by the fields.
+type JSONEncoder struct {
+}
+
+func (JSONEncoder) Encode(r *Record) []byte {
+    buf := &bytes.Buffer{}
+    buf.WriteString(`{"time":`)
+    writeJSON(buf, r.Time.UTC().Format("2006-01-02T15:04:05.000000Z"))
+    buf.WriteString(`,"level":`)
+    writeJSON(buf, r.Level.String())
+    buf.WriteString(`,"msg":`)
+    writeJSON(buf, r.Message)
+    for _, f := range r.Fields {
+        buf.WriteByte(',')
+        writeJSON(buf, f.Key)
+        buf.WriteByte(':')
+        writeJSON(buf, f.Value)
+    }
+    buf.WriteString("}\n")
+    return buf.Bytes()
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+    switch t := v.(type) {
+    case error:
+        v = t.Error()
+    case fmt.Stringer:
+        v = t.String()
+    }
+    b, err := json.Marshal(v)
+    if err != nil {
+        b, _ = json.Marshal(fmt.Sprint(v))
+    }
+    buf.Write(b)
+}
@@ -24,11 +24,12 @@
 // ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
 // (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
 // SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
-
 package sippy_log
 
 import (
+    "errors"
     "fmt"
+    "log/syslog"
     "runtime"
     "os"
     "strings"
@@ -39,22 +40,41 @@ import (
 type ErrorLogger interface {
     ErrorAndTraceback(interface{})
     Error(...interface{})
+    Warning(...interface{})
+    Info(...interface{})
     Debug(...interface{})
     Errorf(string, ...interface{})
     Debugf(string, ...interface{})
+    Log(Level, string, ...Field)
+    // With returns a logger that adds the fields to every record. The
+    // new logger shares the output with the parent.
+    With(...Field) ErrorLogger
 }
 
-type errorLogger struct {
+type logOutput struct {
     lock    sync.Mutex
+    fd_lock sync.Mutex
+    fname   string
+    fd      *os.File
+    level   Level
+    encoder Encoder
+    syslog  *syslog.Writer
+}
+
+type errorLogger struct {
+    out     *logOutput
+    fields  []Field
 }
 
 func NewErrorLogger() *errorLogger {
-    return &errorLogger{}
+    return &errorLogger{
+        out     : &logOutput{ encoder : TextEncoder{} },
+    }
 }
 
 func (self *errorLogger) ErrorAndTraceback(err interface{}) {
-    self.lock.Lock()
-    defer self.lock.Unlock()
+    self.out.lock.Lock()
+    defer self.out.lock.Unlock()
     self.Error(err)
     buf := make([]byte, 16384)
     n := runtime.Stack(buf, false)
@@ -65,30 +85,215 @@ func (self *errorLogger) ErrorAndTraceback(err interface{}) {
 }
 
 func (self *errorLogger) Debug(params...interface{}) {
-    self.write("DEBUG:", params...)
+    self.write(LevelDebug, params...)
 }
 
 func (self *errorLogger) Debugf(format string, params...interface{}) {
-    self.write("DEBUG:", fmt.Sprintf(format, params...))
+    self.write(LevelDebug, fmt.Sprintf(format, params...))
+}
+
+func (self *errorLogger) Info(params...interface{}) {
+    self.write(LevelInfo, params...)
+}
+
+func (self *errorLogger) Warning(params...interface{}) {
+    self.write(LevelWarning, params...)
 }
 
 func (self *errorLogger) Error(params...interface{}) {
-    self.write("ERROR:", params...)
+    self.write(LevelError, params...)
 }
 
 func (self *errorLogger) Errorf(format string, params...interface{}) {
-    self.write("ERROR:", fmt.Sprintf(format, params...))
+    self.write(LevelError, fmt.Sprintf(format, params...))
+}
+
+func (self *errorLogger) Log(level Level, msg string, fields ...Field) {
+    if level < self.getLevel() {
+        return
+    }
+    self.output(&Record{
+        Time    : time.Now(),
+        Level   : level,
+        Message : msg,
+        Fields  : append(self.fields[:len(self.fields):len(self.fields)], fields...),
+    })
+}
+
+func (self *errorLogger) With(fields ...Field) ErrorLogger {
+    return &errorLogger{
+        out     : self.out,
+        fields  : append(self.fields[:len(self.fields):len(self.fields)], fields...),
+    }
+}
+
+// SetLevel sets the minimal level of the records that reach the output.
+func (self *errorLogger) SetLevel(level Level) {
+    self.out.fd_lock.Lock()
+    self.out.level = level
+    self.out.fd_lock.Unlock()
 }
 
-func (*errorLogger) Reopen() {
+func (self *errorLogger) getLevel() Level {
+    self.out.fd_lock.Lock()
+    defer self.out.fd_lock.Unlock()
+    return self.out.level
 }
 
-func (*errorLogger) write(prefix string, params ...interface{}) {
-    t := time.Now().UTC()
-    buf := []interface{}{ fmt.Sprintf("%d-%02d-%02d %02d:%02d:%02d+00", t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second()), " ", prefix }
+// SetFormat selects the record encoder, either "text" or "json".
+func (self *errorLogger) SetFormat(format string) error {
+    var encoder Encoder
+    switch format {
+    case "text":
+        encoder = TextEncoder{}
+    case "json":
+        encoder = JSONEncoder{}
+    default:
+        return errors.New("unknown log format: " + format)
+    }
+    self.SetEncoder(encoder)
+    return nil
+}
+
+func (self *errorLogger) SetEncoder(encoder Encoder) {
+    self.out.fd_lock.Lock()
+    self.out.encoder = encoder
+    self.out.fd_lock.Unlock()
+}
+
+var syslog_facilities = map[string]syslog.Priority{
+    "kern"      : syslog.LOG_KERN,
+    "user"      : syslog.LOG_USER,
+    "mail"      : syslog.LOG_MAIL,
+    "daemon"    : syslog.LOG_DAEMON,
+    "auth"      : syslog.LOG_AUTH,
+    "syslog"    : syslog.LOG_SYSLOG,
+    "lpr"       : syslog.LOG_LPR,
+    "news"      : syslog.LOG_NEWS,
+    "uucp"      : syslog.LOG_UUCP,
+    "cron"      : syslog.LOG_CRON,
+    "authpriv"  : syslog.LOG_AUTHPRIV,
+    "ftp"       : syslog.LOG_FTP,
+    "local0"    : syslog.LOG_LOCAL0,
+    "local1"    : syslog.LOG_LOCAL1,
+    "local2"    : syslog.LOG_LOCAL2,
+    "local3"    : syslog.LOG_LOCAL3,
+    "local4"    : syslog.LOG_LOCAL4,
+    "local5"    : syslog.LOG_LOCAL5,
+    "local6"    : syslog.LOG_LOCAL6,
+    "local7"    : syslog.LOG_LOCAL7,
+}
+
+func ParseSyslogFacility(facility string) (syslog.Priority, error) {
+    prio, ok := syslog_facilities[strings.ToLower(facility)]
+    if ! ok {
+        return 0, errors.New("unknown syslog facility: " + facility)
+    }
+    return prio, nil
+}
+
+// SetSyslog sends the output to the local syslog instead of the file or
+// the stderr. An empty facility switches the syslog output off.
+func (self *errorLogger) SetSyslog(facility, tag string) error {
+    var w *syslog.Writer
+    if facility != "" {
+        prio, err := ParseSyslogFacility(facility)
+        if err != nil {
+            return err
+        }
+        w, err = syslog.New(prio | syslog.LOG_INFO, tag)
+        if err != nil {
+            return err
+        }
+    }
+    self.out.fd_lock.Lock()
+    defer self.out.fd_lock.Unlock()
+    if self.out.syslog != nil {
+        self.out.syslog.Close()
+    }
+    self.out.syslog = w
+    return nil
+}
+
+// SetLogFile redirects the output from the stderr to the file. An empty
+// name switches the output back to the stderr.
+func (self *errorLogger) SetLogFile(fname string) error {
+    self.out.fd_lock.Lock()
+    self.out.fname = fname
+    self.out.fd_lock.Unlock()
+    return self.Reopen()
+}
+
+// Reopen closes and opens again the log file, e.g. after it has been
+// rotated. The old file stays in use if the new one cannot be opened.
+func (self *errorLogger) Reopen() error {
+    self.out.fd_lock.Lock()
+    defer self.out.fd_lock.Unlock()
+    var fd *os.File
+    if self.out.fname != "" {
+        var err error
+        fd, err = os.OpenFile(self.out.fname, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0644)
+        if err != nil {
+            return err
+        }
+    }
+    if self.out.fd != nil {
+        self.out.fd.Close()
+    }
+    self.out.fd = fd
+    return nil
+}
+
+func (self *errorLogger) write(level Level, params ...interface{}) {
+    if level < self.getLevel() {
+        return
+    }
+    msg := make([]string, 0, len(params))
+    fields := self.fields[:len(self.fields):len(self.fields)]
     for _, it := range params {
-        buf = append(buf, " ", it)
+        if f, ok := it.(Field); ok {
+            fields = append(fields, f)
+        } else {
+            msg = append(msg, fmt.Sprint(it))
+        }
+    }
+    self.output(&Record{
+        Time    : time.Now(),
+        Level   : level,
+        Message : strings.Join(msg, " "),
+        Fields  : fields,
+    })
+}
+
+func (self *errorLogger) output(r *Record) {
+    self.out.fd_lock.Lock()
+    defer self.out.fd_lock.Unlock()
+    if self.out.syslog != nil {
+        self.writeSyslog(r)
+        return
+    }
+    buf := self.out.encoder.Encode(r)
+    if self.out.fd != nil {
+        self.out.fd.Write(buf)
+    } else {
+        os.Stderr.Write(buf)
+    }
+}
+
+func (self *errorLogger) writeSyslog(r *Record) {
+    encoder := self.out.encoder
+    if _, ok := encoder.(TextEncoder); ok {
+        encoder = TextEncoder{ Bare : true }
+    }
+    msg := strings.TrimSuffix(string(encoder.Encode(r)), "\n")
+    switch {
+    case r.Level >= LevelError:
+        self.out.syslog.Err(msg)
+    case r.Level == LevelWarning:
+        self.out.syslog.Warning(msg)
+    case r.Level == LevelInfo:
+        self.out.syslog.Info(msg)
+    default:
+        self.out.syslog.Debug(msg)
     }
-    buf = append(buf, "\n")
-    fmt.Fprint(os.Stderr, buf...)
 }
@@ -0,0 +1,176 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package sippy_log
+
+import (
+    "encoding/json"
+    "errors"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func readLog(t *testing.T, fname string) string {
+    buf, err := ioutil.ReadFile(fname)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return string(buf)
+}
+
+func TestSipLoggerReopen(t *testing.T) {
+    dir, err := ioutil.TempDir("", "sip_logger")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    fname := filepath.Join(dir, "sip.log")
+    logger, err := NewSipLogger("test", fname)
+    if err != nil {
+        t.Fatal(err)
+    }
+    logger.Write(nil, "call1", "before rotation")
+    if err = os.Rename(fname, fname + ".0"); err != nil {
+        t.Fatal(err)
+    }
+    logger.Write(nil, "call1", "still to the old file")
+    if err = logger.Reopen(); err != nil {
+        t.Fatal(err)
+    }
+    logger.Write(nil, "call2", "after rotation")
+    old := readLog(t, fname + ".0")
+    if ! strings.Contains(old, "before rotation") || ! strings.Contains(old, "still to the old file") || strings.Contains(old, "after rotation") {
+        t.Errorf("unexpected content of the rotated log: %s", old)
+    }
+    cur := readLog(t, fname)
+    if ! strings.Contains(cur, "call2/test: after rotation") || strings.Contains(cur, "before") {
+        t.Errorf("unexpected content of the new log: %s", cur)
+    }
+    // The failed reopen keeps the old file in use
+    if err = os.Rename(dir, dir + ".moved"); err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir + ".moved")
+    if err = logger.Reopen(); err == nil {
+        t.Error("the reopen should have failed")
+    }
+    logger.Write(nil, "call3", "after failed reopen")
+    if cur = readLog(t, filepath.Join(dir + ".moved", "sip.log")); ! strings.Contains(cur, "after failed reopen") {
+        t.Errorf("the message has been lost after the failed reopen: %s", cur)
+    }
+}
+
+func TestErrorLoggerReopen(t *testing.T) {
+    dir, err := ioutil.TempDir("", "error_logger")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    fname := filepath.Join(dir, "error.log")
+    logger := NewErrorLogger()
+    if err = logger.SetLogFile(fname); err != nil {
+        t.Fatal(err)
+    }
+    logger.Error("before rotation")
+    if err = os.Rename(fname, fname + ".0"); err != nil {
+        t.Fatal(err)
+    }
+    if err = logger.Reopen(); err != nil {
+        t.Fatal(err)
+    }
+    logger.Debugf("after %s", "rotation")
+    if old := readLog(t, fname + ".0"); ! strings.Contains(old, "ERROR: before rotation") || strings.Contains(old, "after") {
+        t.Errorf("unexpected content of the rotated log: %s", old)
+    }
+    if cur := readLog(t, fname); ! strings.Contains(cur, "DEBUG: after rotation") || strings.Contains(cur, "before") {
+        t.Errorf("unexpected content of the new log: %s", cur)
+    }
+}
+
+func TestErrorLoggerLevelsAndFields(t *testing.T) {
+    dir, err := ioutil.TempDir("", "error_logger")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    fname := filepath.Join(dir, "error.log")
+    logger := NewErrorLogger()
+    if err = logger.SetLogFile(fname); err != nil {
+        t.Fatal(err)
+    }
+    logger.SetLevel(LevelInfo)
+    call_logger := logger.With(F("call_id", "abc@host"))
+    call_logger.Debug("filtered out")
+    call_logger.Info("call connected", F("leg", "A"), F("reason", "Normal Clearing"))
+    logger.Warning("no fields")
+    cur := readLog(t, fname)
+    if strings.Contains(cur, "filtered out") {
+        t.Errorf("the debug message passed the info level: %s", cur)
+    }
+    if ! strings.Contains(cur, `INFO: call connected call_id=abc@host leg=A reason="Normal Clearing"`) {
+        t.Errorf("unexpected text record: %s", cur)
+    }
+    if ! strings.Contains(cur, "WARNING: no fields\n") {
+        t.Errorf("the parent logger has got the child fields: %s", cur)
+    }
+    if err = logger.SetFormat("json"); err != nil {
+        t.Fatal(err)
+    }
+    if err = os.Remove(fname); err != nil {
+        t.Fatal(err)
+    }
+    if err = logger.Reopen(); err != nil {
+        t.Fatal(err)
+    }
+    call_logger.Log(LevelError, "call failed", F("code", 503), F("error", errors.New("timeout")))
+    var rec map[string]interface{}
+    if err = json.Unmarshal([]byte(readLog(t, fname)), &rec); err != nil {
+        t.Fatal(err)
+    }
+    for k, v := range map[string]interface{}{ "level" : "error", "msg" : "call failed", "call_id" : "abc@host", "code" : float64(503), "error" : "timeout" } {
+        if rec[k] != v {
+            t.Errorf("%s: expected %v, got %v", k, v, rec[k])
+        }
+    }
+    if err = logger.SetFormat("xml"); err == nil {
+        t.Error("the unknown format has been accepted")
+    }
+}
+
+func TestParseLevel(t *testing.T) {
+    for s, level := range map[string]Level{ "debug" : LevelDebug, "INFO" : LevelInfo, "warn" : LevelWarning, "error" : LevelError } {
+        if l, err := ParseLevel(s); err != nil || l != level {
+            t.Errorf("%s: expected %v, got %v, %v", s, level, l, err)
+        }
+    }
+    if _, err := ParseLevel("verbose"); err == nil {
+        t.Error("the unknown level has been accepted")
+    }
+}
@@ -28,8 +28,11 @@
 package sippy_log
 
 import (
+    "bytes"
+    "errors"
     "os"
     "fmt"
+    "sync"
     "time"
     "sippy/time"
 )
@@ -42,6 +45,8 @@ type sipLogger struct {
     fname   string
     id      string
     fd      *os.File
+    lock    sync.Mutex
+    json    bool
 }
 
 func NewSipLogger(id, fname string) (*sipLogger, error) {
@@ -63,18 +68,52 @@ func (self *sipLogger) Write(rtime *sippy_time.MonoTime, call_id string, msg str
     } else {
         t = time.Now()
     }
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if self.json {
+        buf := &bytes.Buffer{}
+        buf.WriteString(`{"time":`)
+        writeJSON(buf, t.UTC().Format("2006-01-02T15:04:05.000000Z"))
+        buf.WriteString(`,"call_id":`)
+        writeJSON(buf, call_id)
+        buf.WriteString(`,"id":`)
+        writeJSON(buf, self.id)
+        buf.WriteString(`,"msg":`)
+        writeJSON(buf, msg)
+        buf.WriteString("}\n")
+        self.fd.Write(buf.Bytes())
+        return
+    }
     buf := fmt.Sprintf("%d %s %02d:%02d:%06.3f/%s/%s: %s\n",
                 t.Day(), t.Month().String()[:3], t.Hour(), t.Minute(), float64(t.Second()) + float64(t.Nanosecond()) / 1e9,
                 call_id, self.id, msg)
     self.fd.Write([]byte(buf))
 }
 
+// SetFormat selects between the classic "text" log lines and the "json"
+// lines carrying the whole SIP message in the "msg" key.
+func (self *sipLogger) SetFormat(format string) error {
+    if format != "text" && format != "json" {
+        return errors.New("unknown log format: " + format)
+    }
+    self.lock.Lock()
+    self.json = format == "json"
+    self.lock.Unlock()
+    return nil
+}
+
+// Reopen closes and opens again the log file, e.g. after it has been
+// rotated. The old file stays in use if the new one cannot be opened.
 func (self *sipLogger) Reopen() error {
-    var err error
-    if self.fd == nil {
+    fd, err := os.OpenFile(self.fname, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0644)
+    if err != nil {
+        return err
+    }
+    self.lock.Lock()
+    if self.fd != nil {
         self.fd.Close()
-        self.fd = nil
     }
-    self.fd, err = os.OpenFile(self.fname, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0644)
-    return err
+    self.fd = fd
+    self.lock.Unlock()
+    return nil
 }
@@ -41,7 +41,7 @@ func newRedirectController(ua sippy_types.UA) *redirectController {
 }
 
 func (self *redirectController) RecvResponse(resp sippy_types.SipResponse, t sippy_types.ClientTransaction) {
-    req := self.ua.GenRequest("BYE", nil, "", "", nil)
+    req := self.ua.GenRequest("BYE", nil, nil, nil)
     self.ua.IncLCSeq()
     self.ua.SipTM().BeginNewClientTransaction(req, nil, self.ua.GetSessionLock(), /*laddress*/ self.ua.GetSourceAddress(), nil, self.ua.BeforeRequestSent)
 }
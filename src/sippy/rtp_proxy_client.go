@@ -32,10 +32,13 @@ import (
     "strconv"
     "strings"
     "sync"
+    "sync/atomic"
+    "time"
 
     "sippy/conf"
     "sippy/log"
     "sippy/types"
+    "sippy/utils"
 )
 
 func NewRtpProxyClient(opts *rtpProxyClientOpts, config sippy_conf.Config, logger sippy_log.ErrorLogger) (sippy_types.RtpProxyClient, error) {
@@ -56,7 +59,13 @@ type Rtp_proxy_client_base struct {
     stat_supported  bool
     wdnt_supported  bool
     caps_done       bool
+    caps_checking   bool
     shut_down       bool
+    vc_running      bool
+    hb_running      bool
+    lock            sync.Mutex
+    health_lock     sync.Mutex
+    health_notified bool
     active_sessions int64
     sessions_created int64
     active_streams  int64
@@ -70,24 +79,71 @@ type rtp_proxy_transport interface {
     is_local() bool
     send_command(string, func(string), sync.Locker)
     shutdown()
+    get_rtpc_delay() float64
+}
+
+// Get the time to wait for the reply to the command. The statistics
+// queries may take longer to complete while the stats polling is expected
+// to be fast.
+func rtpp_command_timeout(command string, timeout time.Duration) time.Duration {
+    if command == "" {
+        return timeout
+    }
+    switch command[0] {
+    case 'I':
+        if timeout < 10 * time.Second {
+            return 10 * time.Second
+        }
+    case 'G':
+        if timeout > time.Second {
+            return time.Second
+        }
+    }
+    return timeout
 }
 
 func (self *Rtp_proxy_client_base) IsLocal() bool {
-    return self.transport.is_local()
+    transport := self.get_transport()
+    if transport == nil {
+        return false
+    }
+    return transport.is_local()
 }
 
 func (self *Rtp_proxy_client_base) IsOnline() bool {
+    self.lock.Lock()
+    defer self.lock.Unlock()
     return self.online
 }
 
 func (self *Rtp_proxy_client_base) SBindSupported() bool {
+    self.lock.Lock()
+    defer self.lock.Unlock()
     return self.sbind_supported
 }
 
 func (self *Rtp_proxy_client_base) TNotSupported() bool {
+    self.lock.Lock()
+    defer self.lock.Unlock()
     return self.tnot_supported
 }
 
+func (self *Rtp_proxy_client_base) is_shut_down() bool {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.shut_down
+}
+
+// Returns nil once the client has been shut down.
+func (self *Rtp_proxy_client_base) get_transport() rtp_proxy_transport {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if self.shut_down {
+        return nil
+    }
+    return self.transport
+}
+
 func (self *Rtp_proxy_client_base) GetProxyAddress() string {
     return self.proxy_address
 }
@@ -115,90 +171,11 @@ func NewRtp_proxy_client_base(heir sippy_types.RtpProxyClient, global_config sip
 }
 
 func (self *Rtp_proxy_client_base) Init() error {
-    var err error
-    var rtpp_class func(sippy_types.RtpProxyClient, sippy_conf.Config, net.Addr) (rtp_proxy_transport, error)
-    var rtppa net.Addr
-
-    a := self.opts.spath
-    if strings.HasPrefix(a, "udp:") {
-        tmp := strings.SplitN(a, ":", 3)
-        if len(tmp) == 2 {
-            rtppa, err = net.ResolveUDPAddr("udp", tmp[1] + ":22222")
-        } else {
-            rtppa, err = net.ResolveUDPAddr("udp", tmp[1] + ":" + tmp[2])
-        }
-        if err != nil { return err }
-        self.proxy_address, _, err = net.SplitHostPort(rtppa.String())
-        if err != nil { return err }
-        rtpp_class = newRtp_proxy_client_udp
-    } else if strings.HasPrefix(a, "udp6:") {
-        tmp := strings.SplitN(a, ":", 2)
-        a := tmp[1]
-        rtp_proxy_host, rtp_proxy_port := a, "22222"
-        if a[len(a)-1] != ']' {
-            idx := strings.LastIndexByte(a, ':')
-            if idx < 0 {
-                rtp_proxy_host = a
-            } else {
-                rtp_proxy_host, rtp_proxy_port = a[:idx], a[idx+1:]
-            }
-        }
-        if rtp_proxy_host[0] != '[' {
-            rtp_proxy_host = "[" + rtp_proxy_host + "]"
-        }
-        rtppa, err = net.ResolveUDPAddr("udp", rtp_proxy_host + ":" + rtp_proxy_port)
-        if err != nil { return err }
-        self.proxy_address, _, err = net.SplitHostPort(rtppa.String())
-        if err != nil { return err }
-        rtpp_class = newRtp_proxy_client_udp
-    } else if strings.HasPrefix(a, "tcp:") {
-        tmp := strings.SplitN(a, ":", 3)
-        if len(tmp) == 2 {
-            rtppa, err = net.ResolveTCPAddr("tcp", tmp[1] + ":22222")
-        } else {
-            rtppa, err = net.ResolveTCPAddr("tcp", tmp[1] + ":" + tmp[2])
-        }
-        if err != nil { return err }
-        self.proxy_address, _, err = net.SplitHostPort(rtppa.String())
-        if err != nil { return err }
-        rtpp_class = newRtp_proxy_client_stream
-    } else if strings.HasPrefix(a, "tcp6:") {
-        tmp := strings.SplitN(a, ":", 2)
-        a := tmp[1]
-        rtp_proxy_host, rtp_proxy_port := a, "22222"
-        if a[len(a)-1] != ']' {
-            idx := strings.LastIndexByte(a, ':')
-            if idx < 0 {
-                rtp_proxy_host = a
-            } else {
-                rtp_proxy_host, rtp_proxy_port = a[:idx], a[idx+1:]
-            }
-        }
-        if rtp_proxy_host[0] != '[' {
-            rtp_proxy_host = "[" + rtp_proxy_host + "]"
-        }
-        rtppa, err = net.ResolveTCPAddr("tcp", rtp_proxy_host + ":" + rtp_proxy_port)
-        if err != nil { return err }
-        self.proxy_address, _, err = net.SplitHostPort(rtppa.String())
-        if err != nil { return err }
-        rtpp_class = newRtp_proxy_client_stream
-    } else {
-        if strings.HasPrefix(a, "unix:") {
-            rtppa, err = net.ResolveUnixAddr("unix", a[5:])
-        } else if strings.HasPrefix(a, "cunix:") {
-            rtppa, err = net.ResolveUnixAddr("unix", a[6:])
-        } else {
-            rtppa, err = net.ResolveUnixAddr("unix", a)
-        }
-        self.proxy_address = self.global_config.SipAddress().String()
-        rtpp_class = newRtp_proxy_client_stream
-    }
-    self.transport, err = rtpp_class(self.me(), self.global_config, rtppa)
+    address, err := parseRtpProxyAddress(self.opts.spath)
     if err != nil {
         return err
     }
-    self.start()
-    return nil
+    return self.InitWithAddress(address)
 }
 
 func (self *Rtp_proxy_client_base) InitWithAddress(address net.Addr) error {
@@ -225,35 +202,60 @@ func (self *Rtp_proxy_client_base) InitWithAddress(address net.Addr) error {
 
 func (self *Rtp_proxy_client_base) start() {
     if ! self.opts.no_version_check {
+        self.lock.Lock()
+        self.vc_running = true
+        self.lock.Unlock()
         self.version_check()
     } else {
+        self.lock.Lock()
         self.caps_done = true
         self.online = true
+        self.lock.Unlock()
     }
 }
 
 func (self *Rtp_proxy_client_base) SendCommand(cmd string, cb func(string), session_lock sync.Locker) {
-    self.transport.send_command(cmd, cb, session_lock)
+    self.send_command(cmd, cb, session_lock)
 }
 /*
     def reconnect(self, *args, **kwargs):
         self.rtpp_class.reconnect(self, *args, **kwargs)
 */
 
-func (self *Rtp_proxy_client_base) version_check() {
-    if self.shut_down {
-        return
+// Returns false and drops the command when the client has been shut down.
+// The callback of the dropped command gets the empty result so that the
+// caller does not wait for it forever.
+func (self *Rtp_proxy_client_base) send_command(cmd string, cb func(string), session_lock sync.Locker) bool {
+    transport := self.get_transport()
+    if transport == nil {
+        if cb != nil {
+            go sippy_utils.SafeCall(func() { cb("") }, session_lock, self.logger)
+        }
+        return false
     }
-    self.transport.send_command("V", self.version_check_reply, nil)
+    transport.send_command(cmd, cb, session_lock)
+    return true
+}
+
+func (self *Rtp_proxy_client_base) version_check() {
+    self.send_command("V", self.version_check_reply, nil)
 }
 
 func (self *Rtp_proxy_client_base) version_check_reply(version string) {
+    self.lock.Lock()
     if self.shut_down {
+        self.lock.Unlock()
         return
     }
+    online := self.online
+    if version == "20040107" || online {
+        // the version check loop ends here, GoOffline() restarts it
+        self.vc_running = false
+    }
+    self.lock.Unlock()
     if version == "20040107" {
         self.me().GoOnline()
-    } else if self.online {
+    } else if online {
         self.me().GoOffline()
     } else {
         StartTimeoutWithSpread(self.version_check, nil, self.opts.hrtb_retr_ival, 1, self.logger, 0.1)
@@ -262,97 +264,158 @@ func (self *Rtp_proxy_client_base) version_check_reply(version string) {
 
 func (self *Rtp_proxy_client_base) heartbeat() {
     //print "heartbeat", self, self.address
-    if self.shut_down {
-        return
-    }
-    self.transport.send_command("Ib", self.heartbeat_reply, nil)
+    self.send_command("Ib", self.heartbeat_reply, nil)
 }
 
 func (self *Rtp_proxy_client_base) heartbeat_reply(stats string) {
     //print "heartbeat_reply", self.address, stats, self.online
-    if self.shut_down || ! self.online {
+    self.lock.Lock()
+    if self.shut_down || ! self.online || stats == "" {
+        // the heartbeat loop ends here, GoOnline() restarts it
+        self.hb_running = false
+    }
+    running := self.hb_running
+    self.lock.Unlock()
+    if ! running {
+        if stats == "" {
+            atomic.StoreInt64(&self.active_sessions, 0)
+            self.me().GoOffline()
+        }
         return
     }
-    if stats == "" {
-        self.active_sessions = 0
-        self.me().GoOffline()
-    } else {
-        sessions_created := int64(0)
-        active_sessions := int64(0)
-        active_streams := int64(0)
-        preceived := int64(0)
-        ptransmitted := int64(0)
-        scanner := bufio.NewScanner(strings.NewReader(stats))
-        for scanner.Scan() {
-            line_parts := strings.SplitN(scanner.Text(), ":", 2)
-            if len(line_parts) != 2 { continue }
-            switch line_parts[0] {
-            case "sessions created":
-                sessions_created, _ = strconv.ParseInt(line_parts[1], 10, 64)
-            case "active sessions":
-                active_sessions, _ = strconv.ParseInt(line_parts[1], 10, 64)
-            case "active streams":
-                active_streams, _ = strconv.ParseInt(line_parts[1], 10, 64)
-            case "packets received":
-                preceived, _ = strconv.ParseInt(line_parts[1], 10, 64)
-            case "packets transmitted":
-                ptransmitted, _ = strconv.ParseInt(line_parts[1], 10, 64)
-            }
+    sessions_created := int64(0)
+    active_sessions := int64(0)
+    active_streams := int64(0)
+    preceived := int64(0)
+    ptransmitted := int64(0)
+    scanner := bufio.NewScanner(strings.NewReader(stats))
+    for scanner.Scan() {
+        line_parts := strings.SplitN(scanner.Text(), ":", 2)
+        if len(line_parts) != 2 { continue }
+        switch line_parts[0] {
+        case "sessions created":
+            sessions_created, _ = strconv.ParseInt(strings.TrimSpace(line_parts[1]), 10, 64)
+        case "active sessions":
+            active_sessions, _ = strconv.ParseInt(strings.TrimSpace(line_parts[1]), 10, 64)
+        case "active streams":
+            active_streams, _ = strconv.ParseInt(strings.TrimSpace(line_parts[1]), 10, 64)
+        case "packets received":
+            preceived, _ = strconv.ParseInt(strings.TrimSpace(line_parts[1]), 10, 64)
+        case "packets transmitted":
+            ptransmitted, _ = strconv.ParseInt(strings.TrimSpace(line_parts[1]), 10, 64)
         }
-        self.update_active(active_sessions, sessions_created, active_streams, preceived, ptransmitted)
     }
+    self.update_active(active_sessions, sessions_created, active_streams, preceived, ptransmitted)
     StartTimeoutWithSpread(self.heartbeat, nil, self.opts.hrtb_ival, 1, self.logger, 0.1)
 }
 
+// The state changes are done under the lock as the replies to the
+// commands may arrive concurrently from several transport workers.
 func (self *Rtp_proxy_client_base) GoOnline() {
-    if self.shut_down {
+    self.lock.Lock()
+    if self.shut_down || self.online {
+        self.lock.Unlock()
         return
     }
-    if ! self.online {
-        if ! self.caps_done {
-            newRtppCapsChecker(self)
+    if ! self.caps_done {
+        if self.caps_checking {
+            self.lock.Unlock()
             return
         }
-        self.online = true
+        self.caps_checking = true
+        self.lock.Unlock()
+        newRtppCapsChecker(self)
+        return
+    }
+    self.online = true
+    start_hb := ! self.hb_running
+    self.hb_running = true
+    self.lock.Unlock()
+    self.notify_health()
+    if start_hb {
         self.heartbeat()
     }
 }
 
 func (self *Rtp_proxy_client_base) GoOffline() {
-    if self.shut_down {
+    //print "go_offline", self.address, self.online
+    self.lock.Lock()
+    if self.shut_down || ! self.online {
+        self.lock.Unlock()
         return
     }
-    //print "go_offline", self.address, self.online
-    if self.online {
-        self.online = false
+    self.online = false
+    start_vc := ! self.vc_running
+    self.vc_running = true
+    self.lock.Unlock()
+    self.notify_health()
+    if start_vc {
         StartTimeoutWithSpread(self.version_check, nil, self.opts.hrtb_retr_ival, 1, self.logger, 0.1)
     }
 }
 
+// Reports the current state to the health callback. The callbacks are
+// serialized and only made when the state differs from the last one
+// reported so that the concurrent state changes cannot be delivered out
+// of order.
+func (self *Rtp_proxy_client_base) notify_health() {
+    if self.opts.health_cb == nil {
+        return
+    }
+    self.health_lock.Lock()
+    defer self.health_lock.Unlock()
+    online := self.IsOnline()
+    if online == self.health_notified {
+        return
+    }
+    self.health_notified = online
+    sippy_utils.SafeCall(func() { self.opts.health_cb(self.me(), online) }, nil, self.logger)
+}
+
 func (self *Rtp_proxy_client_base) update_active(active_sessions, sessions_created, active_streams, preceived, ptransmitted int64) {
+    atomic.StoreInt64(&self.active_sessions, active_sessions)
+    atomic.StoreInt64(&self.active_streams, active_streams)
+    self.lock.Lock()
     self.sessions_created = sessions_created
-    self.active_sessions = active_sessions
-    self.active_streams = active_streams
     self.preceived = preceived
     self.ptransmitted = ptransmitted
+    self.lock.Unlock()
 }
 
 func (self *Rtp_proxy_client_base) Shutdown() {
+    self.lock.Lock()
     if self.shut_down { // do not crash when shutdown() called twice
+        self.lock.Unlock()
         return
     }
     self.shut_down = true
-    self.transport.shutdown()
+    transport := self.transport
     self.transport = nil
+    self.lock.Unlock()
+    transport.shutdown()
 }
 
 func (self *Rtp_proxy_client_base) GetOpts() sippy_types.RtpProxyClientOpts {
     return self.opts
 }
-/*
-    def get_rtpc_delay(self):
-        self.transport.get_rtpc_delay(self)
-*/
+
+// Returns the number of the active sessions and streams as reported by
+// the last heartbeat.
+func (self *Rtp_proxy_client_base) GetActiveSessions() int64 {
+    return atomic.LoadInt64(&self.active_sessions)
+}
+
+func (self *Rtp_proxy_client_base) GetActiveStreams() int64 {
+    return atomic.LoadInt64(&self.active_streams)
+}
+
+func (self *Rtp_proxy_client_base) GetRtpcDelay() float64 {
+    transport := self.get_transport()
+    if transport == nil {
+        return 0
+    }
+    return transport.get_rtpc_delay()
+}
 
 type rtppCapsChecker struct {
     caps_requested  int
@@ -364,34 +427,39 @@ func newRtppCapsChecker(rtpc *Rtp_proxy_client_base) *rtppCapsChecker {
     self := &rtppCapsChecker{
         rtpc    : rtpc,
     }
-    rtpc.caps_done = false
     CAPSTABLE := []struct{ vers string; attr *bool }{
-        { "20071218", &self.rtpc.copy_supported },
-        { "20080403", &self.rtpc.stat_supported },
-        { "20081224", &self.rtpc.tnot_supported },
-        { "20090810", &self.rtpc.sbind_supported },
-        { "20150617", &self.rtpc.wdnt_supported },
+        { "20071218", &rtpc.copy_supported },
+        { "20080403", &rtpc.stat_supported },
+        { "20081224", &rtpc.tnot_supported },
+        { "20090810", &rtpc.sbind_supported },
+        { "20150617", &rtpc.wdnt_supported },
     }
     self.caps_requested = len(CAPSTABLE)
     for _, it := range CAPSTABLE {
         attr := it.attr // For some reason the it.attr cannot be passed into the following
                         // function directly - the resulting value is always that of the
                         // last 'it.attr' value.
-        rtpc.transport.send_command("VF " + it.vers, func(res string) { self.caps_query_done(res, attr) }, nil)
+        if ! rtpc.send_command("VF " + it.vers, func(res string) { self.caps_query_done(res, attr) }, nil) {
+            break
+        }
     }
     return self
 }
 
+// The replies may arrive concurrently, both the counter and the
+// capability flags are protected by the client lock.
 func (self *rtppCapsChecker) caps_query_done(result string, attr *bool) {
+    rtpc := self.rtpc
+    rtpc.lock.Lock()
     self.caps_received += 1
-    if result == "1" {
-        *attr = true
-    } else {
-        *attr = false
+    *attr = result == "1"
+    done := self.caps_received == self.caps_requested
+    if done {
+        rtpc.caps_done = true
+        rtpc.caps_checking = false
     }
-    if self.caps_received == self.caps_requested {
-        self.rtpc.caps_done = true
-        self.rtpc.GoOnline()
-        self.rtpc = nil
+    rtpc.lock.Unlock()
+    if done {
+        rtpc.GoOnline()
     }
 }
@@ -0,0 +1,134 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2016 Andriy Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "errors"
+    "net"
+    "strconv"
+    "strings"
+)
+
+const (
+    rtpp_default_port = "22222"
+)
+
+// Split the "host", "host:port", "[host]" or "[host]:port" into the host and
+// port parts. When the port is not specified the default rtpproxy port is
+// used. For the bare IPv6 address without brackets that cannot be parsed as
+// is the part after the last colon is treated as the port number when ipv6
+// is set for the compatibility with the Python version.
+func rtpp_split_host_port(a string, ipv6 bool) (string, string, error) {
+    var host, port string
+
+    if a == "" {
+        return "", "", errors.New("empty rtpproxy address")
+    }
+    if a[0] == '[' {
+        idx := strings.IndexByte(a, ']')
+        if idx < 0 {
+            return "", "", errors.New("missing ']' in the rtpproxy address: " + a)
+        }
+        host, port = a[1:idx], a[idx+1:]
+        if port != "" {
+            if port[0] != ':' {
+                return "", "", errors.New("garbage after ']' in the rtpproxy address: " + a)
+            }
+            port = port[1:]
+        }
+    } else if strings.Count(a, ":") > 1 {
+        if ! ipv6 || net.ParseIP(a) != nil {
+            host = a
+        } else {
+            idx := strings.LastIndexByte(a, ':')
+            host, port = a[:idx], a[idx+1:]
+        }
+    } else {
+        idx := strings.IndexByte(a, ':')
+        if idx < 0 {
+            host = a
+        } else {
+            host, port = a[:idx], a[idx+1:]
+        }
+    }
+    if host == "" {
+        return "", "", errors.New("empty host in the rtpproxy address: " + a)
+    }
+    if port == "" {
+        port = rtpp_default_port
+    }
+    nport, err := strconv.Atoi(port)
+    if err != nil || nport <= 0 || nport > 65535 {
+        return "", "", errors.New("invalid port in the rtpproxy address: " + a)
+    }
+    return host, port, nil
+}
+
+// Parse the rtpproxy control socket specification as accepted by the
+// rtpproxy_clients option. Supported formats are:
+//
+//     udp:host[:port]
+//     udp6:host[:port]
+//     tcp:host[:port]
+//     tcp6:host[:port]
+//     unix:/path, cunix:/path or just /path
+func parseRtpProxyAddress(spath string) (net.Addr, error) {
+    var network, a string
+
+    spath = strings.TrimSpace(spath)
+    switch {
+    case strings.HasPrefix(spath, "udp:"):
+        network, a = "udp", spath[4:]
+    case strings.HasPrefix(spath, "udp6:"):
+        network, a = "udp6", spath[5:]
+    case strings.HasPrefix(spath, "tcp:"):
+        network, a = "tcp", spath[4:]
+    case strings.HasPrefix(spath, "tcp6:"):
+        network, a = "tcp6", spath[5:]
+    case strings.HasPrefix(spath, "unix:"):
+        network, a = "unix", spath[5:]
+    case strings.HasPrefix(spath, "cunix:"):
+        network, a = "unix", spath[6:]
+    default:
+        network, a = "unix", spath
+    }
+    if network == "unix" {
+        if a == "" {
+            return nil, errors.New("empty rtpproxy socket path")
+        }
+        return net.ResolveUnixAddr("unix", a)
+    }
+    ipv6 := strings.HasSuffix(network, "6")
+    host, port, err := rtpp_split_host_port(a, ipv6)
+    if err != nil {
+        return nil, err
+    }
+    if strings.HasPrefix(network, "udp") {
+        return net.ResolveUDPAddr(network, net.JoinHostPort(host, port))
+    }
+    return net.ResolveTCPAddr(network, net.JoinHostPort(host, port))
+}
@@ -28,6 +28,8 @@ package sippy
 
 import (
     "time"
+
+    "sippy/types"
 )
 
 type rtpProxyClientOpts struct {
@@ -36,12 +38,15 @@ type rtpProxyClientOpts struct {
     nworkers            *int
     hrtb_retr_ival      time.Duration
     hrtb_ival           time.Duration
+    cmd_timeout         time.Duration
+    health_cb           sippy_types.OnRtpProxyHealthListener
 }
 
 func NewRtpProxyClientOpts() *rtpProxyClientOpts {
     return &rtpProxyClientOpts{
         hrtb_retr_ival      : 60 * time.Second,
         hrtb_ival           : 10 * time.Second,
+        cmd_timeout         : 3 * time.Second,
         no_version_check    : false,
     }
 }
@@ -61,3 +66,15 @@ func (self *rtpProxyClientOpts) SetHeartbeatRetryInterval(ival time.Duration) {
 func (self *rtpProxyClientOpts) GetNWorkers() *int {
     return self.nworkers
 }
+
+func (self *rtpProxyClientOpts) SetCommandTimeout(timeout time.Duration) {
+    self.cmd_timeout = timeout
+}
+
+func (self *rtpProxyClientOpts) GetCommandTimeout() time.Duration {
+    return self.cmd_timeout
+}
+
+func (self *rtpProxyClientOpts) SetHealthCb(cb sippy_types.OnRtpProxyHealthListener) {
+    self.health_cb = cb
+}
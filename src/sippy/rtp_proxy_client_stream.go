@@ -27,6 +27,7 @@
 package sippy
 
 import (
+    "bufio"
     "fmt"
     "net"
     "strings"
@@ -42,6 +43,10 @@ import (
 
 const (
     _RTPPLWorker_MAX_RETRIES = 3
+    _RTPPLWorker_MIN_BACKOFF = 100 * time.Millisecond
+    _RTPPLWorker_MAX_BACKOFF = 5 * time.Second
+    // How long to wait for the next line of the multi-line reply
+    _RTPPLWorker_LINE_WAIT = 20 * time.Millisecond
 )
 
 type rtpp_req_stream struct {
@@ -53,6 +58,9 @@ type rtpp_req_stream struct {
 type _RTPPLWorker struct {
     userv           *Rtp_proxy_client_stream
     shutdown_chan   chan int
+    s               net.Conn
+    reader          *bufio.Reader
+    backoff         time.Duration
 }
 
 func newRTPPLWorker(userv *Rtp_proxy_client_stream) *_RTPPLWorker {
@@ -64,46 +72,113 @@ func newRTPPLWorker(userv *Rtp_proxy_client_stream) *_RTPPLWorker {
     return self
 }
 
+// The connection is kept open between the commands and is only
+// re-established after an error.
+func (self *_RTPPLWorker) connect(timeout time.Duration) error {
+    self.close()
+    s, err := net.DialTimeout(self.userv.address.Network(), self.userv.address.String(), timeout)
+    if err != nil {
+        return err
+    }
+    self.s = s
+    self.reader = bufio.NewReader(s)
+    return nil
+}
+
+func (self *_RTPPLWorker) close() {
+    if self.s != nil {
+        self.s.Close()
+        self.s = nil
+        self.reader = nil
+    }
+}
+
+// Sleep before the next reconnect attempt. The delay is doubled after
+// each consecutive failure and is reset after a successful command.
+func (self *_RTPPLWorker) sleep_backoff() {
+    if self.backoff < _RTPPLWorker_MIN_BACKOFF {
+        self.backoff = _RTPPLWorker_MIN_BACKOFF
+    }
+    time.Sleep(self.backoff)
+    self.backoff *= 2
+    if self.backoff > _RTPPLWorker_MAX_BACKOFF {
+        self.backoff = _RTPPLWorker_MAX_BACKOFF
+    }
+}
+
 func (self *_RTPPLWorker) send_raw(command string, stime *sippy_time.MonoTime) (string, time.Duration, error) {
     //print "%s.send_raw(%s)" % (id(self), command)
     if stime == nil {
         stime, _ = sippy_time.NewMonoTime()
     }
     var err error
-    var n int
     retries := 0
     rval := ""
-    buf := make([]byte, 1024)
-    var s net.Conn
+    timeout := rtpp_command_timeout(command, self.userv.owner.GetOpts().GetCommandTimeout())
     for {
         if retries > _RTPPLWorker_MAX_RETRIES {
-            return "", 0, fmt.Errorf("Error sending to the rtpproxy on " + self.userv.address.String() + ": " + err.Error())
+            return "", 0, fmt.Errorf("Error sending to the rtpproxy on %s: %s", self.userv.address.String(), err.Error())
+        }
+        if retries > 0 {
+            self.sleep_backoff()
         }
         retries++
-        if s != nil {
-            s.Close()
+        if self.s == nil {
+            err = self.connect(timeout)
+            if err != nil {
+                continue
+            }
         }
-        s, err = net.Dial(self.userv.address.Network(), self.userv.address.String())
+        rval, err = self.exchange(command, timeout)
         if err != nil {
-            time.Sleep(100 * time.Millisecond)
+            self.close()
             continue
         }
-        _, err = s.Write([]byte(command))
-        if err != nil {
-            time.Sleep(100 * time.Millisecond)
-            continue
+        break
+    }
+    self.backoff = 0
+    rtpc_delay, _ := stime.OffsetFromNow()
+    return strings.TrimSpace(rval), rtpc_delay, nil
+}
+
+// Send the command and read the reply. The replies are newline
+// terminated, except the ones to the "I" command which span several
+// lines. Those are sent by the rtpproxy at once, so the lines following
+// the first one are read for as long as they keep arriving.
+func (self *_RTPPLWorker) exchange(command string, timeout time.Duration) (string, error) {
+    err := self.s.SetDeadline(time.Now().Add(timeout))
+    if err != nil {
+        return "", err
+    }
+    _, err = self.s.Write([]byte(command))
+    if err != nil {
+        return "", err
+    }
+    rval, err := self.reader.ReadString('\n')
+    if err != nil {
+        return "", err
+    }
+    if command[0] != 'I' {
+        return rval, nil
+    }
+    for {
+        if self.reader.Buffered() == 0 {
+            err = self.s.SetReadDeadline(time.Now().Add(_RTPPLWorker_LINE_WAIT))
+            if err != nil {
+                return "", err
+            }
         }
-        n, err = s.Read(buf)
+        line, err := self.reader.ReadString('\n')
         if err != nil {
-            time.Sleep(100 * time.Millisecond)
-            continue
+            if nerr, ok := err.(net.Error); ok && nerr.Timeout() && line == "" {
+                break
+            }
+            // The connection is out of sync after the partial line
+            return "", err
         }
-        rval = strings.TrimSpace(string(buf[:n]))
-        break
+        rval += line
     }
-    s.Close()
-    rtpc_delay, _ := stime.OffsetFromNow()
-    return rval, rtpc_delay, nil
+    return rval, nil
 }
 
 func (self *_RTPPLWorker) run() {
@@ -119,6 +194,7 @@ func (self *_RTPPLWorker) run() {
         if err != nil {
             self.userv.global_config.ErrorLogger().Debug("Error communicating the rtpproxy: " + err.Error())
             data, rtpc_delay = "", -1
+            self.userv.owner.GoOffline()
         }
         if len(data) == 0 {
             rtpc_delay = -1
@@ -130,6 +206,7 @@ func (self *_RTPPLWorker) run() {
             self.userv.register_delay(rtpc_delay)
         }
     }
+    self.close()
     self.shutdown_chan <- 1
 }
 
@@ -139,6 +216,7 @@ type Rtp_proxy_client_stream struct {
     nworkers    int
     workers     []*_RTPPLWorker
     delay_flt   sippy_math.RecFilter
+    delay_lock  sync.Mutex
     _is_local    bool
     wi          chan *rtpp_req_stream
     global_config sippy_conf.Config
@@ -206,12 +284,17 @@ func (self *Rtp_proxy_client_stream) shutdown() {
 }
 
 func (self *Rtp_proxy_client_stream) register_delay(rtpc_delay time.Duration) {
+    self.delay_lock.Lock()
     self.delay_flt.Apply(rtpc_delay.Seconds())
+    self.delay_lock.Unlock()
 }
-/*
-    def get_rtpc_delay(self):
-        return self.delay_flt.lastval
 
+func (self *Rtp_proxy_client_stream) get_rtpc_delay() float64 {
+    self.delay_lock.Lock()
+    defer self.delay_lock.Unlock()
+    return self.delay_flt.GetLastval()
+}
+/*
 if __name__ == "__main__":
     from twisted.internet import reactor
     def display(*args):
@@ -0,0 +1,219 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2016 Andriy Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "sippy/conf"
+    "sippy/log"
+    "sippy/rtpptest"
+    "sippy/types"
+)
+
+func waitFor(cond func() bool, timeout time.Duration) bool {
+    deadline := time.Now().Add(timeout)
+    for time.Now().Before(deadline) {
+        if cond() {
+            return true
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    return cond()
+}
+
+func newTestRtpProxyClient(t *testing.T, rtpp *sippy_rtpptest.FakeRtpProxy, health_cb sippy_types.OnRtpProxyHealthListener) sippy_types.RtpProxyClient {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+    opts := NewRtpProxyClientOpts()
+    opts.SetSocketPath(rtpp.Address())
+    opts.SetHeartbeatInterval(100 * time.Millisecond)
+    opts.SetHeartbeatRetryInterval(100 * time.Millisecond)
+    opts.SetCommandTimeout(500 * time.Millisecond)
+    opts.SetHealthCb(health_cb)
+    rtpc, err := NewRtpProxyClient(opts, config, config.ErrorLogger())
+    if err != nil {
+        t.Fatalf("Cannot create rtpproxy client: %s", err.Error())
+    }
+    return rtpc
+}
+
+func newTestUnixRtpProxy(t *testing.T) (*sippy_rtpptest.FakeRtpProxy, func()) {
+    dir, err := ioutil.TempDir("", "rtpptest")
+    if err != nil {
+        t.Fatal(err)
+    }
+    rtpp, err := sippy_rtpptest.NewFakeRtpProxyUnix(filepath.Join(dir, "rtpproxy.sock"))
+    if err != nil {
+        os.RemoveAll(dir)
+        t.Fatal(err)
+    }
+    return rtpp, func() { rtpp.Close(); os.RemoveAll(dir) }
+}
+
+func testRtpProxyClientOnline(t *testing.T, rtpp *sippy_rtpptest.FakeRtpProxy) {
+    rtpp.SetCapability("20090810", false)
+    rtpc := newTestRtpProxyClient(t, rtpp, nil)
+    defer rtpc.Shutdown()
+    if ! waitFor(rtpc.IsOnline, 3 * time.Second) {
+        t.Fatalf("The rtpproxy client has not gone online, commands: %v", rtpp.Commands())
+    }
+    if rtpc.SBindSupported() {
+        t.Errorf("The sbind capability is reported as supported")
+    }
+    if ! rtpc.TNotSupported() {
+        t.Errorf("The tnot capability is reported as unsupported")
+    }
+    if len(rtpp.CommandsWithPrefix("V")) != 6 {
+        t.Errorf("Expected one version and 5 capability queries, got: %v", rtpp.CommandsWithPrefix("V"))
+    }
+    if ! waitFor(func() bool { return len(rtpp.CommandsWithPrefix("Ib")) > 0 }, time.Second) {
+        t.Errorf("No heartbeat has been sent")
+    }
+}
+
+func TestRtpProxyClientUDP(t *testing.T) {
+    rtpp, err := sippy_rtpptest.NewFakeRtpProxyUDP("127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer rtpp.Close()
+    testRtpProxyClientOnline(t, rtpp)
+}
+
+func TestRtpProxyClientUnix(t *testing.T) {
+    rtpp, cleanup := newTestUnixRtpProxy(t)
+    defer cleanup()
+    testRtpProxyClientOnline(t, rtpp)
+}
+
+// The commands sent after the shutdown get the empty result instead of
+// being dropped silently.
+func TestRtpProxyClientShutdown(t *testing.T) {
+    rtpp, err := sippy_rtpptest.NewFakeRtpProxyUDP("127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer rtpp.Close()
+    rtpc := newTestRtpProxyClient(t, rtpp, nil)
+    rtpc.Shutdown()
+    var lock sync.Mutex
+    res := make(chan string, 1)
+    lock.Lock()
+    rtpc.SendCommand("V", func(r string) { res <- r }, &lock)
+    lock.Unlock()
+    select {
+    case r := <-res:
+        if r != "" {
+            t.Errorf("Unexpected result %q", r)
+        }
+    case <-time.After(time.Second):
+        t.Error("The callback of the dropped command has not been called")
+    }
+}
+
+func TestRtpProxyClientBadVersion(t *testing.T) {
+    rtpp, cleanup := newTestUnixRtpProxy(t)
+    defer cleanup()
+    rtpp.InjectFailure("V", "E1", -1)
+    rtpc := newTestRtpProxyClient(t, rtpp, nil)
+    defer rtpc.Shutdown()
+    if ! waitFor(func() bool { return len(rtpp.CommandsWithPrefix("V")) >= 2 }, 3 * time.Second) {
+        t.Fatalf("The version check has not been retried")
+    }
+    if rtpc.IsOnline() {
+        t.Errorf("The rtpproxy client has gone online with a bad version")
+    }
+}
+
+func TestRtpProxyClientHealth(t *testing.T) {
+    rtpp, cleanup := newTestUnixRtpProxy(t)
+    defer cleanup()
+    states := make(chan bool, 10)
+    rtpc := newTestRtpProxyClient(t, rtpp, func(rtpc sippy_types.RtpProxyClient, online bool) { states <- online })
+    defer rtpc.Shutdown()
+    for _, expected := range []bool{ true, false, true } {
+        select {
+        case online := <-states:
+            if online != expected {
+                t.Fatalf("Got health state %v, expected %v", online, expected)
+            }
+        case <-time.After(5 * time.Second):
+            t.Fatalf("Timeout waiting for the health state %v", expected)
+        }
+        if expected {
+            // let the heartbeat fail including all the retries
+            rtpp.InjectFailure("Ib", "", _RTPPLWorker_MAX_RETRIES + 1)
+        }
+    }
+}
+
+func TestRtpProxyClientUnixMultiline(t *testing.T) {
+    rtpp, cleanup := newTestUnixRtpProxy(t)
+    defer cleanup()
+    rtpc := newTestRtpProxyClient(t, rtpp, nil)
+    defer rtpc.Shutdown()
+    if ! waitFor(rtpc.IsOnline, 3 * time.Second) {
+        t.Fatalf("The rtpproxy client has not gone online, commands: %v", rtpp.Commands())
+    }
+    replies := make(chan string, 10)
+    rtpc.SendCommand("U test-call-id 10.0.0.1 16000 from-tag", func(res string) { replies <- res }, nil)
+    <-replies
+    // The number of the active streams comes in the third line of the
+    // heartbeat reply
+    if ! waitFor(func() bool { return rtpc.GetActiveStreams() == 2 }, 3 * time.Second) {
+        t.Fatalf("The heartbeat reply has not been read completely, active streams: %d", rtpc.GetActiveStreams())
+    }
+    if rtpc.GetActiveSessions() != 1 {
+        t.Errorf("Expected one active session, got %d", rtpc.GetActiveSessions())
+    }
+    // The replies must not get out of sync with the commands
+    start := time.Now()
+    for i := 0; i < 5; i++ {
+        rtpc.SendCommand("Ib", func(res string) { replies <- res }, nil)
+        if res := <-replies; ! strings.HasPrefix(res, "sessions created: 1\n") || ! strings.HasSuffix(res, "packets transmitted: 0") {
+            t.Fatalf("Unexpected reply to the Ib command: %q", res)
+        }
+        rtpc.SendCommand("V", func(res string) { replies <- res }, nil)
+        if res := <-replies; res != "20040107" {
+            t.Fatalf("Unexpected reply to the V command: %q", res)
+        }
+    }
+    // The replies are read without waiting for the command timeout
+    if elapsed := time.Now().Sub(start); elapsed > 2 * time.Second {
+        t.Errorf("The commands took %s", elapsed)
+    }
+    // The workers keep their connections open
+    if n := rtpp.Connections(); n > 4 {
+        t.Errorf("Expected no more than one connection per worker, got %d", n)
+    }
+}
@@ -140,25 +140,36 @@ func (self *Rtp_proxy_client_udp) send_command(command string, result_callback f
     buf := make([]byte, 16)
     rand.Read(buf)
     cookie := fmt.Sprintf("%x", buf)
+    self.lock.Lock()
     next_retr := self.delay_flt.GetLastval() * 4.0
-    exp_time := 3.0
-    if command[0] == 'I' {
-        exp_time = 10.0
-    } else if command[0] == 'G' {
-        exp_time = 1.0
-    }
+    self.lock.Unlock()
+    exp_time := rtpp_command_timeout(command, self.owner.GetOpts().GetCommandTimeout()).Seconds()
     nretr, err := getnretrans(next_retr, exp_time)
     if err != nil {
         self.global_config.ErrorLogger().Debug("getnretrans error: " + err.Error())
+        self.drop_command(result_callback, session_lock)
         return
     }
     command = cookie + " " + command
-    timer := StartTimeout(func() { self.retransmit(cookie) }, nil, time.Duration(next_retr * float64(time.Second)), 1, self.global_config.ErrorLogger())
-    preq := new_rtpp_req_udp(next_retr, nretr - 1, timer, command, result_callback, session_lock)
-    self.worker.SendTo([]byte(command), self.hostport)
+    preq := new_rtpp_req_udp(next_retr, nretr - 1, nil, command, result_callback, session_lock)
     self.lock.Lock()
+    worker := self.worker
+    if worker == nil {
+        self.lock.Unlock()
+        self.drop_command(result_callback, session_lock)
+        return
+    }
     self.pending_requests[cookie] = preq
+    preq.timer = StartTimeout(func() { self.retransmit(cookie) }, nil, time.Duration(next_retr * float64(time.Second)), 1, self.global_config.ErrorLogger())
     self.lock.Unlock()
+    worker.SendTo([]byte(command), self.hostport)
+}
+
+// Report the empty result of the command that has not been sent.
+func (self *Rtp_proxy_client_udp) drop_command(result_callback func(string), session_lock sync.Locker) {
+    if result_callback != nil {
+        go sippy_utils.SafeCall(func() { result_callback("") }, session_lock, self.global_config.ErrorLogger())
+    }
 }
 
 func (self *Rtp_proxy_client_udp) retransmit(cookie string) {
@@ -195,11 +206,14 @@ func (self *Rtp_proxy_client_udp) process_reply(data []byte, address *sippy_conf
     cookie, result := arr[0], arr[1]
     self.lock.Lock()
     req, ok := self.pending_requests[cookie]
+    if ok {
+        delete(self.pending_requests, cookie)
+        req.timer.Cancel()
+    }
     self.lock.Unlock()
     if ! ok {
         return
     }
-    req.timer.Cancel()
     if req.result_callback != nil {
         sippy_utils.SafeCall(func() { req.result_callback(strings.TrimSpace(result)) }, req.session_lock, self.global_config.ErrorLogger())
     }
@@ -211,7 +225,9 @@ func (self *Rtp_proxy_client_udp) process_reply(data []byte, address *sippy_conf
         // while the original response is already in the queue waiting to be
         // processed. This should not be a big issue since UDP command channel does
         // not work very well if the packet loss goes to more than 30-40%.
+        self.lock.Lock()
         self.delay_flt.Apply(rtime.Sub(req.stime).Seconds())
+        self.lock.Unlock()
         //print "Rtp_proxy_client_udp.process_reply(): delay %f" % (rtime - stime)
     }
 }
@@ -225,13 +241,21 @@ func (self *Rtp_proxy_client_udp) process_reply(data []byte, address *sippy_conf
             self.delay_flt = recfilter(0.95, 0.25)
 */
 func (self *Rtp_proxy_client_udp) shutdown() {
-    self.worker.Shutdown()
+    self.lock.Lock()
+    worker := self.worker
     self.worker = nil
+    self.lock.Unlock()
+    if worker != nil {
+        worker.Shutdown()
+    }
 }
-/*
-    def get_rtpc_delay(self):
-        return self.delay_flt.lastval
 
+func (self *Rtp_proxy_client_udp) get_rtpc_delay() float64 {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.delay_flt.GetLastval()
+}
+/*
 class selftest(object):
     def gotreply(self, *args):
         from twisted.internet import reactor
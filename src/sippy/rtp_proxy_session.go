@@ -31,7 +31,10 @@ import (
     "fmt"
     "math/big"
     "runtime"
+    "strconv"
+    "strings"
     "sync"
+    "sync/atomic"
 
     "sippy/conf"
     "sippy/sdp"
@@ -147,6 +150,10 @@ func (self *Rtp_proxy_session) PlayCaller(prompt_name string, times int/*= 1*/,
     self.caller._play(prompt_name, times, result_callback, index)
 }
 
+func (self *Rtp_proxy_session) PlayCallee(prompt_name string, times int/*= 1*/, result_callback func(string)/*= nil*/, index int /*= 0*/) {
+    self.callee._play(prompt_name, times, result_callback, index)
+}
+
 func (self *Rtp_proxy_session) StopPlayCaller(result_callback func(string)/*= nil*/, index int/*= 0*/) {
     if ! self.caller_session_exists {
         return
@@ -186,17 +193,83 @@ func (self *Rtp_proxy_session) command_result(result string, result_callback fun
 }
 
 func (self *Rtp_proxy_session) Delete() {
-    if self.rtp_proxy_client == nil {
+    self.DeleteWithCallback(nil)
+}
+
+// DeleteWithCallback deletes the session and calls the result_callback
+// once the rtpproxy has replied to all the delete commands or they have
+// failed.
+func (self *Rtp_proxy_session) DeleteWithCallback(result_callback func()) {
+    if self.rtp_proxy_client == nil || self.max_index < 0 {
+        self.rtp_proxy_client = nil
+        if result_callback != nil {
+            result_callback()
+        }
         return
     }
+    var cb func(string)
+    if result_callback != nil {
+        pending := int64(self.max_index + 1)
+        cb = func(string) {
+            if atomic.AddInt64(&pending, -1) == 0 {
+                result_callback()
+            }
+        }
+    }
     for self.max_index >= 0 {
         command := fmt.Sprintf("D %s-%d %s %s", self.call_id, self.max_index, self.from_tag, self.to_tag)
-        self.rtp_proxy_client.SendCommand(command, nil, self.session_lock)
+        self.rtp_proxy_client.SendCommand(command, cb, self.session_lock)
         self.max_index--
     }
     self.rtp_proxy_client = nil
 }
 
+// RtpProxySessionStats holds the counters of the session reported by
+// the rtpproxy "Q" command.
+type RtpProxySessionStats struct {
+    Ttl             int
+    CallerPackets   int64
+    CalleePackets   int64
+    Relayed         int64
+    Dropped         int64
+}
+
+func parseRtpProxySessionStats(result string) *RtpProxySessionStats {
+    arr := strings.Fields(result)
+    if len(arr) < 5 {
+        return nil
+    }
+    ttl, err := strconv.Atoi(arr[0])
+    if err != nil {
+        return nil
+    }
+    counters := make([]int64, 4)
+    for i := range counters {
+        if counters[i], err = strconv.ParseInt(arr[i + 1], 10, 64); err != nil {
+            return nil
+        }
+    }
+    return &RtpProxySessionStats{
+        Ttl             : ttl,
+        CallerPackets   : counters[0],
+        CalleePackets   : counters[1],
+        Relayed         : counters[2],
+        Dropped         : counters[3],
+    }
+}
+
+// Query requests the packet counters of the primary media stream. The
+// callback gets nil if the session does not exist or the rtpproxy has
+// not replied.
+func (self *Rtp_proxy_session) Query(result_callback func(*RtpProxySessionStats)) {
+    if self.rtp_proxy_client == nil || self.max_index < 0 {
+        result_callback(nil)
+        return
+    }
+    command := fmt.Sprintf("Q %s-0 %s %s", self.call_id, self.from_tag, self.to_tag)
+    self.rtp_proxy_client.SendCommand(command, func(result string) { result_callback(parseRtpProxySessionStats(result)) }, self.session_lock)
+}
+
 func (self *Rtp_proxy_session) OnCallerSdpChange(sdp_body sippy_types.MsgBody, cc_event sippy_types.CCEvent, result_callback func(sippy_types.MsgBody)) error {
     return self.caller._on_sdp_change(sdp_body, result_callback)
 }
@@ -211,6 +284,16 @@ func rtp_proxy_session_destructor(self *Rtp_proxy_session) {
 
 func (self *Rtp_proxy_session) CallerSessionExists() bool { return self.caller_session_exists }
 
+func (self *Rtp_proxy_session) GetCallId() string { return self.call_id }
+
+func (self *Rtp_proxy_session) GetFromTag() string { return self.from_tag }
+
+func (self *Rtp_proxy_session) GetToTag() string { return self.to_tag }
+
+func (self *Rtp_proxy_session) GetProxyAddress() string {
+    return self.rtp_proxy_client.GetProxyAddress()
+}
+
 func (self *Rtp_proxy_session) SetCallerLaddress(addr string) {
     self.caller.laddress = addr
 }
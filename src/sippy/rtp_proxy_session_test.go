@@ -0,0 +1,159 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2016 Andriy Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "sippy/conf"
+    "sippy/log"
+    "sippy/rtpptest"
+    "sippy/types"
+)
+
+const test_caller_sdp = "v=0\r\n" +
+    "o=- 12345 12345 IN IP4 10.0.0.1\r\n" +
+    "s=-\r\n" +
+    "c=IN IP4 10.0.0.1\r\n" +
+    "t=0 0\r\n" +
+    "m=audio 16000 RTP/AVP 0 8 101\r\n" +
+    "a=rtpmap:101 telephone-event/8000\r\n"
+
+const test_callee_sdp = "v=0\r\n" +
+    "o=- 54321 54321 IN IP4 10.0.0.2\r\n" +
+    "s=-\r\n" +
+    "c=IN IP4 10.0.0.2\r\n" +
+    "t=0 0\r\n" +
+    "m=audio 18000 RTP/AVP 0\r\n"
+
+func newTestRtpProxySession(t *testing.T, rtpp *sippy_rtpptest.FakeRtpProxy) (*Rtp_proxy_session, sippy_types.RtpProxyClient) {
+    rtpc := newTestRtpProxyClient(t, rtpp, nil)
+    if ! waitFor(rtpc.IsOnline, 3 * time.Second) {
+        t.Fatalf("The rtpproxy client has not gone online")
+    }
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+    rtp_proxy_session, err := NewRtp_proxy_session(config, []sippy_types.RtpProxyClient{ rtpc }, "test-call-id", "", "", "", "", new(sync.Mutex), nil)
+    if err != nil {
+        t.Fatalf("Cannot create rtpproxy session: %s", err.Error())
+    }
+    rtp_proxy_session.SetCallerRaddress(sippy_conf.NewHostPort("10.0.0.2", "5060"))
+    rtp_proxy_session.SetCalleeRaddress(sippy_conf.NewHostPort("10.0.0.1", "5060"))
+    rtp_proxy_session.SetInsertNortpp(true)
+    return rtp_proxy_session, rtpc
+}
+
+func rewriteSdp(t *testing.T, sdp string, fn func(sippy_types.MsgBody, func(sippy_types.MsgBody)) error) sippy_types.ParsedMsgBody {
+    done := make(chan sippy_types.MsgBody, 1)
+    err := fn(NewMsgBody(sdp, "application/sdp"), func(body sippy_types.MsgBody) { done <- body })
+    if err != nil {
+        t.Fatalf("SDP change failed: %s", err.Error())
+    }
+    select {
+    case body := <-done:
+        parsed_body, err := body.GetParsedBody()
+        if err != nil {
+            t.Fatalf("Cannot parse the resulting SDP: %s", err.Error())
+        }
+        return parsed_body
+    case <-time.After(3 * time.Second):
+        t.Fatalf("Timeout waiting for the SDP to be rewritten")
+    }
+    return nil
+}
+
+func TestRtpProxySessionB2BCall(t *testing.T) {
+    rtpp, err := sippy_rtpptest.NewFakeRtpProxyUDP("127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer rtpp.Close()
+    rtpp.SetAdvertisedAddress("192.0.2.10")
+    rtp_proxy_session, rtpc := newTestRtpProxySession(t, rtpp)
+    defer rtpc.Shutdown()
+
+    // The INVITE received from the caller is passed to the callee
+    offer := rewriteSdp(t, test_caller_sdp, func(body sippy_types.MsgBody, cb func(sippy_types.MsgBody)) error {
+        return rtp_proxy_session.OnCallerSdpChange(body, nil, cb)
+    })
+    if offer.GetSections()[0].GetCHeader().GetAddr() != "192.0.2.10" {
+        t.Errorf("Bad media address in the offer: %s", offer.String())
+    }
+    if offer.GetSections()[0].GetMHeader().GetPort() == "16000" {
+        t.Errorf("The media port has not been replaced in the offer: %s", offer.String())
+    }
+    if ! strings.Contains(offer.String(), "nortpproxy=yes") {
+        t.Errorf("No nortpproxy attribute in the offer: %s", offer.String())
+    }
+    // The 200 OK received from the callee is passed to the caller
+    answer := rewriteSdp(t, test_callee_sdp, func(body sippy_types.MsgBody, cb func(sippy_types.MsgBody)) error {
+        return rtp_proxy_session.OnCalleeSdpChange(body, nil, cb)
+    })
+    if answer.GetSections()[0].GetCHeader().GetAddr() != "192.0.2.10" {
+        t.Errorf("Bad media address in the answer: %s", answer.String())
+    }
+    if answer.GetSections()[0].GetMHeader().GetPort() == offer.GetSections()[0].GetMHeader().GetPort() {
+        t.Errorf("The same port has been allocated for both call legs")
+    }
+    if rtpp.ActiveSessions() != 1 {
+        t.Errorf("Expected one rtpproxy session, got %d", rtpp.ActiveSessions())
+    }
+    stats_ch := make(chan *RtpProxySessionStats, 1)
+    rtp_proxy_session.Query(func(stats *RtpProxySessionStats) { stats_ch <- stats })
+    select {
+    case stats := <-stats_ch:
+        if stats == nil || stats.Ttl != 60 {
+            t.Errorf("Unexpected session stats: %+v", stats)
+        }
+    case <-time.After(3 * time.Second):
+        t.Errorf("Timeout waiting for the session stats")
+    }
+    rtp_proxy_session.Delete()
+    if ! waitFor(func() bool { return rtpp.ActiveSessions() == 0 }, 3 * time.Second) {
+        t.Errorf("The rtpproxy session has not been deleted, commands: %v", rtpp.Commands())
+    }
+}
+
+func TestRtpProxySessionUpdateFailure(t *testing.T) {
+    rtpp, cleanup := newTestUnixRtpProxy(t)
+    defer cleanup()
+    rtp_proxy_session, rtpc := newTestRtpProxySession(t, rtpp)
+    defer rtpc.Shutdown()
+
+    rtpp.InjectFailure("U", "E71", 1)
+    offer := rewriteSdp(t, test_caller_sdp, func(body sippy_types.MsgBody, cb func(sippy_types.MsgBody)) error {
+        return rtp_proxy_session.OnCallerSdpChange(body, nil, cb)
+    })
+    if offer.GetSections()[0].GetCHeader().GetAddr() != "10.0.0.1" || offer.GetSections()[0].GetMHeader().GetPort() != "16000" {
+        t.Errorf("The SDP has been modified after a failed update: %s", offer.String())
+    }
+    if len(rtpp.CommandsWithPrefix("U")) != 1 {
+        t.Errorf("Expected exactly one update command, got %v", rtpp.CommandsWithPrefix("U"))
+    }
+}
@@ -0,0 +1,403 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2016 Andriy Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy_rtpptest
+
+import (
+    "bufio"
+    "fmt"
+    "net"
+    "os"
+    "strings"
+    "sync"
+)
+
+// The FakeRtpProxy is an in-process implementation of the rtpproxy control
+// protocol that is intended to be used in tests. It accepts commands either
+// on a UDP or a unix stream socket, allocates fake media ports, records all
+// issued commands and allows the failures to be injected.
+type FakeRtpProxy struct {
+    lock            sync.Mutex
+    network         string
+    address         string
+    udp_conn        net.PacketConn
+    listener        net.Listener
+    conns           map[net.Conn]bool
+    accepted        int
+    commands        []string
+    sessions        map[string]*fake_session
+    failures        []*fake_failure
+    caps            map[string]bool
+    next_port       int
+    sessions_created int
+    adv_address     string
+    shut_down       bool
+    wg              sync.WaitGroup
+}
+
+type fake_session struct {
+    call_id         string
+    caller_port     int
+    callee_port     int
+    recording       bool
+    playing         bool
+}
+
+type fake_failure struct {
+    prefix          string
+    reply           string
+    count           int
+}
+
+var default_caps = []string{ "20071218", "20080403", "20081224", "20090810", "20150617" }
+
+func newFakeRtpProxy(network string) *FakeRtpProxy {
+    self := &FakeRtpProxy{
+        network         : network,
+        conns           : make(map[net.Conn]bool),
+        commands        : make([]string, 0),
+        sessions        : make(map[string]*fake_session),
+        failures        : make([]*fake_failure, 0),
+        caps            : make(map[string]bool),
+        next_port       : 20000,
+    }
+    for _, vers := range default_caps {
+        self.caps[vers] = true
+    }
+    return self
+}
+
+// Start the fake rtpproxy listening on the UDP address, e.g. "127.0.0.1:0".
+func NewFakeRtpProxyUDP(laddr string) (*FakeRtpProxy, error) {
+    self := newFakeRtpProxy("udp")
+    conn, err := net.ListenPacket("udp", laddr)
+    if err != nil {
+        return nil, err
+    }
+    self.udp_conn = conn
+    self.address = conn.LocalAddr().String()
+    self.wg.Add(1)
+    go self.run_udp()
+    return self, nil
+}
+
+// Start the fake rtpproxy listening on the unix stream socket.
+func NewFakeRtpProxyUnix(path string) (*FakeRtpProxy, error) {
+    self := newFakeRtpProxy("unix")
+    os.Remove(path)
+    listener, err := net.Listen("unix", path)
+    if err != nil {
+        return nil, err
+    }
+    self.listener = listener
+    self.address = path
+    self.wg.Add(1)
+    go self.run_stream()
+    return self, nil
+}
+
+// Returns the control socket specification suitable for the
+// rtpProxyClientOpts.SetSocketPath().
+func (self *FakeRtpProxy) Address() string {
+    return self.network + ":" + self.address
+}
+
+func (self *FakeRtpProxy) Close() {
+    self.lock.Lock()
+    if self.shut_down {
+        self.lock.Unlock()
+        return
+    }
+    self.shut_down = true
+    if self.udp_conn != nil {
+        self.udp_conn.Close()
+    }
+    if self.listener != nil {
+        self.listener.Close()
+        os.Remove(self.address)
+    }
+    for conn := range self.conns {
+        conn.Close()
+    }
+    self.lock.Unlock()
+    self.wg.Wait()
+}
+
+// Returns the copy of all commands received so far in the order of arrival.
+// The UDP cookies are stripped.
+func (self *FakeRtpProxy) Commands() []string {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    ret := make([]string, len(self.commands))
+    copy(ret, self.commands)
+    return ret
+}
+
+// Returns the number of the stream connections accepted so far.
+func (self *FakeRtpProxy) Connections() int {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.accepted
+}
+
+// Returns the received commands that start with the prefix.
+func (self *FakeRtpProxy) CommandsWithPrefix(prefix string) []string {
+    ret := []string{}
+    for _, cmd := range self.Commands() {
+        if strings.HasPrefix(cmd, prefix) {
+            ret = append(ret, cmd)
+        }
+    }
+    return ret
+}
+
+func (self *FakeRtpProxy) ActiveSessions() int {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return len(self.sessions)
+}
+
+// Make the next count commands starting with the prefix fail with the
+// reply. The empty reply means that the command is silently dropped, on the
+// stream socket the connection is closed without a reply. The negative
+// count makes the failure permanent.
+func (self *FakeRtpProxy) InjectFailure(prefix, reply string, count int) {
+    self.lock.Lock()
+    self.failures = append(self.failures, &fake_failure{ prefix, reply, count })
+    self.lock.Unlock()
+}
+
+func (self *FakeRtpProxy) ClearFailures() {
+    self.lock.Lock()
+    self.failures = make([]*fake_failure, 0)
+    self.lock.Unlock()
+}
+
+// Enable or disable the support of the capability reported via "VF".
+func (self *FakeRtpProxy) SetCapability(vers string, supported bool) {
+    self.lock.Lock()
+    self.caps[vers] = supported
+    self.lock.Unlock()
+}
+
+// Set the media address that is returned in the replies to "U" and "L".
+// When not set only the port number is returned.
+func (self *FakeRtpProxy) SetAdvertisedAddress(addr string) {
+    self.lock.Lock()
+    self.adv_address = addr
+    self.lock.Unlock()
+}
+
+func (self *FakeRtpProxy) run_udp() {
+    defer self.wg.Done()
+    buf := make([]byte, 8192)
+    for {
+        n, raddr, err := self.udp_conn.ReadFrom(buf)
+        if err != nil {
+            return
+        }
+        arr := strings.SplitN(strings.TrimSpace(string(buf[:n])), " ", 2)
+        if len(arr) != 2 {
+            continue
+        }
+        cookie, command := arr[0], arr[1]
+        reply, ok := self.process_command(command)
+        if ! ok {
+            continue
+        }
+        self.udp_conn.WriteTo([]byte(cookie + " " + reply + "\n"), raddr)
+    }
+}
+
+func (self *FakeRtpProxy) run_stream() {
+    defer self.wg.Done()
+    for {
+        conn, err := self.listener.Accept()
+        if err != nil {
+            return
+        }
+        self.lock.Lock()
+        if self.shut_down {
+            self.lock.Unlock()
+            conn.Close()
+            return
+        }
+        self.conns[conn] = true
+        self.accepted++
+        self.lock.Unlock()
+        self.wg.Add(1)
+        go self.handle_conn(conn)
+    }
+}
+
+func (self *FakeRtpProxy) handle_conn(conn net.Conn) {
+    defer self.wg.Done()
+    defer func() {
+        self.lock.Lock()
+        delete(self.conns, conn)
+        self.lock.Unlock()
+        conn.Close()
+    }()
+    reader := bufio.NewReader(conn)
+    for {
+        line, err := reader.ReadString('\n')
+        if err != nil {
+            return
+        }
+        reply, ok := self.process_command(strings.TrimSpace(line))
+        if ! ok {
+            // Drop the connection without reply like the crashed rtpproxy.
+            return
+        }
+        _, err = conn.Write([]byte(reply + "\n"))
+        if err != nil {
+            return
+        }
+    }
+}
+
+// Process the command and return the reply. The false is returned when the
+// command has to be dropped without any reply.
+func (self *FakeRtpProxy) process_command(command string) (string, bool) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.commands = append(self.commands, command)
+    for i, f := range self.failures {
+        if ! strings.HasPrefix(command, f.prefix) {
+            continue
+        }
+        if f.count > 0 {
+            f.count--
+            if f.count == 0 {
+                self.failures = append(self.failures[:i], self.failures[i + 1:]...)
+            }
+        }
+        return f.reply, f.reply != ""
+    }
+    args := strings.Fields(command)
+    if len(args) == 0 {
+        return "E1", true
+    }
+    cmd, args := strings.ToUpper(args[0]), args[1:]
+    switch cmd[0] {
+    case 'V':
+        if cmd == "VF" {
+            if len(args) != 1 {
+                return "E2", true
+            }
+            if self.caps[args[0]] {
+                return "1", true
+            }
+            return "0", true
+        }
+        return "20040107", true
+    case 'I':
+        return fmt.Sprintf("sessions created: %d\nactive sessions: %d\nactive streams: %d\n" +
+            "packets received: 0\npackets transmitted: 0", self.sessions_created, len(self.sessions),
+            len(self.sessions) * 2), true
+    case 'U', 'L':
+        // U[opts] call_id remote_ip remote_port from_tag [to_tag [notify_socket notify_tag]]
+        if len(args) < 4 {
+            return "E3", true
+        }
+        sess, ok := self.sessions[args[0]]
+        if cmd[0] == 'L' {
+            if ! ok {
+                return "E8", true
+            }
+            if sess.callee_port == 0 {
+                sess.callee_port = self.alloc_port()
+            }
+            return self.port_reply(sess.callee_port), true
+        }
+        if ! ok {
+            sess = &fake_session{ call_id : args[0] }
+            self.sessions[args[0]] = sess
+            self.sessions_created++
+        }
+        if len(args) == 4 {
+            if sess.caller_port == 0 {
+                sess.caller_port = self.alloc_port()
+            }
+            return self.port_reply(sess.caller_port), true
+        }
+        if sess.callee_port == 0 {
+            sess.callee_port = self.alloc_port()
+        }
+        return self.port_reply(sess.callee_port), true
+    case 'D':
+        if len(args) < 2 {
+            return "E3", true
+        }
+        if _, ok := self.sessions[args[0]]; ! ok {
+            return "E8", true
+        }
+        delete(self.sessions, args[0])
+        return "0", true
+    case 'Q':
+        if len(args) < 3 {
+            return "E3", true
+        }
+        if _, ok := self.sessions[args[0]]; ! ok {
+            return "E8", true
+        }
+        return "60 0 0 0 0", true
+    case 'P', 'S', 'R', 'C':
+        if len(args) < 2 {
+            return "E3", true
+        }
+        sess, ok := self.sessions[args[0]]
+        if ! ok {
+            return "E8", true
+        }
+        switch cmd[0] {
+        case 'P':
+            sess.playing = true
+        case 'S':
+            sess.playing = false
+        default:
+            sess.recording = true
+        }
+        return "0", true
+    case 'X':
+        self.sessions = make(map[string]*fake_session)
+        return "0", true
+    }
+    return "E1", true
+}
+
+func (self *FakeRtpProxy) alloc_port() int {
+    port := self.next_port
+    self.next_port += 2
+    return port
+}
+
+func (self *FakeRtpProxy) port_reply(port int) string {
+    if self.adv_address != "" {
+        return fmt.Sprintf("%d %s", port, self.adv_address)
+    }
+    return fmt.Sprintf("%d", port)
+}
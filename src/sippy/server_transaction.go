@@ -30,6 +30,7 @@ import (
     "sync"
     "time"
 
+    "sippy/conf"
     "sippy/headers"
     "sippy/time"
     "sippy/types"
@@ -52,6 +53,7 @@ type serverTransaction struct {
     expires         time.Duration
     ack_cb          func(sippy_types.SipRequest)
     before_response_sent func(sippy_types.SipResponse)
+    source          *sippy_conf.HostPort
 }
 
 func NewServerTransaction(req sippy_types.SipRequest, checksum string, tid *sippy_header.TID, userv sippy_types.UdpServer, sip_tm *sipTransactionManager) sippy_types.ServerTransaction {
@@ -75,6 +77,7 @@ func NewServerTransaction(req sippy_types.SipRequest, checksum string, tid *sipp
         r487            : r487,
         branch          : branch,
         expires         : expires,
+        source          : req.GetSource(),
     }
     self.baseTransaction = newBaseTransaction(self, tid, userv, sip_tm, nil, nil, needack, sip_tm.config.ErrorLogger())
     return self
@@ -176,7 +179,7 @@ func (self *serverTransaction) timerF() {
     //print("timerF", t.GetTID())
     self.cancelTeF()
     if self.state == RINGING && self.sip_tm.provisional_retr > 0 {
-        self.sip_tm.transmitData(self.userv, self.data, self.address, /*checksum*/ "", self.tid.CallId, 0)
+        self.sip_tm.retransmitData(self.userv, self.data, self.address, /*checksum*/ "", self.tid.CallId)
         self.startTeF(self.sip_tm.provisional_retr)
     }
 }
@@ -207,8 +210,9 @@ func (self *serverTransaction) IncomingRequest(req sippy_types.SipRequest, check
     if req.GetMethod() == self.method {
         // Duplicate received, check that we have sent any response on this
         // request already
+        self.sip_tm.stats.retransmissionIn()
         if self.data != nil && len(self.data) > 0 {
-            self.sip_tm.transmitData(self.userv, self.data, self.address, checksum, self.tid.CallId, 0)
+            self.sip_tm.retransmitData(self.userv, self.data, self.address, checksum, self.tid.CallId)
         }
         return
     }
@@ -36,6 +36,7 @@ import (
     "sippy/types"
     "sippy/time"
     "sippy/headers"
+    "sippy/log"
 )
 
 type sipMsg struct {
@@ -65,6 +66,8 @@ type sipMsg struct {
     sip_authorization   *sippy_header.SipAuthorization
     sip_proxy_authorization *sippy_header.SipProxyAuthorization
     sip_proxy_authenticate *sippy_header.SipProxyAuthenticate
+    sip_www_authenticates []*sippy_header.SipWWWAuthenticate
+    sip_proxy_authenticates []*sippy_header.SipProxyAuthenticate
     sip_server          *sippy_header.SipServer
     sip_user_agent      *sippy_header.SipUserAgent
     sip_cisco_guid      *sippy_header.SipCiscoGUID
@@ -127,10 +130,9 @@ func ParseSipMsg(_buf []byte, rtime *sippy_time.MonoTime, config sippy_conf.Conf
             return nil, err
         }
         for _, header := range headers {
-            if contact, ok := header.(*sippy_header.SipContact); ok {
-                if contact.Address.String() == "*" {
-                    continue
-                }
+            // The wildcard Contact is only meaningful in REGISTER
+            if contact, ok := header.(*sippy_header.SipContact); ok && contact.Asterisk && ! strings.HasPrefix(self.startline, "REGISTER ") {
+                continue
             }
             self.AppendHeader(header)
         }
@@ -188,6 +190,7 @@ func (self *sipMsg) AppendHeader(hdr sippy_header.SipHeader) {
         self.contacts = append(self.contacts, t)
     case *sippy_header.SipWWWAuthenticate:
         self.sip_www_authenticate = t
+        self.sip_www_authenticates = append(self.sip_www_authenticates, t)
     case *sippy_header.SipAuthorization:
         self.sip_authorization = t
     case *sippy_header.SipServer:
@@ -206,6 +209,7 @@ func (self *sipMsg) AppendHeader(hdr sippy_header.SipHeader) {
     case *sippy_header.SipReferredBy:
     case *sippy_header.SipProxyAuthenticate:
         self.sip_proxy_authenticate = t
+        self.sip_proxy_authenticates = append(self.sip_proxy_authenticates, t)
     case *sippy_header.SipProxyAuthorization:
         self.sip_proxy_authorization = t
     case *sippy_header.SipReplaces:
@@ -219,7 +223,7 @@ func (self *sipMsg) AppendHeader(hdr sippy_header.SipHeader) {
     self.headers = append(self.headers, hdr)
 }
 
-func (self *sipMsg) init_body() error {
+func (self *sipMsg) init_body(logger sippy_log.ErrorLogger) error {
     if self.content_length != nil {
         blen := self.content_length.Length
         mblen := 0
@@ -238,19 +242,19 @@ func (self *sipMsg) init_body() error {
                 // XXX: we should not really be doing this, but it appears to be
                 // a common off-by-one/two/.../six problem with SDPs generates by
                 // the consumer-grade devices.
-                fmt.Printf("Truncated SIP body, %d bytes expected, %d received, fixing...", blen, mblen)
+                logger.Warning("Truncated SIP body, fixing...", sippy_log.F("expected", blen), sippy_log.F("received", mblen))
                 blen = mblen
             } else if blen - mblen == 2 && (*self.__mbody)[len(*self.__mbody)-2:] == "\r\n" {
                 // Missed last 2 \r\n is another common problem.
-                fmt.Printf("Truncated SIP body, %d bytes expected, %d received, fixing...", blen, mblen)
+                logger.Warning("Truncated SIP body, fixing...", sippy_log.F("expected", blen), sippy_log.F("received", mblen))
                 (*self.__mbody) += "\r\n"
             } else if blen - mblen == 1 && (*self.__mbody)[len(*self.__mbody)-3:] == "\r\n\n" {
                 // Another possible mishap
-                fmt.Printf("Truncated SIP body, %d bytes expected, %d received, fixing...", blen, mblen)
+                logger.Warning("Truncated SIP body, fixing...", sippy_log.F("expected", blen), sippy_log.F("received", mblen))
                 (*self.__mbody) = (*self.__mbody)[:len(*self.__mbody)-3] + "\r\n\r\n"
             } else if blen - mblen == 1 && (*self.__mbody)[len(*self.__mbody)-2:] == "\r\n" {
                 // One more
-                fmt.Printf("Truncated SIP body, %d bytes expected, %d received, fixing...", blen, mblen)
+                logger.Warning("Truncated SIP body, fixing...", sippy_log.F("expected", blen), sippy_log.F("received", mblen))
                 (*self.__mbody) += "\r\n"
                 blen += 1
                 mblen += 2
@@ -450,6 +454,14 @@ func (self *sipMsg) GetSipWWWAuthenticate() *sippy_header.SipWWWAuthenticate {
     return self.sip_www_authenticate
 }
 
+func (self *sipMsg) GetSipWWWAuthenticates() []*sippy_header.SipWWWAuthenticate {
+    return self.sip_www_authenticates
+}
+
+func (self *sipMsg) GetSipProxyAuthenticates() []*sippy_header.SipProxyAuthenticate {
+    return self.sip_proxy_authenticates
+}
+
 func (self *sipMsg) GetTo() *sippy_header.SipTo {
     return self.to
 }
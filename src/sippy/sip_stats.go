@@ -0,0 +1,181 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2015 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "bytes"
+    "strconv"
+    "sync"
+
+    "sippy/types"
+)
+
+// The methods are counted separately, anything else falls into the
+// "OTHER" bucket to keep the number of the counters bounded.
+var stats_methods = map[string]bool{
+    "ACK"       : true,
+    "BYE"       : true,
+    "CANCEL"    : true,
+    "INFO"      : true,
+    "INVITE"    : true,
+    "MESSAGE"   : true,
+    "NOTIFY"    : true,
+    "OPTIONS"   : true,
+    "PRACK"     : true,
+    "PUBLISH"   : true,
+    "REFER"     : true,
+    "REGISTER"  : true,
+    "SUBSCRIBE" : true,
+    "UPDATE"    : true,
+}
+
+func statsMethod(method string) string {
+    if stats_methods[method] {
+        return method
+    }
+    return "OTHER"
+}
+
+type sipStats struct {
+    lock            sync.Mutex
+    requests_in     map[string]int64
+    requests_out    map[string]int64
+    responses_in    map[sippy_types.SipResponseKey]int64
+    responses_out   map[sippy_types.SipResponseKey]int64
+    retrans_in      int64
+    retrans_out     int64
+}
+
+func (self *sipStats) init() {
+    if self.requests_in == nil {
+        self.requests_in = make(map[string]int64)
+        self.requests_out = make(map[string]int64)
+        self.responses_in = make(map[sippy_types.SipResponseKey]int64)
+        self.responses_out = make(map[sippy_types.SipResponseKey]int64)
+    }
+}
+
+func (self *sipStats) requestIn(method string) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.init()
+    self.requests_in[statsMethod(method)]++
+}
+
+func (self *sipStats) responseIn(method string, code int) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.init()
+    self.responses_in[sippy_types.SipResponseKey{ Method : statsMethod(method), Code : code }]++
+}
+
+func (self *sipStats) retransmissionIn() {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.retrans_in++
+}
+
+// Outgoing messages are only available in the wire format at the point
+// they are sent so the method and the status code are taken from there.
+func (self *sipStats) messageOut(data []byte, retrans bool) {
+    method, code := sipMessageLabels(data)
+    if method == "" {
+        return
+    }
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.init()
+    if code == 0 {
+        self.requests_out[statsMethod(method)]++
+    } else {
+        self.responses_out[sippy_types.SipResponseKey{ Method : statsMethod(method), Code : code }]++
+    }
+    if retrans {
+        self.retrans_out++
+    }
+}
+
+func (self *sipStats) snapshot() *sippy_types.SipStats {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.init()
+    ret := &sippy_types.SipStats{
+        RequestsIn          : make(map[string]int64, len(self.requests_in)),
+        RequestsOut         : make(map[string]int64, len(self.requests_out)),
+        ResponsesIn         : make(map[sippy_types.SipResponseKey]int64, len(self.responses_in)),
+        ResponsesOut        : make(map[sippy_types.SipResponseKey]int64, len(self.responses_out)),
+        RetransmissionsIn   : self.retrans_in,
+        RetransmissionsOut  : self.retrans_out,
+    }
+    for k, v := range self.requests_in { ret.RequestsIn[k] = v }
+    for k, v := range self.requests_out { ret.RequestsOut[k] = v }
+    for k, v := range self.responses_in { ret.ResponsesIn[k] = v }
+    for k, v := range self.responses_out { ret.ResponsesOut[k] = v }
+    return ret
+}
+
+// sipMessageLabels returns the method and the status code of a SIP
+// message in the wire format. The code is zero for requests and the
+// method is taken from the CSeq header for responses.
+func sipMessageLabels(data []byte) (string, int) {
+    eol := bytes.IndexByte(data, '\n')
+    if eol < 0 {
+        return "", 0
+    }
+    first := bytes.Fields(data[:eol])
+    if len(first) < 2 {
+        return "", 0
+    }
+    if ! bytes.Equal(first[0], []byte("SIP/2.0")) {
+        return string(first[0]), 0
+    }
+    code, err := strconv.Atoi(string(first[1]))
+    if err != nil {
+        return "", 0
+    }
+    for rest := data[eol + 1:]; len(rest) > 0; {
+        line := rest
+        if eol = bytes.IndexByte(rest, '\n'); eol >= 0 {
+            line, rest = rest[:eol], rest[eol + 1:]
+        } else {
+            rest = nil
+        }
+        line = bytes.TrimRight(line, "\r")
+        if len(line) == 0 {
+            break
+        }
+        colon := bytes.IndexByte(line, ':')
+        if colon < 0 || ! bytes.EqualFold(bytes.TrimSpace(line[:colon]), []byte("CSeq")) {
+            continue
+        }
+        if fields := bytes.Fields(line[colon + 1:]); len(fields) == 2 {
+            return string(fields[1]), code
+        }
+        break
+    }
+    return "OTHER", code
+}
@@ -31,6 +31,7 @@ import (
     "errors"
     "fmt"
     "net"
+    "sort"
     "sync"
     "time"
 
@@ -61,6 +62,7 @@ type sipTransactionManager struct {
     pass_t_to_cb    bool
     provisional_retr time.Duration
     before_response_sent func(sippy_types.SipResponse)
+    stats           sipStats
 }
 
 type sipTMRetransmitO struct {
@@ -177,11 +179,12 @@ func (self *sipTransactionManager) handleIncoming(data []byte, address *sippy_co
     retrans, ok := self.rcache_get_no_lock(checksum)
     if ok {
         self.rcache_lock.Unlock()
+        self.stats.retransmissionIn()
         self.config.SipLogger().Write(rtime, retrans.call_id, "RECEIVED message from " + address.String() + ":\n" + string(data))
         if retrans.data == nil {
             return
         }
-        self.transmitData(retrans.userv, retrans.data, retrans.address, "", retrans.call_id, 0)
+        self.retransmitData(retrans.userv, retrans.data, retrans.address, "", retrans.call_id)
         return
     }
     self.rcache_put_no_lock(checksum, &sipTMRetransmitO{
@@ -212,6 +215,7 @@ func (self *sipTransactionManager) process_response(rtime *sippy_time.MonoTime,
         self.rcache_set_call_id(checksum, tid.CallId)
         return
     }
+    self.stats.responseIn(tid.CSeqMethod, resp.scode)
     self.tclient_lock.Lock()
     t, ok := self.tclient[*tid]
     self.tclient_lock.Unlock()
@@ -272,6 +276,7 @@ func (self *sipTransactionManager) process_request(rtime *sippy_time.MonoTime, d
         return
     }
     tids := req.getTIds()
+    self.stats.requestIn(req.method)
     self.config.SipLogger().Write(rtime, tids[0].CallId, "RECEIVED message from " + address.String() + ":\n" + string(data))
     ahost, aport := req.vias[0].GetAddr(self.config)
     rhost, rport := address.Host.String(), address.Port.String()
@@ -521,9 +526,19 @@ func (self *sipTransactionManager) transmitMsg(userv sippy_types.UdpServer, msg
 }
 
 func (self *sipTransactionManager) transmitData(userv sippy_types.UdpServer, data []byte, address *sippy_conf.HostPort, cachesum, call_id string, lossemul int /*=0*/) {
+    self._transmitData(userv, data, address, cachesum, call_id, lossemul, false)
+}
+
+// Same as transmitData() but the message is accounted as a retransmission.
+func (self *sipTransactionManager) retransmitData(userv sippy_types.UdpServer, data []byte, address *sippy_conf.HostPort, cachesum, call_id string) {
+    self._transmitData(userv, data, address, cachesum, call_id, 0, true)
+}
+
+func (self *sipTransactionManager) _transmitData(userv sippy_types.UdpServer, data []byte, address *sippy_conf.HostPort, cachesum, call_id string, lossemul int, retrans bool) {
     logop := "SENDING"
     if lossemul == 0 {
         userv.SendTo(data, address)
+        self.stats.messageOut(data, retrans)
     } else {
         logop = "DISCARDING"
     }
@@ -580,3 +595,78 @@ func (self *sipTransactionManager) beforeResponseSent(resp sippy_types.SipRespon
 func (self *sipTransactionManager) SetBeforeResponseSent(cb func(sippy_types.SipResponse)) {
     self.before_response_sent = cb
 }
+
+// ClientTransactions returns the client transactions in progress, the
+// oldest ones first.
+func (self *sipTransactionManager) ClientTransactions() []*sippy_types.TransactionInfo {
+    self.tclient_lock.Lock()
+    tlist := make([]*clientTransaction, 0, len(self.tclient))
+    for _, t := range self.tclient {
+        if ct, ok := t.(*clientTransaction); ok {
+            tlist = append(tlist, ct)
+        }
+    }
+    self.tclient_lock.Unlock()
+    now, _ := sippy_time.NewMonoTime()
+    ret := make([]*sippy_types.TransactionInfo, 0, len(tlist))
+    for _, t := range tlist {
+        t.Lock()
+        if info := t.getInfo(now, t.address); info != nil {
+            ret = append(ret, info)
+        }
+        t.Unlock()
+    }
+    sortTransactionInfo(ret)
+    return ret
+}
+
+// ServerTransactions returns the server transactions in progress, the
+// oldest ones first.
+func (self *sipTransactionManager) ServerTransactions() []*sippy_types.TransactionInfo {
+    self.tserver_lock.Lock()
+    tlist := make([]*serverTransaction, 0, len(self.tserver))
+    for _, t := range self.tserver {
+        if st, ok := t.(*serverTransaction); ok {
+            tlist = append(tlist, st)
+        }
+    }
+    self.tserver_lock.Unlock()
+    now, _ := sippy_time.NewMonoTime()
+    ret := make([]*sippy_types.TransactionInfo, 0, len(tlist))
+    for _, t := range tlist {
+        t.Lock()
+        if info := t.getInfo(now, t.source); info != nil {
+            ret = append(ret, info)
+        }
+        t.Unlock()
+    }
+    sortTransactionInfo(ret)
+    return ret
+}
+
+// GetStats returns a snapshot of the SIP message and transaction counters
+// along with the state of the listening sockets.
+func (self *sipTransactionManager) GetStats() *sippy_types.SipStats {
+    ret := self.stats.snapshot()
+    self.tclient_lock.Lock()
+    ret.ClientTransactions = len(self.tclient)
+    self.tclient_lock.Unlock()
+    self.tserver_lock.Lock()
+    ret.ServerTransactions = len(self.tserver)
+    self.tserver_lock.Unlock()
+    ret.UdpServers = make([]*sippy_types.UdpServerStats, 0)
+    if self.l4r != nil {
+        for _, userv := range self.l4r.servers() {
+            ret.UdpServers = append(ret.UdpServers, userv.getStats())
+        }
+    }
+    return ret
+}
+
+func sortTransactionInfo(tinfo []*sippy_types.TransactionInfo) {
+    sort.SliceStable(tinfo, func(i, j int) bool { return tinfo[i].Age > tinfo[j].Age })
+}
+
+func (self *sipTransactionManager) SetNatTraversal(nat_traversal bool) {
+    self.nat_traversal = nat_traversal
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2016 Andriy Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "sync"
+    "testing"
+    "time"
+
+    "sippy/conf"
+    "sippy/headers"
+    "sippy/log"
+    "sippy/types"
+)
+
+func TestTransactionIntrospection(t *testing.T) {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+    tm := &sipTransactionManager{
+        config          : config,
+        tclient         : make(map[sippy_header.TID]sippy_types.ClientTransaction),
+        tserver         : make(map[sippy_header.TID]sippy_types.ServerTransaction),
+    }
+    ctid := &sippy_header.TID{ CallId : "call1", CSeq : "1", CSeqMethod : "INVITE", Branch : "z9hG4bK1" }
+    ct := &clientTransaction{}
+    ct.baseTransaction = newBaseTransaction(new(sync.Mutex), ctid, nil, tm, sippy_conf.NewHostPort("192.0.2.1", "5060"), nil, true, config.ErrorLogger())
+    ct.baseTransaction.ctime = ct.baseTransaction.ctime.Add(-90 * time.Second)
+    tm.tclient[*ctid] = ct
+    ctid2 := &sippy_header.TID{ CallId : "call2", CSeq : "2", CSeqMethod : "BYE", Branch : "z9hG4bK2" }
+    ct2 := &clientTransaction{}
+    ct2.baseTransaction = newBaseTransaction(new(sync.Mutex), ctid2, nil, tm, sippy_conf.NewHostPort("192.0.2.2", "5060"), nil, false, config.ErrorLogger())
+    tm.tclient[*ctid2] = ct2
+    stid := &sippy_header.TID{ CallId : "call3", CSeq : "3", CSeqMethod : "OPTIONS", Branch : "z9hG4bK3" }
+    st := &serverTransaction{ source : sippy_conf.NewHostPort("192.0.2.3", "5070") }
+    st.baseTransaction = newBaseTransaction(st, stid, nil, tm, nil, nil, false, config.ErrorLogger())
+    st.state = COMPLETED
+    tm.tserver[*stid] = st
+
+    clist := tm.ClientTransactions()
+    if len(clist) != 2 {
+        t.Fatalf("%d client transactions, expected 2", len(clist))
+    }
+    if clist[0].TID.CallId != "call1" || clist[0].Method != "INVITE" || clist[0].State != "TRYING" ||
+      clist[0].Remote != "192.0.2.1:5060" || clist[0].Age < 90 * time.Second {
+        t.Errorf("unexpected first client transaction: %+v", clist[0])
+    }
+    if clist[1].TID.CallId != "call2" || clist[1].Age >= 90 * time.Second {
+        t.Errorf("unexpected second client transaction: %+v", clist[1])
+    }
+    slist := tm.ServerTransactions()
+    if len(slist) != 1 || slist[0].Method != "OPTIONS" || slist[0].State != "COMPLETED" || slist[0].Remote != "192.0.2.3:5070" {
+        t.Errorf("unexpected server transactions: %+v", slist)
+    }
+    // The terminated transactions are skipped
+    ct2.cleanup()
+    if clist = tm.ClientTransactions(); len(clist) != 1 {
+        t.Errorf("%d client transactions, expected 1", len(clist))
+    }
+}
+
+func TestSipMessageLabels(t *testing.T) {
+    for _, tc := range []struct {
+        data    string
+        method  string
+        code    int
+    }{
+        { "INVITE sip:123@192.0.2.1 SIP/2.0\r\nCSeq: 1 INVITE\r\n\r\n", "INVITE", 0 },
+        { "SIP/2.0 486 Busy Here\r\nVia: SIP/2.0/UDP 192.0.2.1\r\ncseq : 2 BYE\r\n\r\n", "BYE", 486 },
+        { "SIP/2.0 200 OK\r\nVia: SIP/2.0/UDP 192.0.2.1\r\n\r\nCSeq: 1 INVITE\r\n", "OTHER", 200 },
+        { "garbage", "", 0 },
+    } {
+        method, code := sipMessageLabels([]byte(tc.data))
+        if method != tc.method || code != tc.code {
+            t.Errorf("%q: got %q/%d, expected %q/%d", tc.data, method, code, tc.method, tc.code)
+        }
+    }
+}
+
+func TestSipStats(t *testing.T) {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+    tm := &sipTransactionManager{
+        config          : config,
+        tclient         : make(map[sippy_header.TID]sippy_types.ClientTransaction),
+        tserver         : make(map[sippy_header.TID]sippy_types.ServerTransaction),
+    }
+    tm.stats.requestIn("INVITE")
+    tm.stats.requestIn("FOO")
+    tm.stats.responseIn("INVITE", 200)
+    tm.stats.retransmissionIn()
+    tm.stats.messageOut([]byte("SIP/2.0 100 Trying\r\nCSeq: 1 INVITE\r\n\r\n"), false)
+    tm.stats.messageOut([]byte("SIP/2.0 100 Trying\r\nCSeq: 1 INVITE\r\n\r\n"), true)
+    tm.stats.messageOut([]byte("BYE sip:123@192.0.2.1 SIP/2.0\r\nCSeq: 2 BYE\r\n\r\n"), false)
+    tm.tserver[sippy_header.TID{ CallId : "call1" }] = nil
+
+    stats := tm.GetStats()
+    if stats.RequestsIn["INVITE"] != 1 || stats.RequestsIn["OTHER"] != 1 || stats.RequestsOut["BYE"] != 1 {
+        t.Errorf("unexpected request counters: %v %v", stats.RequestsIn, stats.RequestsOut)
+    }
+    if stats.ResponsesIn[sippy_types.SipResponseKey{ Method : "INVITE", Code : 200 }] != 1 ||
+      stats.ResponsesOut[sippy_types.SipResponseKey{ Method : "INVITE", Code : 100 }] != 2 {
+        t.Errorf("unexpected response counters: %v %v", stats.ResponsesIn, stats.ResponsesOut)
+    }
+    if stats.RetransmissionsIn != 1 || stats.RetransmissionsOut != 1 {
+        t.Errorf("unexpected retransmission counters: %d/%d", stats.RetransmissionsIn, stats.RetransmissionsOut)
+    }
+    if stats.ClientTransactions != 0 || stats.ServerTransactions != 1 || len(stats.UdpServers) != 0 {
+        t.Errorf("unexpected transaction counts: %+v", stats)
+    }
+}
@@ -38,6 +38,7 @@ import (
     "fmt"
     "strings"
     "strconv"
+    "sync"
     "time"
 
     "sippy/math"
@@ -53,6 +54,7 @@ type GoroutineCtx interface {
 }
 
 type monoGlobals struct {
+    lock      sync.Mutex
     monot_max time.Time
     realt_flt sippy_math.RecFilter
 }
@@ -68,6 +70,8 @@ func init() {
 }
 
 func (self *monoGlobals) Apply(realt, monot time.Time) time.Duration {
+    self.lock.Lock()
+    defer self.lock.Unlock()
     diff_flt := self.realt_flt.Apply(realt.Sub(monot).Seconds())
     if self.monot_max.Before(monot) {
         self.monot_max = monot
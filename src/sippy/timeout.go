@@ -88,12 +88,22 @@ func (self *Timeout) SpreadRuns(spread float64) {
 }
 
 func (self *Timeout) Cancel() {
-    self.shutdown = true
-    close(self.shutdown_chan)
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    if ! self.shutdown {
+        self.shutdown = true
+        close(self.shutdown_chan)
+    }
+}
+
+func (self *Timeout) is_shutdown() bool {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return self.shutdown
 }
 
 func (self *Timeout) run() {
-    for !self.shutdown {
+    for ! self.is_shutdown() {
         self._run()
     }
     self.callback = nil
@@ -101,9 +111,11 @@ func (self *Timeout) run() {
 }
 
 func (self *Timeout) _run() {
-    for !self.shutdown {
+    for ! self.is_shutdown() {
         if self.nticks == 0 {
+            self.lock.Lock()
             self.shutdown = true
+            self.lock.Unlock()
             break
         }
         if self.nticks > 0 {
@@ -115,9 +127,8 @@ func (self *Timeout) _run() {
         }
         select {
         case <-self.shutdown_chan:
-            self.shutdown = true
         case <-time.After(t):
-            if ! self.shutdown {
+            if ! self.is_shutdown() {
                 sippy_utils.SafeCall(self.callback, self.cb_lock, self.logger)
             }
         }
@@ -107,6 +107,8 @@ type SipResponse interface {
     GetSCodeReason() string
     GetSipWWWAuthenticate() *sippy_header.SipWWWAuthenticate
     GetSipProxyAuthenticate() *sippy_header.SipProxyAuthenticate
+    GetSipWWWAuthenticates() []*sippy_header.SipWWWAuthenticate
+    GetSipProxyAuthenticates() []*sippy_header.SipProxyAuthenticate
     SetSCodeReason(string)
     GetCopy() SipResponse
 }
@@ -196,7 +198,7 @@ type UA interface {
     SetLSDP(MsgBody)
     GetRSDP() MsgBody
     SetRSDP(MsgBody)
-    GenRequest(method string, body MsgBody, nonce string, realm string, SipXXXAuthorization sippy_header.NewSipXXXAuthorizationFunc, extra_headers ...sippy_header.SipHeader) SipRequest
+    GenRequest(method string, body MsgBody, challenge *sippy_header.SipWWWAuthenticate, SipXXXAuthorization sippy_header.NewSipXXXAuthorizationFunc, extra_headers ...sippy_header.SipHeader) SipRequest
     IncLCSeq()
     GetSourceAddress() *sippy_conf.HostPort
     SetSourceAddress(*sippy_conf.HostPort)
@@ -324,6 +326,16 @@ type ServerTransaction interface {
     SetBeforeResponseSent(func(SipResponse))
 }
 
+// TransactionInfo is a snapshot of the transaction state for the
+// introspection purposes.
+type TransactionInfo struct {
+    TID         sippy_header.TID
+    Method      string
+    State       string
+    Age         time.Duration
+    Remote      string
+}
+
 type SipTransactionManager interface {
     RegConsumer(UA, string)
     UnregConsumer(UA, string)
@@ -334,6 +346,9 @@ type SipTransactionManager interface {
     SendResponseWithLossEmul(resp SipResponse, lock bool, ack_cb func(SipRequest), lossemul int)
     Run()
     Shutdown()
+    ClientTransactions() []*TransactionInfo
+    ServerTransactions() []*TransactionInfo
+    GetStats() *SipStats
 }
 
 type UaState interface {
@@ -370,9 +385,11 @@ type OnConnectListener func(*sippy_time.MonoTime, string)
 type OnDeadListener func()
 type OnLocalSdpChange func(MsgBody, CCEvent, func(MsgBody)) error
 type OnRemoteSdpChange func(MsgBody, SipMsg, func(MsgBody)) error
+type OnRtpProxyHealthListener func(rtpc RtpProxyClient, online bool)
 
 type RtpProxyClientOpts interface {
     GetNWorkers() *int
+    GetCommandTimeout() time.Duration
 }
 
 type RtpProxyClient interface {
@@ -385,6 +402,10 @@ type RtpProxyClient interface {
     GoOnline()
     GoOffline()
     GetOpts() RtpProxyClientOpts
+    GetRtpcDelay() float64
+    GetActiveSessions() int64
+    GetActiveStreams() int64
+    Shutdown()
 }
 
 type RtpProxyUpdateResult interface {
@@ -33,3 +33,35 @@ type Ua_context struct {
     CancelCB   func(*sippy_time.MonoTime, SipRequest)
     NoAckCB    func(*sippy_time.MonoTime)
 }
+
+// SipResponseKey identifies the SIP responses by the CSeq method and
+// the status code for the statistics purposes.
+type SipResponseKey struct {
+    Method  string
+    Code    int
+}
+
+// UdpServerStats is a snapshot of the counters of a single listening
+// UDP socket.
+type UdpServerStats struct {
+    Laddress        string
+    PacketsRecvd    int64
+    PacketsSent     int64
+    PacketsQueued   int64
+    SendQueue       int
+    ResolveQueue    int
+}
+
+// SipStats is a snapshot of the SIP message counters maintained by the
+// transaction manager. The outgoing counters include the retransmissions.
+type SipStats struct {
+    RequestsIn          map[string]int64
+    RequestsOut         map[string]int64
+    ResponsesIn         map[SipResponseKey]int64
+    ResponsesOut        map[SipResponseKey]int64
+    RetransmissionsIn   int64
+    RetransmissionsOut  int64
+    ClientTransactions  int
+    ServerTransactions  int
+    UdpServers          []*UdpServerStats
+}
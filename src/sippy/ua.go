@@ -37,6 +37,9 @@ import (
     "sippy/utils"
 )
 
+// The origin of the disconnect event generated when the credit time expires
+const CreditExpiredOrigin = "credit"
+
 type Ua struct {
     sip_tm          sippy_types.SipTransactionManager
     config          sippy_conf.Config
@@ -110,6 +113,7 @@ type Ua struct {
     late_media      bool
     heir            sippy_types.UA
     uas_lossemul    int
+    nonce_counts    *sippy_header.NonceCounter
 }
 
 func (self *Ua) me() sippy_types.UA {
@@ -143,6 +147,7 @@ func NewUA(sip_tm sippy_types.SipTransactionManager, config sippy_conf.Config, n
         p100_ts         : nil,
         p1xx_ts         : nil,
         credit_times    : make(map[int64]*sippy_time.MonoTime),
+        nonce_counts    : sippy_header.NewNonceCounter(),
         config          : config,
         rAddr           : nh_address,
         rAddr0          : nh_address,
@@ -207,9 +212,10 @@ func (self *Ua) RecvResponse(resp sippy_types.SipResponse, tr sippy_types.Client
     cseq, method := resp.GetCSeq().CSeq, resp.GetCSeq().Method
     orig_req, cseq_found := self.reqs[cseq]
     if method == "INVITE" && !self.pass_auth && cseq_found && code == 401 && resp.GetSipWWWAuthenticate() != nil &&
-      self.username != "" && self.password != "" && orig_req.sip_authorization == nil {
-        challenge := resp.GetSipWWWAuthenticate()
-        req := self.GenRequest("INVITE", self.lSDP, challenge.GetNonce(), challenge.GetRealm(), /*SipXXXAuthorization*/ nil)
+      self.username != "" && self.password != "" && orig_req.sip_authorization == nil &&
+      sippy_header.BestChallenge(resp.GetSipWWWAuthenticates()) != nil {
+        challenge := sippy_header.BestChallenge(resp.GetSipWWWAuthenticates())
+        req := self.GenRequest("INVITE", self.lSDP, challenge, /*SipXXXAuthorization*/ nil)
         self.lCSeq += 1
         self.tr, err = self.PrepTr(req)
         if err == nil {
@@ -219,9 +225,10 @@ func (self *Ua) RecvResponse(resp sippy_types.SipResponse, tr sippy_types.Client
         return
     }
     if method == "INVITE" && !self.pass_auth && cseq_found && code == 407 && resp.GetSipProxyAuthenticate() != nil &&
-      self.username != "" && self.password != "" && orig_req.GetSipProxyAuthorization() == nil {
-        challenge := resp.GetSipProxyAuthenticate()
-        req := self.me().GenRequest("INVITE", self.lSDP, challenge.GetNonce(), challenge.GetRealm(), sippy_header.NewSipProxyAuthorization)
+      self.username != "" && self.password != "" && orig_req.GetSipProxyAuthorization() == nil &&
+      sippy_header.BestProxyChallenge(resp.GetSipProxyAuthenticates()) != nil {
+        challenge := sippy_header.BestProxyChallenge(resp.GetSipProxyAuthenticates())
+        req := self.me().GenRequest("INVITE", self.lSDP, challenge, sippy_header.NewSipProxyAuthorization)
         self.lCSeq += 1
         self.tr, err = self.PrepTr(req)
         if err == nil {
@@ -309,7 +316,13 @@ func (self *Ua) no_reply_expires() {
 
 func (self *Ua) credit_expires(rtime *sippy_time.MonoTime) {
     self.credit_timer = nil
-    self.me().Disconnect(rtime)
+    if self.sip_tm == nil {
+        return // we are already in a dead state
+    }
+    // Let both the peer and the controller know why the call is over
+    reason := sippy_header.NewSipReason("Q.850", "102", "Credit time expired")
+    self.equeue = append(self.equeue, NewCCEventDisconnect(nil, rtime, CreditExpiredOrigin, reason))
+    self.RecvEvent(NewCCEventDisconnect(nil, rtime, CreditExpiredOrigin, reason))
 }
 
 func (self *Ua) ChangeState(newstate sippy_types.UaState) {
@@ -343,7 +356,7 @@ func (self *Ua) emitPendingEvents() {
     }
 }
 
-func (self *Ua) GenRequest(method string, body sippy_types.MsgBody, nonce string, realm string, SipXXXAuthorization sippy_header.NewSipXXXAuthorizationFunc, extra_headers ...sippy_header.SipHeader) sippy_types.SipRequest {
+func (self *Ua) GenRequest(method string, body sippy_types.MsgBody, challenge *sippy_header.SipWWWAuthenticate, SipXXXAuthorization sippy_header.NewSipXXXAuthorizationFunc, extra_headers ...sippy_header.SipHeader) sippy_types.SipRequest {
     var target *sippy_conf.HostPort
     if self.outbound_proxy != nil {
         target = self.outbound_proxy
@@ -354,9 +367,16 @@ func (self *Ua) GenRequest(method string, body sippy_types.MsgBody, nonce string
                     /*via*/ nil, /*cseq*/ self.lCSeq, /*callid*/ self.cId, /*maxforwars*/ nil, /*body*/ body,
                     /*contact*/ self.lContact, /*routes*/ self.routes, /*target*/ target, /*cguid*/ self.cGUID,
                      /*user_agent*/ self.local_ua, /*expires*/ nil, self.config)
-    if nonce != "" && realm != "" && self.username != "" && self.password != "" {
-        auth := SipXXXAuthorization(/*realm*/ realm, /*nonce*/ nonce, /*method*/ method, /*uri*/ self.rTarget.String(),
-          /*username*/ self.username, /*password*/ self.password)
+    if challenge != nil && self.username != "" && self.password != "" {
+        if SipXXXAuthorization == nil {
+            SipXXXAuthorization = sippy_header.NewSipWWWAuthorization
+        }
+        entity_body := ""
+        if body != nil {
+            entity_body = body.String()
+        }
+        auth := SipXXXAuthorization(/*challenge*/ challenge, /*method*/ method, /*uri*/ self.rTarget.String(),
+          /*username*/ self.username, /*password*/ self.password, /*nc*/ self.nonce_counts.Next(challenge), entity_body)
         req.AppendHeader(auth)
     }
     if self.extra_headers != nil {
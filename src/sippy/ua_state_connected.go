@@ -154,7 +154,7 @@ func (self *UaStateConnected) RecvEvent(event sippy_types.CCEvent) (sippy_types.
     if ok {
         //print "event", event, "received in the Connected state sending BYE"
         if redirect != nil && self.ua.ShouldUseRefer() {
-            req := self.ua.GenRequest("REFER", nil, "", "", nil, eh...)
+            req := self.ua.GenRequest("REFER", nil, nil, nil, eh...)
             self.ua.IncLCSeq()
             also := sippy_header.NewSipReferTo(sippy_header.NewSipAddress("", redirect))
             req.AppendHeader(also)
@@ -162,7 +162,7 @@ func (self *UaStateConnected) RecvEvent(event sippy_types.CCEvent) (sippy_types.
             req.AppendHeader(rby)
             self.ua.SipTM().BeginNewClientTransaction(req, newRedirectController(self.ua), self.ua.GetSessionLock(), self.ua.GetSourceAddress(), nil, self.ua.BeforeRequestSent)
         } else {
-            req := self.ua.GenRequest("BYE", nil, "", "", nil, eh...)
+            req := self.ua.GenRequest("BYE", nil, nil, nil, eh...)
             self.ua.IncLCSeq()
             if redirect != nil {
                 also := sippy_header.NewSipAlso(sippy_header.NewSipAddress("", redirect))
@@ -201,7 +201,7 @@ func (self *UaStateConnected) RecvEvent(event sippy_types.CCEvent) (sippy_types.
             }
             eh2 = append(eh2, sippy_header.NewSipMaxForwards(_event.GetMaxForwards().GetNum() - 1))
         }
-        req := self.ua.GenRequest("INVITE", body, "", "", nil, eh2...)
+        req := self.ua.GenRequest("INVITE", body, nil, nil, eh2...)
         self.ua.IncLCSeq()
         self.ua.SetLSDP(body)
         tr, err := self.ua.PrepTr(req)
@@ -214,7 +214,7 @@ func (self *UaStateConnected) RecvEvent(event sippy_types.CCEvent) (sippy_types.
     }
     if _event, ok := event.(*CCEventInfo); ok {
         body := _event.GetBody()
-        req := self.ua.GenRequest("INFO", nil, "", "", nil, eh...)
+        req := self.ua.GenRequest("INFO", nil, nil, nil, eh...)
         req.SetBody(body)
         self.ua.IncLCSeq()
         self.ua.SipTM().BeginNewClientTransaction(req, nil, self.ua.GetSessionLock(), self.ua.GetSourceAddress(), nil, self.ua.BeforeRequestSent)
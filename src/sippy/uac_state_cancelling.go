@@ -98,7 +98,7 @@ func (self *UacStateCancelling) RecvResponse(resp sippy_types.SipResponse, tr si
     if code >= 200 && code < 300 {
         self.ua.UpdateRouting(resp, true, true)
         self.ua.GetRUri().SetTag(resp.GetTo().GetTag())
-        req := self.ua.GenRequest("BYE", nil, "", "", nil)
+        req := self.ua.GenRequest("BYE", nil, nil, nil)
         self.ua.IncLCSeq()
         self.ua.SipTM().BeginNewClientTransaction(req, nil, self.ua.GetSessionLock(), /*laddress*/ self.ua.GetSourceAddress(), nil, self.ua.BeforeRequestSent)
         return NewUaStateDisconnected(self.ua, nil, "", 0, nil)
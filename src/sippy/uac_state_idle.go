@@ -103,7 +103,7 @@ func (self *UacStateIdle) RecvEvent(_event sippy_types.CCEvent) (sippy_types.UaS
         if event.GetMaxForwards() != nil {
             eh = append(eh, event.GetMaxForwards())
         }
-        req := self.ua.GenRequest("INVITE", event.GetBody(), /*nonce*/ "", /*realm*/ "", /*SipXXXAuthorization*/ nil, eh...)
+        req := self.ua.GenRequest("INVITE", event.GetBody(), /*challenge*/ nil, /*SipXXXAuthorization*/ nil, eh...)
         self.ua.IncLCSeq()
         var tr sippy_types.ClientTransaction
         tr, err = self.ua.PrepTr(req)
@@ -94,7 +94,7 @@ func (self *UacStateRinging) RecvResponse(resp sippy_types.SipResponse, tr sippy
             //print "tag-less 200 OK, disconnecting"
             event := NewCCEventFail(502, "Bad Gateway", resp.GetRtime(), self.ua.GetOrigin())
             self.ua.Enqueue(event)
-            req := self.ua.GenRequest("BYE", nil, "", "", nil)
+            req := self.ua.GenRequest("BYE", nil, nil, nil)
             self.ua.IncLCSeq()
             self.ua.SipTM().BeginNewClientTransaction(req, nil, self.ua.GetSessionLock(), self.ua.GetSourceAddress(), nil, self.ua.BeforeRequestSent)
             if self.ua.GetSetupTs() != nil && !self.ua.GetSetupTs().After(resp.GetRtime())  {
@@ -98,7 +98,7 @@ func (self *UacStateTrying) RecvResponse(resp sippy_types.SipResponse, tr sippy_
             //logger.Debug("tag-less 200 OK, disconnecting")
             self.ua.Enqueue(NewCCEventFail(502, "Bad Gateway", resp.GetRtime(), self.ua.GetOrigin()))
             // Generate and send BYE
-            req := self.ua.GenRequest("BYE", nil, "", "", nil)
+            req := self.ua.GenRequest("BYE", nil, nil, nil)
             self.ua.IncLCSeq()
             self.ua.SipTM().BeginNewClientTransaction(req, nil, self.ua.GetSessionLock(), self.ua.GetSourceAddress(), nil, self.ua.BeforeRequestSent)
             if self.ua.GetSetupTs() != nil && !self.ua.GetSetupTs().After(resp.GetRtime()) {
@@ -132,7 +132,7 @@ func (self *UacStateUpdating) updateFailed(event sippy_types.CCEvent) sippy_type
     if event.GetReason() != nil {
         eh = append(eh, event.GetReason())
     }
-    req := self.ua.GenRequest("BYE", nil, "", "", nil, eh...)
+    req := self.ua.GenRequest("BYE", nil, nil, nil, eh...)
     self.ua.IncLCSeq()
     self.ua.SipTM().BeginNewClientTransaction(req, nil, self.ua.GetSessionLock(), self.ua.GetSourceAddress(), nil, self.ua.BeforeRequestSent)
 
@@ -152,7 +152,7 @@ func (self *UacStateUpdating) RecvEvent(event sippy_types.CCEvent) (sippy_types.
     }
     if send_bye {
         self.ua.GetClientTransaction().Cancel()
-        req := self.ua.GenRequest("BYE", nil, "", "", nil, event.GetExtraHeaders()...)
+        req := self.ua.GenRequest("BYE", nil, nil, nil, event.GetExtraHeaders()...)
         self.ua.IncLCSeq()
         self.ua.SipTM().BeginNewClientTransaction(req, nil, self.ua.GetSessionLock(), self.ua.GetSourceAddress(), nil, self.ua.BeforeRequestSent)
         self.ua.CancelCreditTimer()
@@ -41,12 +41,15 @@ import (
     "os"
     "runtime"
     "strconv"
+    "sync"
+    "sync/atomic"
     "syscall"
     "time"
 
     "sippy/conf"
     "sippy/log"
     "sippy/time"
+    "sippy/types"
     "sippy/utils"
 )
 
@@ -126,7 +129,14 @@ SEND_LOOP:
         for wi != nil {
             for i := 0; i < 20; i++ {
                 if _, err := userv.skt.WriteTo(wi.data, wi.address); err == nil {
+                    atomic.AddInt64(&userv.packets_sent, 1)
+                    if capture := userv.config.SipCapture(); capture != nil {
+                        now, _ := sippy_time.NewMonoTime()
+                        capture.Capture(wi.data, userv.capture_laddr(wi.address), wi.address, now)
+                    }
                     break SEND_LOOP
+                } else if i == 0 {
+                    atomic.AddInt64(&userv.packets_queued, 1)
                 }
             }
             time.Sleep(time.Duration(0.01 * float64(time.Second)))
@@ -185,6 +195,7 @@ func NewUdpServerOpts(laddress *sippy_conf.HostPort, data_callback UdpPacketRece
 
 type udpServer struct {
     uopts           udpServerOpts
+    config          sippy_conf.Config
     //skt             *net.UDPConn
     skt             net.PacketConn
     wi              chan *write_req
@@ -192,11 +203,15 @@ type udpServer struct {
     asenders        []*asyncSender
     areceivers      []*asyncReceiver
     aresolvers      []*asyncResolver
-    packets_recvd int
-    packets_sent int
-    packets_queued int
+    packets_recvd   int64
+    packets_sent    int64
+    packets_queued  int64
+    laddr_cache     map[string]*net.UDPAddr
+    laddr_lock      sync.Mutex
 }
 
+const _UDP_LADDR_CACHE_MAX = 1000
+
 func zoneToUint32(zone string) uint32 {
     if zone == "" {
         return 0
@@ -270,6 +285,7 @@ func NewUdpServer(config sippy_conf.Config, uopts *udpServerOpts) (*udpServer, e
     */
     self := &udpServer{
         uopts       : *uopts,
+        config      : config,
         skt         : skt,
         wi          : make(chan *write_req, 1000),
         wi_resolv   : make(chan *resolv_req, 1000),
@@ -306,12 +322,47 @@ func (self *udpServer) _send_to(data []byte, address net.Addr) {
 
 func (self *udpServer) handle_read(data []byte, address net.Addr, rtime *sippy_time.MonoTime) {
     if len(data) > 0 {
-        self.packets_recvd++
+        atomic.AddInt64(&self.packets_recvd, 1)
+        if capture := self.config.SipCapture(); capture != nil {
+            capture.Capture(data, address, self.capture_laddr(address), rtime)
+        }
         host, port, _ := net.SplitHostPort(address.String())
         self.uopts.data_callback(data, sippy_conf.NewHostPort(host, port), self, rtime)
     }
 }
 
+// The local address of the packet exchanged with the peer as reported to
+// the SIP capture. The socket bound to the wildcard address reports the
+// unspecified address, so the address the system uses to reach the peer
+// is looked up instead, the same way local4remote does it.
+func (self *udpServer) capture_laddr(peer net.Addr) net.Addr {
+    laddr, ok := self.skt.LocalAddr().(*net.UDPAddr)
+    if ! ok || ! laddr.IP.IsUnspecified() {
+        return self.skt.LocalAddr()
+    }
+    raddr, ok := peer.(*net.UDPAddr)
+    if ! ok {
+        return laddr
+    }
+    key := raddr.IP.String()
+    self.laddr_lock.Lock()
+    defer self.laddr_lock.Unlock()
+    if ret, ok := self.laddr_cache[key]; ok {
+        return ret
+    }
+    conn, err := net.DialUDP("udp", nil, raddr)
+    if err != nil {
+        return laddr
+    }
+    ret := &net.UDPAddr{ IP : conn.LocalAddr().(*net.UDPAddr).IP, Port : laddr.Port }
+    conn.Close()
+    if self.laddr_cache == nil || len(self.laddr_cache) >= _UDP_LADDR_CACHE_MAX {
+        self.laddr_cache = make(map[string]*net.UDPAddr)
+    }
+    self.laddr_cache[key] = ret
+    return ret
+}
+
 func (self *udpServer) Shutdown() {
     // shutdown the senders and resolvers first
     self.wi <- nil
@@ -330,3 +381,16 @@ func (self *udpServer) Shutdown() {
 func (self *udpServer) GetLaddress() *sippy_conf.HostPort {
     return self.uopts.laddress
 }
+
+// The queue depths are the number of the outgoing packets waiting for
+// a sender or a resolver regardless of how many workers are running.
+func (self *udpServer) getStats() *sippy_types.UdpServerStats {
+    return &sippy_types.UdpServerStats{
+        Laddress        : self.uopts.laddress.String(),
+        PacketsRecvd    : atomic.LoadInt64(&self.packets_recvd),
+        PacketsSent     : atomic.LoadInt64(&self.packets_sent),
+        PacketsQueued   : atomic.LoadInt64(&self.packets_queued),
+        SendQueue       : len(self.wi),
+        ResolveQueue    : len(self.wi_resolv),
+    }
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2003-2005 Maxim Sobolev. All rights reserved.
+// Copyright (c) 2006-2014 Sippy Software, Inc. All rights reserved.
+// Copyright (c) 2016 Andriy Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy
+
+import (
+    "net"
+    "strconv"
+    "sync"
+    "testing"
+    "time"
+
+    "sippy/conf"
+    "sippy/log"
+    "sippy/time"
+)
+
+type testSipCapture struct {
+    lock    sync.Mutex
+    src     []net.Addr
+    dst     []net.Addr
+}
+
+func (self *testSipCapture) Capture(data []byte, src, dst net.Addr, ts *sippy_time.MonoTime) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    self.src = append(self.src, src)
+    self.dst = append(self.dst, dst)
+}
+
+func (self *testSipCapture) captured() ([]net.Addr, []net.Addr) {
+    self.lock.Lock()
+    defer self.lock.Unlock()
+    return append([]net.Addr{}, self.src...), append([]net.Addr{}, self.dst...)
+}
+
+func TestUdpServerCaptureWildcard(t *testing.T) {
+    config := sippy_conf.NewConfig(sippy_log.NewErrorLogger(), nil)
+    capture := &testSipCapture{}
+    config.SetSipCapture(capture)
+    received := make(chan bool, 1)
+    uopts := NewUdpServerOpts(sippy_conf.NewHostPort("0.0.0.0", "0"), func([]byte, *sippy_conf.HostPort, *udpServer, *sippy_time.MonoTime) {
+        received <- true
+    })
+    userv, err := NewUdpServer(config, uopts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer userv.Shutdown()
+    port := userv.skt.LocalAddr().(*net.UDPAddr).Port
+
+    peer, err := net.ListenUDP("udp", &net.UDPAddr{ IP : net.IPv4(127, 0, 0, 1) })
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer peer.Close()
+    if _, err = peer.WriteTo([]byte("OPTIONS"), &net.UDPAddr{ IP : net.IPv4(127, 0, 0, 1), Port : port }); err != nil {
+        t.Fatal(err)
+    }
+    select {
+    case <-received:
+    case <-time.After(5 * time.Second):
+        t.Fatal("the packet has not been received")
+    }
+    paddr := peer.LocalAddr().(*net.UDPAddr)
+    userv.SendTo([]byte("200 OK"), sippy_conf.NewHostPort(paddr.IP.String(), strconv.Itoa(paddr.Port)))
+    peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+    if _, _, err = peer.ReadFrom(make([]byte, 100)); err != nil {
+        t.Fatal(err)
+    }
+    var src, dst []net.Addr
+    for i := 0; i < 100; i++ {
+        if src, dst = capture.captured(); len(src) == 2 {
+            break
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    if len(src) != 2 {
+        t.Fatalf("expected 2 captured packets, got %d", len(src))
+    }
+    // the received packet is captured first, the sent one second
+    for _, laddr := range []net.Addr{ dst[0], src[1] } {
+        ua, ok := laddr.(*net.UDPAddr)
+        if ! ok || ! ua.IP.Equal(net.IPv4(127, 0, 0, 1)) || ua.Port != port {
+            t.Fatalf("expected the local address 127.0.0.1:%d, got %v", port, laddr)
+        }
+    }
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy_utils
+
+import (
+    "os"
+    "syscall"
+)
+
+const daemon_env = "SIPPY_DAEMONIZED"
+
+// Daemonize starts a copy of the running program detached from the
+// controlling terminal with the stdout and stderr redirected to the logfile.
+// Since the Go runtime cannot fork, the copy starts from the scratch and
+// calls Daemonize() again which returns false there. The caller should exit
+// when true is returned.
+func Daemonize(logfile string) (bool, error) {
+    if os.Getenv(daemon_env) != "" {
+        os.Unsetenv(daemon_env)
+        return false, nil
+    }
+    exe, err := os.Executable()
+    if err != nil {
+        return false, err
+    }
+    null, err := os.Open(os.DevNull)
+    if err != nil {
+        return false, err
+    }
+    defer null.Close()
+    fd, err := os.OpenFile(logfile, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0644)
+    if err != nil {
+        return false, err
+    }
+    defer fd.Close()
+    proc, err := os.StartProcess(exe, os.Args, &os.ProcAttr{
+        Env     : append(os.Environ(), daemon_env + "=1"),
+        Files   : []*os.File{ null, fd, fd },
+        Sys     : &syscall.SysProcAttr{ Setsid : true },
+    })
+    if err != nil {
+        return false, err
+    }
+    proc.Release()
+    return true, nil
+}
+
+// ReopenStdio points the stdout and stderr of the daemonized process to
+// the logfile opened anew, so that the panics and the other output not
+// going through the logger follow the log rotation.
+func ReopenStdio(logfile string) error {
+    fd, err := os.OpenFile(logfile, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0644)
+    if err != nil {
+        return err
+    }
+    defer fd.Close()
+    for _, stdfd := range []int{ 1, 2 } {
+        if err = syscall.Dup2(int(fd.Fd()), stdfd); err != nil {
+            return err
+        }
+    }
+    return nil
+}
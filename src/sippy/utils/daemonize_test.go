@@ -0,0 +1,78 @@
+// Copyright (c) 2015 Andrii Pylypenko. All rights reserved.
+//
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification,
+// are permitted provided that the following conditions are met:
+//
+// 1. Redistributions of source code must retain the above copyright notice, this
+// list of conditions and the following disclaimer.
+//
+// 2. Redistributions in binary form must reproduce the above copyright notice,
+// this list of conditions and the following disclaimer in the documentation and/or
+// other materials provided with the distribution.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND
+// ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED
+// WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE FOR
+// ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+// (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES;
+// LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON
+// ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE OF THIS
+// SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+package sippy_utils
+
+import (
+    "fmt"
+    "io/ioutil"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// Runs in the child process started by TestReopenStdio.
+func TestReopenStdioChild(t *testing.T) {
+    logfile := os.Getenv("SIPPY_TEST_LOGFILE")
+    if logfile == "" {
+        t.Skip("only runs as the child of TestReopenStdio")
+    }
+    fmt.Fprintln(os.Stdout, "before")
+    os.Rename(logfile, logfile + ".0")
+    if err := ReopenStdio(logfile); err != nil {
+        t.Fatal(err)
+    }
+    fmt.Fprintln(os.Stdout, "stdout after")
+    fmt.Fprintln(os.Stderr, "stderr after")
+}
+
+func TestReopenStdio(t *testing.T) {
+    dir, err := ioutil.TempDir("", "reopen")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    logfile := filepath.Join(dir, "b2bua.log")
+    fd, err := os.Create(logfile)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer fd.Close()
+    cmd := exec.Command(os.Args[0], "-test.run=^TestReopenStdioChild$")
+    cmd.Env = append(os.Environ(), "SIPPY_TEST_LOGFILE=" + logfile)
+    cmd.Stdout, cmd.Stderr = fd, fd
+    if err = cmd.Run(); err != nil {
+        t.Fatal(err)
+    }
+    rotated, _ := ioutil.ReadFile(logfile + ".0")
+    current, _ := ioutil.ReadFile(logfile)
+    if string(rotated) != "before\n" {
+        t.Errorf("unexpected output before the reopen: %q", rotated)
+    }
+    if ! strings.HasPrefix(string(current), "stdout after\nstderr after\n") {
+        t.Errorf("unexpected output after the reopen: %q", current)
+    }
+}